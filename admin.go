@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// adminTokens are the bearer tokens accepted on /admin routes, from
+// QR_ADMIN_TOKENS. With none configured the admin API refuses everything.
+var adminTokens []string
+
+// registerAdminRoutes mounts the administrative API under /admin on r,
+// behind the admin IP filter and bearer token check.
+func registerAdminRoutes(r *mux.Router) {
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(loadIPFilter("QR_ADMIN").middleware)
+	admin.Use(requireAdminToken)
+
+	admin.HandleFunc("/templates/{name:[a-z0-9_-]{1,64}}", getTemplate).Methods("GET")
+	admin.HandleFunc("/templates/{name:[a-z0-9_-]{1,64}}", putTemplate).Methods("PUT")
+	admin.HandleFunc("/templates/{name:[a-z0-9_-]{1,64}}/rerender", rerenderTemplate).Methods("POST")
+	admin.HandleFunc("/sync", syncState).Methods("POST")
+	admin.HandleFunc("/warmup", warmup).Methods("POST")
+	admin.HandleFunc("/errors", errorsReport).Methods("GET")
+	admin.HandleFunc("/usage", usageExport).Methods("GET")
+	admin.HandleFunc("/replication/changes", replicationChanges).Methods("GET")
+}
+
+func requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(adminTokens) == 0 {
+			http.Error(w, "Admin API is disabled", http.StatusForbidden)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !validAdminToken(token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validAdminToken compares against every configured token in constant time.
+func validAdminToken(token string) bool {
+	valid := 0
+	for _, t := range adminTokens {
+		valid |= subtle.ConstantTimeCompare([]byte(token), []byte(t))
+	}
+	return valid == 1
+}
+
+// newAdminRouter returns the router admin routes should be mounted on.
+// When QR_ADMIN_ADDR is set the admin API gets its own listener and is not
+// reachable through the public one.
+func newAdminRouter(public *mux.Router, addr string) *mux.Router {
+	if addr == "" {
+		return public
+	}
+
+	r := mux.NewRouter()
+	r.Use(logRequests)
+	r.Use(metrics.middleware)
+	r.Use(limitBody)
+	go func() {
+		log.Printf("Admin API listening on %s", addr)
+		listen(addr, r)
+	}()
+	return r
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// linkHit is one redirect through a short link. The client address is
+// only used to look up the country and is not kept. Token is the scan
+// token of a link that tracks conversions.
+type linkHit struct {
+	Time      time.Time `json:"time"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Referrer  string    `json:"referrer,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	Token     string    `json:"token,omitempty"`
+}
+
+// maxHitField caps the user agent and referrer kept per hit.
+const maxHitField = 512
+
+const (
+	defaultStatsDays  = 30
+	maxStatsDays      = 366
+	maxStatsReferrers = 10
+)
+
+// geoIP is the MaxMind country database named by QR_GEOIP_DB, or nil to
+// record hits without a country. Hits go without one too while geoBreaker
+// is open.
+var (
+	geoIP      *maxminddb.Reader
+	geoBreaker *breaker
+)
+
+func loadGeoIP() error {
+	path := os.Getenv("QR_GEOIP_DB")
+	if path == "" {
+		return nil
+	}
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return err
+	}
+	geoIP = db
+	return nil
+}
+
+// countryOf returns the ISO country code of addr, or "" when unknown.
+func countryOf(addr netip.Addr) string {
+	if geoIP == nil || !addr.IsValid() {
+		return ""
+	}
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	err := geoBreaker.call(func() error { return geoIP.Lookup(addr.AsSlice(), &rec) })
+	if err != nil {
+		return ""
+	}
+	return rec.Country.ISOCode
+}
+
+func truncateHitField(s string) string {
+	if len(s) > maxHitField {
+		return s[:maxHitField]
+	}
+	return s
+}
+
+// recordHit logs a redirect through l and returns its scan token, if the
+// link tracks conversions. Failures are logged but never keep the scanner
+// from its destination.
+func recordHit(r *http.Request, l shortLink) string {
+	addr, _ := clientAddr(r)
+	hit := linkHit{
+		Time:      time.Now().UTC(),
+		UserAgent: truncateHitField(r.UserAgent()),
+		Referrer:  truncateHitField(r.Referer()),
+		Country:   countryOf(addr),
+	}
+	if l.TrackConversions {
+		hit.Token = newScanToken(l.Slug, hit.Time)
+	}
+	if err := links.RecordHit(l.Slug, hit); err != nil {
+		if !errors.Is(err, errBreakerOpen) {
+			log.Printf("Failed to record hit on short link %s: %v", l.Slug, err)
+		}
+		return ""
+	}
+	return hit.Token
+}
+
+// deviceClass sorts a user agent into bot, tablet, mobile or desktop, or
+// unknown without one.
+func deviceClass(ua string) string {
+	lower := strings.ToLower(ua)
+	switch {
+	case ua == "":
+		return "unknown"
+	case strings.Contains(lower, "bot") || strings.Contains(lower, "spider") || strings.Contains(lower, "crawl"):
+		return "bot"
+	case strings.Contains(lower, "ipad") || strings.Contains(lower, "tablet") ||
+		(strings.Contains(lower, "android") && !strings.Contains(lower, "mobile")):
+		return "tablet"
+	case strings.Contains(lower, "mobile") || strings.Contains(lower, "iphone"):
+		return "mobile"
+	default:
+		return "desktop"
+	}
+}
+
+// osFamily names the operating system of a user agent.
+func osFamily(ua string) string {
+	lower := strings.ToLower(ua)
+	switch {
+	case strings.Contains(lower, "iphone") || strings.Contains(lower, "ipad") || strings.Contains(lower, "ios"):
+		return "ios"
+	case strings.Contains(lower, "android"):
+		return "android"
+	case strings.Contains(lower, "windows"):
+		return "windows"
+	case strings.Contains(lower, "mac os") || strings.Contains(lower, "macintosh"):
+		return "macos"
+	case strings.Contains(lower, "linux") || strings.Contains(lower, "cros"):
+		return "linux"
+	default:
+		return "other"
+	}
+}
+
+// referrerHost reduces a referrer to its host, so stats group by site.
+func referrerHost(ref string) string {
+	if ref == "" {
+		return "direct"
+	}
+	if _, rest, ok := strings.Cut(ref, "://"); ok {
+		ref = rest
+	}
+	host, _, _ := strings.Cut(ref, "/")
+	return strings.ToLower(host)
+}
+
+type dailyHits struct {
+	Date string `json:"date"`
+	Hits int    `json:"hits"`
+}
+
+// linkStats summarises a link's hits: Total since it was created, the
+// rest over the last Days days (UTC), with a point for every day.
+type linkStats struct {
+	Slug      string         `json:"slug"`
+	Total     int            `json:"total"`
+	Days      int            `json:"days"`
+	Hits      int            `json:"hits"`
+	Daily     []dailyHits    `json:"daily"`
+	Devices   map[string]int `json:"devices"`
+	OS        map[string]int `json:"os"`
+	Countries map[string]int `json:"countries"`
+	Referrers map[string]int `json:"referrers"`
+
+	*conversionStats
+}
+
+// statsDays reads the 'days' window of a stats request.
+func statsDays(r *http.Request) (int, error) {
+	v := r.FormValue("days")
+	if v == "" {
+		return defaultStatsDays, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maxStatsDays {
+		return 0, badRequest("Invalid 'days' parameter (must be 1 to " + strconv.Itoa(maxStatsDays) + ")")
+	}
+	return n, nil
+}
+
+// collectStats summarises the hits of l over the last days days.
+func collectStats(l shortLink, days int) (linkStats, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	return collectStatsFrom(l, today.AddDate(0, 0, 1-days), days)
+}
+
+// collectStatsFrom summarises the hits of l over days days from since, a
+// UTC midnight, with their conversions if l tracks them.
+func collectStatsFrom(l shortLink, since time.Time, days int) (linkStats, error) {
+	end := since.AddDate(0, 0, days)
+	stats := linkStats{
+		Slug:      l.Slug,
+		Days:      days,
+		Devices:   map[string]int{},
+		OS:        map[string]int{},
+		Countries: map[string]int{},
+		Referrers: map[string]int{},
+	}
+	perDay := make([]int, days)
+	var err error
+	stats.Total, err = links.EachHit(l.Slug, since, func(h linkHit) {
+		if !h.Time.Before(end) {
+			return
+		}
+		if d := int(h.Time.Sub(since) / (24 * time.Hour)); d >= 0 && d < days {
+			perDay[d]++
+		}
+		stats.Hits++
+		stats.Devices[deviceClass(h.UserAgent)]++
+		stats.OS[osFamily(h.UserAgent)]++
+		country := h.Country
+		if country == "" {
+			country = "unknown"
+		}
+		stats.Countries[country]++
+		stats.Referrers[referrerHost(h.Referrer)]++
+	})
+	if err != nil {
+		return stats, internalError("Failed to read short link hits", err)
+	}
+	for d, n := range perDay {
+		stats.Daily = append(stats.Daily, dailyHits{since.AddDate(0, 0, d).Format("2006-01-02"), n})
+	}
+	stats.Referrers = topCounts(stats.Referrers, maxStatsReferrers)
+	if l.TrackConversions {
+		if stats.conversionStats, err = collectConversions(l, since, end, stats.Hits); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// linkStatsHandler returns the hit statistics of a link. 'days' sets the
+// window of the daily series and breakdowns, 30 by default. Referrers are
+// the most frequent sites only.
+func linkStatsHandler(w http.ResponseWriter, r *http.Request) {
+	days, err := statsDays(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	l, ok := ownLink(w, r)
+	if !ok {
+		return
+	}
+	stats, err := collectStats(l, days)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// maxStatsQueryLinks caps the links of one stats query.
+const maxStatsQueryLinks = 100
+
+// statsQuery asks for the stats of several links over the same days, from
+// From to To inclusive, as YYYY-MM-DD in UTC. Querying the links of a
+// campaign together gives its conversion rate in Totals.
+type statsQuery struct {
+	Slugs []string `json:"slugs"`
+	From  string   `json:"from"`
+	To    string   `json:"to"`
+}
+
+type statsQueryResult struct {
+	From     string      `json:"from"`
+	To       string      `json:"to"`
+	Links    []linkStats `json:"links"`
+	NotFound []string    `json:"not_found"`
+	Totals   statsTotals `json:"totals"`
+}
+
+// statsTotals sums the links of a stats query. The conversions are those
+// of the links that track them, and the rate is over their hits only.
+type statsTotals struct {
+	Hits int `json:"hits"`
+
+	*conversionStats
+	tracked int
+}
+
+func (t *statsTotals) add(s linkStats) {
+	t.Hits += s.Hits
+	if s.conversionStats == nil {
+		return
+	}
+	if t.conversionStats == nil {
+		t.conversionStats = &conversionStats{Types: map[string]int{}, TypeValues: map[string]float64{}}
+	}
+	cs := t.conversionStats
+	cs.Conversions += s.Conversions
+	cs.Converted += s.Converted
+	cs.Value += s.Value
+	for k, n := range s.Types {
+		cs.Types[k] += n
+	}
+	for k, v := range s.TypeValues {
+		cs.TypeValues[k] += v
+	}
+	t.tracked += s.Hits
+	cs.rate(t.tracked)
+}
+
+// queryStats returns the stats of every link in a statsQuery at once, for
+// dashboards that would otherwise fetch them one by one. Links the client
+// does not own are reported as not found, like on /links/{slug}/stats.
+// Without a range it is the last 30 days.
+func queryStats(w http.ResponseWriter, r *http.Request) {
+	var q statsQuery
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		writeError(w, bodyError(err, "Invalid stats query JSON"))
+		return
+	}
+	if len(q.Slugs) == 0 {
+		http.Error(w, "Missing 'slugs' (the short links to report on)", http.StatusBadRequest)
+		return
+	}
+	if len(q.Slugs) > maxStatsQueryLinks {
+		writeError(w, tooLarge(fmt.Sprintf("Stats query has %d links (at most %d)", len(q.Slugs), maxStatsQueryLinks)))
+		return
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	to, from := today, today.AddDate(0, 0, 1-defaultStatsDays)
+	var err error
+	if q.To != "" {
+		if to, err = time.Parse("2006-01-02", q.To); err != nil {
+			http.Error(w, "Invalid 'to' date (expected YYYY-MM-DD)", http.StatusBadRequest)
+			return
+		}
+		if q.From == "" {
+			from = to.AddDate(0, 0, 1-defaultStatsDays)
+		}
+	}
+	if q.From != "" {
+		if from, err = time.Parse("2006-01-02", q.From); err != nil {
+			http.Error(w, "Invalid 'from' date (expected YYYY-MM-DD)", http.StatusBadRequest)
+			return
+		}
+	}
+	days := int(to.Sub(from)/(24*time.Hour)) + 1
+	if days < 1 || days > maxStatsDays {
+		http.Error(w, fmt.Sprintf("Invalid date range (must be 1 to %d days, 'from' first)", maxStatsDays), http.StatusBadRequest)
+		return
+	}
+
+	t := tenantFrom(r.Context())
+	res := statsQueryResult{From: from.Format("2006-01-02"), To: to.Format("2006-01-02"), Links: []linkStats{}, NotFound: []string{}}
+	seen := make(map[string]bool)
+	for _, slug := range q.Slugs {
+		if seen[slug] {
+			continue
+		}
+		seen[slug] = true
+		l, err := links.Get(slug)
+		if errors.Is(err, errLinkNotFound) || (err == nil && !l.ownedBy(t, linkToken(r))) {
+			res.NotFound = append(res.NotFound, slug)
+			continue
+		}
+		if err != nil {
+			writeError(w, internalError("Failed to load short link", err))
+			return
+		}
+		stats, err := collectStatsFrom(l, from, days)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		res.Links = append(res.Links, stats)
+		res.Totals.add(stats)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// topCounts keeps the n largest counts, ties broken by name.
+func topCounts(counts map[string]int, n int) map[string]int {
+	if len(counts) <= n {
+		return counts
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	top := make(map[string]int, n)
+	for _, name := range names[:n] {
+		top[name] = counts[name]
+	}
+	return top
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font/gofont/gomedium"
+)
+
+// The server-wide logo and font put into every default spec. checkAssets
+// clears them when the assets are missing and QR_MISSING_ASSETS=degrade:
+// an empty logo renders codes without one, and an empty font uses
+// builtinFont.
+var (
+	serverLogo string
+	serverFont string
+)
+
+// builtinFont is Go Medium, compiled in as the fallback label font.
+var builtinFont = func() *truetype.Font {
+	f, err := truetype.Parse(gomedium.TTF)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}()
+
+// checkAssets makes sure the server logo, font and emoji font load before the first
+// request needs them. By default a missing or corrupt asset stops the
+// server; with QR_MISSING_ASSETS=degrade it is logged and rendering goes
+// on without it.
+func checkAssets() {
+	degrade := false
+	switch mode := os.Getenv("QR_MISSING_ASSETS"); mode {
+	case "", "fail":
+	case "degrade":
+		degrade = true
+	default:
+		log.Fatalf("Invalid QR_MISSING_ASSETS=%q: expected fail or degrade", mode)
+	}
+
+	if err := checkLogoAsset(serverLogo); err != nil {
+		if !degrade {
+			log.Fatalf("Logo %s is unusable: %v (set QR_MISSING_ASSETS=degrade to render without a logo)", serverLogo, err)
+		}
+		log.Printf("Logo %s is unusable, rendering codes without a logo: %v", serverLogo, err)
+		serverLogo = ""
+	}
+	if _, err := loadFont(serverFont); err != nil {
+		if !degrade {
+			log.Fatalf("Font %s is unusable: %v (set QR_MISSING_ASSETS=degrade to use the built-in font)", serverFont, err)
+		}
+		log.Printf("Font %s is unusable, using the built-in font: %v", serverFont, err)
+		serverFont = ""
+	}
+	usable := serverFallbackFonts[:0]
+	for _, name := range serverFallbackFonts {
+		if _, err := loadFallbackFont(name); err != nil {
+			if !degrade {
+				log.Fatalf("Fallback font %s is unusable: %v (set QR_MISSING_ASSETS=degrade to go without it)", name, err)
+			}
+			log.Printf("Fallback font %s is unusable, going without it: %v", name, err)
+			continue
+		}
+		usable = append(usable, name)
+	}
+	serverFallbackFonts = usable
+	if serverEmojiFont != "" {
+		if _, err := loadColorFont(serverEmojiFont); err != nil {
+			if !degrade {
+				log.Fatalf("Emoji font %s is unusable: %v (set QR_MISSING_ASSETS=degrade to render labels without emoji)", serverEmojiFont, err)
+			}
+			log.Printf("Emoji font %s is unusable, rendering labels without emoji: %v", serverEmojiFont, err)
+			serverEmojiFont = ""
+		}
+	}
+}
+
+func loadLogoDecodeErrors() bool {
+	switch mode := os.Getenv("QR_LOGO_DECODE_ERRORS"); mode {
+	case "", "skip":
+		return false
+	case "fail":
+		return true
+	default:
+		log.Fatalf("Invalid QR_LOGO_DECODE_ERRORS=%q: expected skip or fail", mode)
+		return false
+	}
+}
+
+func checkLogoAsset(name string) error {
+	b, err := assets.Get(name)
+	if err != nil {
+		return err
+	}
+	_, err = decodeLogo(b, serverConfig.LogoSize)
+	return err
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A backup is a gzipped tar of:
+//
+//	links.jsonl    one backupLink per line, every tenant's links with their hits
+//	               and the conversions of their scans
+//	data/<key>     every file of the data store
+//	assets/<key>   uploaded and fetched logos, which live with the assets
+//	manifest.json  written last, with a checksum of everything above
+//
+// The link database goes in as records rather than as the bolt file, so a
+// backup can be restored into another store. Fonts and the default logo
+// come with the deployment and are only listed in the manifest, with a
+// checksum, so a restore can tell whether the target has the same ones.
+const backupFormat = 1
+
+const (
+	backupLinksEntry    = "links.jsonl"
+	backupManifestEntry = "manifest.json"
+	backupDataPrefix    = "data/"
+	backupAssetPrefix   = "assets/"
+)
+
+type backupManifest struct {
+	Format     int           `json:"format"`
+	CreatedAt  time.Time     `json:"created_at"`
+	DataSchema int           `json:"data_schema"`
+	Links      int           `json:"links"`
+	Hits       int           `json:"hits"`
+	Entries    []backupEntry `json:"entries"`
+	Assets     []backupAsset `json:"assets"`
+}
+
+type backupEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// backupAsset is an asset a stored spec or template refers to. Included
+// ones are in the archive; the rest must already be in place.
+type backupAsset struct {
+	Name     string `json:"name"`
+	SHA256   string `json:"sha256,omitempty"`
+	Included bool   `json:"included,omitempty"`
+	Missing  bool   `json:"missing,omitempty"`
+}
+
+// backupLink is a link with its hits. Scans come back with the hits that
+// carry their tokens, so only those with conversions are listed.
+type backupLink struct {
+	Link  shortLink  `json:"link"`
+	Hits  []linkHit  `json:"hits,omitempty"`
+	Scans []linkScan `json:"scans,omitempty"`
+}
+
+// storedAssetPrefixes are the asset prefixes written by the API rather than
+// shipped with it.
+var storedAssetPrefixes = []string{logoUploadPrefix}
+
+// backupWriter adds entries to the tar and keeps their checksums for the
+// manifest.
+type backupWriter struct {
+	tw       *tar.Writer
+	manifest backupManifest
+}
+
+func (bw *backupWriter) add(name string, data []byte) error {
+	err := bw.tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: bw.manifest.CreatedAt})
+	if err != nil {
+		return err
+	}
+	if _, err := bw.tw.Write(data); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	bw.manifest.Entries = append(bw.manifest.Entries, backupEntry{name, int64(len(data)), hex.EncodeToString(sum[:])})
+	return nil
+}
+
+// writeBackup archives the link store, the data store and the stored
+// assets to w.
+func writeBackup(w io.Writer, data *diskStorage, ls linkStore) (backupManifest, error) {
+	gz := gzip.NewWriter(w)
+	bw := &backupWriter{tw: tar.NewWriter(gz)}
+	bw.manifest = backupManifest{Format: backupFormat, CreatedAt: time.Now().UTC().Truncate(time.Second), DataSchema: len(dataMigrations)}
+
+	all, err := ls.All()
+	if err != nil {
+		return bw.manifest, fmt.Errorf("listing links: %w", err)
+	}
+	var lines []byte
+	for _, l := range all {
+		rec := backupLink{Link: l}
+		if _, err := ls.EachHit(l.Slug, time.Unix(0, 0), func(h linkHit) { rec.Hits = append(rec.Hits, h) }); err != nil {
+			return bw.manifest, fmt.Errorf("reading hits of %s: %w", l.Slug, err)
+		}
+		err := ls.EachScan(l.Slug, time.Unix(0, 0), func(s linkScan) {
+			if len(s.Conversions) > 0 {
+				rec.Scans = append(rec.Scans, s)
+			}
+		})
+		if err != nil {
+			return bw.manifest, fmt.Errorf("reading conversions of %s: %w", l.Slug, err)
+		}
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return bw.manifest, err
+		}
+		lines = append(append(lines, b...), '\n')
+		bw.manifest.Links++
+		bw.manifest.Hits += len(rec.Hits)
+	}
+	if err := bw.add(backupLinksEntry, lines); err != nil {
+		return bw.manifest, err
+	}
+
+	// The schema version belongs to the target, and the link database, when
+	// it lives in the data directory, is already covered by the records
+	linkDB, _ := filepath.Abs(linkDBPath())
+	err = data.Walk(func(key string) error {
+		if key == dataSchemaKey || filepath.Join(data.root, filepath.FromSlash(key)) == linkDB {
+			return nil
+		}
+		b, err := data.Get(key)
+		if err != nil {
+			return err
+		}
+		return bw.add(backupDataPrefix+key, b)
+	})
+	if err != nil {
+		return bw.manifest, fmt.Errorf("reading data store: %w", err)
+	}
+
+	refs, err := referencedAssets()
+	if err != nil {
+		return bw.manifest, err
+	}
+	for _, prefix := range storedAssetPrefixes {
+		keys, err := assets.List(prefix)
+		if err != nil {
+			return bw.manifest, fmt.Errorf("listing assets: %w", err)
+		}
+		for _, k := range keys {
+			refs[k] = true
+		}
+	}
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		asset := backupAsset{Name: name}
+		b, err := assets.Get(name)
+		switch {
+		case errors.Is(err, errNotFound):
+			asset.Missing = true
+		case err != nil:
+			return bw.manifest, fmt.Errorf("reading asset %s: %w", name, err)
+		default:
+			sum := sha256.Sum256(b)
+			asset.SHA256 = hex.EncodeToString(sum[:])
+			if isStoredAsset(name) {
+				asset.Included = true
+				if err := bw.add(backupAssetPrefix+name, b); err != nil {
+					return bw.manifest, err
+				}
+			}
+		}
+		bw.manifest.Assets = append(bw.manifest.Assets, asset)
+	}
+
+	m, err := json.MarshalIndent(bw.manifest, "", "  ")
+	if err != nil {
+		return bw.manifest, err
+	}
+	hdr := &tar.Header{Name: backupManifestEntry, Mode: 0o644, Size: int64(len(m)), ModTime: bw.manifest.CreatedAt}
+	if err := bw.tw.WriteHeader(hdr); err != nil {
+		return bw.manifest, err
+	}
+	if _, err := bw.tw.Write(m); err != nil {
+		return bw.manifest, err
+	}
+	if err := bw.tw.Close(); err != nil {
+		return bw.manifest, err
+	}
+	return bw.manifest, gz.Close()
+}
+
+func isStoredAsset(name string) bool {
+	for _, prefix := range storedAssetPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// referencedAssets collects the logos and fonts named by stored specs and
+// templates.
+func referencedAssets() (map[string]bool, error) {
+	refs := make(map[string]bool)
+	add := func(names ...string) {
+		for _, n := range names {
+			if n != "" {
+				refs[n] = true
+			}
+		}
+	}
+	ids, err := specs.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing specs: %w", err)
+	}
+	for _, id := range ids {
+		spec, err := specs.Load(id)
+		if err != nil {
+			return nil, fmt.Errorf("loading spec %s: %w", id, err)
+		}
+		add(spec.LogoFile, spec.FontFile, spec.EmojiFont)
+	}
+	names, err := templates.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing templates: %w", err)
+	}
+	for _, name := range names {
+		t, err := templates.Load(name)
+		if err != nil {
+			return nil, fmt.Errorf("loading template %s: %w", name, err)
+		}
+		add(t.LogoFile, t.FontFile)
+	}
+	return refs, nil
+}
+
+// eachBackupEntry calls fn for each entry of the archive at path, up to
+// the manifest, which it returns.
+func eachBackupEntry(path string, fn func(name string, data []byte) error) (backupManifest, error) {
+	var m backupManifest
+	f, err := os.Open(path)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return m, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return m, errors.New("backup has no manifest")
+		}
+		if err != nil {
+			return m, err
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return m, err
+		}
+		if hdr.Name == backupManifestEntry {
+			return m, json.Unmarshal(b, &m)
+		}
+		if err := fn(hdr.Name, b); err != nil {
+			return m, err
+		}
+	}
+}
+
+// verifyBackup checks every entry of the archive against the manifest
+// before anything is restored.
+func verifyBackup(path string) (backupManifest, error) {
+	sums := make(map[string]string)
+	m, err := eachBackupEntry(path, func(name string, data []byte) error {
+		sum := sha256.Sum256(data)
+		sums[name] = hex.EncodeToString(sum[:])
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+	if m.Format != backupFormat {
+		return m, fmt.Errorf("backup format %d is not supported (expected %d)", m.Format, backupFormat)
+	}
+	if m.DataSchema != len(dataMigrations) {
+		return m, fmt.Errorf("backup is of data schema %d, this build is at %d", m.DataSchema, len(dataMigrations))
+	}
+	if len(sums) != len(m.Entries) {
+		return m, fmt.Errorf("backup has %d entries, its manifest lists %d", len(sums), len(m.Entries))
+	}
+	for _, e := range m.Entries {
+		if sums[e.Name] != e.SHA256 {
+			return m, fmt.Errorf("backup entry %s does not match its checksum", e.Name)
+		}
+	}
+	return m, nil
+}
+
+// restoreBackup loads an archive into the stores. The link store must be
+// empty, so hits are not counted twice; data store files and stored assets
+// are written over what is there.
+func restoreBackup(path string, data storage, ls linkStore) (backupManifest, error) {
+	m, err := verifyBackup(path)
+	if err != nil {
+		return m, err
+	}
+	existing, err := ls.All()
+	if err != nil {
+		return m, fmt.Errorf("listing links: %w", err)
+	}
+	if len(existing) > 0 {
+		return m, fmt.Errorf("link store already has %d links; restore into an empty one", len(existing))
+	}
+
+	_, err = eachBackupEntry(path, func(name string, b []byte) error {
+		switch {
+		case name == backupLinksEntry:
+			return restoreLinks(b, ls)
+		case strings.HasPrefix(name, backupDataPrefix):
+			return data.Put(strings.TrimPrefix(name, backupDataPrefix), b)
+		case strings.HasPrefix(name, backupAssetPrefix):
+			key := strings.TrimPrefix(name, backupAssetPrefix)
+			if !isStoredAsset(key) {
+				return fmt.Errorf("backup entry %s is not a stored asset", name)
+			}
+			return assets.Put(key, b)
+		}
+		return fmt.Errorf("unexpected backup entry %s", name)
+	})
+	if err != nil {
+		return m, err
+	}
+
+	for _, a := range m.Assets {
+		if a.Included || a.Missing {
+			continue
+		}
+		b, err := assets.Get(a.Name)
+		if err != nil {
+			log.Printf("Asset %s used by the backup is missing here: %v", a.Name, err)
+			continue
+		}
+		if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != a.SHA256 {
+			log.Printf("Asset %s differs from the one in the backup; codes using it may not reprint identically", a.Name)
+		}
+	}
+	return m, nil
+}
+
+func restoreLinks(b []byte, ls linkStore) error {
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(nil, len(b)+1)
+	for sc.Scan() {
+		var rec backupLink
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return fmt.Errorf("reading link record: %w", err)
+		}
+		if err := ls.Create(rec.Link); err != nil {
+			return fmt.Errorf("restoring link %s: %w", rec.Link.Slug, err)
+		}
+		if err := importHits(ls, rec.Link.Slug, rec.Hits); err != nil {
+			return fmt.Errorf("restoring hits of %s: %w", rec.Link.Slug, err)
+		}
+		for _, s := range rec.Scans {
+			for _, c := range s.Conversions {
+				if err := ls.RecordConversion(rec.Link.Slug, s.Token, c); err != nil {
+					return fmt.Errorf("restoring conversions of %s: %w", rec.Link.Slug, err)
+				}
+			}
+		}
+	}
+	return sc.Err()
+}
+
+// importHits adds a link's hits in one go where the store can, rather than
+// a commit per hit.
+func importHits(ls linkStore, slug string, hits []linkHit) error {
+	if bulk, ok := ls.(interface {
+		importHits(slug string, hits []linkHit) error
+	}); ok {
+		return bulk.importHits(slug, hits)
+	}
+	for _, h := range hits {
+		if err := ls.RecordHit(slug, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupCommand is "api backup FILE", run with the server stopped, as the
+// link database allows one process at a time.
+func backupCommand(data *diskStorage, ls linkStore) {
+	if len(os.Args) != 3 {
+		fmt.Fprintln(os.Stderr, "usage: api backup FILE")
+		os.Exit(2)
+	}
+	f, err := os.Create(os.Args[2])
+	if err != nil {
+		log.Fatal("Failed to create backup: ", err)
+	}
+	m, err := writeBackup(f, data, ls)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		os.Remove(os.Args[2])
+		log.Fatal("Failed to write backup: ", err)
+	}
+	log.Printf("Backed up %d links, %d hits and %d files to %s", m.Links, m.Hits, len(m.Entries)-1, os.Args[2])
+}
+
+// restoreCommand is "api restore FILE", into a stopped server.
+func restoreCommand(data storage, ls linkStore) {
+	if len(os.Args) != 3 {
+		fmt.Fprintln(os.Stderr, "usage: api restore FILE")
+		os.Exit(2)
+	}
+	m, err := restoreBackup(os.Args[2], data, ls)
+	if err != nil {
+		log.Fatal("Failed to restore backup: ", err)
+	}
+	log.Printf("Restored %d links, %d hits and %d files from %s, taken %s", m.Links, m.Hits, len(m.Entries)-1, os.Args[2], m.CreatedAt.Format(time.RFC3339))
+}
@@ -0,0 +1,802 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Files a batch ZIP carries besides the images. errors.csv lists the rows
+// that could not render; the manifests map every image back to its row.
+const (
+	batchErrorsFile       = "errors.csv"
+	batchManifestCSVFile  = "manifest.csv"
+	batchManifestJSONFile = "manifest.json"
+)
+
+// Limits on the 'filename' a batch row may give its image.
+const (
+	maxBatchPathDepth   = 8
+	maxBatchSegmentLen  = 128
+	batchFilenameColumn = "filename"
+)
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// batchResult is the outcome of one batch row.
+type batchResult struct {
+	id       string
+	file     string
+	shortURL string
+	warnings []string
+	failure  *jobFailure
+}
+
+// manifestEntry describes one image in a batch ZIP. ShortURL is set for
+// rows that encode a short link.
+type manifestEntry struct {
+	File     string   `json:"file"`
+	Row      int      `json:"row"`
+	ID       string   `json:"id"`
+	Data     string   `json:"data"`
+	Label    string   `json:"label"`
+	ShortURL string   `json:"short_url"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// batchState is the input and per-row outcome of a batch, shared by the
+// batch job and any retry jobs started from it. All of those jobs serve the
+// latest merged artifact.
+type batchState struct {
+	mu       sync.Mutex
+	tenant   *tenant
+	linkBase string
+	opts     jobOptions
+	rows     []map[string]string
+	results  []batchResult
+	jobs     []*job
+	retrying bool
+}
+
+// newBatchState starts a batch for tenant t. Short links in its rows are
+// encoded with linkBase, the API's address for the request that made it.
+func newBatchState(t *tenant, linkBase string, opts jobOptions, rows []map[string]string) *batchState {
+	return &batchState{tenant: t, linkBase: linkBase, opts: opts, rows: rows, results: make([]batchResult, len(rows))}
+}
+
+// failedRows returns the indexes of the rows that have not rendered.
+func (st *batchState) failedRows() []int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var idx []int
+	for i, res := range st.results {
+		if res.failure != nil {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// failures returns the failed rows' count and the first maxJobFailures of
+// them.
+func (st *batchState) failures() (int, []jobFailure) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	n := 0
+	var list []jobFailure
+	for _, res := range st.results {
+		if res.failure != nil {
+			n++
+			if len(list) < maxJobFailures {
+				list = append(list, *res.failure)
+			}
+		}
+	}
+	return n, list
+}
+
+// batchRowSpec resolves one row of /qrcode style parameters for tenant t,
+// applying its features and quota. A short link is encoded on linkBase.
+// action is the over-quota behaviour applied, as for quotaSpec.
+func batchRowSpec(t *tenant, linkBase string, row map[string]string) (spec renderSpec, action string, err error) {
+	params := url.Values{}
+	for k, v := range row {
+		if k != batchFilenameColumn {
+			params.Set(k, v)
+		}
+	}
+
+	err = checkNoLogoURL(params)
+	if err == nil {
+		err = resolveLink(t, params, linkBase)
+	}
+	if err == nil {
+		spec, err = specFromValues(t, params)
+	}
+	if err == nil {
+		err = checkFeatures(t, spec)
+	}
+	if err == nil {
+		spec, action, err = quotaSpec(t, spec)
+	}
+	return spec, action, err
+}
+
+// renderBatchRow renders one batch row in lane and stores the result.
+func renderBatchRow(t *tenant, linkBase string, row map[string]string, lane renderLane) (string, []byte, []string, error) {
+	spec, _, err := batchRowSpec(t, linkBase, row)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	id, b, cached, warnings, err := renderStored(spec, nil, lane)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	recordUsage(t, "png", spec, storedBytes(b, cached))
+	return id, b, warnings, nil
+}
+
+// batchFilename returns the sanitized 'filename' of a row, such as
+// "venue/table-12.png", or "" when it has none. Characters outside [A-Za-z0-9._-] in each folder or file name become '-',
+// leading dots are dropped so nothing becomes hidden, and the name always
+// ends in .png.
+func batchFilename(row map[string]string) (string, error) {
+	name, ok := row[batchFilenameColumn]
+	if !ok {
+		return "", nil
+	}
+
+	var segs []string
+	for _, seg := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if seg == "." {
+			continue
+		}
+		if seg == ".." {
+			return "", badRequest("Invalid 'filename' (must not contain '..')")
+		}
+		seg = strings.TrimLeft(unsafeFilenameChars.ReplaceAllString(seg, "-"), ".-")
+		if seg == "" {
+			continue
+		}
+		if len(seg) > maxBatchSegmentLen {
+			seg = seg[:maxBatchSegmentLen]
+		}
+		segs = append(segs, seg)
+	}
+	if len(segs) == 0 {
+		return "", badRequest("Invalid 'filename' (empty after sanitizing)")
+	}
+	if len(segs) > maxBatchPathDepth {
+		return "", badRequest(fmt.Sprintf("Invalid 'filename' (at most %d folders deep)", maxBatchPathDepth-1))
+	}
+
+	file := path.Join(segs...)
+	if !strings.EqualFold(path.Ext(file), ".png") {
+		file += ".png"
+	}
+	return file, nil
+}
+
+// runBatch renders the rows at idx into a ZIP artifact. With a base
+// artifact from an earlier run, its images are carried over and the new
+// ones added. A row that fails is reported in the job's failures and in
+// errors.csv inside the ZIP, and the remaining rows still render; only
+// storage or ZIP errors fail the job.
+func runBatch(j *job, st *batchState, idx []int, base *jobArtifact) (*jobArtifact, error) {
+	j.start(len(idx))
+
+	buf := newSpillBuffer(serverLimits.JobMemoryBytes, spillDir)
+	zw := zip.NewWriter(buf)
+
+	if base != nil {
+		if err := copyZipEntries(zw, base); err != nil {
+			buf.discard()
+			return nil, err
+		}
+	}
+
+	// owners maps each file in the ZIP to the code it holds, starting
+	// with the rows that rendered in an earlier run. Names are compared
+	// case-insensitively as they collide when unzipped on most desktops.
+	owners := make(map[string]string)
+	st.mu.Lock()
+	for _, res := range st.results {
+		if res.failure == nil && res.file != "" {
+			owners[strings.ToLower(res.file)] = res.id
+		}
+	}
+	st.mu.Unlock()
+
+	br := newBatchRenderer(st, idx)
+	defer br.close()
+	for k, i := range idx {
+		o := br.outcome(k)
+		id, b, name, err := o.id, o.b, o.name, o.err
+		if owner, ok := owners[strings.ToLower(name)]; err == nil && ok && owner != id {
+			err = badRequest(fmt.Sprintf("Filename %q is already used by another row", name))
+		}
+		if err != nil {
+			f := newJobFailure(i+1, "", err)
+			st.mu.Lock()
+			st.results[i] = batchResult{failure: f}
+			st.mu.Unlock()
+			j.progress(f)
+			continue
+		}
+
+		// Identical rows render to the same code, which is written once
+		if _, ok := owners[strings.ToLower(name)]; !ok {
+			if err := writeZipFile(zw, name, b); err != nil {
+				buf.discard()
+				return nil, err
+			}
+			owners[strings.ToLower(name)] = id
+		}
+		st.mu.Lock()
+		st.results[i] = batchResult{id: id, file: name, shortURL: o.shortURL, warnings: o.warnings}
+		st.mu.Unlock()
+		j.progress(nil)
+	}
+
+	if err := writeBatchErrors(zw, st); err != nil {
+		buf.discard()
+		return nil, err
+	}
+	if err := writeBatchManifest(zw, st); err != nil {
+		buf.discard()
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		buf.discard()
+		return nil, err
+	}
+	return buf.finish()
+}
+
+// batchOutcome is a rendered batch row waiting to be written to the ZIP.
+type batchOutcome struct {
+	id, name string
+	shortURL string
+	b        []byte
+	warnings []string
+	err      error
+}
+
+// batchRenderer renders batch rows on st.opts.concurrency workers, each
+// waiting for a job slot per row it renders, and hands them back in input order. The
+// workers run at most a few rows ahead of the consumer, so memory stays
+// bounded however large the batch.
+type batchRenderer struct {
+	outcomes []chan batchOutcome
+	ahead    chan struct{}
+	stop     chan struct{}
+}
+
+func newBatchRenderer(st *batchState, idx []int) *batchRenderer {
+	br := &batchRenderer{
+		outcomes: make([]chan batchOutcome, len(idx)),
+		ahead:    make(chan struct{}, 2*st.opts.concurrency),
+		stop:     make(chan struct{}),
+	}
+	for k := range br.outcomes {
+		br.outcomes[k] = make(chan batchOutcome, 1)
+	}
+
+	// ahead holds a token for every row handed out but not yet consumed
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		for k := range idx {
+			select {
+			case br.ahead <- struct{}{}:
+			case <-br.stop:
+				return
+			}
+			select {
+			case next <- k:
+			case <-br.stop:
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < st.opts.concurrency; w++ {
+		go func() {
+			for k := range next {
+				row := st.rows[idx[k]]
+				var o batchOutcome
+				o.name, o.err = batchFilename(row)
+				if o.err == nil {
+					o.id, o.b, o.warnings, o.err = renderBatchRow(st.tenant, st.linkBase, row, renderLane{pool: jobSlots, priority: st.opts.priority})
+				}
+				if slug := row["link"]; slug != "" && o.err == nil {
+					o.shortURL = shortURL(st.linkBase, slug)
+				}
+				if o.name == "" {
+					o.name = o.id + ".png"
+				}
+				br.outcomes[k] <- o
+			}
+		}()
+	}
+	return br
+}
+
+// outcome waits for the k-th row.
+func (br *batchRenderer) outcome(k int) batchOutcome {
+	o := <-br.outcomes[k]
+	<-br.ahead
+	return o
+}
+
+// close abandons the rows not yet handed out.
+func (br *batchRenderer) close() {
+	close(br.stop)
+}
+
+// copyZipEntries copies the images of an earlier batch artifact into zw,
+// leaving out its errors and manifest files.
+func copyZipEntries(zw *zip.Writer, base *jobArtifact) error {
+	ra, err := base.open()
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+
+	zr, err := zip.NewReader(ra, base.size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		switch f.Name {
+		case batchErrorsFile, batchManifestCSVFile, batchManifestJSONFile:
+			continue
+		}
+		if err := zw.Copy(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBatchErrors adds errors.csv to the ZIP when any row failed.
+func writeBatchErrors(zw *zip.Writer, st *batchState) error {
+	st.mu.Lock()
+	var failed []*jobFailure
+	for _, res := range st.results {
+		if res.failure != nil {
+			failed = append(failed, res.failure)
+		}
+	}
+	st.mu.Unlock()
+	if len(failed) == 0 {
+		return nil
+	}
+
+	f, err := zw.Create(batchErrorsFile)
+	if err != nil {
+		return err
+	}
+	return writeFailuresCSV(f, failed)
+}
+
+func writeFailuresCSV(w io.Writer, failed []*jobFailure) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"row", "code", "error"})
+	for _, fl := range failed {
+		cw.Write([]string{strconv.Itoa(fl.Row), fl.Code, fl.Error})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeBatchManifest adds manifest.csv and manifest.json, listing every
+// rendered row in input order.
+func writeBatchManifest(zw *zip.Writer, st *batchState) error {
+	st.mu.Lock()
+	entries := []manifestEntry{}
+	for i, res := range st.results {
+		if res.failure != nil || res.file == "" {
+			continue
+		}
+		data := st.rows[i]["data"]
+		if res.shortURL != "" {
+			data = res.shortURL
+		}
+		entries = append(entries, manifestEntry{
+			File:     res.file,
+			Row:      i + 1,
+			ID:       res.id,
+			Data:     data,
+			Label:    st.rows[i]["label"],
+			ShortURL: res.shortURL,
+			Warnings: res.warnings,
+		})
+	}
+	st.mu.Unlock()
+
+	f, err := zw.Create(batchManifestCSVFile)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(f)
+	cw.Write([]string{"file", "row", "id", "data", "label", "short_url", "warnings"})
+	for _, e := range entries {
+		cw.Write([]string{e.File, strconv.Itoa(e.Row), e.ID, e.Data, e.Label, e.ShortURL, strings.Join(e.Warnings, "; ")})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+
+	f, err = zw.Create(batchManifestJSONFile)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(f).Encode(entries)
+}
+
+func batchJob(j *job, st *batchState) {
+	all := make([]int, len(st.rows))
+	for i := range all {
+		all[i] = i
+	}
+	artifact, err := runBatch(j, st, all, nil)
+	if err != nil {
+		j.finish(internalError("Failed to build batch ZIP", err))
+		return
+	}
+
+	j.mu.Lock()
+	j.artifact = artifact
+	j.mu.Unlock()
+	j.finish(nil)
+}
+
+// retryBatchJob re-renders the failed rows of orig and merges them into
+// its artifact. Every job of the batch ends up serving the merged ZIP, and
+// their failures are updated to the rows that still fail.
+func retryBatchJob(j, orig *job, idx []int) {
+	st := orig.batch
+	defer func() {
+		st.mu.Lock()
+		st.retrying = false
+		st.mu.Unlock()
+	}()
+
+	orig.mu.Lock()
+	base := orig.artifact
+	orig.mu.Unlock()
+
+	artifact, err := runBatch(j, st, idx, base)
+	if err != nil {
+		j.finish(internalError("Failed to build batch ZIP", err))
+		return
+	}
+
+	failed, failures := st.failures()
+	st.mu.Lock()
+	related := st.jobs
+	st.mu.Unlock()
+	for _, bj := range related {
+		bj.mu.Lock()
+		bj.artifact = artifact
+		if bj != j {
+			bj.Failed = failed
+			bj.Failures = failures
+			bj.notify()
+		}
+		bj.mu.Unlock()
+	}
+	base.remove()
+	j.finish(nil)
+}
+
+// batchRequest is the object form of a batch: every row inherits the
+// parameters in Defaults and overrides those it sets itself.
+type batchRequest struct {
+	Defaults map[string]string   `json:"defaults"`
+	Rows     []map[string]string `json:"rows"`
+}
+
+// batchRows reads the rows of a new batch: from a finished resumable
+// upload named by ?upload=<id>, from a text/csv body, or from JSON.
+func batchRows(r *http.Request) ([]map[string]string, error) {
+	if id := r.URL.Query().Get("upload"); id != "" {
+		return readUploadedBatch(r, id)
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "text/csv" {
+		return readBatchCSV(r.Body)
+	}
+	return decodeBatch(r)
+}
+
+// decodeBatch reads a JSON batch body, either a bare array of rows or a
+// batchRequest, and returns the rows with the defaults merged in. A row
+// setting a parameter to "" clears its default.
+func decodeBatch(r *http.Request) ([]map[string]string, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return nil, bodyError(err, "Invalid batch JSON")
+	}
+
+	var req batchRequest
+	if trimmed := bytes.TrimLeft(raw, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(raw, &req.Rows); err != nil {
+			return nil, badRequest("Invalid batch JSON")
+		}
+		return req.Rows, nil
+	}
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return nil, badRequest("Invalid batch JSON")
+	}
+
+	rows := make([]map[string]string, len(req.Rows))
+	for i, row := range req.Rows {
+		merged := make(map[string]string, len(req.Defaults)+len(row))
+		for k, v := range req.Defaults {
+			merged[k] = v
+		}
+		for k, v := range row {
+			if v == "" {
+				delete(merged, k)
+			} else {
+				merged[k] = v
+			}
+		}
+		rows[i] = merged
+	}
+	return rows, nil
+}
+
+// batchValidation is the result of a dry run.
+type batchValidation struct {
+	Rows     int           `json:"rows"`
+	Valid    int           `json:"valid"`
+	Failed   int           `json:"failed"`
+	Failures []*jobFailure `json:"failures"`
+}
+
+// validateBatch checks every row the way runBatch would, short of drawing
+// and storing anything, and lists all the rows that would fail.
+func validateBatch(t *tenant, linkBase string, rows []map[string]string) batchValidation {
+	v := batchValidation{Rows: len(rows), Failures: []*jobFailure{}}
+	owners := make(map[string]string)
+	for i, row := range rows {
+		var id string
+		name, err := batchFilename(row)
+		if err == nil {
+			var spec renderSpec
+			if spec, _, err = batchRowSpec(t, linkBase, row); err == nil {
+				err = checkSpec(spec)
+			}
+			if err == nil {
+				if id, err = specID(spec); err != nil {
+					err = internalError("Failed to hash QR code spec", err)
+				}
+			}
+		}
+		if name == "" {
+			name = id + ".png"
+		}
+		if owner, ok := owners[strings.ToLower(name)]; err == nil && ok && owner != id {
+			err = badRequest(fmt.Sprintf("Filename %q is already used by another row", name))
+		}
+		if err != nil {
+			v.Failures = append(v.Failures, newJobFailure(i+1, "", err))
+			continue
+		}
+		owners[strings.ToLower(name)] = id
+		v.Valid++
+	}
+	v.Failed = len(v.Failures)
+	return v
+}
+
+func checkBatchSize(rows []map[string]string) error {
+	if len(rows) == 0 {
+		return badRequest("Batch has no rows")
+	}
+	if len(rows) > serverLimits.MaxBatchRows {
+		return tooLarge(fmt.Sprintf("Batch has %d rows, maximum is %d", len(rows), serverLimits.MaxBatchRows))
+	}
+	return nil
+}
+
+// createBatch starts a background job rendering /qrcode parameter objects,
+// e.g. [{"data": "https://example.com", "label": "A"}], into a ZIP of PNGs.
+// The body may also be {"defaults": {...}, "rows": [...]} so a mixed
+// catalog shares its styling, each row overriding the template, palette,
+// pattern or label it needs. A row's optional "filename" places its image
+// in the ZIP, e.g. "venue/table-12.png"; otherwise it is named after the
+// code id. 'concurrency' and 'priority' schedule the job, see jobOptions.
+// Rows can also come as CSV, with the parameter names as header
+// row, posted directly or sent beforehand as a resumable upload.
+//
+// With dry_run=true the rows are only validated, and the failures are
+// returned straight away as JSON, or as errors.csv with output=csv.
+func createBatch(w http.ResponseWriter, r *http.Request) {
+	opts, err := jobOptionsFromRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rows, err := batchRows(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkBatchSize(rows); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if r.URL.Query().Get("dry_run") == "true" {
+		v := validateBatch(tenantFrom(r.Context()), publicBaseURL(r), rows)
+		if r.URL.Query().Get("output") == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+batchErrorsFile+`"`)
+			writeFailuresCSV(w, v.Failures)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+
+	j := jobs.create("batch")
+	j.schedule(opts)
+	j.batch = newBatchState(tenantFrom(r.Context()), publicBaseURL(r), opts, rows)
+	j.batch.jobs = []*job{j}
+	go batchJob(j, j.batch)
+
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	writeJob(w, http.StatusAccepted, j)
+}
+
+// retryFailed starts a job re-rendering only the failed rows of a
+// finished batch, merging the results into the batch's artifact.
+func retryFailed(w http.ResponseWriter, r *http.Request) {
+	orig, ok := jobs.get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	orig.mu.Lock()
+	st, finished := orig.batch, orig.finished() && orig.artifact != nil
+	orig.mu.Unlock()
+	if st == nil {
+		http.Error(w, "Job is not a batch", http.StatusConflict)
+		return
+	}
+	if !finished {
+		http.Error(w, "Batch has not completed", http.StatusConflict)
+		return
+	}
+
+	idx := st.failedRows()
+	if len(idx) == 0 {
+		http.Error(w, "Batch has no failed rows", http.StatusConflict)
+		return
+	}
+	st.mu.Lock()
+	if st.retrying {
+		st.mu.Unlock()
+		http.Error(w, "A retry of this batch is already running", http.StatusConflict)
+		return
+	}
+	j := jobs.create("batch-retry")
+	j.schedule(st.opts)
+	j.batch = st
+	st.retrying = true
+	st.jobs = append(st.jobs, j)
+	st.mu.Unlock()
+
+	go retryBatchJob(j, orig, idx)
+
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	writeJob(w, http.StatusAccepted, j)
+}
+
+// batchEntry is an item of a /qrcode/batch body, encoding either data or
+// the short link named by Link. Options holds any other /qrcode
+// parameters, as strings, numbers or booleans.
+type batchEntry struct {
+	Data     string                 `json:"data"`
+	Link     string                 `json:"link"`
+	Label    string                 `json:"label"`
+	Filename string                 `json:"filename"`
+	Options  map[string]interface{} `json:"options"`
+}
+
+// decodeBatchEntries reads a /qrcode/batch body into batch rows.
+func decodeBatchEntries(r *http.Request) ([]map[string]string, error) {
+	var entries []batchEntry
+	if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+		return nil, bodyError(err, "Invalid batch JSON (expected an array of {data, label, options} objects)")
+	}
+
+	rows := make([]map[string]string, len(entries))
+	for i, e := range entries {
+		row := make(map[string]string, len(e.Options)+3)
+		for k, v := range e.Options {
+			switch v := v.(type) {
+			case string:
+				row[k] = v
+			case float64:
+				row[k] = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				row[k] = strconv.FormatBool(v)
+			default:
+				return nil, badRequest(fmt.Sprintf("Invalid option %q in item %d (must be a string, number or boolean)", k, i+1))
+			}
+		}
+		row["data"], row["label"] = e.Data, e.Label
+		if e.Link != "" {
+			row["link"] = e.Link
+		}
+		if e.Filename != "" {
+			row[batchFilenameColumn] = e.Filename
+		}
+		rows[i] = row
+	}
+	return rows, nil
+}
+
+// generateBatch renders a JSON array of {data, label, options} items, e.g.
+// [{"data": "https://example.com", "label": "A", "options": {"size": 512}}],
+// and responds with their ZIP once all have rendered. It runs the rows as
+// a batch job, by default on as many workers as a job may use, so the
+// ZIP has the same errors and manifest files and X-Job-Id can be passed to
+// /jobs/{id}/retry-failed. X-Batch-Failed counts the rows that failed.
+func generateBatch(w http.ResponseWriter, r *http.Request) {
+	opts, err := jobOptionsFromRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if r.URL.Query().Get("concurrency") == "" {
+		opts.concurrency = serverLimits.MaxJobConcurrency
+	}
+	rows, err := decodeBatchEntries(r)
+	if err == nil {
+		err = checkBatchSize(rows)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	j := jobs.create("batch")
+	j.schedule(opts)
+	j.batch = newBatchState(tenantFrom(r.Context()), publicBaseURL(r), opts, rows)
+	j.batch.jobs = []*job{j}
+	batchJob(j, j.batch)
+
+	j.mu.Lock()
+	failed, jobErr := j.Failed, j.Error
+	j.mu.Unlock()
+	if jobErr != "" {
+		writeError(w, internalError("Failed to build batch archive", errors.New(jobErr)))
+		return
+	}
+	w.Header().Set("X-Job-Id", j.ID)
+	w.Header().Set("X-Batch-Failed", strconv.Itoa(failed))
+	serveJobArtifact(w, r, j)
+}
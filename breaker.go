@@ -0,0 +1,312 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// errBreakerOpen is returned without calling a dependency whose breaker
+// has tripped.
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// breakerConfig is shared by every breaker. A dependency trips after
+// Failures failed or slow calls in a row and is left alone for Cooldown,
+// after which a single trial call decides whether it closes again.
+type breakerConfig struct {
+	Failures int
+	Cooldown time.Duration
+	Slow     time.Duration
+}
+
+func loadBreakerConfig() breakerConfig {
+	return breakerConfig{
+		Failures: envInt("QR_BREAKER_FAILURES", 5),
+		Cooldown: time.Duration(envInt("QR_BREAKER_COOLDOWN_SECONDS", 30)) * time.Second,
+		Slow:     time.Duration(envInt("QR_BREAKER_SLOW_MS", 2000)) * time.Millisecond,
+	}
+}
+
+// breaker fails calls fast while a dependency is failing, so requests that
+// can do without it are not held up waiting on it.
+type breaker struct {
+	name string
+	cfg  breakerConfig
+
+	mu        sync.Mutex
+	streak    int
+	openUntil time.Time
+	trial     bool
+}
+
+var (
+	breakerMu sync.Mutex
+	breakers  []*breaker
+)
+
+func newBreaker(name string, cfg breakerConfig) *breaker {
+	b := &breaker{name: name, cfg: cfg}
+	breakerMu.Lock()
+	breakers = append(breakers, b)
+	breakerMu.Unlock()
+	return b
+}
+
+// isOpen reports whether calls are currently being refused.
+func (b *breaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.streak >= b.cfg.Failures && (time.Now().Before(b.openUntil) || b.trial)
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.streak < b.cfg.Failures {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *breaker) done(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := b.streak >= b.cfg.Failures
+	b.trial = false
+	if !failed {
+		if wasOpen {
+			log.Printf("Circuit breaker for %s closed", b.name)
+		}
+		b.streak = 0
+		return
+	}
+	b.streak++
+	if b.streak >= b.cfg.Failures {
+		if !wasOpen {
+			log.Printf("Circuit breaker for %s opened after %d failures", b.name, b.streak)
+		}
+		b.openUntil = time.Now().Add(b.cfg.Cooldown)
+	}
+}
+
+// call runs fn unless the breaker is open. Calls that fail with a
+// dependency error, or take longer than the slow threshold, count against
+// the dependency.
+func (b *breaker) call(fn func() error) error {
+	if !b.allow() {
+		return errBreakerOpen
+	}
+	start := time.Now()
+	err := fn()
+	b.done(dependencyFailed(err) || time.Since(start) > b.cfg.Slow)
+	return err
+}
+
+// dependencyFailed tells a failing dependency apart from an answer it gave:
+// a missing key, link or scan, or a rejection from the caller's own update.
+func dependencyFailed(err error) bool {
+	var he *httpError
+	switch {
+	case err == nil, errors.Is(err, errNotFound), errors.Is(err, errLinkNotFound), errors.Is(err, errLinkExists):
+		return false
+	case errors.Is(err, errScanNotFound), errors.Is(err, errDuplicateConversion), errors.Is(err, errTooManyConversions):
+		return false
+	case errors.As(err, &he):
+		return false
+	}
+	return true
+}
+
+func writeBreakerMetrics(w io.Writer) {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	fmt.Fprintln(w, "# HELP qr_breaker_open Whether calls to a dependency are being refused.")
+	fmt.Fprintln(w, "# TYPE qr_breaker_open gauge")
+	for _, b := range breakers {
+		open := 0
+		if b.isOpen() {
+			open = 1
+		}
+		fmt.Fprintf(w, "qr_breaker_open{dependency=%q} %d\n", b.name, open)
+	}
+}
+
+// breakerStorage guards a storage with a breaker.
+type breakerStorage struct {
+	st storage
+	b  *breaker
+}
+
+func (s breakerStorage) Get(key string) ([]byte, error) {
+	var data []byte
+	err := s.b.call(func() (err error) {
+		data, err = s.st.Get(key)
+		return err
+	})
+	return data, err
+}
+
+func (s breakerStorage) Put(key string, data []byte) error {
+	return s.b.call(func() error { return s.st.Put(key, data) })
+}
+
+func (s breakerStorage) Append(key string, data []byte) error {
+	return s.b.call(func() error { return s.st.Append(key, data) })
+}
+
+func (s breakerStorage) List(prefix string) ([]string, error) {
+	var keys []string
+	err := s.b.call(func() (err error) {
+		keys, err = s.st.List(prefix)
+		return err
+	})
+	return keys, err
+}
+
+func (s breakerStorage) Delete(key string) error {
+	return s.b.call(func() error { return s.st.Delete(key) })
+}
+
+// breakerLinks guards a link store with a breaker. Links it has loaded are
+// remembered, so redirects keep working from memory while the store is
+// failing; hits are not recorded meanwhile.
+type breakerLinks struct {
+	links linkStore
+	b     *breaker
+	known *linkCache
+}
+
+func (s breakerLinks) Get(slug string) (shortLink, error) {
+	var l shortLink
+	err := s.b.call(func() (err error) {
+		l, err = s.links.Get(slug)
+		return err
+	})
+	switch {
+	case err == nil:
+		s.known.add(l)
+	case errors.Is(err, errLinkNotFound):
+		s.known.remove(slug)
+	case dependencyFailed(err):
+		if known, ok := s.known.get(slug); ok {
+			return known, nil
+		}
+	}
+	return l, err
+}
+
+func (s breakerLinks) Create(l shortLink) error {
+	return s.b.call(func() error { return s.links.Create(l) })
+}
+
+func (s breakerLinks) Update(slug string, fn func(*shortLink) error) (shortLink, error) {
+	var l shortLink
+	err := s.b.call(func() (err error) {
+		l, err = s.links.Update(slug, fn)
+		return err
+	})
+	if err == nil {
+		s.known.add(l)
+	}
+	return l, err
+}
+
+func (s breakerLinks) Delete(slug string) error {
+	s.known.remove(slug)
+	return s.b.call(func() error { return s.links.Delete(slug) })
+}
+
+func (s breakerLinks) List(tenantID string) ([]shortLink, error) {
+	var ls []shortLink
+	err := s.b.call(func() (err error) {
+		ls, err = s.links.List(tenantID)
+		return err
+	})
+	return ls, err
+}
+
+func (s breakerLinks) All() ([]shortLink, error) {
+	var ls []shortLink
+	err := s.b.call(func() (err error) {
+		ls, err = s.links.All()
+		return err
+	})
+	return ls, err
+}
+
+func (s breakerLinks) RecordHit(slug string, h linkHit) error {
+	return s.b.call(func() error { return s.links.RecordHit(slug, h) })
+}
+
+func (s breakerLinks) EachHit(slug string, since time.Time, fn func(linkHit)) (int, error) {
+	var n int
+	err := s.b.call(func() (err error) {
+		n, err = s.links.EachHit(slug, since, fn)
+		return err
+	})
+	return n, err
+}
+
+func (s breakerLinks) RecordConversion(slug, token string, c conversion) error {
+	return s.b.call(func() error { return s.links.RecordConversion(slug, token, c) })
+}
+
+func (s breakerLinks) EachScan(slug string, since time.Time, fn func(linkScan)) error {
+	return s.b.call(func() error { return s.links.EachScan(slug, since, fn) })
+}
+
+// linkCache keeps the most recently loaded links, up to limit entries.
+type linkCache struct {
+	mu      sync.Mutex
+	limit   int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newLinkCache(limit int) *linkCache {
+	return &linkCache{limit: limit, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *linkCache) get(slug string) (shortLink, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[slug]
+	if !ok {
+		return shortLink{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(shortLink), true
+}
+
+func (c *linkCache) add(l shortLink) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[l.Slug]; ok {
+		e.Value = l
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[l.Slug] = c.order.PushFront(l)
+	for c.order.Len() > c.limit {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(shortLink).Slug)
+	}
+}
+
+func (c *linkCache) remove(slug string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[slug]; ok {
+		c.order.Remove(e)
+		delete(c.entries, slug)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+)
+
+// The default logo and font are compiled in, so a server started from
+// another directory, or from an image that left the files out, still
+// renders. A file of the same name in the asset store takes precedence,
+// and QR_LOGO_FILE and QR_FONT_FILE name other assets to use instead.
+var (
+	//go:embed smartlink-logo.png
+	bundledLogo []byte
+	//go:embed Roboto-Medium.ttf
+	bundledFont []byte
+)
+
+var bundledFiles = map[string][]byte{
+	"smartlink-logo.png": bundledLogo,
+	"Roboto-Medium.ttf":  bundledFont,
+}
+
+// bundledAssets serves the compiled-in files for keys the store does not
+// have.
+type bundledAssets struct {
+	storage
+}
+
+func (s bundledAssets) Get(key string) ([]byte, error) {
+	b, err := s.storage.Get(key)
+	if errors.Is(err, errNotFound) {
+		if bundled, ok := bundledFiles[key]; ok {
+			return bundled, nil
+		}
+	}
+	return b, err
+}
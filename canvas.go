@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// canvasPreset is a social media format: the canvas size, and the share of
+// its width and height the code and label may take up. The rest is margin,
+// which keeps the code clear of the app controls stories overlay.
+type canvasPreset struct {
+	width, height int
+	fillW, fillH  float64
+}
+
+var canvasPresets = map[string]canvasPreset{
+	"square": {1080, 1080, 0.8, 0.75},
+	"story":  {1080, 1920, 0.8, 0.75},
+	"banner": {1920, 1080, 0.8, 0.75},
+}
+
+// canvasAliases lets presets be named by their aspect ratio.
+var canvasAliases = map[string]string{
+	"1:1":  "square",
+	"9:16": "story",
+	"16:9": "banner",
+}
+
+func canvasPresetName(v string) (string, bool) {
+	if name, ok := canvasAliases[v]; ok {
+		v = name
+	}
+	_, ok := canvasPresets[v]
+	return v, ok
+}
+
+// placeOnCanvas centres the code and label on the spec's canvas. The code
+// is rendered again at the size that fills the preset's area rather than
+// resampled, so modules and text stay sharp; sizes beyond QR_MAX_SIZE keep
+// the code at the maximum.
+func placeOnCanvas(img image.Image, spec renderSpec, tm *stageTimer) (image.Image, []string, error) {
+	preset := canvasPresets[spec.Canvas]
+	b := img.Bounds()
+	f := math.Min(float64(preset.width)*preset.fillW/float64(b.Dx()), float64(preset.height)*preset.fillH/float64(b.Dy()))
+
+	var warnings []string
+	if size := int(float64(spec.Size) * f); size != spec.Size {
+		if size > serverLimits.MaxSize {
+			size = serverLimits.MaxSize
+		}
+		var err error
+		img, warnings, err = renderCode(spec.scaled(size), tm)
+		if err != nil {
+			return nil, nil, err
+		}
+		b = img.Bounds()
+	}
+
+	defer tm.start("canvas")()
+	bg, err := parseHexColor(spec.CanvasBackground)
+	if err != nil {
+		return nil, nil, badRequest("Invalid canvas background color")
+	}
+	canvas := imaging.New(preset.width, preset.height, bg)
+	if spec.CanvasImage != "" {
+		data, err := loadCanvasImage(spec.CanvasImage)
+		if err != nil {
+			return nil, nil, err
+		}
+		bgImg, err := decodeLogo(data, int(math.Max(float64(preset.width), float64(preset.height))))
+		if err != nil {
+			return nil, nil, badRequest("Canvas image " + spec.CanvasImage + " is not a supported image")
+		}
+		canvas = imaging.Overlay(canvas, imaging.Fill(bgImg, preset.width, preset.height, imaging.Center, imaging.Lanczos), image.Point{}, 1.0)
+	}
+
+	at := image.Pt((preset.width-b.Dx())/2, (preset.height-b.Dy())/2)
+	draw.Draw(canvas, b.Sub(b.Min).Add(at), img, b.Min, draw.Over)
+	return canvas, warnings, nil
+}
+
+func loadCanvasImage(name string) ([]byte, error) {
+	data, err := assets.Get(name)
+	if errors.Is(err, errNotFound) {
+		return nil, badRequest("Unknown canvas image " + name)
+	}
+	if err != nil {
+		return nil, internalError("Failed to open canvas image", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Minimum WCAG contrast ratio between the QR modules and anything drawn
+// behind them. Below this, phone cameras start misreading light modules.
+const minContrastRatio = 4.5
+
+// parseHexColor parses "#rrggbb" or "rrggbb" into an opaque color.
+func parseHexColor(s string) (color.RGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid hex color %q", s)
+	}
+
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid hex color %q", s)
+	}
+
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}, nil
+}
+
+// hexColor formats c as "#rrggbb", dropping alpha.
+func hexColor(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+// relativeLuminance returns the WCAG relative luminance of c.
+func relativeLuminance(c color.Color) float64 {
+	r, g, b, _ := c.RGBA()
+	channel := func(v uint32) float64 {
+		s := float64(v) / 0xffff
+		if s <= 0.03928 {
+			return s / 12.92
+		}
+		return math.Pow((s+0.055)/1.055, 2.4)
+	}
+	return 0.2126*channel(r) + 0.7152*channel(g) + 0.0722*channel(b)
+}
+
+// contrastRatio returns the WCAG contrast ratio between two colors.
+func contrastRatio(a, b color.Color) float64 {
+	la, lb := relativeLuminance(a), relativeLuminance(b)
+	if la < lb {
+		la, lb = lb, la
+	}
+	return (la + 0.05) / (lb + 0.05)
+}
+
+// moduleColors returns the colours of the dark and light modules of
+// spec, black and white unless it sets others.
+func moduleColors(spec renderSpec) (fg, bg color.Color, err error) {
+	fg, bg = color.Black, color.White
+	if spec.Foreground != "" {
+		if fg, err = parseHexColor(spec.Foreground); err != nil {
+			return nil, nil, badRequest("Invalid foreground color")
+		}
+	}
+	if spec.Background != "" {
+		if bg, err = parseHexColor(spec.Background); err != nil {
+			return nil, nil, badRequest("Invalid background color")
+		}
+	}
+	return fg, bg, nil
+}
+
+// checkModuleContrast rejects module colours scanners cannot rely on:
+// too little contrast, or light modules on a dark background, which many
+// scanners do not read at all.
+func checkModuleContrast(fg, bg color.Color) error {
+	if relativeLuminance(fg) > relativeLuminance(bg) {
+		return fmt.Errorf("foreground %s is lighter than background %s", hexColor(fg), hexColor(bg))
+	}
+	if ratio := contrastRatio(fg, bg); ratio < minContrastRatio {
+		return fmt.Errorf("foreground %s on background %s has contrast ratio %.2f, below the minimum of %.1f", hexColor(fg), hexColor(bg), ratio, minContrastRatio)
+	}
+	return nil
+}
+
+// checkSpecColors checks the module colours of spec, and the palette
+// against a background that is not white.
+func checkSpecColors(spec renderSpec) error {
+	fg, bg, err := moduleColors(spec)
+	if err != nil {
+		return err
+	}
+	if err := checkModuleContrast(fg, bg); err != nil {
+		return classified(badRequest("Colors rejected: "+err.Error()), classLowContrast)
+	}
+	if spec.Background == "" {
+		return nil
+	}
+	for _, p := range spec.Palette {
+		c, err := parseHexColor(p)
+		if err != nil {
+			return badRequest("Invalid palette: " + err.Error())
+		}
+		if err := checkModuleContrast(c, bg); err != nil {
+			return classified(badRequest("Palette rejected: "+err.Error()), classLowContrast)
+		}
+	}
+	return nil
+}
+
+// darkestPixel returns the color of the lowest-luminance pixel in img.
+func darkestPixel(img image.Image) color.Color {
+	var darkest color.Color = color.White
+	min := math.MaxFloat64
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.At(x, y)
+			if l := relativeLuminance(c); l < min {
+				min = l
+				darkest = c
+			}
+		}
+	}
+	return darkest
+}
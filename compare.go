@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+type compareResult struct {
+	Width           int     `json:"width"`
+	Height          int     `json:"height"`
+	DifferentPixels int     `json:"different_pixels"`
+	DiffPercent     float64 `json:"diff_percent"`
+	Resized         bool    `json:"resized"`
+	DiffImage       string  `json:"diff_image"`
+}
+
+// compareImages counts pixels whose channels differ by more than tolerance
+// and draws a diff image: a faded copy of a with the differing pixels in
+// red. b is resized to a's dimensions first when they differ.
+func compareImages(a, b image.Image, tolerance int) (compareResult, image.Image) {
+	ab := a.Bounds()
+	res := compareResult{Width: ab.Dx(), Height: ab.Dy()}
+	if b.Bounds().Dx() != ab.Dx() || b.Bounds().Dy() != ab.Dy() {
+		b = imaging.Resize(b, ab.Dx(), ab.Dy(), imaging.Lanczos)
+		res.Resized = true
+	}
+
+	na := imaging.Clone(a)
+	nb := imaging.Clone(b)
+	diff := imaging.AdjustBrightness(imaging.Grayscale(na), 60)
+	red := color.NRGBA{R: 255, A: 255}
+
+	for i := 0; i < len(na.Pix); i += 4 {
+		different := false
+		for c := 0; c < 4; c++ {
+			d := int(na.Pix[i+c]) - int(nb.Pix[i+c])
+			if d > tolerance || -d > tolerance {
+				different = true
+				break
+			}
+		}
+		if different {
+			res.DifferentPixels++
+			p := i / 4
+			diff.SetNRGBA(p%ab.Dx(), p/ab.Dx(), red)
+		}
+	}
+	if total := ab.Dx() * ab.Dy(); total > 0 {
+		res.DiffPercent = 100 * float64(res.DifferentPixels) / float64(total)
+	}
+	return res, diff
+}
+
+// decodeUpload reads an uploaded image, scanning it first and refusing
+// dimensions beyond twice the largest code we render.
+func decodeUpload(r *http.Request, field string) (image.Image, error) {
+	f, hdr, err := r.FormFile(field)
+	if err != nil {
+		return nil, badRequest(fmt.Sprintf("Missing '%s' file", field))
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, bodyError(err, fmt.Sprintf("Failed to read '%s' file", field))
+	}
+	if err := scanUpload(r.Context(), hdr.Filename, data); err != nil {
+		return nil, err
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, badRequest(fmt.Sprintf("Unsupported image in '%s'", field))
+	}
+	if limit := 2 * serverLimits.MaxSize; cfg.Width > limit || cfg.Height > limit {
+		return nil, tooLarge(fmt.Sprintf("Image '%s' is %dx%d, maximum is %dx%d", field, cfg.Width, cfg.Height, limit, limit))
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, badRequest(fmt.Sprintf("Unsupported image in '%s'", field))
+	}
+	return img, nil
+}
+
+// compareHandler diffs two images so a print vendor can check a proof
+// against what we generated. The multipart form carries either files 'a'
+// and 'b', or a stored code 'id' and file 'b'. 'tolerance' (0-255) ignores
+// small per-channel differences; output=image returns the diff PNG itself
+// instead of JSON.
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(serverLimits.MaxBodyBytes); err != nil {
+		writeError(w, bodyError(err, "Expected a multipart form"))
+		return
+	}
+
+	tolerance := 0
+	if v := r.FormValue("tolerance"); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil || t < 0 || t > 255 {
+			http.Error(w, "Invalid 'tolerance' parameter (must be 0-255)", http.StatusBadRequest)
+			return
+		}
+		tolerance = t
+	}
+
+	var a image.Image
+	if id := r.FormValue("id"); id != "" {
+		b, err := renders.Get(id)
+		if errors.Is(err, errNotFound) {
+			http.Error(w, "QR code not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeError(w, internalError("Failed to load stored render", err))
+			return
+		}
+		a, _, err = image.Decode(bytes.NewReader(b))
+		if err != nil {
+			writeError(w, internalError("Failed to decode stored render", err))
+			return
+		}
+	} else {
+		var err error
+		a, err = decodeUpload(r, "a")
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	b, err := decodeUpload(r, "b")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	res, diff := compareImages(a, b, tolerance)
+	png, err := encodePNG(diff)
+	if err != nil {
+		writeError(w, internalError("Failed to encode diff image", err))
+		return
+	}
+
+	if r.FormValue("output") == "image" {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("X-Diff-Percent", strconv.FormatFloat(res.DiffPercent, 'f', 4, 64))
+		w.Write(png)
+		return
+	}
+
+	res.DiffImage = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
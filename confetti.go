@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"math/rand"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	maxPaletteColors = 8
+	finderSize       = 7
+)
+
+// parsePalette parses a comma separated list of hex colors and rejects any
+// that are too light to read against a white background.
+func parsePalette(s string) ([]color.Color, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) > maxPaletteColors {
+		return nil, fmt.Errorf("palette has %d colors, maximum is %d", len(parts), maxPaletteColors)
+	}
+
+	palette := make([]color.Color, 0, len(parts))
+	for _, part := range parts {
+		c, err := parseHexColor(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		if ratio := contrastRatio(c, color.White); ratio < minContrastRatio {
+			return nil, fmt.Errorf("palette color %s contrast ratio %.2f is below the minimum of %.1f", part, ratio, minContrastRatio)
+		}
+		palette = append(palette, c)
+	}
+	return palette, nil
+}
+
+// paletteSeed derives a stable seed from the payload so the same request
+// always produces the same confetti.
+func paletteSeed(data string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(data))
+	return int64(h.Sum64())
+}
+
+// confettiImage renders qr on grid g with every dark module colored from
+// palette. The three finder patterns ("eyes") keep the QR foreground color
+// so scanners can still lock on.
+func confettiImage(qr *qrcode.QRCode, bitmap [][]bool, g moduleGrid, palette []color.Color, seed int64) image.Image {
+	colors := confettiColors(qr, bitmap, palette, seed)
+
+	size := g.size
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y2, yok := g.module(y)
+		for x := 0; x < size; x++ {
+			x2, xok := g.module(x)
+			if yok && xok && colors[y2][x2] != nil {
+				img.Set(x, y, colors[y2][x2])
+			} else {
+				img.Set(x, y, qr.BackgroundColor)
+			}
+		}
+	}
+	return img
+}
+
+// confettiColors picks the color of every dark module, nil for light ones.
+// The choice is made per module so it does not depend on the output size
+// or format.
+func confettiColors(qr *qrcode.QRCode, bitmap [][]bool, palette []color.Color, seed int64) [][]color.Color {
+	realSize := len(bitmap)
+	rng := rand.New(rand.NewSource(seed))
+	symbolSize := 17 + 4*qr.VersionNumber
+	quiet := (realSize - symbolSize) / 2
+	colors := make([][]color.Color, realSize)
+	for y := range bitmap {
+		colors[y] = make([]color.Color, realSize)
+		for x := range bitmap[y] {
+			if !bitmap[y][x] {
+				continue
+			}
+			if isFinderModule(x-quiet, y-quiet, symbolSize) {
+				colors[y][x] = qr.ForegroundColor
+			} else {
+				colors[y][x] = palette[rng.Intn(len(palette))]
+			}
+		}
+	}
+	return colors
+}
+
+// isFinderModule reports whether symbol coordinate (x, y) lies inside one of
+// the three finder patterns of a symbol n modules wide.
+func isFinderModule(x, y, n int) bool {
+	inTop := y >= 0 && y < finderSize
+	inLeft := x >= 0 && x < finderSize
+	inRight := x >= n-finderSize && x < n
+	inBottom := y >= n-finderSize && y < n
+	return (inTop && inLeft) || (inTop && inRight) || (inBottom && inLeft)
+}
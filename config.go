@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// limits caps how much work a single request can ask for. Requests over a
+// limit are answered with 413 and the limits in the body.
+type limits struct {
+	MaxSize      int   `json:"max_size"`
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+	MaxBatchRows int   `json:"max_batch_rows"`
+
+	// MaxUploadBytes caps a resumable upload; each of its chunks is still
+	// a request body limited by MaxBodyBytes.
+	MaxUploadBytes int64 `json:"max_upload_bytes"`
+
+	MaxJobConcurrency int `json:"max_job_concurrency"`
+
+	// MaxLogoBytes caps a logo downloaded from a logo_url.
+	MaxLogoBytes int64 `json:"max_logo_bytes"`
+
+	// JobMemoryBytes is how much of a job artifact is kept in memory
+	// before it spills to disk. It is not a request limit.
+	JobMemoryBytes int64 `json:"-"`
+}
+
+var serverLimits limits
+
+func loadLimits() limits {
+	return limits{
+		MaxSize:      envInt("QR_MAX_SIZE", 4096),
+		MaxBodyBytes: int64(envInt("QR_MAX_BODY_BYTES", 1<<20)),
+		MaxBatchRows: envInt("QR_MAX_BATCH_ROWS", 1000),
+
+		MaxUploadBytes: int64(envInt("QR_MAX_UPLOAD_BYTES", 64<<20)),
+
+		MaxJobConcurrency: envInt("QR_MAX_JOB_CONCURRENCY", 4),
+
+		MaxLogoBytes: int64(envInt("QR_MAX_LOGO_BYTES", 2<<20)),
+
+		JobMemoryBytes: int64(envInt("QR_JOB_MEMORY_BYTES", 64<<20)),
+	}
+}
+
+// envInt reads an integer setting from the environment, exiting on values
+// that do not parse so a typo is caught at startup.
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Fatalf("Invalid %s=%q: expected a positive integer", key, v)
+	}
+	return n
+}
+
+// envList reads a comma separated setting from the environment.
+func envList(key string, def []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// config is the deployment's layout and branding: where the server listens
+// and keeps its files, the logo and font it renders with, and the default
+// size and label style. loadConfig reads it from the YAML file named by
+// QR_CONFIG_FILE, if any, and then from QR_* settings in the environment,
+// which win, so one image can run with a different file per environment.
+// Requests and templates still override the rendering defaults.
+type config struct {
+	Addr      string `yaml:"addr"`       // QR_ADDR
+	DataDir   string `yaml:"data_dir"`   // QR_DATA_DIR
+	AssetsDir string `yaml:"assets_dir"` // QR_ASSETS_DIR
+	// TempDir takes spilled job artifacts and uploads; empty means the
+	// system temporary directory.
+	TempDir string `yaml:"temp_dir"` // QR_SPILL_DIR
+
+	// LogoFile and FontFile are names in the asset store.
+	LogoFile string `yaml:"logo_file"` // QR_LOGO_FILE
+	FontFile string `yaml:"font_file"` // QR_FONT_FILE
+
+	Size            int     `yaml:"size"`             // QR_DEFAULT_SIZE
+	LogoSize        int     `yaml:"logo_size"`        // QR_LOGO_SIZE
+	LabelHeight     int     `yaml:"label_height"`     // QR_LABEL_HEIGHT
+	LabelFontSize   float64 `yaml:"label_font_size"`  // QR_LABEL_FONT_SIZE
+	LabelPosition   string  `yaml:"label_position"`   // QR_LABEL_POSITION
+	LabelBackground string  `yaml:"label_background"` // QR_LABEL_BACKGROUND
+	LabelColor      string  `yaml:"label_color"`      // QR_LABEL_COLOR
+}
+
+var serverConfig config
+
+func defaultConfig() config {
+	return config{
+		Addr:            ":8080",
+		DataDir:         "data",
+		AssetsDir:       ".",
+		LogoFile:        "smartlink-logo.png",
+		FontFile:        "Roboto-Medium.ttf",
+		Size:            1024,
+		LogoSize:        200,
+		LabelHeight:     80,
+		LabelFontSize:   30,
+		LabelBackground: "#017cfe",
+		LabelColor:      "#ffffff",
+	}
+}
+
+// loadConfig layers the config file and the environment over the
+// defaults and validates the result. It needs serverLimits.
+func loadConfig() (config, error) {
+	c := defaultConfig()
+	if path := os.Getenv("QR_CONFIG_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(&c); err != nil && err != io.EOF {
+			return c, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+
+	for _, s := range []struct {
+		key   string
+		field *string
+	}{
+		{"QR_ADDR", &c.Addr},
+		{"QR_DATA_DIR", &c.DataDir},
+		{"QR_ASSETS_DIR", &c.AssetsDir},
+		{"QR_SPILL_DIR", &c.TempDir},
+		{"QR_LOGO_FILE", &c.LogoFile},
+		{"QR_FONT_FILE", &c.FontFile},
+		{"QR_LABEL_POSITION", &c.LabelPosition},
+		{"QR_LABEL_BACKGROUND", &c.LabelBackground},
+		{"QR_LABEL_COLOR", &c.LabelColor},
+	} {
+		if v := os.Getenv(s.key); v != "" {
+			*s.field = v
+		}
+	}
+	c.Size = envInt("QR_DEFAULT_SIZE", c.Size)
+	c.LogoSize = envInt("QR_LOGO_SIZE", c.LogoSize)
+	c.LabelHeight = envInt("QR_LABEL_HEIGHT", c.LabelHeight)
+	if v := os.Getenv("QR_LABEL_FONT_SIZE"); v != "" {
+		size, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return c, fmt.Errorf("label_font_size %q is not a number", v)
+		}
+		c.LabelFontSize = size
+	}
+	return c, c.validate()
+}
+
+// validate checks c and writes its colours in the form specs use.
+func (c *config) validate() error {
+	if c.Addr == "" || c.DataDir == "" || c.AssetsDir == "" {
+		return errors.New("addr, data_dir and assets_dir must not be empty")
+	}
+	// An empty logo renders codes without one
+	for _, f := range []string{c.LogoFile, c.FontFile} {
+		if f == "" {
+			continue
+		}
+		if err := checkKey(f); err != nil {
+			return fmt.Errorf("asset name %q: %w", f, err)
+		}
+	}
+	if c.Size < minSize || c.Size > serverLimits.MaxSize {
+		return fmt.Errorf("size must be %d to %d pixels (QR_MAX_SIZE)", minSize, serverLimits.MaxSize)
+	}
+	if c.LogoSize < minLogoUpload || c.LogoSize > c.Size/2 {
+		return fmt.Errorf("logo_size must be %d to %d pixels, half the size", minLogoUpload, c.Size/2)
+	}
+	if c.LabelHeight < minLabelHeight || c.LabelHeight > maxLabelHeight {
+		return fmt.Errorf("label_height must be %d to %d pixels", minLabelHeight, maxLabelHeight)
+	}
+	if c.LabelFontSize < minLabelFontSize || c.LabelFontSize > float64(c.LabelHeight) {
+		return fmt.Errorf("label_font_size must be %d to %d pixels, the label height", minLabelFontSize, c.LabelHeight)
+	}
+	switch c.LabelPosition {
+	case labelBottom:
+		c.LabelPosition = ""
+	case "", labelTop, labelLeft, labelRight:
+	default:
+		return fmt.Errorf("unknown label_position %q: expected bottom, top, left or right", c.LabelPosition)
+	}
+	for _, s := range []struct {
+		name  string
+		field *string
+	}{{"label_background", &c.LabelBackground}, {"label_color", &c.LabelColor}} {
+		col, err := parseHexColor(*s.field)
+		if err != nil {
+			return fmt.Errorf("%s %q is not a hex color", s.name, *s.field)
+		}
+		*s.field = hexColor(col)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Links with track_conversions set hand every scan a token, added to the
+// destination as ?qr_scan=<token>. The destination calls POST /conversions
+// with the token when the visitor goes on to order or sign up, and the
+// conversion counts towards the scan's link in its stats.
+
+const (
+	scanTokenParam        = "qr_scan"
+	defaultConversionType = "conversion"
+	// maxScanConversions caps the conversions one scan can collect.
+	maxScanConversions = 100
+)
+
+var (
+	errScanNotFound        = errors.New("scan not found")
+	conversionTypePattern  = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+	conversionIDPattern    = regexp.MustCompile(`^[\x21-\x7e]{1,128}$`)
+	errTooManyConversions  = errors.New("too many conversions for one scan")
+	errDuplicateConversion = errors.New("conversion already recorded")
+)
+
+// conversion is something a visitor did after scanning, reported by the
+// destination. ID, such as an order number, makes a report that is sent
+// again count once.
+type conversion struct {
+	Type  string    `json:"type"`
+	ID    string    `json:"id,omitempty"`
+	Value float64   `json:"value,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// linkScan is a tracked scan and the conversions that followed it.
+type linkScan struct {
+	Token       string       `json:"token"`
+	Time        time.Time    `json:"time"`
+	Conversions []conversion `json:"conversions,omitempty"`
+}
+
+// newScanToken returns a token for a scan of slug at t. The link and time
+// are part of it, so a conversion finds its scan without an index.
+func newScanToken(slug string, t time.Time) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return slug + "." + scanKeyPrefix(t) + hex.EncodeToString(b)
+}
+
+// scanKeyPrefix orders scan keys by time.
+func scanKeyPrefix(t time.Time) string {
+	return fmt.Sprintf("%016x", uint64(t.UnixNano()))
+}
+
+// splitScanToken returns the slug of a token and its key among the link's
+// scans.
+func splitScanToken(token string) (slug, key string, ok bool) {
+	slug, key, ok = strings.Cut(token, ".")
+	if !ok || !slugPattern.MatchString(slug) || len(key) != 32 {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(key); err != nil {
+		return "", "", false
+	}
+	return slug, key, true
+}
+
+// trackedDestination adds the scan token to a destination URL.
+func trackedDestination(dest, token string) string {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return dest
+	}
+	q := u.Query()
+	q.Set(scanTokenParam, token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// recordConversion takes {"token": ..., "type": ..., "id": ..., "value":
+// ...} from a destination. Only token is required; type defaults to
+// "conversion".
+func recordConversion(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string  `json:"token"`
+		Type  string  `json:"type"`
+		ID    string  `json:"id"`
+		Value float64 `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, bodyError(err, "Invalid conversion JSON"))
+		return
+	}
+	if req.Token == "" {
+		http.Error(w, "Missing 'token' (the qr_scan parameter of the visit)", http.StatusBadRequest)
+		return
+	}
+	if req.Type == "" {
+		req.Type = defaultConversionType
+	}
+	if !conversionTypePattern.MatchString(req.Type) {
+		http.Error(w, "Invalid 'type' (lowercase letters, digits, '-' and '_', up to 32)", http.StatusBadRequest)
+		return
+	}
+	if req.ID != "" && !conversionIDPattern.MatchString(req.ID) {
+		http.Error(w, "Invalid 'id' (up to 128 printable characters)", http.StatusBadRequest)
+		return
+	}
+	if req.Value < 0 {
+		http.Error(w, "Invalid 'value' (must not be negative)", http.StatusBadRequest)
+		return
+	}
+
+	slug, _, ok := splitScanToken(req.Token)
+	if !ok {
+		http.Error(w, "Unknown scan token", http.StatusNotFound)
+		return
+	}
+	c := conversion{Type: req.Type, ID: req.ID, Value: req.Value, Time: time.Now().UTC()}
+	err := links.RecordConversion(slug, req.Token, c)
+	switch {
+	case errors.Is(err, errScanNotFound):
+		http.Error(w, "Unknown scan token", http.StatusNotFound)
+	case errors.Is(err, errTooManyConversions):
+		writeError(w, tooLarge(fmt.Sprintf("Scan already has %d conversions", maxScanConversions)))
+	case errors.Is(err, errDuplicateConversion), err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, internalError("Failed to record conversion", err))
+	}
+}
+
+// conversionStats sums the conversions of a link's scans.
+type conversionStats struct {
+	Conversions int                `json:"conversions"`
+	Converted   int                `json:"converted_scans"`
+	Rate        float64            `json:"conversion_rate"`
+	Value       float64            `json:"conversion_value"`
+	Types       map[string]int     `json:"conversion_types"`
+	TypeValues  map[string]float64 `json:"conversion_values,omitempty"`
+}
+
+func (cs *conversionStats) add(s linkScan) {
+	if len(s.Conversions) > 0 {
+		cs.Converted++
+	}
+	for _, c := range s.Conversions {
+		cs.Conversions++
+		cs.Value += c.Value
+		cs.Types[c.Type]++
+		if c.Value != 0 {
+			cs.TypeValues[c.Type] += c.Value
+		}
+	}
+}
+
+// rate sets the share of hits that converted.
+func (cs *conversionStats) rate(hits int) {
+	if hits > 0 {
+		cs.Rate = float64(cs.Converted) / float64(hits)
+	}
+}
+
+// collectConversions sums the conversions of l's scans from since until
+// end, by when the scan was made.
+func collectConversions(l shortLink, since, end time.Time, hits int) (*conversionStats, error) {
+	cs := &conversionStats{Types: map[string]int{}, TypeValues: map[string]float64{}}
+	err := links.EachScan(l.Slug, since, func(s linkScan) {
+		if s.Time.Before(end) {
+			cs.add(s)
+		}
+	})
+	if err != nil {
+		return nil, internalError("Failed to read conversions", err)
+	}
+	cs.rate(hits)
+	return cs, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/makiuchi-d/gozxing"
+	qrreader "github.com/makiuchi-d/gozxing/qrcode"
+)
+
+// verifyDecode scans img as a phone would and checks that it yields want.
+// Used to guard stylings that trade contrast for looks.
+func verifyDecode(img image.Image, want string) error {
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return fmt.Errorf("prepare image: %w", err)
+	}
+
+	hints := map[gozxing.DecodeHintType]interface{}{
+		gozxing.DecodeHintType_TRY_HARDER: true,
+	}
+	result, err := qrreader.NewQRCodeReader().Decode(bmp, hints)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	if got := result.GetText(); got != want {
+		return fmt.Errorf("decoded %q, want %q", got, want)
+	}
+	return nil
+}
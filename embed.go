@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// oEmbed is an oEmbed style photo response. URL is the data URI of the
+// image, so the consumer needs nothing hosted.
+type oEmbed struct {
+	Version      string `json:"version"`
+	Type         string `json:"type"`
+	Title        string `json:"title"`
+	ProviderName string `json:"provider_name"`
+	URL          string `json:"url"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	HTML         string `json:"html"`
+	ID           string `json:"id"`
+}
+
+const embedProvider = "SmartLink QR"
+
+// imgTag returns an img element showing src at width by height, the alt
+// text escaped.
+func imgTag(src, alt string, width, height int) string {
+	return fmt.Sprintf(`<img src="%s" alt="%s" width="%d" height="%d">`, html.EscapeString(src), html.EscapeString(alt), width, height)
+}
+
+func pngDataURI(b []byte) string {
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(b)
+}
+
+// displaySize scales the image size in b to width, keeping the aspect
+// ratio, or returns it unchanged for a width of 0.
+func displaySize(b []byte, width int) (int, int, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return 0, 0, err
+	}
+	if width == 0 || cfg.Width == 0 {
+		return cfg.Width, cfg.Height, nil
+	}
+	return width, (cfg.Height*width + cfg.Width/2) / cfg.Width, nil
+}
+
+// embedQRCode renders a code like /qrcode and returns it ready to paste:
+// an img element carrying the PNG as a data URI, or with output=json an
+// oEmbed document. 'alt' sets the alt text, the label by default, and
+// 'width' the displayed width in CSS pixels.
+func embedQRCode(w http.ResponseWriter, r *http.Request) {
+	output := r.FormValue("output")
+	if output != "" && output != "html" && output != "json" {
+		http.Error(w, "Invalid 'output' parameter (must be html or json)", http.StatusBadRequest)
+		return
+	}
+	width := 0
+	if v := r.FormValue("width"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid 'width' parameter (must be a positive integer)", http.StatusBadRequest)
+			return
+		}
+		width = n
+	}
+
+	spec, err := specFromRequest(r)
+	if err == nil {
+		spec, err = applyQuota(w, r, spec)
+	}
+	if err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+
+	tm := requestTimer()
+	id, b, cached, warnings, err := renderStored(spec, tm, interactive)
+	if err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+	dw, dh, err := displaySize(b, width)
+	if err != nil {
+		writeError(w, internalError("Failed to read QR code image", err))
+		return
+	}
+	writeTiming(w, tm)
+	writeWarnings(w, warnings)
+	recordGeneration(r, "png", spec, storedBytes(b, cached))
+	w.Header().Set("X-QR-Id", id)
+
+	alt := r.FormValue("alt")
+	if alt == "" {
+		alt = spec.Label
+	}
+	uri := pngDataURI(b)
+	snippet := imgTag(uri, alt, dw, dh)
+	if output == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(oEmbed{
+			Version:      "1.0",
+			Type:         "photo",
+			Title:        alt,
+			ProviderName: embedProvider,
+			URL:          uri,
+			Width:        dw,
+			Height:       dh,
+			HTML:         snippet,
+			ID:           id,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, snippet)
+}
+
+// publicBaseURL is the scheme and host clients reach the API at, for links
+// returned to them: QR_PUBLIC_URL when set, else the request's Host over
+// HTTPS when it arrived over TLS or through a trusted proxy that says so.
+func publicBaseURL(r *http.Request) string {
+	if base := os.Getenv("QR_PUBLIC_URL"); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	} else if addr, ok := peerAddr(r); ok && matchAny(trustedProxies, addr) && r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// getQRCodeImage serves a stored code inline, for pages and emails that
+// link to it rather than embed it. Ids name content, so the response never
+// changes and is cached for good. Views are not generations and do not
+// count against quotas.
+func getQRCodeImage(w http.ResponseWriter, r *http.Request) {
+	spec, err := specs.Load(mux.Vars(r)["id"])
+	if errors.Is(err, errSpecNotFound) {
+		http.Error(w, "QR code not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, internalError("Failed to load QR code spec", err))
+		return
+	}
+	id, err := specID(spec)
+	if err != nil {
+		writeError(w, internalError("Failed to hash QR code spec", err))
+		return
+	}
+	if checkNotModified(w, r, codeETag(id, pngFormat), "public, max-age=31536000, immutable") {
+		return
+	}
+
+	id, b, _, warnings, err := renderStored(spec, nil, interactive)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeWarnings(w, warnings)
+	if len(warnings) > 0 {
+		uncacheable(w)
+	}
+	w.Header().Set("X-QR-Id", id)
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(b)
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/math/fixed"
+)
+
+// serverEmojiFont names the colour emoji font asset, from QR_EMOJI_FONT.
+// Labels containing emoji record it in their spec; without it emoji are
+// dropped as before, since the label fonts have no glyphs for them.
+var serverEmojiFont string
+
+// emojiRanges are the blocks treated as emoji when choosing whether a label
+// needs the emoji font.
+var emojiRanges = [][2]rune{
+	{0x2300, 0x23ff},
+	{0x2600, 0x27bf},
+	{0x2b00, 0x2bff},
+	{0x1f000, 0x1faff},
+}
+
+func isEmoji(r rune) bool {
+	for _, rg := range emojiRanges {
+		if r >= rg[0] && r <= rg[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func hasEmoji(s string) bool {
+	for _, r := range s {
+		if isEmoji(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Emoji presentation selectors and joiners carry no glyph of their own.
+// Joined sequences such as family emoji need shaping and come out as their
+// separate parts.
+const (
+	variationSelector16 = 0xfe0f
+	zeroWidthJoiner     = 0x200d
+)
+
+// colorFont reads colour glyph bitmaps from an emoji font: the CBLC/CBDT
+// tables of Noto Color Emoji style fonts, or the sbix table of Apple style
+// ones. Only the largest strike is used and scaled to the label size.
+type colorFont struct {
+	data   []byte
+	tables map[string][]byte
+	cmap   map[rune]uint16
+
+	// CBLC strike, or sbix strike offset
+	strike     []byte
+	sbixStrike int
+	ppem       float64
+
+	mu     sync.Mutex
+	glyphs map[uint16]*colorGlyph
+}
+
+// colorGlyph is a decoded bitmap with its metrics in strike pixels:
+// bearingY is the distance from the baseline up to the bitmap's top.
+type colorGlyph struct {
+	img                         image.Image
+	bearingX, bearingY, advance float64
+}
+
+var errNoColorGlyphs = errors.New("font has no CBDT or sbix colour glyphs")
+
+func parseColorFont(b []byte) (*colorFont, error) {
+	if len(b) < 12 {
+		return nil, errors.New("font is truncated")
+	}
+	f := &colorFont{data: b, tables: make(map[string][]byte), glyphs: make(map[uint16]*colorGlyph)}
+	n := int(binary.BigEndian.Uint16(b[4:]))
+	for i := 0; i < n; i++ {
+		rec := 12 + 16*i
+		if rec+16 > len(b) {
+			return nil, errors.New("font table directory is truncated")
+		}
+		off := binary.BigEndian.Uint32(b[rec+8:])
+		length := binary.BigEndian.Uint32(b[rec+12:])
+		if uint64(off)+uint64(length) > uint64(len(b)) {
+			return nil, fmt.Errorf("font table %q is out of bounds", b[rec:rec+4])
+		}
+		f.tables[string(b[rec:rec+4])] = b[off : off+length]
+	}
+
+	cmap, err := parseCmap(f.tables["cmap"])
+	if err != nil {
+		return nil, err
+	}
+	f.cmap = cmap
+
+	switch {
+	case f.tables["CBLC"] != nil && f.tables["CBDT"] != nil:
+		err = f.pickCBLCStrike()
+	case f.tables["sbix"] != nil:
+		err = f.pickSbixStrike()
+	default:
+		err = errNoColorGlyphs
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseCmap reads the best Unicode subtable: format 12 for the full range,
+// else format 4 for the BMP.
+func parseCmap(t []byte) (map[rune]uint16, error) {
+	if len(t) < 4 {
+		return nil, errors.New("font has no cmap table")
+	}
+	var best []byte
+	bestFormat := uint16(0)
+	n := int(binary.BigEndian.Uint16(t[2:]))
+	for i := 0; i < n && 4+8*i+8 <= len(t); i++ {
+		rec := t[4+8*i:]
+		platform, encoding := binary.BigEndian.Uint16(rec), binary.BigEndian.Uint16(rec[2:])
+		off := int(binary.BigEndian.Uint32(rec[4:]))
+		if off+2 > len(t) || !(platform == 0 || platform == 3 && (encoding == 1 || encoding == 10)) {
+			continue
+		}
+		format := binary.BigEndian.Uint16(t[off:])
+		if format == 12 || format == 4 && bestFormat != 12 {
+			best, bestFormat = t[off:], format
+		}
+	}
+
+	m := make(map[rune]uint16)
+	switch bestFormat {
+	case 12:
+		if len(best) < 16 {
+			return nil, errors.New("cmap format 12 is truncated")
+		}
+		groups := int(binary.BigEndian.Uint32(best[12:]))
+		for g := 0; g < groups && 16+12*g+12 <= len(best); g++ {
+			rec := best[16+12*g:]
+			start, end := binary.BigEndian.Uint32(rec), binary.BigEndian.Uint32(rec[4:])
+			gid := binary.BigEndian.Uint32(rec[8:])
+			for c := start; c <= end && c-start < 0x10000; c++ {
+				m[rune(c)] = uint16(gid + c - start)
+			}
+		}
+	case 4:
+		if len(best) < 14 {
+			return nil, errors.New("cmap format 4 is truncated")
+		}
+		segs := int(binary.BigEndian.Uint16(best[6:])) / 2
+		ends, starts := 14, 16+2*segs
+		deltas, ranges := starts+2*segs, starts+4*segs
+		if ranges+2*segs > len(best) {
+			return nil, errors.New("cmap format 4 is truncated")
+		}
+		u16 := func(i int) uint16 { return binary.BigEndian.Uint16(best[i:]) }
+		for s := 0; s < segs; s++ {
+			start, end := u16(starts+2*s), u16(ends+2*s)
+			delta, ro := u16(deltas+2*s), u16(ranges+2*s)
+			for c := uint32(start); c <= uint32(end) && c != 0xffff; c++ {
+				var gid uint16
+				if ro == 0 {
+					gid = uint16(c) + delta
+				} else {
+					i := ranges + 2*s + int(ro) + 2*int(c-uint32(start))
+					if i+2 > len(best) {
+						continue
+					}
+					if gid = u16(i); gid != 0 {
+						gid += delta
+					}
+				}
+				if gid != 0 {
+					m[rune(c)] = gid
+				}
+			}
+		}
+	default:
+		return nil, errors.New("font has no Unicode cmap")
+	}
+	return m, nil
+}
+
+// pickCBLCStrike selects the bitmap size record with the most pixels per em.
+func (f *colorFont) pickCBLCStrike() error {
+	t := f.tables["CBLC"]
+	if len(t) < 8 {
+		return errors.New("CBLC table is truncated")
+	}
+	n := int(binary.BigEndian.Uint32(t[4:]))
+	for i := 0; i < n; i++ {
+		off := 8 + 48*i
+		if off+48 > len(t) {
+			return errors.New("CBLC table is truncated")
+		}
+		rec := t[off : off+48]
+		if ppem := float64(rec[45]); ppem > f.ppem {
+			f.strike, f.ppem = rec, ppem
+		}
+	}
+	if f.strike == nil {
+		return errNoColorGlyphs
+	}
+	return nil
+}
+
+// pickSbixStrike selects the sbix strike with the most pixels per em.
+func (f *colorFont) pickSbixStrike() error {
+	t := f.tables["sbix"]
+	if len(t) < 8 {
+		return errors.New("sbix table is truncated")
+	}
+	n := int(binary.BigEndian.Uint32(t[4:]))
+	for i := 0; i < n && 8+4*i+4 <= len(t); i++ {
+		off := int(binary.BigEndian.Uint32(t[8+4*i:]))
+		if off+4 > len(t) {
+			continue
+		}
+		if ppem := float64(binary.BigEndian.Uint16(t[off:])); ppem > f.ppem {
+			f.sbixStrike, f.ppem = off, ppem
+		}
+	}
+	if f.ppem == 0 {
+		return errNoColorGlyphs
+	}
+	return nil
+}
+
+// glyph returns the colour glyph for r, decoding it on first use.
+func (f *colorFont) glyph(r rune) (*colorGlyph, bool) {
+	gid, ok := f.cmap[r]
+	if !ok {
+		return nil, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if g, ok := f.glyphs[gid]; ok {
+		return g, g != nil
+	}
+
+	var g *colorGlyph
+	var err error
+	if f.strike != nil {
+		g, err = f.cbdtGlyph(gid)
+	} else {
+		g, err = f.sbixGlyph(gid, 0)
+	}
+	if err != nil {
+		g = nil
+	}
+	f.glyphs[gid] = g
+	return g, g != nil
+}
+
+// cbdtGlyph finds gid in the strike's index subtables and decodes its PNG.
+// Image formats 17 and 18 carry their own metrics; format 19 takes them
+// from index formats 2 and 5.
+func (f *colorFont) cbdtGlyph(gid uint16) (*colorGlyph, error) {
+	cblc, cbdt := f.tables["CBLC"], f.tables["CBDT"]
+	u16 := func(b []byte, i int) int { return int(binary.BigEndian.Uint16(b[i:])) }
+	u32 := func(b []byte, i int) int { return int(binary.BigEndian.Uint32(b[i:])) }
+
+	arrayOff := u32(f.strike, 0)
+	for i := 0; i < u32(f.strike, 8); i++ {
+		entry := arrayOff + 8*i
+		if entry+8 > len(cblc) {
+			break
+		}
+		first, last := u16(cblc, entry), u16(cblc, entry+2)
+		if int(gid) < first || int(gid) > last {
+			continue
+		}
+		sub := arrayOff + u32(cblc, entry+4)
+		if sub+8 > len(cblc) {
+			return nil, errors.New("CBLC subtable out of bounds")
+		}
+		indexFormat, imageFormat := u16(cblc, sub), u16(cblc, sub+2)
+		dataOff := u32(cblc, sub+4)
+		k := int(gid) - first
+
+		var start, end int
+		var metrics []byte
+		switch indexFormat {
+		case 1:
+			start, end = dataOff+u32(cblc, sub+8+4*k), dataOff+u32(cblc, sub+12+4*k)
+		case 2:
+			size := u32(cblc, sub+8)
+			metrics = cblc[sub+12 : sub+20]
+			start = dataOff + size*k
+			end = start + size
+		case 3:
+			start, end = dataOff+u16(cblc, sub+8+2*k), dataOff+u16(cblc, sub+10+2*k)
+		case 4:
+			num := u32(cblc, sub+8)
+			for j := 0; j < num; j++ {
+				if u16(cblc, sub+12+4*j) == int(gid) {
+					start, end = dataOff+u16(cblc, sub+14+4*j), dataOff+u16(cblc, sub+18+4*j)
+					break
+				}
+			}
+		case 5:
+			size := u32(cblc, sub+8)
+			metrics = cblc[sub+12 : sub+20]
+			num := u32(cblc, sub+20)
+			for j := 0; j < num; j++ {
+				if u16(cblc, sub+24+2*j) == int(gid) {
+					start = dataOff + size*j
+					end = start + size
+					break
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unsupported CBLC index format %d", indexFormat)
+		}
+		if end <= start || end > len(cbdt) {
+			return nil, errors.New("glyph has no bitmap")
+		}
+		d := cbdt[start:end]
+
+		var pngData []byte
+		switch imageFormat {
+		case 17:
+			if len(d) < 9 {
+				return nil, errors.New("CBDT glyph is truncated")
+			}
+			metrics = []byte{d[0], d[1], d[2], d[3], d[4]}
+			pngData = d[9:]
+		case 18:
+			if len(d) < 12 {
+				return nil, errors.New("CBDT glyph is truncated")
+			}
+			metrics = d[:8]
+			pngData = d[12:]
+		case 19:
+			if len(d) < 4 || metrics == nil {
+				return nil, errors.New("CBDT glyph is truncated")
+			}
+			pngData = d[4:]
+		default:
+			return nil, fmt.Errorf("unsupported CBDT image format %d", imageFormat)
+		}
+		img, err := png.Decode(bytes.NewReader(pngData))
+		if err != nil {
+			return nil, err
+		}
+
+		// Small metrics are height, width, bearingX, bearingY, advance;
+		// big metrics put the horizontal advance at the same offset
+		g := &colorGlyph{
+			img:      img,
+			bearingX: float64(int8(metrics[2])),
+			bearingY: float64(int8(metrics[3])),
+			advance:  float64(metrics[4]),
+		}
+		return g, nil
+	}
+	return nil, errors.New("glyph not in strike")
+}
+
+// sbixGlyph decodes gid from the chosen sbix strike, following 'dupe'
+// records. The advance comes from hmtx.
+func (f *colorFont) sbixGlyph(gid uint16, depth int) (*colorGlyph, error) {
+	t := f.tables["sbix"]
+	off := f.sbixStrike + 4 + 4*int(gid)
+	if off+8 > len(t) {
+		return nil, errors.New("glyph not in strike")
+	}
+	start := f.sbixStrike + int(binary.BigEndian.Uint32(t[off:]))
+	end := f.sbixStrike + int(binary.BigEndian.Uint32(t[off+4:]))
+	if end-start < 8 || end > len(t) {
+		return nil, errors.New("glyph has no bitmap")
+	}
+	d := t[start:end]
+	originX, originY := int16(binary.BigEndian.Uint16(d)), int16(binary.BigEndian.Uint16(d[2:]))
+	switch string(d[4:8]) {
+	case "dupe":
+		if depth > 0 || len(d) < 10 {
+			return nil, errors.New("bad sbix dupe record")
+		}
+		return f.sbixGlyph(binary.BigEndian.Uint16(d[8:]), depth+1)
+	case "png ":
+	default:
+		return nil, fmt.Errorf("unsupported sbix graphic type %q", d[4:8])
+	}
+	img, err := png.Decode(bytes.NewReader(d[8:]))
+	if err != nil {
+		return nil, err
+	}
+	return &colorGlyph{
+		img:      img,
+		bearingX: float64(originX),
+		bearingY: float64(int(originY) + img.Bounds().Dy()),
+		advance:  f.hAdvance(gid) * f.ppem,
+	}, nil
+}
+
+// hAdvance is the advance width of gid in ems, from hmtx.
+func (f *colorFont) hAdvance(gid uint16) float64 {
+	head, hhea, hmtx := f.tables["head"], f.tables["hhea"], f.tables["hmtx"]
+	if len(head) < 20 || len(hhea) < 36 {
+		return 1
+	}
+	upem := float64(binary.BigEndian.Uint16(head[18:]))
+	n := int(binary.BigEndian.Uint16(hhea[34:]))
+	i := int(gid)
+	if i >= n {
+		i = n - 1
+	}
+	if upem == 0 || i < 0 || 4*i+2 > len(hmtx) {
+		return 1
+	}
+	return float64(binary.BigEndian.Uint16(hmtx[4*i:])) / upem
+}
+
+var (
+	colorFontsMu sync.Mutex
+	colorFonts   = make(map[string]*colorFont)
+)
+
+// loadColorFont parses the named emoji font asset once and keeps it; emoji
+// fonts run to megabytes.
+func loadColorFont(name string) (*colorFont, error) {
+	colorFontsMu.Lock()
+	defer colorFontsMu.Unlock()
+	if f, ok := colorFonts[name]; ok {
+		return f, nil
+	}
+	b, err := assets.Get(name)
+	if err != nil {
+		return nil, internalError("Failed to load emoji font", err)
+	}
+	f, err := parseColorFont(b)
+	if err != nil {
+		return nil, internalError("Failed to parse emoji font", err)
+	}
+	colorFonts[name] = f
+	return f, nil
+}
+
+// drawGlyph draws g scaled to size with its origin at pt and returns its
+// advance.
+func (f *colorFont) drawGlyph(dst draw.Image, g *colorGlyph, pt fixed.Point26_6, size float64) fixed.Int26_6 {
+	scale := size / f.ppem
+	w := int(math.Round(float64(g.img.Bounds().Dx()) * scale))
+	h := int(math.Round(float64(g.img.Bounds().Dy()) * scale))
+	if w > 0 && h > 0 {
+		img := imaging.Resize(g.img, w, h, imaging.Lanczos)
+		x := pt.X.Round() + int(math.Round(g.bearingX*scale))
+		y := pt.Y.Round() - int(math.Round(g.bearingY*scale))
+		draw.Draw(dst, image.Rect(x, y, x+w, y+h), img, image.Point{}, draw.Over)
+	}
+	return f.advance(g, size)
+}
+
+// advance is the advance of g at size.
+func (f *colorFont) advance(g *colorGlyph, size float64) fixed.Int26_6 {
+	return fixed.Int26_6(math.Round(g.advance * size / f.ppem * 64))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// httpError carries the status code and client-facing message for a failed
+// request, along with the underlying cause for the server log.
+type httpError struct {
+	status int
+	class  string
+	msg    string
+	err    error
+}
+
+// Failure classes group errors in the failure report by what went wrong
+// rather than by message text.
+const (
+	classInvalidRequest  = "invalid_request"
+	classMissingParam    = "missing_parameter"
+	classCapacity        = "capacity_exceeded"
+	classLowContrast     = "low_contrast"
+	classUnscannable     = "unscannable"
+	classLimit           = "limit_exceeded"
+	classFeatureDisabled = "feature_disabled"
+	classQuota           = "quota_exceeded"
+	classUploadRejected  = "upload_rejected"
+	classDependency      = "dependency_unavailable"
+	classInternal        = "internal"
+)
+
+func (e *httpError) Error() string {
+	if e.err != nil {
+		return e.msg + ": " + e.err.Error()
+	}
+	return e.msg
+}
+
+func (e *httpError) Unwrap() error { return e.err }
+
+func badRequest(msg string) error {
+	return &httpError{status: http.StatusBadRequest, class: classInvalidRequest, msg: msg}
+}
+
+func tooLarge(msg string) error {
+	return &httpError{status: http.StatusRequestEntityTooLarge, class: classLimit, msg: msg}
+}
+
+// internalError reports a failure on the server's side. One caused by an
+// open circuit breaker is a 503, as the dependency is known to be down.
+func internalError(msg string, err error) error {
+	if errors.Is(err, errBreakerOpen) {
+		return &httpError{status: http.StatusServiceUnavailable, class: classDependency, msg: msg, err: err}
+	}
+	return &httpError{status: http.StatusInternalServerError, class: classInternal, msg: msg, err: err}
+}
+
+// classified returns err with its failure class replaced.
+func classified(err error, class string) error {
+	var he *httpError
+	if errors.As(err, &he) {
+		c := *he
+		c.class = class
+		return &c
+	}
+	return err
+}
+
+// errorClass returns the failure class of err.
+func errorClass(err error) string {
+	var he *httpError
+	if errors.As(err, &he) && he.class != "" {
+		return he.class
+	}
+	return classInternal
+}
+
+// publicMessage is the client-facing text for err, without the internal
+// cause.
+func publicMessage(err error) string {
+	var he *httpError
+	if errors.As(err, &he) {
+		return he.msg
+	}
+	return "Internal server error"
+}
+
+// writeError responds with the status and message carried by err. Errors
+// that are not an *httpError are logged and reported as a plain 500.
+func writeError(w http.ResponseWriter, err error) {
+	var he *httpError
+	if !errors.As(err, &he) {
+		log.Println("Unexpected error:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if he.err != nil {
+		log.Printf("%s: %v", he.msg, he.err)
+	}
+
+	// Tell the client what it is allowed to ask for
+	if he.status == http.StatusRequestEntityTooLarge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(he.status)
+		json.NewEncoder(w).Encode(struct {
+			Error  string `json:"error"`
+			Limits limits `json:"limits"`
+		}{he.msg, serverLimits})
+		return
+	}
+	http.Error(w, he.msg, he.status)
+}
+
+// limitBody caps request bodies at the configured maximum. Handlers see a
+// *http.MaxBytesError from their reads once the cap is hit.
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, serverLimits.MaxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyError maps a failure reading the request body to a response error.
+func bodyError(err error, msg string) error {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return tooLarge("Request body too large")
+	}
+	return badRequest(msg)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Failed generation attempts are appended to one JSON lines file per UTC
+// day under failuresPrefix.
+const (
+	failuresPrefix     = "failures/"
+	maxFailureParamLen = 256
+	maxFailureDays     = 90
+	recentFailures     = 100
+)
+
+type failureRecord struct {
+	Time    time.Time         `json:"time"`
+	Route   string            `json:"route"`
+	Tenant  string            `json:"tenant,omitempty"`
+	Client  string            `json:"client"`
+	Status  int               `json:"status"`
+	Class   string            `json:"class"`
+	Message string            `json:"message"`
+	Params  map[string]string `json:"params,omitempty"`
+}
+
+// failureLog records failed generations in st.
+type failureLog struct {
+	st storage
+}
+
+func failureKey(day time.Time) string {
+	return failuresPrefix + day.UTC().Format("2006-01-02") + ".jsonl"
+}
+
+func (l *failureLog) Record(rec failureRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return l.st.Append(failureKey(rec.Time), append(b, '\n'))
+}
+
+// Since returns the records of the last days days, oldest first.
+func (l *failureLog) Since(days int) ([]failureRecord, error) {
+	var recs []failureRecord
+	today := time.Now().UTC()
+	for d := days - 1; d >= 0; d-- {
+		b, err := l.st.Get(failureKey(today.AddDate(0, 0, -d)))
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			var rec failureRecord
+			// A torn line from a crash mid-append is skipped, not fatal
+			if json.Unmarshal(sc.Bytes(), &rec) == nil {
+				recs = append(recs, rec)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return recs, nil
+}
+
+// failGeneration writes err to w and records the attempt in the failure
+// log, so integrations sending bad payloads show up in /admin/errors.
+// Values longer than maxFailureParamLen are truncated.
+func failGeneration(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, err)
+
+	rec := failureRecord{
+		Time:    time.Now().UTC(),
+		Route:   routeName(r),
+		Status:  http.StatusInternalServerError,
+		Class:   errorClass(err),
+		Message: err.Error(),
+	}
+	var he *httpError
+	if errors.As(err, &he) {
+		rec.Status = he.status
+	}
+	if t := tenantFrom(r.Context()); t != nil {
+		rec.Tenant = t.ID
+	}
+	if addr, ok := clientAddr(r); ok {
+		rec.Client = addr.String()
+	}
+	if len(r.Form) > 0 {
+		rec.Params = make(map[string]string, len(r.Form))
+		for k, v := range r.Form {
+			val := v[0]
+			if len(val) > maxFailureParamLen {
+				val = val[:maxFailureParamLen] + "..."
+			}
+			rec.Params[k] = val
+		}
+	}
+
+	if err := failures.Record(rec); err != nil {
+		log.Printf("Failed to record generation failure: %v", err)
+	}
+}
+
+type failureCount struct {
+	Tenant string `json:"tenant,omitempty"`
+	Client string `json:"client"`
+	Class  string `json:"class"`
+	Count  int    `json:"count"`
+}
+
+type failureReport struct {
+	Days   int             `json:"days"`
+	Total  int             `json:"total"`
+	Counts []failureCount  `json:"counts"`
+	Recent []failureRecord `json:"recent"`
+}
+
+// errorsReport summarises recorded failures per tenant, client and class
+// over the last 'days' days (default 7), most frequent first, along with
+// the most recent records.
+func errorsReport(w http.ResponseWriter, r *http.Request) {
+	days := 7
+	if v := r.FormValue("days"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 1 || d > maxFailureDays {
+			http.Error(w, "Invalid 'days' parameter (must be 1-"+strconv.Itoa(maxFailureDays)+")", http.StatusBadRequest)
+			return
+		}
+		days = d
+	}
+
+	recs, err := failures.Since(days)
+	if err != nil {
+		writeError(w, internalError("Failed to read failure log", err))
+		return
+	}
+
+	type countKey struct{ tenant, client, class string }
+	counts := make(map[countKey]int)
+	for _, rec := range recs {
+		counts[countKey{rec.Tenant, rec.Client, rec.Class}]++
+	}
+	report := failureReport{Days: days, Total: len(recs), Counts: []failureCount{}}
+	for k, n := range counts {
+		report.Counts = append(report.Counts, failureCount{Tenant: k.tenant, Client: k.client, Class: k.class, Count: n})
+	}
+	sort.Slice(report.Counts, func(i, j int) bool {
+		a, b := report.Counts[i], report.Counts[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		if a.Client != b.Client {
+			return a.Client < b.Client
+		}
+		return a.Class < b.Class
+	})
+
+	if len(recs) > recentFailures {
+		recs = recs[len(recs)-recentFailures:]
+	}
+	report.Recent = make([]failureRecord, 0, len(recs))
+	for i := len(recs) - 1; i >= 0; i-- {
+		report.Recent = append(report.Recent, recs[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+)
+
+// serverFallbackFonts are the font assets tried, in order, for characters
+// the label font has no glyph for: the .ttf, .otf and .ttc files of the
+// asset directory QR_FONT_DIR, sorted by name, so a prefix like
+// "10-NotoSansJP.otf" sets the order. Labels that need one record those
+// they use in their spec.
+var serverFallbackFonts []string
+
+// listFallbackFonts returns the font assets in dir.
+func listFallbackFonts(dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	keys, err := assets.List(strings.Trim(dir, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, k := range keys {
+		switch strings.ToLower(path.Ext(k)) {
+		case ".ttf", ".otf", ".ttc":
+			names = append(names, k)
+		}
+	}
+	return names, nil
+}
+
+var (
+	fallbackFontsMu sync.Mutex
+	fallbackFonts   = make(map[string]*sfnt.Font)
+)
+
+// loadFallbackFont parses a fallback font asset, once. Unlike the label
+// font it may have CFF outlines, as most CJK fonts do.
+func loadFallbackFont(name string) (*sfnt.Font, error) {
+	fallbackFontsMu.Lock()
+	defer fallbackFontsMu.Unlock()
+	if f, ok := fallbackFonts[name]; ok {
+		return f, nil
+	}
+	b, err := assets.Get(name)
+	if err != nil {
+		return nil, internalError("Failed to load fallback font", err)
+	}
+	var f *sfnt.Font
+	if strings.EqualFold(path.Ext(name), ".ttc") {
+		var c *sfnt.Collection
+		if c, err = sfnt.ParseCollection(b); err == nil {
+			f, err = c.Font(0)
+		}
+	} else {
+		f, err = sfnt.Parse(b)
+	}
+	if err != nil {
+		return nil, internalError("Failed to parse fallback font", err)
+	}
+	fallbackFonts[name] = f
+	return f, nil
+}
+
+func sfntHas(f *sfnt.Font, r rune) bool {
+	var buf sfnt.Buffer
+	g, err := f.GlyphIndex(&buf, r)
+	return err == nil && g != 0
+}
+
+// needsGlyph reports whether r is drawn with a glyph of its own, as
+// opposed to spaces and joiners, or emoji, which the emoji font covers.
+func needsGlyph(r rune, emoji bool) bool {
+	if unicode.IsSpace(r) || unicode.IsControl(r) || r == variationSelector16 || r == zeroWidthJoiner {
+		return false
+	}
+	return !(emoji && isEmoji(r))
+}
+
+// labelFallbacks picks the fallback fonts spec's label needs: for each
+// character the label font lacks, the first fallback that has it.
+func labelFallbacks(spec renderSpec) ([]string, error) {
+	if len(serverFallbackFonts) == 0 {
+		return nil, nil
+	}
+	var missing []rune
+	for _, r := range spec.Label {
+		if r >= 0x80 && needsGlyph(r, spec.EmojiFont != "") {
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	primary, err := loadFont(spec.FontFile)
+	if err != nil {
+		return nil, err
+	}
+
+	used := make([]bool, len(serverFallbackFonts))
+	for _, r := range missing {
+		if primary.Index(r) != 0 {
+			continue
+		}
+		for i, name := range serverFallbackFonts {
+			f, err := loadFallbackFont(name)
+			if err != nil {
+				return nil, err
+			}
+			if sfntHas(f, r) {
+				used[i] = true
+				break
+			}
+		}
+	}
+	var names []string
+	for i, u := range used {
+		if u {
+			names = append(names, serverFallbackFonts[i])
+		}
+	}
+	return names, nil
+}
+
+// labelFonts is the label font with the fallbacks of a spec, for finding
+// which font draws a character.
+type labelFonts struct {
+	primary   *truetype.Font
+	fallbacks []*sfnt.Font
+	faces     []font.Face
+	size      float64
+}
+
+func newLabelFonts(f *truetype.Font, st labelStyle) *labelFonts {
+	return &labelFonts{primary: f, fallbacks: st.fallbacks, faces: make([]font.Face, len(st.fallbacks)), size: st.size}
+}
+
+// fallbackFor returns the face of the first fallback with a glyph for r,
+// or nil when the label font has one or no fallback does.
+func (lf *labelFonts) fallbackFor(r rune) font.Face {
+	if len(lf.fallbacks) == 0 || lf.primary.Index(r) != 0 {
+		return nil
+	}
+	for i, f := range lf.fallbacks {
+		if !sfntHas(f, r) {
+			continue
+		}
+		if lf.faces[i] == nil {
+			face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: lf.size, DPI: 72, Hinting: font.HintingNone})
+			if err != nil {
+				return nil
+			}
+			lf.faces[i] = face
+		}
+		return lf.faces[i]
+	}
+	return nil
+}
+
+// has reports whether any of the fonts can draw r.
+func (lf *labelFonts) has(r rune) bool {
+	return lf.primary.Index(r) != 0 || lf.fallbackFor(r) != nil
+}
+
+// fallbackFamilies names the fallback fonts for an SVG font-family list.
+func fallbackFamilies(names []string) []string {
+	var families []string
+	for _, name := range names {
+		f, err := loadFallbackFont(name)
+		if err != nil {
+			continue
+		}
+		if family, err := f.Name(nil, sfnt.NameIDFamily); err == nil && family != "" {
+			families = append(families, family)
+		}
+	}
+	return families
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Feature flags gate experimental rendering options. A flag is resolved
+// from the tenant's own setting, then QR_FEATURES, then the default here,
+// so a feature can be switched off globally and enabled per tenant while
+// it rolls out.
+var featureDefaults = map[string]bool{
+	"palette": true,
+	"pattern": true,
+}
+
+// globalFeatures holds the QR_FEATURES overrides, e.g. "palette=off".
+var globalFeatures map[string]bool
+
+func isFeature(name string) bool {
+	_, ok := featureDefaults[name]
+	return ok
+}
+
+func featureNames() []string {
+	names := make([]string, 0, len(featureDefaults))
+	for name := range featureDefaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadFeatures parses QR_FEATURES, a comma separated list of name=on or
+// name=off, exiting on unknown names so a typo is caught at startup.
+func loadFeatures() map[string]bool {
+	flags := make(map[string]bool)
+	for _, s := range envList("QR_FEATURES", nil) {
+		name, state, _ := strings.Cut(s, "=")
+		if !isFeature(name) || (state != "on" && state != "off") {
+			log.Fatalf("Invalid QR_FEATURES entry %q: expected one of %s with =on or =off", s, strings.Join(featureNames(), ", "))
+		}
+		flags[name] = state == "on"
+	}
+	return flags
+}
+
+// featureEnabled reports whether name is on for tenant t, which may be nil.
+func featureEnabled(t *tenant, name string) bool {
+	if t != nil {
+		if on, ok := t.Features[name]; ok {
+			return on
+		}
+	}
+	if on, ok := globalFeatures[name]; ok {
+		return on
+	}
+	return featureDefaults[name]
+}
+
+// checkFeatures refuses a spec that uses a feature not enabled for t.
+func checkFeatures(t *tenant, spec renderSpec) error {
+	var used []string
+	if len(spec.Palette) > 0 {
+		used = append(used, "palette")
+	}
+	if spec.Pattern != "" {
+		used = append(used, "pattern")
+	}
+	for _, name := range used {
+		if !featureEnabled(t, name) {
+			return &httpError{status: http.StatusForbidden, class: classFeatureDisabled, msg: fmt.Sprintf("Feature '%s' is not enabled", name)}
+		}
+	}
+	return nil
+}
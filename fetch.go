@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// fetchPolicy controls which remote URLs the server may fetch on a client's
+// behalf (logos, backgrounds). Everything outbound that takes a
+// client-supplied URL must go through fetchClient.
+//
+// Fetches follow the outbound proxy settings. A proxy resolves names
+// itself, so through a proxy only IP literals in the URL are checked here
+// and the proxy is trusted to refuse internal destinations.
+type fetchPolicy struct {
+	Schemes      []string
+	MaxRedirects int
+	// Timeout bounds a whole fetch, redirects and body included.
+	Timeout time.Duration
+
+	DialTimeout   time.Duration
+	TLSTimeout    time.Duration
+	HeaderTimeout time.Duration
+	IdleTimeout   time.Duration
+	TLSMinVersion uint16
+
+	// Pool sizes. MaxConnsPerHost makes fetches to a slow host queue for a
+	// connection, within Timeout, rather than each opening another.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+
+	// DNSServer is a host:port to resolve names with instead of the
+	// system resolver, each lookup bounded by DNSTimeout.
+	DNSServer  string
+	DNSTimeout time.Duration
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func loadFetchPolicy() fetchPolicy {
+	seconds := func(key string, def int) time.Duration {
+		return time.Duration(envInt(key, def)) * time.Second
+	}
+	p := fetchPolicy{
+		Schemes:      envList("QR_FETCH_SCHEMES", []string{"https"}),
+		MaxRedirects: envInt("QR_FETCH_MAX_REDIRECTS", 3),
+		Timeout:      seconds("QR_FETCH_TIMEOUT_SECONDS", 10),
+
+		DialTimeout:   seconds("QR_FETCH_DIAL_TIMEOUT_SECONDS", 5),
+		TLSTimeout:    seconds("QR_FETCH_TLS_TIMEOUT_SECONDS", 5),
+		HeaderTimeout: seconds("QR_FETCH_HEADER_TIMEOUT_SECONDS", 10),
+		IdleTimeout:   seconds("QR_FETCH_IDLE_TIMEOUT_SECONDS", 90),
+
+		MaxIdleConns:        envInt("QR_FETCH_MAX_IDLE_CONNS", 100),
+		MaxIdleConnsPerHost: envInt("QR_FETCH_MAX_IDLE_CONNS_PER_HOST", 4),
+		MaxConnsPerHost:     envInt("QR_FETCH_MAX_CONNS_PER_HOST", 16),
+
+		DNSServer:  os.Getenv("QR_FETCH_DNS_SERVER"),
+		DNSTimeout: seconds("QR_FETCH_DNS_TIMEOUT_SECONDS", 5),
+	}
+
+	v := os.Getenv("QR_FETCH_TLS_MIN_VERSION")
+	if v == "" {
+		v = "1.2"
+	}
+	version, ok := tlsVersions[v]
+	if !ok {
+		log.Fatalf("Invalid QR_FETCH_TLS_MIN_VERSION=%q: expected 1.2 or 1.3", v)
+	}
+	p.TLSMinVersion = version
+	if p.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(p.DNSServer); err != nil {
+			log.Fatalf("Invalid QR_FETCH_DNS_SERVER=%q: expected host:port", p.DNSServer)
+		}
+	}
+	return p
+}
+
+// resolver returns the resolver for fetches, nil for the system one.
+func (p fetchPolicy) resolver() *net.Resolver {
+	if p.DNSServer == "" {
+		return nil
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: p.DNSTimeout}
+			return d.DialContext(ctx, network, p.DNSServer)
+		},
+	}
+}
+
+var (
+	fetchPolicyConfig fetchPolicy
+	fetchClient       *http.Client
+)
+
+// Ranges that are never public even though netip does not flag them.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+var errBlockedAddress = errors.New("destination address is not allowed")
+
+// checkFetchAddr rejects loopback, private, link-local (which includes the
+// 169.254.169.254 cloud metadata endpoint), multicast and reserved addresses.
+func checkFetchAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() ||
+		addr.IsUnspecified() {
+		return errBlockedAddress
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return errBlockedAddress
+		}
+	}
+	return nil
+}
+
+// checkFetchURL applies the scheme allowlist and rejects URLs that smuggle
+// credentials.
+func (p fetchPolicy) checkFetchURL(u *url.URL) error {
+	allowed := false
+	for _, s := range p.Schemes {
+		if strings.EqualFold(u.Scheme, s) {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("scheme %q is not allowed", u.Scheme)
+	}
+	if u.User != nil {
+		return errors.New("URLs with credentials are not allowed")
+	}
+	if u.Hostname() == "" {
+		return errors.New("URL has no host")
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+		return checkFetchAddr(addr)
+	}
+	return nil
+}
+
+// newFetchClient builds the HTTP client used for client-supplied URLs. The
+// address check runs in the dialer, after DNS resolution, so a hostname that
+// resolves (or re-resolves) to an internal address is still refused. The
+// configured proxies are exempt, as they are usually internal themselves.
+func newFetchClient(p fetchPolicy) *http.Client {
+	proxies := proxyAddrs()
+	resolver := p.resolver()
+	proxyDialer := &net.Dialer{Timeout: p.DialTimeout, Resolver: resolver}
+	dialer := &net.Dialer{
+		Timeout:  p.DialTimeout,
+		Resolver: resolver,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return checkFetchAddr(ap.Addr())
+		},
+	}
+
+	return &http.Client{
+		Timeout: p.Timeout,
+		Transport: &http.Transport{
+			Proxy: outboundProxy,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if proxies[addr] {
+					return proxyDialer.DialContext(ctx, network, addr)
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSHandshakeTimeout:   p.TLSTimeout,
+			TLSClientConfig:       &tls.Config{MinVersion: p.TLSMinVersion},
+			ResponseHeaderTimeout: p.HeaderTimeout,
+			IdleConnTimeout:       p.IdleTimeout,
+			MaxIdleConns:          p.MaxIdleConns,
+			MaxIdleConnsPerHost:   p.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       p.MaxConnsPerHost,
+			ForceAttemptHTTP2:     true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > p.MaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", p.MaxRedirects)
+			}
+			return p.checkFetchURL(req.URL)
+		},
+	}
+}
+
+// fetchRemote issues a guarded GET for a client-supplied URL.
+func fetchRemote(ctx context.Context, rawURL string) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	if err := fetchPolicyConfig.checkFetchURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return fetchClient.Do(req)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// moduleGrid maps image pixels to QR modules, including the quiet zone.
+//
+// Renderer 1 uses go-qrcode's nearest-module mapping, which gives modules
+// of uneven width whenever the size is not a multiple of the module count.
+// Later renderers draw every module exactly pixels wide and centre the
+// symbol, leaving the remainder as extra quiet zone.
+type moduleGrid struct {
+	modules int
+	size    int
+	pixels  int
+	offset  int
+	border  int
+	legacy  bool
+}
+
+// quietZoneModules is the quiet zone go-qrcode puts around the symbol, and
+// the default. 'border' can set another width, up to maxQuietZone.
+const (
+	quietZoneModules = 4
+	maxQuietZone     = 16
+)
+
+func newModuleGrid(spec renderSpec, modules int) moduleGrid {
+	size := spec.Size
+	if size < modules {
+		size = modules
+	}
+	if spec.Renderer < 2 {
+		return moduleGrid{modules: modules, size: size, border: quietZoneModules, legacy: true}
+	}
+	pixels := size / modules
+	return moduleGrid{
+		modules: modules,
+		size:    size,
+		pixels:  pixels,
+		offset:  (size - pixels*modules) / 2,
+		border:  spec.quietZone(),
+	}
+}
+
+// moduleBitmap returns the modules of qr surrounded by spec's quiet zone.
+func moduleBitmap(qr *qrcode.QRCode, spec renderSpec) [][]bool {
+	bitmap := qr.Bitmap()
+	border := spec.quietZone()
+	if border == quietZoneModules {
+		return bitmap
+	}
+	symbol := len(bitmap) - 2*quietZoneModules
+	out := make([][]bool, symbol+2*border)
+	for y := range out {
+		out[y] = make([]bool, len(out))
+		if sy := y - border; sy >= 0 && sy < symbol {
+			copy(out[y][border:], bitmap[sy+quietZoneModules][quietZoneModules:quietZoneModules+symbol])
+		}
+	}
+	return out
+}
+
+// module returns the module under pixel coordinate p, or false in the
+// margin outside the grid.
+func (g moduleGrid) module(p int) (int, bool) {
+	if g.legacy {
+		return int(float64(p) * float64(g.modules) / float64(g.size)), true
+	}
+	if p < g.offset {
+		return 0, false
+	}
+	m := (p - g.offset) / g.pixels
+	return m, m < g.modules
+}
+
+// quietZone is the height in pixels of the light border above the symbol.
+func (g moduleGrid) quietZone() int {
+	if g.legacy {
+		return g.size * g.border / g.modules
+	}
+	return g.offset + g.border*g.pixels
+}
+
+// modulePixels is the exact width of one module, or 0 for the legacy
+// mapping where widths vary.
+func (g moduleGrid) modulePixels() int {
+	return g.pixels
+}
+
+// qrImage draws the modules of bitmap on the grid in the foreground and
+// background colours of qr.
+func qrImage(qr *qrcode.QRCode, bitmap [][]bool, g moduleGrid) image.Image {
+	if g.legacy {
+		return qr.Image(g.size)
+	}
+
+	img := image.NewPaletted(image.Rect(0, 0, g.size, g.size), color.Palette{qr.BackgroundColor, qr.ForegroundColor})
+	for y := 0; y < g.size; y++ {
+		my, ok := g.module(y)
+		if !ok {
+			continue
+		}
+		for x := 0; x < g.size; x++ {
+			if mx, ok := g.module(x); ok && bitmap[my][mx] {
+				img.Pix[img.PixOffset(x, y)] = 1
+			}
+		}
+	}
+	return img
+}
+
+// snapSize returns the multiple of spec's module count, quiet zone
+// included, nearest its size and within the size limits. At that size
+// modules fill the code exactly, with no leftover pixels added to the
+// quiet zone.
+func snapSize(spec renderSpec) (int, error) {
+	level, ok := recoveryLevels[spec.RecoveryLevel]
+	if !ok {
+		return 0, badRequest("Unknown recovery level " + spec.RecoveryLevel)
+	}
+	qr, err := qrcode.New(spec.Data, level)
+	if err != nil {
+		return 0, classified(badRequest("Data is too long to encode at recovery level "+spec.RecoveryLevel), classCapacity)
+	}
+	modules := len(moduleBitmap(qr, spec))
+	pixels := max((spec.Size+modules/2)/modules, 1)
+	for pixels*modules > serverLimits.MaxSize && pixels > 1 {
+		pixels--
+	}
+	for pixels*modules < minSize {
+		pixels++
+	}
+	if pixels*modules > serverLimits.MaxSize {
+		return 0, tooLarge(fmt.Sprintf("No multiple of the %d modules fits within %d to %d pixels", modules, minSize, serverLimits.MaxSize))
+	}
+	return pixels * modules, nil
+}
+
+// snapFromValues applies snap=true, which moves the size to the nearest
+// one with whole-pixel modules.
+func snapFromValues(spec *renderSpec, params url.Values) error {
+	switch v := params.Get("snap"); v {
+	case "", "false":
+		return nil
+	case "true":
+	default:
+		return badRequest("Invalid 'snap' parameter (must be true or false)")
+	}
+	if spec.Renderer < 2 {
+		return badRequest("Invalid 'snap' parameter (codes drawn by renderer 1 have uneven modules at any size)")
+	}
+	size, err := snapSize(*spec)
+	if err != nil {
+		return err
+	}
+	if size != spec.Size {
+		from := spec.Size
+		*spec = spec.scaled(size)
+		spec.snappedFrom = from
+	}
+	return nil
+}
+
+// writeModulePixels reports the exact pixels per module of spec's render
+// in X-QR-Module-Pixels, and in X-QR-Snapped-From the size asked for when
+// snap=true changed it. Legacy renders have no exact value and get no
+// header.
+func writeModulePixels(w http.ResponseWriter, spec renderSpec) {
+	if spec.snappedFrom != 0 {
+		w.Header().Set("X-QR-Snapped-From", strconv.Itoa(spec.snappedFrom))
+	}
+	level, ok := recoveryLevels[spec.RecoveryLevel]
+	if !ok {
+		return
+	}
+	qr, err := qrcode.New(spec.Data, level)
+	if err != nil {
+		return
+	}
+	if px := newModuleGrid(spec, len(moduleBitmap(qr, spec))).modulePixels(); px > 0 {
+		w.Header().Set("X-QR-Module-Pixels", strconv.Itoa(px))
+	}
+}
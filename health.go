@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Both probes answer with a JSON report of their checks and 503 when one
+// fails. /healthz only covers what the process reads locally to render, so
+// an outage of the stores does not get pods restarted; /readyz adds the
+// data store and the link store, which every request but a plain render
+// needs.
+
+type healthCheck struct {
+	name string
+	fn   func() error
+}
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// healthProbeKey is written and removed again to check the data store is
+// writable.
+const healthProbeKey = "health/probe"
+
+func livenessChecks() []healthCheck {
+	return []healthCheck{
+		{"logo", checkServerLogo},
+		{"fonts", checkServerFonts},
+		{"temp_dir", checkTempDir},
+	}
+}
+
+func readinessChecks() []healthCheck {
+	return append(livenessChecks(),
+		healthCheck{"storage", checkDataStore},
+		healthCheck{"links", checkLinkStore},
+	)
+}
+
+// checkServerLogo decodes the server logo. Without one, after
+// QR_MISSING_ASSETS=degrade dropped it at startup, there is nothing to check.
+func checkServerLogo() error {
+	if serverLogo == "" {
+		return nil
+	}
+	return checkLogoAsset(serverLogo)
+}
+
+// checkServerFonts reads each font file the server renders labels with.
+// They are parsed once and cached, so the files are read here to find out
+// whether they are still there.
+func checkServerFonts() error {
+	names := append([]string{serverFont, serverEmojiFont}, serverFallbackFonts...)
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if _, err := assets.Get(name); err != nil {
+			return fmt.Errorf("font %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// checkTempDir creates and removes a file where job artifacts spill.
+func checkTempDir() error {
+	f, err := os.CreateTemp(spillDir, "qr-health-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkDataStore writes, reads back and deletes a probe key.
+func checkDataStore() error {
+	st := specs.st
+	want := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	if err := st.Put(healthProbeKey, want); err != nil {
+		return err
+	}
+	got, err := st.Get(healthProbeKey)
+	if err != nil {
+		return err
+	}
+	if string(got) != string(want) {
+		return errors.New("probe read back differs from what was written")
+	}
+	return st.Delete(healthProbeKey)
+}
+
+// checkLinkStore looks up a slug no link can have.
+func checkLinkStore() error {
+	_, err := links.Get("_health")
+	if errors.Is(err, errLinkNotFound) {
+		return nil
+	}
+	return err
+}
+
+func runHealthChecks(checks []healthCheck) healthReport {
+	report := healthReport{Status: "ok", Checks: make(map[string]checkResult, len(checks))}
+	for _, c := range checks {
+		start := time.Now()
+		err := c.fn()
+		res := checkResult{Status: "ok", LatencyMS: milliseconds(time.Since(start))}
+		if err != nil {
+			res.Status = "fail"
+			res.Error = err.Error()
+			report.Status = "fail"
+		}
+		report.Checks[c.name] = res
+	}
+	return report
+}
+
+func writeHealthReport(w http.ResponseWriter, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// healthz is the liveness probe.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, runHealthChecks(livenessChecks()))
+}
+
+// readyz is the readiness probe.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, runHealthChecks(readinessChecks()))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Rendered codes are named by the id of their spec, a hash of everything
+// that goes into the image, so the id and the format make a strong ETag:
+// a request that resolves to the same spec gets the same bytes. A
+// conditional GET that matches is answered with 304 before anything is
+// rendered.
+
+// qrCacheControl is the Cache-Control of codes rendered from parameters,
+// from QR_CACHE_CONTROL. The default lets caches keep a code but has them
+// revalidate it, which is cheap with the ETag; a CDN in front of the API
+// can be allowed more with e.g. "public, max-age=86400".
+var qrCacheControl string
+
+func loadCacheControl() string {
+	if v := os.Getenv("QR_CACHE_CONTROL"); v != "" {
+		return v
+	}
+	return "no-cache"
+}
+
+// codeETag is the entity tag of the code with spec id id served in f.
+func codeETag(id string, f rasterFormat) string {
+	tag := id + "." + f.name
+	if f.quality != 0 {
+		tag += "-q" + strconv.Itoa(f.quality)
+	}
+	return `"` + tag + `"`
+}
+
+// checkNotModified sets the caching headers of a code and reports whether
+// r already has it, in which case a 304 has been written. Tenants' codes
+// differ by API key, so caches must key on it too.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag, cacheControl string) bool {
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", cacheControl)
+	h.Add("Vary", "X-API-Key")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches applies the weak comparison If-None-Match calls for.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// uncacheable undoes the caching headers for a render with warnings,
+// which is redone once the problem behind them is fixed.
+func uncacheable(w http.ResponseWriter) {
+	w.Header().Del("ETag")
+	w.Header().Set("Cache-Control", "no-store")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+)
+
+// registerInternalRoutes mounts the operational endpoints. pprof is only
+// mounted when withPprof is set, i.e. on the dedicated internal listener.
+func registerInternalRoutes(r *mux.Router, withPprof bool) {
+	r.HandleFunc("/healthz", healthz).Methods("GET")
+	r.HandleFunc("/readyz", readyz).Methods("GET")
+	r.HandleFunc("/metrics", metrics.serveHTTP).Methods("GET")
+	r.HandleFunc("/slo", slo.serveSLO).Methods("GET")
+	r.HandleFunc("/selftest", selftest).Methods("GET")
+
+	if withPprof {
+		r.HandleFunc("/debug/pprof/", pprof.Index)
+		r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		r.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	}
+}
+
+// serveInternal starts the internal listener for metrics, SLO, health
+// probes, selftest and pprof when QR_INTERNAL_ADDR is set. Otherwise
+// everything but pprof stays on the public router, and pprof is not served
+// at all.
+func serveInternal(public *mux.Router, addr string) {
+	if addr == "" {
+		registerInternalRoutes(public, false)
+		return
+	}
+
+	r := mux.NewRouter()
+	registerInternalRoutes(r, true)
+	go func() {
+		log.Printf("Internal endpoints listening on %s", addr)
+		listen(addr, r)
+	}()
+}
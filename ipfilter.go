@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ipFilter admits or rejects requests by client address. Deny entries win;
+// when the allow list is non-empty the client must also match it.
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// Proxies whose X-Forwarded-For header is believed. Empty means the TCP
+// peer address is always the client.
+var trustedProxies []netip.Prefix
+
+// loadIPFilter reads <prefix>_ALLOW_CIDRS and <prefix>_DENY_CIDRS.
+func loadIPFilter(prefix string) ipFilter {
+	return ipFilter{
+		allow: envCIDRs(prefix + "_ALLOW_CIDRS"),
+		deny:  envCIDRs(prefix + "_DENY_CIDRS"),
+	}
+}
+
+// envCIDRs parses a comma separated list of CIDRs or bare addresses,
+// exiting on malformed entries.
+func envCIDRs(key string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, s := range envList(key, nil) {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				log.Fatalf("Invalid %s entry %q: %v", key, s, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			log.Fatalf("Invalid %s entry %q: %v", key, s, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes
+}
+
+func matchAny(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f ipFilter) allows(addr netip.Addr) bool {
+	if matchAny(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || matchAny(f.allow, addr)
+}
+
+func (f ipFilter) middleware(next http.Handler) http.Handler {
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, ok := clientAddr(r)
+		if !ok || !f.allows(addr) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// peerAddr returns the address of the TCP peer that sent r, which may be a
+// proxy.
+func peerAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// clientAddr returns the address of the client that made r. Behind trusted
+// proxies it walks X-Forwarded-For from the right and returns the first hop
+// that is not itself a trusted proxy.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	addr, ok := peerAddr(r)
+	if !ok {
+		return netip.Addr{}, false
+	}
+
+	if !matchAny(trustedProxies, addr) {
+		return addr, true
+	}
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		return addr, true
+	}
+	hops := strings.Split(strings.Join(forwarded, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		hop = hop.Unmap()
+		if !matchAny(trustedProxies, hop) {
+			return hop, true
+		}
+		addr = hop
+	}
+	return addr, true
+}
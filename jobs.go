@@ -0,0 +1,433 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Job states.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// maxJobFailures caps the failures kept in a job's status document; Failed
+// still counts them all.
+const maxJobFailures = 100
+
+// job tracks a long-running background render. Its exported fields are the
+// JSON status document served from GET /jobs/{id}. Completed counts items
+// processed, successfully or not; ETASeconds extrapolates from the rate so
+// far.
+type job struct {
+	mu sync.Mutex
+
+	ID          string       `json:"id"`
+	Kind        string       `json:"kind"`
+	Priority    string       `json:"priority"`
+	Concurrency int          `json:"concurrency"`
+	Status      string       `json:"status"`
+	Total       int          `json:"total"`
+	Completed   int          `json:"completed"`
+	Failed      int          `json:"failed"`
+	Failures    []jobFailure `json:"failures,omitempty"`
+	ETASeconds  *float64     `json:"eta_seconds,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"`
+	StartedAt   *time.Time   `json:"started_at,omitempty"`
+	FinishedAt  *time.Time   `json:"finished_at,omitempty"`
+
+	artifact *jobArtifact
+	batch    *batchState
+
+	// changed is closed and replaced on every update, waking event streams
+	changed chan struct{}
+}
+
+// jobFailure is an item the job could not produce. Batch items are named
+// by their 1-based input row, stored codes by id. Code is the failure class.
+type jobFailure struct {
+	Row   int    `json:"row,omitempty"`
+	ID    string `json:"id,omitempty"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+func newJobFailure(row int, id string, err error) *jobFailure {
+	return &jobFailure{Row: row, ID: id, Code: errorClass(err), Error: publicMessage(err)}
+}
+
+// jobStore holds jobs in memory; they do not survive a restart. Finished
+// jobs are dropped ttl after they finish, with their artifacts.
+type jobStore struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	jobs map[string]*job
+}
+
+func newJobStore(ttl time.Duration) *jobStore {
+	return &jobStore{ttl: ttl, jobs: make(map[string]*job)}
+}
+
+func (s *jobStore) create(kind string) *job {
+	b := make([]byte, 8)
+	rand.Read(b)
+	j := &job{
+		ID:        hex.EncodeToString(b),
+		Kind:      kind,
+		Status:    jobQueued,
+		CreatedAt: time.Now().UTC(),
+		changed:   make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	s.prune(time.Now())
+	s.jobs[j.ID] = j
+	s.mu.Unlock()
+	return j
+}
+
+// prune drops jobs that finished more than ttl ago. A batch and its retries
+// share their state and artifact, so they go together once the last of
+// them has expired, and not while a retry is reading the artifact. The
+// caller holds s.mu.
+func (s *jobStore) prune(now time.Time) {
+	expired := func(j *job) bool {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		return j.FinishedAt != nil && now.Sub(*j.FinishedAt) > s.ttl
+	}
+	for id, j := range s.jobs {
+		related := []*job{j}
+		if st := j.batch; st != nil {
+			st.mu.Lock()
+			related = st.jobs
+			retrying := st.retrying
+			st.mu.Unlock()
+			if retrying {
+				continue
+			}
+		}
+		done := true
+		for _, rj := range related {
+			done = done && expired(rj)
+		}
+		if !done {
+			continue
+		}
+		j.mu.Lock()
+		artifact := j.artifact
+		j.mu.Unlock()
+		delete(s.jobs, id)
+		if artifact != nil && !s.references(artifact) {
+			artifact.remove()
+		}
+	}
+}
+
+// references reports whether a job still held uses a. The caller holds
+// s.mu.
+func (s *jobStore) references(a *jobArtifact) bool {
+	for _, j := range s.jobs {
+		j.mu.Lock()
+		same := j.artifact == a
+		j.mu.Unlock()
+		if same {
+			return true
+		}
+	}
+	return false
+}
+
+// schedule records how the job's renders are scheduled. It is called
+// before the job starts.
+func (j *job) schedule(opts jobOptions) {
+	j.Priority = priorityNames[opts.priority]
+	j.Concurrency = opts.concurrency
+}
+
+func (s *jobStore) get(id string) (*job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	return j, ok
+}
+
+// notify wakes everyone waiting on the job. The caller holds j.mu.
+func (j *job) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+func (j *job) start(total int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now().UTC()
+	j.Status = jobRunning
+	j.Total = total
+	j.StartedAt = &now
+	j.notify()
+}
+
+// progress records one processed item, with its failure if it failed.
+func (j *job) progress(failure *jobFailure) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Completed++
+	if failure != nil {
+		j.Failed++
+		if len(j.Failures) < maxJobFailures {
+			j.Failures = append(j.Failures, *failure)
+		}
+	}
+	if j.StartedAt != nil && j.Completed < j.Total {
+		perItem := time.Since(*j.StartedAt).Seconds() / float64(j.Completed)
+		eta := perItem * float64(j.Total-j.Completed)
+		j.ETASeconds = &eta
+	}
+	j.notify()
+}
+
+func (j *job) finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now().UTC()
+	j.FinishedAt = &now
+	j.ETASeconds = nil
+	defer j.notify()
+	if err != nil {
+		// The job is served without authentication, so it only carries
+		// the public message; the cause, which may name paths, is logged.
+		log.Printf("Job %s failed: %v", j.ID, err)
+		j.Status = jobFailed
+		j.Error = publicMessage(err)
+		return
+	}
+	j.Status = jobDone
+}
+
+func (j *job) finished() bool {
+	return j.Status == jobDone || j.Status == jobFailed
+}
+
+// rerenderTemplateJob resolves every stored code that references tmpl
+// again under it (see styleTemplate.restyle) and collects the new images in
+// a ZIP artifact. A restyled code is a new spec, so it is stored under its
+// own id; the old id keeps serving the old design, and ids.csv in the ZIP
+// maps each old id to its new one. Codes that fail to resolve or render are
+// listed in the job's failures; storage errors fail the whole job.
+// Artifacts over the job memory budget spill to a temporary file. It renders
+// one code at a time at low priority, behind customer batches.
+func rerenderTemplateJob(j *job, tmpl styleTemplate) {
+	ids, err := specs.List()
+	if err != nil {
+		j.finish(internalError("Failed to list QR code specs", err))
+		return
+	}
+
+	type item struct {
+		id   string
+		spec renderSpec
+	}
+	var items []item
+	for _, id := range ids {
+		spec, err := specs.Load(id)
+		if err != nil {
+			j.finish(internalError("Failed to load QR code spec "+id, err))
+			return
+		}
+		if spec.Template == tmpl.Name {
+			items = append(items, item{id: id, spec: spec})
+		}
+	}
+
+	j.start(len(items))
+
+	buf := newSpillBuffer(serverLimits.JobMemoryBytes, spillDir)
+	zw := zip.NewWriter(buf)
+	fail := func(err error) {
+		buf.discard()
+		j.finish(err)
+	}
+	var mapping bytes.Buffer
+	mapping.WriteString("id,new_id\n")
+	written := make(map[string]bool)
+	for _, it := range items {
+		spec, err := tmpl.restyle(it.spec)
+		var id string
+		if err == nil {
+			if id, err = specID(spec); err != nil {
+				err = internalError("Failed to hash QR code spec", err)
+			}
+		}
+		if err != nil {
+			j.progress(newJobFailure(0, it.id, err))
+			continue
+		}
+		fmt.Fprintf(&mapping, "%s,%s\n", it.id, id)
+		if written[id] {
+			// Another old code restyled to the same spec
+			j.progress(nil)
+			continue
+		}
+
+		jobSlots.acquire(priorityLow)
+		img, warnings, err := render(spec, nil)
+		jobSlots.release()
+		if err != nil {
+			j.progress(newJobFailure(0, it.id, err))
+			continue
+		}
+
+		b, err := encodePNG(img)
+		if err == nil {
+			err = writeZipFile(zw, id+".png", b)
+		}
+		if err == nil {
+			err = specs.Put(id, spec)
+		}
+		if err == nil && len(warnings) == 0 {
+			err = renders.Put(id, b)
+		}
+		if err != nil {
+			fail(internalError("Failed to store restyled code "+it.id, err))
+			return
+		}
+		written[id] = true
+		j.progress(nil)
+	}
+
+	err = writeZipFile(zw, "ids.csv", mapping.Bytes())
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		fail(internalError("Failed to write ZIP", err))
+		return
+	}
+	artifact, err := buf.finish()
+	if err != nil {
+		j.finish(internalError("Failed to write ZIP", err))
+		return
+	}
+
+	j.mu.Lock()
+	j.artifact = artifact
+	j.mu.Unlock()
+	j.finish(nil)
+}
+
+func writeZipFile(zw *zip.Writer, name string, b []byte) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	return err
+}
+
+func writeJob(w http.ResponseWriter, status int, j *job) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(j)
+}
+
+func getJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobs.get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	writeJob(w, http.StatusOK, j)
+}
+
+func getJobArtifact(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobs.get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	serveJobArtifact(w, r, j)
+}
+
+// serveJobArtifact responds with the job's ZIP.
+func serveJobArtifact(w http.ResponseWriter, r *http.Request, j *job) {
+	j.mu.Lock()
+	artifact := j.artifact
+	j.mu.Unlock()
+	if artifact == nil {
+		http.Error(w, "Job has no artifact yet", http.StatusConflict)
+		return
+	}
+
+	f, err := artifact.open()
+	if err != nil {
+		writeError(w, internalError("Failed to open job artifact", err))
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename="+j.ID+".zip")
+	http.ServeContent(w, r, j.ID+".zip", time.Time{}, f)
+}
+
+// getJobEvents streams the job's status document as server-sent events:
+// a "progress" event per update, then a final "done" or "failed" event.
+func getJobEvents(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobs.get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// The stream lasts as long as the job, past the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for {
+		j.mu.Lock()
+		b, err := json.Marshal(j)
+		done := j.finished()
+		event := "progress"
+		if done {
+			event = j.Status
+		}
+		changed := j.changed
+		j.mu.Unlock()
+		if err != nil {
+			return
+		}
+
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+		flusher.Flush()
+		if done {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+// labelKey identifies a rasterised label strip. The font is keyed by its
+// asset name.
+type labelKey struct {
+	renderer      int
+	text          string
+	font          string
+	emojiFont     string
+	fallbacks     string
+	fontSize      float64
+	spacing       float64
+	noKerning     bool
+	outline       string
+	outlineW      int
+	shadow        string
+	shadowOff     int
+	shadowBlur    float64
+	width, height int
+	autoHeight    bool
+	padding       int
+	background    string
+	color         string
+}
+
+type labelEntry struct {
+	key labelKey
+	img *image.RGBA
+}
+
+// labelCache keeps the most recently used label strips, up to limit entries.
+// Cached images are shared and must not be modified.
+type labelCache struct {
+	mu      sync.Mutex
+	limit   int
+	order   *list.List
+	entries map[labelKey]*list.Element
+}
+
+var labels = newLabelCache(64)
+
+func newLabelCache(limit int) *labelCache {
+	return &labelCache{limit: limit, order: list.New(), entries: make(map[labelKey]*list.Element)}
+}
+
+func (c *labelCache) get(k labelKey) (*image.RGBA, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[k]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*labelEntry).img, true
+}
+
+func (c *labelCache) add(k labelKey, img *image.RGBA) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[k]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[k] = c.order.PushFront(&labelEntry{key: k, img: img})
+	for c.order.Len() > c.limit {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*labelEntry).key)
+	}
+}
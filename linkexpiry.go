@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GET /links/expiring lists the caller's links that expire within the
+// next 'days' days (30 by default), soonest first, so campaign owners can
+// renew destinations before printed codes go dead. Links that expired in
+// the last 'days' days are listed too, so they do not drop out of the
+// feed the moment it matters. /links/expiring.ics is the same list as an
+// iCalendar feed with an event at each expiry, for calendar apps.
+
+const (
+	defaultExpiringDays = 30
+	maxExpiringDays     = 366
+
+	// expiringLinksSlug is reserved, as /links/expiring is not a link.
+	expiringLinksSlug = "expiring"
+)
+
+// expiringLinks returns the links of t that expire between days before and
+// days after now, soonest first.
+func expiringLinks(t *tenant, now time.Time, days int) ([]shortLink, error) {
+	list, err := links.List(t.ID)
+	if err != nil {
+		return nil, err
+	}
+	from, until := now.AddDate(0, 0, -days), now.AddDate(0, 0, days)
+	out := []shortLink{}
+	for _, l := range list {
+		if l.ExpiresAt != nil && l.ExpiresAt.After(from) && !l.ExpiresAt.After(until) {
+			out = append(out, l)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].ExpiresAt.Before(*out[j].ExpiresAt) })
+	return out, nil
+}
+
+// expiringDays reads the 'days' window of an expiring links request.
+func expiringDays(r *http.Request) (int, error) {
+	v := r.FormValue("days")
+	if v == "" {
+		return defaultExpiringDays, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maxExpiringDays {
+		return 0, badRequest("Invalid 'days' parameter (must be 1 to " + strconv.Itoa(maxExpiringDays) + ")")
+	}
+	return n, nil
+}
+
+// loadExpiringLinks reads the request's window and the caller's links in
+// it. They are a tenant's, so the feed needs an API key like the list of
+// links does.
+func loadExpiringLinks(w http.ResponseWriter, r *http.Request) ([]shortLink, bool) {
+	t := tenantFrom(r.Context())
+	if t == nil {
+		http.Error(w, "Listing links needs an API key", http.StatusUnauthorized)
+		return nil, false
+	}
+	days, err := expiringDays(r)
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	list, err := expiringLinks(t, time.Now(), days)
+	if err != nil {
+		writeError(w, internalError("Failed to list short links", err))
+		return nil, false
+	}
+	return list, true
+}
+
+func listExpiringLinks(w http.ResponseWriter, r *http.Request) {
+	list, ok := loadExpiringLinks(w, r)
+	if !ok {
+		return
+	}
+	base := publicBaseURL(r)
+	out := make([]linkResponse, len(list))
+	for i, l := range list {
+		out[i] = newLinkResponse(base, l)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+const icalTimeFormat = "20060102T150405Z"
+
+// expiringLinksCalendar writes list as an iCalendar (RFC 5545) feed with
+// an event at each link's expiry and a reminder a week ahead. Text values
+// are escaped and lines folded as in vCards, which share the rules.
+func expiringLinksCalendar(list []shortLink, base string, now time.Time) string {
+	host := base
+	if u, err := url.Parse(base); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+
+	var b strings.Builder
+	add := func(format string, args ...any) {
+		b.WriteString(vcardFold(fmt.Sprintf(format, args...)))
+	}
+	add("BEGIN:VCALENDAR")
+	add("VERSION:2.0")
+	add("PRODID:-//SmartQR//Expiring links//EN")
+	add("CALSCALE:GREGORIAN")
+	add("X-WR-CALNAME:Expiring short links")
+	for _, l := range list {
+		short := shortURL(base, l.Slug)
+		add("BEGIN:VEVENT")
+		add("UID:%s@%s", l.Slug, host)
+		add("DTSTAMP:%s", now.UTC().Format(icalTimeFormat))
+		add("DTSTART:%s", l.ExpiresAt.UTC().Format(icalTimeFormat))
+		add("SUMMARY:%s", vcardText("Short link "+l.Slug+" expires"))
+		add("DESCRIPTION:%s", vcardText(short+" redirects to "+l.URL+". Codes printed with it stop working when it expires."))
+		add("URL:%s", short)
+		add("BEGIN:VALARM")
+		add("ACTION:DISPLAY")
+		add("DESCRIPTION:%s", vcardText("Short link "+l.Slug+" expires in a week"))
+		add("TRIGGER:-P7D")
+		add("END:VALARM")
+		add("END:VEVENT")
+	}
+	add("END:VCALENDAR")
+	return b.String()
+}
+
+func expiringLinksFeed(w http.ResponseWriter, r *http.Request) {
+	list, ok := loadExpiringLinks(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", "inline; filename=expiring-links.ics")
+	w.Write([]byte(expiringLinksCalendar(list, publicBaseURL(r), time.Now())))
+}
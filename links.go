@@ -0,0 +1,719 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// shortLink is a redirect from /s/{slug} to URL. A code made from the link
+// encodes the short URL, so the destination can change after printing.
+// Links belong to the tenant that created them, "" for requests without an
+// API key. A link created without a key is managed with the owner token
+// returned when it was created, of which only OwnerTokenHash is kept.
+// StatsToken is set while the link's stats are shared, and
+// TrackConversions while its scans are given tokens for conversions. A
+// link with ExpiresAt stops redirecting at that time.
+type shortLink struct {
+	Slug             string     `json:"slug"`
+	URL              string     `json:"url"`
+	Tenant           string     `json:"tenant,omitempty"`
+	OwnerTokenHash   string     `json:"owner_token_sha256,omitempty"`
+	StatsToken       string     `json:"stats_token,omitempty"`
+	TrackConversions bool       `json:"track_conversions,omitempty"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// expired reports whether the link had expired by now.
+func (l shortLink) expired(now time.Time) bool {
+	return l.ExpiresAt != nil && !now.Before(*l.ExpiresAt)
+}
+
+// ownedBy reports whether a caller authenticated as t, or presenting the
+// owner token when t is nil, may read and change the link. Links created
+// without a key before owner tokens existed have no owner among anonymous
+// callers.
+func (l shortLink) ownedBy(t *tenant, token string) bool {
+	if t != nil {
+		return l.Tenant == t.ID
+	}
+	if l.Tenant != "" || l.OwnerTokenHash == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashOwnerToken(token)), []byte(l.OwnerTokenHash)) == 1
+}
+
+// usableBy reports whether codes for the link can be made by a caller
+// authenticated as t. Such a code only encodes the public short URL, so
+// any caller without a key may use a link created without one.
+func (l shortLink) usableBy(t *tenant) bool {
+	if t == nil {
+		return l.Tenant == ""
+	}
+	return l.Tenant == t.ID
+}
+
+func hashOwnerToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// linkToken is the owner token a request presents in X-Link-Token.
+func linkToken(r *http.Request) string {
+	return r.Header.Get("X-Link-Token")
+}
+
+// linkStore keeps short links by slug.
+type linkStore interface {
+	Get(slug string) (shortLink, error)
+	// Create adds a link, failing with errLinkExists if its slug is taken.
+	Create(l shortLink) error
+	// Update applies fn to the stored link and saves the result.
+	Update(slug string, fn func(*shortLink) error) (shortLink, error)
+	Delete(slug string) error
+	// List returns the links of one tenant, sorted by slug.
+	List(tenantID string) ([]shortLink, error)
+	// All returns the links of every tenant, sorted by slug.
+	All() ([]shortLink, error)
+
+	// RecordHit appends a redirect to the link's hits. A hit with a token
+	// is also kept as a scan that conversions can be recorded against.
+	RecordHit(slug string, h linkHit) error
+	// EachHit calls fn, oldest first, for the link's hits since the given
+	// time, and returns how many hits the link has had in all.
+	EachHit(slug string, since time.Time, fn func(linkHit)) (int, error)
+	// RecordConversion adds c to the scan with the given token, failing
+	// with errScanNotFound if there is none.
+	RecordConversion(slug, token string, c conversion) error
+	// EachScan calls fn, oldest first, for the link's scans since the given
+	// time.
+	EachScan(slug string, since time.Time, fn func(linkScan)) error
+}
+
+var (
+	links linkStore
+
+	errLinkNotFound = errors.New("short link not found")
+	errLinkExists   = errors.New("short link already exists")
+)
+
+var slugPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// newLinkStore opens the store named by QR_LINK_STORE. The only one so far
+// is "bolt", the default, a BoltDB file at QR_LINK_DB.
+func newLinkStore() (linkStore, error) {
+	switch kind := os.Getenv("QR_LINK_STORE"); kind {
+	case "", "bolt":
+		return openBoltLinks(linkDBPath())
+	default:
+		return nil, fmt.Errorf("unknown QR_LINK_STORE %q", kind)
+	}
+}
+
+// linkDBPath is where the bolt link store keeps its database.
+func linkDBPath() string {
+	if path := os.Getenv("QR_LINK_DB"); path != "" {
+		return path
+	}
+	return filepath.Join(serverConfig.DataDir, "links.db")
+}
+
+// boltLinks stores each link as JSON under its slug, and its hits in a
+// bucket of their own keyed by time.
+type boltLinks struct {
+	db *bolt.DB
+}
+
+var (
+	linksBucket = []byte("links")
+	hitsBucket  = []byte("hits")
+	scansBucket = []byte("scans")
+)
+
+func openBoltLinks(path string) (*boltLinks, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateLinkDB(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltLinks{db: db}, nil
+}
+
+func getLink(b *bolt.Bucket, slug string) (shortLink, error) {
+	var l shortLink
+	v := b.Get([]byte(slug))
+	if v == nil {
+		return l, errLinkNotFound
+	}
+	err := json.Unmarshal(v, &l)
+	return l, err
+}
+
+func putLink(b *bolt.Bucket, l shortLink) error {
+	v, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(l.Slug), v)
+}
+
+func (s *boltLinks) Get(slug string) (shortLink, error) {
+	var l shortLink
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		l, err = getLink(tx.Bucket(linksBucket), slug)
+		return err
+	})
+	return l, err
+}
+
+func (s *boltLinks) Create(l shortLink) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(linksBucket)
+		if b.Get([]byte(l.Slug)) != nil {
+			return errLinkExists
+		}
+		return putLink(b, l)
+	})
+}
+
+func (s *boltLinks) Update(slug string, fn func(*shortLink) error) (shortLink, error) {
+	var l shortLink
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(linksBucket)
+		var err error
+		if l, err = getLink(b, slug); err != nil {
+			return err
+		}
+		if err := fn(&l); err != nil {
+			return err
+		}
+		return putLink(b, l)
+	})
+	return l, err
+}
+
+func (s *boltLinks) Delete(slug string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(linksBucket)
+		if b.Get([]byte(slug)) == nil {
+			return errLinkNotFound
+		}
+		if err := b.Delete([]byte(slug)); err != nil {
+			return err
+		}
+		for _, name := range [][]byte{hitsBucket, scansBucket} {
+			err := tx.Bucket(name).DeleteBucket([]byte(slug))
+			if err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// hitKey orders hits by time, with a sequence number keeping hits in the
+// same nanosecond apart.
+func hitKey(t time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+// RecordHit goes through Batch, so concurrent redirects share a commit.
+func (s *boltLinks) RecordHit(slug string, h linkHit) error {
+	v, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(hitsBucket).CreateBucketIfNotExists([]byte(slug))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := b.Put(hitKey(h.Time, seq), v); err != nil {
+			return err
+		}
+		return putScan(tx, slug, h)
+	})
+}
+
+// putScan keeps a hit with a token as a scan without conversions yet.
+func putScan(tx *bolt.Tx, slug string, h linkHit) error {
+	if h.Token == "" {
+		return nil
+	}
+	_, key, ok := splitScanToken(h.Token)
+	if !ok {
+		return fmt.Errorf("invalid scan token %q", h.Token)
+	}
+	b, err := tx.Bucket(scansBucket).CreateBucketIfNotExists([]byte(slug))
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(linkScan{Token: h.Token, Time: h.Time})
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), v)
+}
+
+// importHits records hits in a single transaction, for restores.
+func (s *boltLinks) importHits(slug string, hits []linkHit) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(hitsBucket).CreateBucketIfNotExists([]byte(slug))
+		if err != nil {
+			return err
+		}
+		for _, h := range hits {
+			v, err := json.Marshal(h)
+			if err != nil {
+				return err
+			}
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := b.Put(hitKey(h.Time, seq), v); err != nil {
+				return err
+			}
+			if err := putScan(tx, slug, h); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltLinks) EachHit(slug string, since time.Time, fn func(linkHit)) (int, error) {
+	total := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(hitsBucket).Bucket([]byte(slug))
+		if b == nil {
+			return nil
+		}
+		total = b.Stats().KeyN
+		c := b.Cursor()
+		for k, v := c.Seek(hitKey(since, 0)); k != nil; k, v = c.Next() {
+			var h linkHit
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+			fn(h)
+		}
+		return nil
+	})
+	return total, err
+}
+
+// RecordConversion ignores a conversion whose ID the scan already has, so
+// a destination can safely send a report again.
+func (s *boltLinks) RecordConversion(slug, token string, c conversion) error {
+	_, key, ok := splitScanToken(token)
+	if !ok {
+		return errScanNotFound
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(scansBucket).Bucket([]byte(slug))
+		if b == nil {
+			return errScanNotFound
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return errScanNotFound
+		}
+		var scan linkScan
+		if err := json.Unmarshal(v, &scan); err != nil {
+			return err
+		}
+		if scan.Token != token {
+			return errScanNotFound
+		}
+		for _, prev := range scan.Conversions {
+			if c.ID != "" && prev.ID == c.ID && prev.Type == c.Type {
+				return errDuplicateConversion
+			}
+		}
+		if len(scan.Conversions) >= maxScanConversions {
+			return errTooManyConversions
+		}
+		scan.Conversions = append(scan.Conversions, c)
+		v, err := json.Marshal(scan)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), v)
+	})
+}
+
+func (s *boltLinks) EachScan(slug string, since time.Time, fn func(linkScan)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(scansBucket).Bucket([]byte(slug))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(scanKeyPrefix(since))); k != nil; k, v = c.Next() {
+			var scan linkScan
+			if err := json.Unmarshal(v, &scan); err != nil {
+				return err
+			}
+			fn(scan)
+		}
+		return nil
+	})
+}
+
+func (s *boltLinks) List(tenantID string) ([]shortLink, error) {
+	return s.filter(func(l shortLink) bool { return l.Tenant == tenantID })
+}
+
+func (s *boltLinks) All() ([]shortLink, error) {
+	return s.filter(func(shortLink) bool { return true })
+}
+
+func (s *boltLinks) filter(keep func(shortLink) bool) ([]shortLink, error) {
+	list := []shortLink{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(linksBucket).ForEach(func(_, v []byte) error {
+			var l shortLink
+			if err := json.Unmarshal(v, &l); err != nil {
+				return err
+			}
+			if keep(l) {
+				list = append(list, l)
+			}
+			return nil
+		})
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Slug < list[j].Slug })
+	return list, err
+}
+
+const slugAlphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+
+// newSlug returns a random 8 character slug, avoiding characters that are
+// easily misread when typed off a print.
+func newSlug() string {
+	b := make([]byte, 8)
+	for i := range b {
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(slugAlphabet))))
+		b[i] = slugAlphabet[n.Int64()]
+	}
+	return string(b)
+}
+
+func shortURL(base, slug string) string {
+	return base + "/s/" + slug
+}
+
+// checkDestination accepts absolute http and https URLs.
+func checkDestination(dest string) error {
+	u, err := url.Parse(dest)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return badRequest("Invalid 'url' (must be an absolute http or https URL)")
+	}
+	return nil
+}
+
+// checkExpiry accepts an expiry in the future.
+func checkExpiry(at time.Time) error {
+	if !at.After(time.Now()) {
+		return badRequest("Invalid 'expires_at' (must be in the future)")
+	}
+	return nil
+}
+
+// resolveLink lets a code encode a short link: 'link' names one of t's
+// links and becomes 'data', the link's short URL on base.
+func resolveLink(t *tenant, params url.Values, base string) error {
+	slug := params.Get("link")
+	if slug == "" {
+		return nil
+	}
+	if params.Get("data") != "" {
+		return badRequest("Use either 'data' or 'link', not both")
+	}
+	if !slugPattern.MatchString(slug) {
+		return badRequest("Invalid 'link' parameter")
+	}
+	l, err := links.Get(slug)
+	if errors.Is(err, errLinkNotFound) || (err == nil && !l.usableBy(t)) {
+		return badRequest("Unknown link " + slug)
+	}
+	if err != nil {
+		return internalError("Failed to load short link", err)
+	}
+	if l.expired(time.Now()) {
+		return badRequest("Link " + slug + " has expired")
+	}
+	params.Set("data", shortURL(base, slug))
+	return nil
+}
+
+// linkResponse is a link as the API returns it. OwnerToken is only set in
+// the response to creating a link without an API key.
+type linkResponse struct {
+	shortLink
+	ShortURL   string `json:"short_url"`
+	OwnerToken string `json:"owner_token,omitempty"`
+}
+
+func newLinkResponse(base string, l shortLink) linkResponse {
+	l.OwnerTokenHash = ""
+	return linkResponse{shortLink: l, ShortURL: shortURL(base, l.Slug)}
+}
+
+func writeLink(w http.ResponseWriter, r *http.Request, status int, l shortLink) {
+	writeLinkResponse(w, status, newLinkResponse(publicBaseURL(r), l))
+}
+
+func writeLinkResponse(w http.ResponseWriter, status int, res linkResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// ownLink loads the link named in the path, answering 404 for links of
+// other tenants, or without the owner token, as for missing ones.
+func ownLink(w http.ResponseWriter, r *http.Request) (shortLink, bool) {
+	l, err := links.Get(mux.Vars(r)["slug"])
+	if errors.Is(err, errLinkNotFound) || (err == nil && !l.ownedBy(tenantFrom(r.Context()), linkToken(r))) {
+		http.Error(w, "Short link not found", http.StatusNotFound)
+		return l, false
+	}
+	if err != nil {
+		writeError(w, internalError("Failed to load short link", err))
+		return l, false
+	}
+	return l, true
+}
+
+// createLink adds a short link from {"url": ..., "slug": ...,
+// "track_conversions": ..., "expires_at": ...}, the expiry being an RFC
+// 3339 time. Without a slug a random one is picked. Codes
+// for it are made with /qrcode?link=<slug>. Without an API key the
+// response carries an owner_token, which later requests for the link must
+// send in X-Link-Token; it is not shown again.
+func createLink(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Slug             string     `json:"slug"`
+		URL              string     `json:"url"`
+		TrackConversions bool       `json:"track_conversions"`
+		ExpiresAt        *time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, bodyError(err, "Invalid link JSON"))
+		return
+	}
+	if err := checkDestination(req.URL); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Slug != "" && (!slugPattern.MatchString(req.Slug) || req.Slug == expiringLinksSlug) {
+		http.Error(w, "Invalid 'slug' (letters, digits, '-' and '_', up to 64)", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != nil {
+		if err := checkExpiry(*req.ExpiresAt); err != nil {
+			writeError(w, err)
+			return
+		}
+		utc := req.ExpiresAt.UTC()
+		req.ExpiresAt = &utc
+	}
+
+	now := time.Now().UTC()
+	l := shortLink{Slug: req.Slug, URL: req.URL, TrackConversions: req.TrackConversions, ExpiresAt: req.ExpiresAt, CreatedAt: now, UpdatedAt: now}
+	var token string
+	if t := tenantFrom(r.Context()); t != nil {
+		l.Tenant = t.ID
+	} else {
+		b := make([]byte, 16)
+		rand.Read(b)
+		token = hex.EncodeToString(b)
+		l.OwnerTokenHash = hashOwnerToken(token)
+	}
+	if l.Slug == "" {
+		l.Slug = newSlug()
+	}
+	err := links.Create(l)
+	for attempt := 0; errors.Is(err, errLinkExists) && req.Slug == "" && attempt < 3; attempt++ {
+		l.Slug = newSlug()
+		err = links.Create(l)
+	}
+	if errors.Is(err, errLinkExists) {
+		http.Error(w, "Short link "+l.Slug+" already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeError(w, internalError("Failed to store short link", err))
+		return
+	}
+
+	res := newLinkResponse(publicBaseURL(r), l)
+	res.OwnerToken = token
+	w.Header().Set("Location", "/links/"+l.Slug)
+	writeLinkResponse(w, http.StatusCreated, res)
+}
+
+// listLinks lists the caller's links. Links created without an API key
+// have no common owner, so listing needs a key.
+func listLinks(w http.ResponseWriter, r *http.Request) {
+	t := tenantFrom(r.Context())
+	if t == nil {
+		http.Error(w, "Listing links needs an API key", http.StatusUnauthorized)
+		return
+	}
+	list, err := links.List(t.ID)
+	if err != nil {
+		writeError(w, internalError("Failed to list short links", err))
+		return
+	}
+
+	base := publicBaseURL(r)
+	out := make([]linkResponse, len(list))
+	for i, l := range list {
+		out[i] = newLinkResponse(base, l)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func getLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if l, ok := ownLink(w, r); ok {
+		writeLink(w, r, http.StatusOK, l)
+	}
+}
+
+// updateLink changes where a link points, from {"url": ...}, whether it
+// tracks conversions if "track_conversions" is given, and its expiry if
+// "expires_at" is, null removing it. Codes already printed follow the new
+// destination.
+func updateLink(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL              string          `json:"url"`
+		TrackConversions *bool           `json:"track_conversions"`
+		ExpiresAt        json.RawMessage `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, bodyError(err, "Invalid link JSON"))
+		return
+	}
+	if err := checkDestination(req.URL); err != nil {
+		writeError(w, err)
+		return
+	}
+	var expiresAt *time.Time
+	if len(req.ExpiresAt) > 0 && string(req.ExpiresAt) != "null" {
+		var at time.Time
+		err := json.Unmarshal(req.ExpiresAt, &at)
+		if err != nil {
+			err = badRequest("Invalid 'expires_at' (must be an RFC 3339 time)")
+		} else {
+			err = checkExpiry(at)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		at = at.UTC()
+		expiresAt = &at
+	}
+	l, ok := ownLink(w, r)
+	if !ok {
+		return
+	}
+
+	l, err := links.Update(l.Slug, func(l *shortLink) error {
+		l.URL = req.URL
+		if req.TrackConversions != nil {
+			l.TrackConversions = *req.TrackConversions
+		}
+		if len(req.ExpiresAt) > 0 {
+			l.ExpiresAt = expiresAt
+		}
+		l.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		writeError(w, internalError("Failed to store short link", err))
+		return
+	}
+	writeLink(w, r, http.StatusOK, l)
+}
+
+func deleteLink(w http.ResponseWriter, r *http.Request) {
+	l, ok := ownLink(w, r)
+	if !ok {
+		return
+	}
+	if err := links.Delete(l.Slug); err != nil && !errors.Is(err, errLinkNotFound) {
+		writeError(w, internalError("Failed to delete short link", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// redirectLink sends a scanned code on to the link's current destination.
+// The redirect is temporary and not cached, so changes apply at once. GET
+// requests count as hits; HEAD is left to link checkers. An expired link
+// answers 410 Gone.
+func redirectLink(w http.ResponseWriter, r *http.Request) {
+	l, err := links.Get(mux.Vars(r)["slug"])
+	if errors.Is(err, errLinkNotFound) {
+		http.Error(w, "Short link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, internalError("Failed to load short link", err))
+		return
+	}
+	if l.expired(time.Now()) {
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, "Short link has expired", http.StatusGone)
+		return
+	}
+
+	dest := l.URL
+	if r.Method == http.MethodGet {
+		if token := recordHit(r, l); token != "" {
+			dest = trackedDestination(dest, token)
+		}
+		if l.Tenant != "" {
+			err := usage.Update(l.Tenant, func(rec *usageRecord) { rec.Redirects++ })
+			if err != nil {
+				log.Printf("Failed to record redirect for tenant %s: %v", l.Tenant, err)
+			}
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, dest, http.StatusFound)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"math"
+
+	"github.com/disintegration/imaging"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	_ "golang.org/x/image/webp"
+)
+
+// decodeLogo decodes a logo asset. PNG, JPEG, GIF and WebP go through
+// image.Decode, with JPEGs turned upright according to their EXIF
+// orientation, as phone photos are usually stored sideways. SVG is
+// rasterized to fit size x size, so it stays sharp at any logo size.
+func decodeLogo(data []byte, size int) (image.Image, error) {
+	if isSVG(data) {
+		return rasterizeSVG(data, size)
+	}
+	return imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+}
+
+// isSVG sniffs for an SVG document: XML whose first element is <svg>,
+// possibly after a prolog, comments or a doctype.
+func isSVG(data []byte) bool {
+	head := data
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	head = bytes.TrimSpace(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")))
+	return bytes.HasPrefix(head, []byte("<")) && bytes.Contains(head, []byte("<svg"))
+}
+
+func rasterizeSVG(data []byte, size int) (image.Image, error) {
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(data), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, err
+	}
+	vw, vh := icon.ViewBox.W, icon.ViewBox.H
+	if vw <= 0 || vh <= 0 {
+		return nil, errors.New("svg has no usable viewBox or size")
+	}
+
+	w, h := size, size
+	if vw > vh {
+		h = int(math.Max(1, math.Round(float64(size)*vh/vw)))
+	} else {
+		w = int(math.Max(1, math.Round(float64(size)*vw/vh)))
+	}
+	icon.SetTarget(0, 0, float64(w), float64(h))
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	scanner := rasterx.NewScannerGV(w, h, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+	return img, nil
+}
+
+// Background removal treats a logo as sitting on a solid box when nearly
+// all of its border is one opaque colour. Pixels within bgTolerance of that
+// colour and connected to the border become transparent, and those up to
+// twice as far are faded, which softens the anti-aliased edge.
+const (
+	bgTolerance     = 24
+	bgBorderPortion = 0.9
+)
+
+// removeLogoBackground returns img with its solid background made
+// transparent, or img itself when it has none. Only the region reachable
+// from the border is cleared, so white shapes inside the logo survive.
+func removeLogoBackground(img image.Image) image.Image {
+	src := imaging.Clone(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w < 3 || h < 3 {
+		return img
+	}
+
+	at := func(x, y int) []uint8 {
+		i := y*src.Stride + x*4
+		return src.Pix[i : i+4]
+	}
+	var border [][2]int
+	for x := 0; x < w; x++ {
+		border = append(border, [2]int{x, 0}, [2]int{x, h - 1})
+	}
+	for y := 1; y < h-1; y++ {
+		border = append(border, [2]int{0, y}, [2]int{w - 1, y})
+	}
+
+	// The background is the most common opaque corner colour
+	var bg []uint8
+	best := 0
+	for _, c := range [][2]int{{0, 0}, {w - 1, 0}, {0, h - 1}, {w - 1, h - 1}} {
+		p := at(c[0], c[1])
+		if p[3] != 255 {
+			continue
+		}
+		n := 0
+		for _, b := range border {
+			if colorDistance(at(b[0], b[1]), p) <= bgTolerance {
+				n++
+			}
+		}
+		if n > best {
+			best, bg = n, append([]uint8(nil), p...)
+		}
+	}
+	if bg == nil || float64(best) < bgBorderPortion*float64(len(border)) {
+		return img
+	}
+
+	// Flood fill from the border through background-like pixels
+	seen := make([]bool, w*h)
+	queue := border
+	for len(queue) > 0 {
+		x, y := queue[0][0], queue[0][1]
+		queue = queue[1:]
+		if seen[y*w+x] {
+			continue
+		}
+		seen[y*w+x] = true
+
+		p := at(x, y)
+		d := colorDistance(p, bg)
+		if d > 2*bgTolerance {
+			continue
+		}
+		if d <= bgTolerance {
+			p[3] = 0
+		} else {
+			p[3] = uint8(int(p[3]) * (d - bgTolerance) / bgTolerance)
+		}
+		for _, n := range [][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+			if n[0] >= 0 && n[0] < w && n[1] >= 0 && n[1] < h && !seen[n[1]*w+n[0]] {
+				queue = append(queue, n)
+			}
+		}
+	}
+	return src
+}
+
+// colorDistance is the largest per-channel difference between two NRGBA
+// pixels, ignoring alpha.
+func colorDistance(a, b []uint8) int {
+	d := 0
+	for c := 0; c < 3; c++ {
+		v := int(a[c]) - int(b[c])
+		if v < 0 {
+			v = -v
+		}
+		if v > d {
+			d = v
+		}
+	}
+	return d
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+)
+
+// Uploaded logos must be at least minLogoUpload pixels on each side, and
+// no larger than twice the biggest code we render.
+const minLogoUpload = 16
+
+// maxLogoArea is the largest share of the code a logo may cover at each
+// recovery level, about half of what the level can correct, so a logo
+// never costs a code its margin for scuffs and glare.
+var maxLogoArea = map[string]float64{
+	"low":      0.05,
+	"medium":   0.10,
+	"quartile": 0.15,
+	"high":     0.20,
+}
+
+// checkLogoArea rejects logos too large for the spec's recovery level. It
+// uses the square the logo is fitted into, so it holds for any logo.
+func checkLogoArea(spec renderSpec) error {
+	if spec.LogoFile == "" || spec.Size == 0 {
+		return nil
+	}
+	area := float64(spec.LogoSize*spec.LogoSize) / float64(spec.Size*spec.Size)
+	if limit, ok := maxLogoArea[spec.RecoveryLevel]; ok && area > limit {
+		return classified(badRequest(fmt.Sprintf("Logo covers %.1f%% of the code, above the %.0f%% allowed at recovery level %s", area*100, limit*100, spec.RecoveryLevel)), classUnscannable)
+	}
+	return nil
+}
+
+// logoFromForm reads the 'logo' file of a POST /qrcode form. The logo is
+// scanned and stored, so a stored spec can render it again. Without a file
+// it returns "".
+func logoFromForm(r *http.Request) (string, error) {
+	f, hdr, err := r.FormFile("logo")
+	if errors.Is(err, http.ErrMissingFile) {
+		return "", nil
+	}
+	if err != nil {
+		return "", badRequest("Invalid 'logo' file")
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return "", bodyError(err, "Failed to read 'logo' file")
+	}
+	if err := scanUpload(r.Context(), hdr.Filename, data); err != nil {
+		return "", err
+	}
+	return storeLogo(data)
+}
+
+// logoUploadPrefix is where uploaded and fetched logos go in the assets.
+const logoUploadPrefix = "logos/"
+
+// storeLogo checks a logo and stores it as an asset named after its
+// content, returning the asset key.
+func storeLogo(data []byte) (string, error) {
+	ext, err := checkLogoUpload(data)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	key := logoUploadPrefix + hex.EncodeToString(sum[:16]) + ext
+	if _, err := assets.Get(key); errors.Is(err, errNotFound) {
+		if err := assets.Put(key, data); err != nil {
+			return "", internalError("Failed to store logo", err)
+		}
+	} else if err != nil {
+		return "", internalError("Failed to store logo", err)
+	}
+	return key, nil
+}
+
+// checkLogoUpload makes sure data is a logo we can draw, PNG, JPEG, GIF,
+// WebP or SVG, of a usable size, and returns its file extension.
+func checkLogoUpload(data []byte) (string, error) {
+	if isSVG(data) {
+		if _, err := rasterizeSVG(data, minLogoUpload); err != nil {
+			return "", badRequest("Unsupported SVG in 'logo': " + err.Error())
+		}
+		return ".svg", nil
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", badRequest("Unsupported image in 'logo' (must be PNG, JPEG, GIF, WebP or SVG)")
+	}
+	if cfg.Width < minLogoUpload || cfg.Height < minLogoUpload {
+		return "", badRequest(fmt.Sprintf("Logo is %dx%d, minimum is %dx%d", cfg.Width, cfg.Height, minLogoUpload, minLogoUpload))
+	}
+	if limit := 2 * serverLimits.MaxSize; cfg.Width > limit || cfg.Height > limit {
+		return "", tooLarge(fmt.Sprintf("Logo is %dx%d, maximum is %dx%d", cfg.Width, cfg.Height, limit, limit))
+	}
+	if _, err := decodeLogo(data, serverConfig.LogoSize); err != nil {
+		return "", badRequest("Unsupported image in 'logo': " + err.Error())
+	}
+	return "." + format, nil
+}
@@ -1,196 +1,454 @@
 package main
 
 import (
-	"fmt"
-	"image"
-	"image/color"
-	"image/draw"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"runtime"
+	"time"
 
-	"github.com/disintegration/imaging"
-	"github.com/golang/freetype"
-	"github.com/golang/freetype/truetype"
 	"github.com/gorilla/mux"
-	qrcode "github.com/skip2/go-qrcode"
 )
 
 const (
-	tempDir       = "temp"
-	logoFile      = "smartlink-logo.png"
-	outputFile    = "SmartQR.png"
-	labelWidth    = 1024
-	labelHeight   = 80
-	labelFontSize = 30.0
+	outputFile = "SmartQR.png"
+	minSize    = 128
+)
+
+var (
+	assets    storage
+	specs     *specStore
+	renders   *renderStore
+	templates *templateStore
+	failures  *failureLog
+	usage     *usageStore
+	jobs      *jobStore
 )
 
 func main() {
+	var err error
+	proxyRules, err = loadProxyRules()
+	if err != nil {
+		log.Fatal("Failed to configure outbound proxies: ", err)
+	}
+	serverLimits = loadLimits()
+	serverConfig, err = loadConfig()
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	serverLogo, serverFont = serverConfig.LogoFile, serverConfig.FontFile
+	globalFeatures = loadFeatures()
+	slo = newSLOTracker(loadSLOConfig())
+	serverTiming = loadServerTiming()
+	labels = newLabelCache(envInt("QR_LABEL_CACHE_ENTRIES", 64))
+	rendered = loadRenderCache()
+	spillDir = serverConfig.TempDir
+	renderSlots = newSlotPool(envInt("QR_RENDER_WORKERS", runtime.NumCPU()))
+	interactive.pool = renderSlots
+	failOnLogoDecode = loadLogoDecodeErrors()
+	jobSlots = newSlotPool(envInt("QR_JOB_WORKERS", (runtime.NumCPU()+1)/2))
+	jobs = newJobStore(time.Duration(envInt("QR_JOB_TTL_SECONDS", 86400)) * time.Second)
+	uploads = newUploadStore(time.Duration(envInt("QR_UPLOAD_TTL_SECONDS", 86400)) * time.Second)
+	timeouts = loadServerTimeouts()
+	qrCacheControl = loadCacheControl()
+	previews = newPreviewStore(time.Duration(envInt("QR_PREVIEW_TTL_SECONDS", 300)) * time.Second)
+	fetchPolicyConfig = loadFetchPolicy()
+	fetchClient = newFetchClient(fetchPolicyConfig)
+
+	pngMode, err = loadPNGMode()
+	if err != nil {
+		log.Fatal("Failed to configure PNG encoder: ", err)
+	}
+	scanner, err = newUploadScanner()
+	if err != nil {
+		log.Fatal("Failed to configure upload scanner: ", err)
+	}
+
+	// --migrate-only brings the stores up to date and exits, for
+	// deployments that run migrations as a step of their own
+	migrateOnly := len(os.Args) > 1 && os.Args[1] == "--migrate-only"
+	autoMigrate = migrateOnly || loadMigrationMode()
+
+	breakerCfg := loadBreakerConfig()
+	disk, err := newDiskStorage(serverConfig.DataDir)
+	if err != nil {
+		log.Fatal("Failed to open data store: ", err)
+	}
+	if err := migrateDataStore(disk); err != nil {
+		log.Fatal("Failed to migrate data store: ", err)
+	}
+	dataStore := breakerStorage{st: disk, b: newBreaker("storage", breakerCfg)}
+	specs = &specStore{st: dataStore}
+	templates = &templateStore{st: dataStore}
+	renders = &renderStore{st: dataStore}
+	failures = &failureLog{st: dataStore}
+	usage = &usageStore{st: dataStore}
+	logoURLs = &logoURLCache{st: dataStore, ttl: time.Duration(envInt("QR_LOGO_URL_TTL_SECONDS", 86400)) * time.Second}
+	linkDB, err := newLinkStore()
+	if err != nil {
+		log.Fatal("Failed to open link store: ", err)
+	}
+	links = breakerLinks{links: linkDB, b: newBreaker("database", breakerCfg), known: newLinkCache(envInt("QR_LINK_CACHE_ENTRIES", 1024))}
+	if migrateOnly {
+		log.Println("Migrations complete")
+		return
+	}
+	role, err := loadReplication(dataStore)
+	if err != nil {
+		log.Fatal("Failed to configure replication: ", err)
+	}
+	if role == replicationPrimary {
+		links = replicatedLinks{linkStore: links, changes: changes}
+		templates.changes = changes
+	}
+	if err := loadGeoIP(); err != nil {
+		log.Fatal("Failed to open GeoIP database: ", err)
+	}
+	geoBreaker = newBreaker("geoip", breakerCfg)
+
+	assetDisk, err := newDiskStorage(serverConfig.AssetsDir)
+	if err != nil {
+		log.Fatal("Failed to open asset store: ", err)
+	}
+	assets = bundledAssets{breakerStorage{st: assetDisk, b: newBreaker("assets", breakerCfg)}}
+	serverEmojiFont = os.Getenv("QR_EMOJI_FONT")
+	serverFallbackFonts, err = listFallbackFonts(os.Getenv("QR_FONT_DIR"))
+	if err != nil {
+		log.Fatal("Failed to list fallback fonts: ", err)
+	}
+	checkAssets()
+	tenants, err = loadTenants()
+	if err != nil {
+		log.Fatal("Failed to load tenants: ", err)
+	}
+
+	if err := loadWallets(); err != nil {
+		log.Fatal("Failed to load wallet credentials: ", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		backupCommand(disk, linkDB)
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		restoreCommand(disk, linkDB)
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		selftestCommand()
+		return
+	}
+
+	trustedProxies = envCIDRs("QR_TRUSTED_PROXIES")
+
+	requestLogger = loadRequestLogger()
 	router := mux.NewRouter()
-	router.HandleFunc("/qrcode", generateQRCode).Methods("GET")
+	router.Use(logRequests)
+	router.Use(metrics.middleware)
+	router.Use(loadIPFilter("QR").middleware)
+	router.Use(identifyTenant)
+	router.Use(loadRateLimiter().middleware)
+	router.Use(limitBody)
+	router.HandleFunc("/qrcode", generateQRCode).Methods("GET", "POST")
 	router.HandleFunc("/qrcode/download", downloadQRCode).Methods("GET")
+	router.HandleFunc("/qrcode/embed", embedQRCode).Methods("GET")
+	router.HandleFunc("/qrcode/signature", signatureQRCode).Methods("GET")
+	router.HandleFunc("/qrcode/wallet", walletQRCode).Methods("GET")
+	router.HandleFunc("/qrcode/pair", pairQRCode).Methods("GET")
+	router.HandleFunc("/qrcode/scan-report", scanReportHandler).Methods("GET")
+	router.HandleFunc("/qrcode/vcard", vcardQRCode).Methods("GET")
+	router.HandleFunc("/qrcode/wifi", wifiQRCode).Methods("GET")
+	router.HandleFunc("/qrcode/poster", posterHandler).Methods("POST")
+	router.HandleFunc("/qrcode/batch", generateBatch).Methods("POST")
+	router.HandleFunc("/qrcodes/{id:[0-9a-f]{20}}", getQRCodeSpec).Methods("GET")
+	router.HandleFunc("/qrcodes/{id:[0-9a-f]{20}}/download", downloadQRCode).Methods("GET")
+	router.HandleFunc("/qrcodes/{id:[0-9a-f]{20}}.png", getQRCodeImage).Methods("GET")
+	router.HandleFunc("/qrcodes/{id:[0-9a-f]{20}}/rerender", rerenderQRCode).Methods("POST")
+	router.HandleFunc("/s/{slug}", redirectLink).Methods("GET", "HEAD")
+	router.HandleFunc("/links", createLink).Methods("POST")
+	router.HandleFunc("/links", listLinks).Methods("GET")
+	router.HandleFunc("/links/expiring", listExpiringLinks).Methods("GET")
+	router.HandleFunc("/links/expiring.ics", expiringLinksFeed).Methods("GET")
+	router.HandleFunc("/links/{slug}", getLinkHandler).Methods("GET")
+	router.HandleFunc("/links/{slug}", updateLink).Methods("PUT")
+	router.HandleFunc("/links/{slug}", deleteLink).Methods("DELETE")
+	router.HandleFunc("/links/{slug}/stats", linkStatsHandler).Methods("GET")
+	router.HandleFunc("/links/{slug}/stats/share", shareStats).Methods("POST")
+	router.HandleFunc("/links/{slug}/stats/share", unshareStats).Methods("DELETE")
+	router.HandleFunc("/s/{slug}/stats/{token:[0-9a-f]{32}}", sharedStats).Methods("GET")
+	router.HandleFunc("/stats/query", queryStats).Methods("POST")
+	router.HandleFunc("/conversions", recordConversion).Methods("POST")
+	router.HandleFunc("/compare", compareHandler).Methods("POST")
+	router.HandleFunc("/themes", listThemes).Methods("GET")
+	router.HandleFunc("/batches", createBatch).Methods("POST")
+	router.HandleFunc("/previews", createPreview).Methods("POST")
+	router.HandleFunc("/previews/{token:[0-9a-f]{32}}", getPreview).Methods("GET")
+	router.HandleFunc("/uploads", createUpload).Methods("POST")
+	router.HandleFunc("/uploads/{id:[0-9a-f]{16}}", headUpload).Methods("HEAD")
+	router.HandleFunc("/uploads/{id:[0-9a-f]{16}}", patchUpload).Methods("PATCH")
+	router.HandleFunc("/uploads/{id:[0-9a-f]{16}}", deleteUpload).Methods("DELETE")
+	router.HandleFunc("/jobs/{id:[0-9a-f]{16}}", getJob).Methods("GET")
+	router.HandleFunc("/jobs/{id:[0-9a-f]{16}}/artifact", getJobArtifact).Methods("GET")
+	router.HandleFunc("/jobs/{id:[0-9a-f]{16}}/events", getJobEvents).Methods("GET")
+	router.HandleFunc("/jobs/{id:[0-9a-f]{16}}/retry-failed", retryFailed).Methods("POST")
+
+	adminTokens = envList("QR_ADMIN_TOKENS", nil)
+	if len(adminTokens) == 0 {
+		log.Println("QR_ADMIN_TOKENS is not set; the admin API is disabled")
+	}
+	registerAdminRoutes(newAdminRouter(router, os.Getenv("QR_ADMIN_ADDR")))
+	serveInternal(router, os.Getenv("QR_INTERNAL_ADDR"))
+	if secondary != nil {
+		go secondary.run()
+	}
 
-	log.Fatal(http.ListenAndServe(":8080", router))
+	serveUntilSignalled(serverConfig.Addr, router)
 }
 
+// generateQRCode renders a code from the request parameters. POST takes
+// them as a multipart form, which may upload the logo as 'logo'.
 func generateQRCode(w http.ResponseWriter, r *http.Request) {
-	data := r.FormValue("data")
-	if data == "" {
-		http.Error(w, "Missing 'data' parameter", http.StatusBadRequest)
+	var err error
+	if r.Method == http.MethodPost {
+		if err = r.ParseMultipartForm(serverLimits.MaxBodyBytes); err != nil {
+			err = bodyError(err, "Expected a multipart form")
+		}
+	}
+	var spec renderSpec
+	if err == nil {
+		spec, err = specFromRequest(r)
+	}
+	if err == nil && r.MultipartForm != nil {
+		var logo string
+		if logo, err = logoFromForm(r); err == nil && logo != "" {
+			spec.LogoFile = logo
+			err = checkLogoArea(spec)
+		}
+	}
+	if err == nil {
+		spec, err = applyQuota(w, r, spec)
+	}
+	if err != nil {
+		failGeneration(w, r, err)
 		return
 	}
 
-	logo, err := os.Open(logoFile)
+	f, err := rasterFormatFrom(r)
 	if err != nil {
-		http.Error(w, "Failed to open logo file", http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+	switch r.FormValue("format") {
+	case "svg":
+		serveSVG(w, r, spec)
+		return
+	case "pdf":
+		servePDF(w, r, spec)
 		return
 	}
 
-	defer logo.Close()
-
-	qr, err := qrcode.New(data, qrcode.Medium)
+	id, err := specID(spec)
 	if err != nil {
-		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
+		writeError(w, internalError("Failed to hash QR code spec", err))
+		return
+	}
+	w.Header().Set("X-QR-Id", id)
+	if checkNotModified(w, r, codeETag(id, f), qrCacheControl) {
 		return
 	}
 
-	// Read and resize the logo image
-	logoImg, _, err := image.Decode(logo)
+	tm := requestTimer()
+	id, b, cached, warnings, err := renderStored(spec, tm, interactive)
 	if err != nil {
-		http.Error(w, "Failed to decode logo image", http.StatusInternalServerError)
+		failGeneration(w, r, err)
 		return
 	}
-	// Define the desired width and height of the logo image
-	logoWidth := 200
-	logoHeight := 200
+	stored := storedBytes(b, cached)
+	if b, err = f.encode(b); err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+	writeTiming(w, tm)
+	writeWarnings(w, warnings)
+	if len(warnings) > 0 {
+		uncacheable(w)
+	}
+	writeModulePixels(w, spec)
+	recordGeneration(r, f.name, spec, stored)
+	w.Header().Set("Content-Type", f.contentType)
 
-	// Resize the logo image while maintaining its aspect ratio
-	resizedLogo := imaging.Fit(logoImg, logoWidth, logoHeight, imaging.Lanczos)
+	// Serve the generated QR code image for preview
+	http.ServeContent(w, r, outputFile, time.Time{}, bytes.NewReader(b))
+}
 
-	// Add the logo to the center of the QR code
-	qrImg := qr.Image(1024)
-	if err != nil {
-		http.Error(w, "Failed to generate QR code image", http.StatusInternalServerError)
+// downloadQRCode serves a generated code as an attachment. The code is
+// named by the X-QR-Id its generation returned, in the path or, on the
+// older /qrcode/download route, the 'id' parameter, so each client gets
+// back its own code. 'format' may ask for it as JPEG or WebP.
+func downloadQRCode(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		id = r.FormValue("id")
+	}
+	if id == "" {
+		http.Error(w, "Missing 'id' parameter (the X-QR-Id of the generated code)", http.StatusBadRequest)
+		return
+	}
+	if !specIDPattern.MatchString(id) {
+		http.Error(w, "Invalid 'id' parameter", http.StatusBadRequest)
 		return
 	}
-	// Calculate the position to overlay the logo at the center of the QR code
-	logoX := (qrImg.Bounds().Max.X - resizedLogo.Bounds().Max.X) / 2
-	logoY := (qrImg.Bounds().Max.Y - resizedLogo.Bounds().Max.Y) / 2
-	logoPos := image.Point{X: logoX, Y: logoY}
-
-	// Overlay the resized logo on the QR code image
-	qrImg = imaging.Overlay(qrImg, resizedLogo, logoPos, 1.0)
 
-	// Load font file
-	fontPath := "Roboto-Medium.ttf"
-	fontBytes, err := os.ReadFile(fontPath)
+	spec, err := specs.Load(id)
+	if errors.Is(err, errSpecNotFound) {
+		http.Error(w, "QR code not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to load font file", http.StatusInternalServerError)
+		writeError(w, internalError("Failed to load QR code spec", err))
 		return
 	}
-
-	font, err := truetype.Parse(fontBytes)
+	f, err := rasterFormatFrom(r)
+	if err == nil && f.name == "" {
+		err = badRequest("Unsupported 'format' parameter for download (expected png, jpeg or webp)")
+	}
 	if err != nil {
-		http.Error(w, "Failed to parse font", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-
-	// Retrieve the label text from the form value
-	labelText := r.FormValue("label")
-	if labelText == "" {
-		http.Error(w, "Missing 'label' parameter", http.StatusBadRequest)
+	spec, err = applyQuota(w, r, spec)
+	if err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+	// A quota can change the spec, so the ETag is that of what is served
+	if id, err = specID(spec); err != nil {
+		writeError(w, internalError("Failed to hash QR code spec", err))
+		return
+	}
+	if checkNotModified(w, r, codeETag(id, f), qrCacheControl) {
 		return
 	}
 
-	// Define the background color for the label
-	backgroundColor := color.RGBA{R: 1, G: 124, B: 254, A: 255}
-
-	// Create the label image with a background color
-	labelImg := image.NewRGBA(image.Rect(0, 0, labelWidth, labelHeight))
-	draw.Draw(labelImg, labelImg.Bounds(), &image.Uniform{C: backgroundColor}, image.ZP, draw.Src)
-
-	labelContext := freetype.NewContext()
-	labelContext.SetDPI(72)
-	labelContext.SetFont(font)
-	labelContext.SetFontSize(labelFontSize)
-	labelContext.SetClip(labelImg.Bounds())
-	labelContext.SetDst(labelImg)
-	labelContext.SetSrc(image.White)
-
-	//add conditional
-	condition := len(labelText) * 2
-	// Create the context for drawing text
-	labelX := ((labelWidth / 2) - (len(labelText) * 7)) + (len(labelText)-condition)*3
-	labelY := labelHeight - int(labelFontSize)
-
-	// Calculate the width of the background fill
-	fillWidth := labelWidth
-
-	// Calculate the spacing
-	labelAndSpacingHeight := labelHeight
-
-	// Calculate the horizontal position for the background fill
-	fillX := (labelWidth - fillWidth) / 2
+	tm := requestTimer()
+	id, b, cached, warnings, err := renderStored(spec, tm, interactive)
+	if err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+	stored := storedBytes(b, cached)
+	if b, err = f.encode(b); err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+	writeTiming(w, tm)
+	writeWarnings(w, warnings)
+	if len(warnings) > 0 {
+		uncacheable(w)
+	}
+	recordGeneration(r, f.name, spec, stored)
 
-	// Calculate the vertical position for the background fill
-	fillY := qrImg.Bounds().Max.Y - labelAndSpacingHeight - labelHeight
+	// Set the appropriate headers for downloading the file
+	w.Header().Set("Content-Disposition", "attachment; filename=SmartQR-"+id+f.ext)
+	w.Header().Set("Content-Type", f.contentType)
+	w.Header().Set("X-QR-Id", id)
 
-	// Draw the background fill below the label text
-	fillRect := image.Rect(fillX, fillY, fillX+fillWidth, qrImg.Bounds().Max.Y)
-	draw.Draw(labelImg, fillRect, &image.Uniform{C: backgroundColor}, image.ZP, draw.Src)
+	// Serve the generated QR code image for download
+	http.ServeContent(w, r, outputFile, time.Time{}, bytes.NewReader(b))
+}
 
-	// Set the starting position of the text
-	pt := freetype.Pt(labelX, labelY)
-	_, err = labelContext.DrawString(labelText, pt)
+// getQRCodeSpec returns the fully resolved spec a code was rendered from.
+// With 'scan_distance' it adds "print", the smallest size to print the
+// code at to be read from that far.
+func getQRCodeSpec(w http.ResponseWriter, r *http.Request) {
+	spec, err := specs.Load(mux.Vars(r)["id"])
+	if errors.Is(err, errSpecNotFound) {
+		http.Error(w, "QR code not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Println("Failed to draw label:", err)
+		writeError(w, internalError("Failed to load QR code spec", err))
+		return
+	}
+	ps, err := printSizeFrom(r, spec)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
 
-	// Calculate the new height for the qrImg bounds
-	newHeight := qrImg.Bounds().Dy() + labelAndSpacingHeight
-
-	// Create a new rectangle with the updated height
-	newBounds := image.Rect(qrImg.Bounds().Min.X, qrImg.Bounds().Min.Y, qrImg.Bounds().Max.X, newHeight)
-
-	// Create a new image with the updated bounds
-	newQrImg := image.NewRGBA(newBounds)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		renderSpec
+		Print *printSize `json:"print,omitempty"`
+	}{spec, ps})
+}
 
-	// Copy the qrImg to the new image
-	draw.Draw(newQrImg, qrImg.Bounds(), qrImg, image.Point{}, draw.Src)
+// rerenderQRCode regenerates a stored code from its saved spec, optionally
+// at a new size, so reprints match the original without the client
+// resubmitting every parameter.
+func rerenderQRCode(w http.ResponseWriter, r *http.Request) {
+	spec, err := specs.Load(mux.Vars(r)["id"])
+	if errors.Is(err, errSpecNotFound) {
+		http.Error(w, "QR code not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, internalError("Failed to load QR code spec", err))
+		return
+	}
 
-	// Overlay the resized logo on the QR code image with increased spacing
-	qrWithLogoAndLabel := imaging.Overlay(newQrImg, labelImg, image.Pt(0, qrImg.Bounds().Dy()), 1.0)
+	f, err := rasterFormatFrom(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
-	// Create a temporary directory if it doesn't exist
-	if _, err := os.Stat(tempDir); os.IsNotExist(err) {
-		err := os.Mkdir(tempDir, os.ModePerm)
+	if v := r.FormValue("size"); v != "" {
+		size, err := parseSize(v)
 		if err != nil {
-			http.Error(w, "Failed to create temporary directory", http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
+		spec = spec.scaled(size)
+	}
+	if err := snapFromValues(&spec, r.Form); err != nil {
+		writeError(w, err)
+		return
 	}
 
-	// Save the QR code image to a temporary file
-	outputPath := filepath.Join(tempDir, outputFile)
-	err = imaging.Save(qrWithLogoAndLabel, outputPath)
+	spec, err = applyQuota(w, r, spec)
 	if err != nil {
-		http.Error(w, "Failed to save QR code image", http.StatusInternalServerError)
+		failGeneration(w, r, err)
+		return
+	}
+	switch r.FormValue("format") {
+	case "svg":
+		serveSVG(w, r, spec)
+		return
+	case "pdf":
+		servePDF(w, r, spec)
 		return
 	}
 
-	fmt.Println("QR code generated successfully!")
-
-	// Serve the generated QR code image for preview
-	http.ServeFile(w, r, outputPath)
-}
-
-func downloadQRCode(w http.ResponseWriter, r *http.Request) {
-	// Set the appropriate headers for downloading the file
-	w.Header().Set("Content-Disposition", "attachment; filename=SmartQR.png")
-	w.Header().Set("Content-Type", "image/png")
-
-	// Serve the generated QR code image for download
-	outputPath := filepath.Join(tempDir, outputFile)
-	http.ServeFile(w, r, outputPath)
+	tm := requestTimer()
+	id, b, cached, warnings, err := renderStored(spec, tm, interactive)
+	if err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+	stored := storedBytes(b, cached)
+	if b, err = f.encode(b); err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+	writeTiming(w, tm)
+	writeWarnings(w, warnings)
+	writeModulePixels(w, spec)
+	recordGeneration(r, f.name, spec, stored)
+	w.Header().Set("X-QR-Id", id)
+	w.Header().Set("Content-Type", f.contentType)
+	w.Write(b)
 }
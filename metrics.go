@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// requestMetrics counts requests per route, method and status, in the
+// Prometheus text format served from /metrics.
+type requestMetrics struct {
+	mu       sync.Mutex
+	counts   map[metricKey]uint64
+	duration map[metricKey]float64
+}
+
+type metricKey struct {
+	route, method, code string
+}
+
+var metrics = &requestMetrics{
+	counts:   make(map[metricKey]uint64),
+	duration: make(map[metricKey]float64),
+}
+
+// statusRecorder captures the status code and body size written by a
+// handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the recorder.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// routeName returns the route template matched for r, so ids in the path
+// do not explode the metric cardinality.
+func routeName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unmatched"
+}
+
+func (m *requestMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		elapsed := time.Since(start)
+		route := routeName(r)
+		key := metricKey{route: route, method: r.Method, code: strconv.Itoa(rec.status)}
+		m.mu.Lock()
+		m.counts[key]++
+		m.duration[key] += elapsed.Seconds()
+		m.mu.Unlock()
+		slo.observe(route, rec.status, elapsed)
+	})
+}
+
+func (m *requestMetrics) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	keys := make([]metricKey, 0, len(m.counts))
+	for k := range m.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP qr_http_requests_total HTTP requests served.")
+	fmt.Fprintln(w, "# TYPE qr_http_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "qr_http_requests_total{route=%q,method=%q,code=%q} %d\n", k.route, k.method, k.code, m.counts[k])
+	}
+	fmt.Fprintln(w, "# HELP qr_http_request_duration_seconds_total Time spent serving HTTP requests.")
+	fmt.Fprintln(w, "# TYPE qr_http_request_duration_seconds_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "qr_http_request_duration_seconds_total{route=%q,method=%q,code=%q} %g\n", k.route, k.method, k.code, m.duration[k])
+	}
+	m.mu.Unlock()
+
+	slo.writePrometheus(w)
+	writeBreakerMetrics(w)
+	writeReplicationMetrics(w)
+	rendered.writeMetrics(w)
+}
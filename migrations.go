@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Each store records the schema version it is at, and the migrations past
+// it are applied in order when the store is opened. A migration is never
+// edited once released; a change to the schema is a new one at the end.
+
+type linkMigration struct {
+	version int
+	name    string
+	up      func(tx *bolt.Tx) error
+}
+
+// linkMigrations build the link database: links by slug, and the hits and
+// tracked scans of each link in buckets of their own.
+var linkMigrations = []linkMigration{
+	{1, "create links and hits buckets", func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(linksBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(hitsBucket)
+		return err
+	}},
+	{2, "create scans bucket for conversions", func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(scansBucket)
+		return err
+	}},
+}
+
+type dataMigration struct {
+	version int
+	name    string
+	up      func(st storage) error
+}
+
+// dataMigrations lay out the data store, where specs, renders, templates,
+// failures and usage are kept as files under their own prefixes.
+var dataMigrations = []dataMigration{
+	{1, "baseline of specs, renders, templates, failures and usage", func(storage) error { return nil }},
+}
+
+var (
+	metaBucket    = []byte("meta")
+	schemaKey     = []byte("schema_version")
+	dataSchemaKey = "schema/version"
+)
+
+// autoMigrate applies pending migrations at startup. QR_MIGRATIONS=manual
+// turns it off, so the server refuses to start on an old schema until it
+// is run with --migrate-only.
+var autoMigrate = true
+
+func loadMigrationMode() bool {
+	switch mode := os.Getenv("QR_MIGRATIONS"); mode {
+	case "", "auto":
+		return true
+	case "manual":
+		return false
+	default:
+		log.Fatalf("Invalid QR_MIGRATIONS=%q: expected auto or manual", mode)
+		return false
+	}
+}
+
+// checkSchema reports the migrations still to apply to a store at version
+// current, of the latest available.
+func checkSchema(store string, current, latest, pending int) error {
+	if current > latest {
+		return fmt.Errorf("%s schema is at version %d, newer than this build knows (%d)", store, current, latest)
+	}
+	if pending > 0 && !autoMigrate {
+		return fmt.Errorf("%s schema is at version %d, %d behind this build (run with --migrate-only)", store, current, pending)
+	}
+	return nil
+}
+
+// migrateLinkDB brings the link database up to date, one transaction per
+// migration so a failure leaves it at the last version that applied.
+func migrateLinkDB(db *bolt.DB) error {
+	var current int
+	err := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(metaBucket); b != nil {
+			var err error
+			current, err = parseSchemaVersion(b.Get(schemaKey))
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var pending []linkMigration
+	for _, m := range linkMigrations {
+		if m.version > current {
+			pending = append(pending, m)
+		}
+	}
+	if err := checkSchema("link database", current, len(linkMigrations), len(pending)); err != nil {
+		return err
+	}
+	for _, m := range pending {
+		m := m
+		err := db.Update(func(tx *bolt.Tx) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			b, err := tx.CreateBucketIfNotExists(metaBucket)
+			if err != nil {
+				return err
+			}
+			return b.Put(schemaKey, []byte(strconv.Itoa(m.version)))
+		})
+		if err != nil {
+			return fmt.Errorf("link database migration %d (%s): %w", m.version, m.name, err)
+		}
+		log.Printf("Applied link database migration %d: %s", m.version, m.name)
+	}
+	return nil
+}
+
+// migrateDataStore brings the data store up to date. The version is
+// written after each migration, so one that fails is retried on the next
+// start and must be safe to run again.
+func migrateDataStore(st storage) error {
+	b, err := st.Get(dataSchemaKey)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	current, err := parseSchemaVersion(b)
+	if err != nil {
+		return err
+	}
+
+	var pending []dataMigration
+	for _, m := range dataMigrations {
+		if m.version > current {
+			pending = append(pending, m)
+		}
+	}
+	if err := checkSchema("data store", current, len(dataMigrations), len(pending)); err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if err := m.up(st); err != nil {
+			return fmt.Errorf("data store migration %d (%s): %w", m.version, m.name, err)
+		}
+		if err := st.Put(dataSchemaKey, []byte(strconv.Itoa(m.version))); err != nil {
+			return err
+		}
+		log.Printf("Applied data store migration %d: %s", m.version, m.name)
+	}
+	return nil
+}
+
+// parseSchemaVersion reads a stored version, 0 for a store from before
+// versions were recorded.
+func parseSchemaVersion(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid schema version %q", b)
+	}
+	return n, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// GET /qrcode/pair renders a code twice, for apps that switch between a
+// light and a dark theme. The light rendition is what /qrcode would return
+// for the same parameters. The dark one keeps dark modules, since codes
+// with light modules on a dark background are refused (see
+// checkModuleContrast), but dims the background and puts the label on a
+// dark strip so it does not glare on a dark page. dark_theme picks a theme
+// for it instead, and dark_fg, dark_bg, dark_label_background and
+// dark_label_color override single colours.
+var darkRendition = colorTheme{
+	Background:      "#d4d4d8",
+	LabelBackground: "#18181b",
+	LabelColor:      "#f4f4f5",
+}
+
+type pairVariant struct {
+	ID          string `json:"id"`
+	URL         string `json:"url"`
+	DownloadURL string `json:"download_url"`
+}
+
+type pairResponse struct {
+	Light pairVariant `json:"light"`
+	Dark  pairVariant `json:"dark"`
+}
+
+// darkSpec derives the dark rendition of spec from the request's dark_*
+// parameters.
+func darkSpec(t *tenant, r *http.Request, spec renderSpec) (renderSpec, error) {
+	th := darkRendition
+	th.Foreground = spec.Foreground
+	if th.Foreground == "" {
+		th.Foreground = "#000000"
+	}
+	if name := r.FormValue("dark_theme"); name != "" {
+		var ok bool
+		if th, ok = t.theme(name); !ok {
+			return spec, badRequest("Unknown theme " + name)
+		}
+	}
+	for _, p := range []struct {
+		name  string
+		field *string
+	}{
+		{"dark_fg", &th.Foreground},
+		{"dark_bg", &th.Background},
+		{"dark_label_background", &th.LabelBackground},
+		{"dark_label_color", &th.LabelColor},
+	} {
+		if v := r.FormValue(p.name); v != "" {
+			if _, err := parseHexColor(v); err != nil {
+				return spec, badRequest(fmt.Sprintf("Invalid '%s' parameter (must be a hex color)", p.name))
+			}
+			*p.field = v
+		}
+	}
+	if err := th.validate(); err != nil {
+		return spec, badRequest("Dark rendition is not scannable: " + err.Error())
+	}
+
+	// Record the colours the rendition changes as the request's own, so a
+	// restyle of the template keeps it dark. Those it leaves alone still
+	// follow the template.
+	dark := th.apply(spec)
+	params := make(url.Values, len(spec.params)+4)
+	for k, v := range spec.params {
+		params[k] = v
+	}
+	for _, p := range []struct {
+		name, value string
+		changed     bool
+	}{
+		{"fg", th.Foreground, dark.Foreground != spec.Foreground},
+		{"bg", th.Background, dark.Background != spec.Background},
+		{"label_background", th.LabelBackground, dark.LabelBackground != spec.LabelBackground},
+		{"label_color", th.LabelColor, dark.LabelColor != spec.LabelColor},
+	} {
+		if p.changed {
+			params.Set(p.name, p.value)
+		}
+	}
+	dark.params = params
+	return dark, nil
+}
+
+// pairQRCode renders and stores both renditions. By default it answers
+// with their ids and image URLs as JSON; output=zip returns the two PNGs
+// instead.
+func pairQRCode(w http.ResponseWriter, r *http.Request) {
+	output := r.FormValue("output")
+	if output != "" && output != "json" && output != "zip" {
+		http.Error(w, "Invalid 'output' parameter (must be json or zip)", http.StatusBadRequest)
+		return
+	}
+
+	light, err := specFromRequest(r)
+	var dark renderSpec
+	if err == nil {
+		dark, err = darkSpec(tenantFrom(r.Context()), r, light)
+	}
+	if err == nil {
+		light, err = applyQuota(w, r, light)
+	}
+	if err == nil {
+		dark, err = applyQuota(w, r, dark)
+	}
+	if err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+
+	tm := requestTimer()
+	var ids [2]string
+	var images [2][]byte
+	for i, spec := range []renderSpec{light, dark} {
+		id, b, cached, warnings, err := renderStored(spec, tm, interactive)
+		if err != nil {
+			failGeneration(w, r, err)
+			return
+		}
+		writeWarnings(w, warnings)
+		recordGeneration(r, "png", spec, storedBytes(b, cached))
+		ids[i], images[i] = id, b
+	}
+	writeTiming(w, tm)
+
+	if output == "zip" {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for i, variant := range []string{"light", "dark"} {
+			if err := writeZipFile(zw, "SmartQR-"+ids[i]+"-"+variant+".png", images[i]); err != nil {
+				writeError(w, internalError("Failed to write ZIP", err))
+				return
+			}
+		}
+		if err := zw.Close(); err != nil {
+			writeError(w, internalError("Failed to write ZIP", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", "attachment; filename=SmartQR-"+ids[0]+"-pair.zip")
+		w.Write(buf.Bytes())
+		return
+	}
+
+	base := publicBaseURL(r) + "/qrcodes/"
+	variant := func(id string) pairVariant {
+		return pairVariant{id, base + id + ".png", base + id + "/download"}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pairResponse{variant(ids[0]), variant(ids[1])})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	defaultPatternOpacity = 0.12
+	maxPatternOpacity     = 0.5
+	patternTileSize       = 24
+	brandTileSize         = 128
+	brandTileLogoSize     = 64
+)
+
+// Default pattern color, matching the label banner.
+var defaultPatternColor = color.RGBA{R: 1, G: 124, B: 254, A: 255}
+
+var patternNames = []string{"dots", "diagonal", "brand"}
+
+func isPattern(name string) bool {
+	for _, n := range patternNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// patternTile builds a single seamless tile of the named pattern in color c.
+// The "brand" pattern tiles a small copy of the logo instead.
+func patternTile(name string, c color.Color, logo image.Image) (image.Image, error) {
+	switch name {
+	case "dots":
+		tile := image.NewNRGBA(image.Rect(0, 0, patternTileSize, patternTileSize))
+		center := patternTileSize / 2
+		radius := 4
+		for y := 0; y < patternTileSize; y++ {
+			for x := 0; x < patternTileSize; x++ {
+				dx, dy := x-center, y-center
+				if dx*dx+dy*dy <= radius*radius {
+					tile.Set(x, y, c)
+				}
+			}
+		}
+		return tile, nil
+	case "diagonal":
+		tile := image.NewNRGBA(image.Rect(0, 0, patternTileSize, patternTileSize))
+		for y := 0; y < patternTileSize; y++ {
+			for x := 0; x < patternTileSize; x++ {
+				if (x+y)%(patternTileSize/2) < 2 {
+					tile.Set(x, y, c)
+				}
+			}
+		}
+		return tile, nil
+	case "brand":
+		if logo == nil {
+			return nil, fmt.Errorf("pattern %q needs a logo", name)
+		}
+		tile := image.NewNRGBA(image.Rect(0, 0, brandTileSize, brandTileSize))
+		small := imaging.Fit(logo, brandTileLogoSize, brandTileLogoSize, imaging.Lanczos)
+		pos := image.Pt((brandTileSize-small.Bounds().Dx())/2, (brandTileSize-small.Bounds().Dy())/2)
+		draw.Draw(tile, small.Bounds().Add(pos), small, image.Point{}, draw.Over)
+		return tile, nil
+	}
+	return nil, fmt.Errorf("unknown pattern %q", name)
+}
+
+// checkPatternContrast rejects patterns whose darkest point, blended over
+// the background bg at the given opacity, is too close to the module color.
+func checkPatternContrast(tile image.Image, opacity float64, fg, bg color.Color) error {
+	b := tile.Bounds()
+	blended := imaging.Overlay(imaging.New(b.Dx(), b.Dy(), bg), tile, image.Point{}, opacity)
+	ratio := contrastRatio(darkestPixel(blended), fg)
+	if ratio < minContrastRatio {
+		return fmt.Errorf("pattern contrast ratio %.2f is below the minimum of %.1f", ratio, minContrastRatio)
+	}
+	return nil
+}
+
+// applyPattern tiles the pattern over a canvas of the background colour at
+// low opacity and draws the QR modules on top. qrImg must have a
+// transparent background.
+func applyPattern(qrImg image.Image, tile image.Image, opacity float64, bg color.Color) *image.NRGBA {
+	b := qrImg.Bounds()
+	layer := image.NewNRGBA(b)
+	tb := tile.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y += tb.Dy() {
+		for x := b.Min.X; x < b.Max.X; x += tb.Dx() {
+			draw.Draw(layer, tb.Add(image.Pt(x, y)), tile, tb.Min, draw.Src)
+		}
+	}
+
+	canvas := imaging.Overlay(imaging.New(b.Dx(), b.Dy(), bg), layer, image.Point{}, opacity)
+	draw.Draw(canvas, canvas.Bounds(), qrImg, b.Min, draw.Over)
+	return canvas
+}
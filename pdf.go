@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// pageSize is a PDF page in millimetres.
+type pageSize struct {
+	width, height float64
+}
+
+var pageSizes = map[string]pageSize{
+	"a4":     {210, 297},
+	"letter": {215.9, 279.4},
+}
+
+const (
+	defaultPageMargin = 10.0
+	maxPageSide       = 1200.0
+	maxPDFCopies      = 500
+)
+
+// pdfLayout places copies of a code on pages: codes of codeWidth
+// millimetres, 0 to fill the page, in a grid with margin around the page
+// and between codes.
+type pdfLayout struct {
+	page      pageSize
+	margin    float64
+	codeWidth float64
+	copies    int
+}
+
+// pdfLayoutFromRequest reads 'page' (a4, letter or WIDTHxHEIGHT in mm),
+// 'margin' and 'code_width' in millimetres, and 'copies'.
+func pdfLayoutFromRequest(r *http.Request) (pdfLayout, error) {
+	l := pdfLayout{page: pageSizes["a4"], margin: defaultPageMargin, copies: 1}
+	if v := strings.ToLower(r.FormValue("page")); v != "" {
+		page, ok := pageSizes[v]
+		if !ok {
+			w, h, found := strings.Cut(v, "x")
+			pw, werr := strconv.ParseFloat(w, 64)
+			ph, herr := strconv.ParseFloat(h, 64)
+			if !found || werr != nil || herr != nil || pw <= 0 || ph <= 0 || pw > maxPageSide || ph > maxPageSide {
+				return l, badRequest(fmt.Sprintf("Invalid 'page' parameter (must be a4, letter or WIDTHxHEIGHT in mm up to %g)", maxPageSide))
+			}
+			page = pageSize{pw, ph}
+		}
+		l.page = page
+	}
+	if v := r.FormValue("margin"); v != "" {
+		m, err := strconv.ParseFloat(v, 64)
+		if err != nil || m < 0 {
+			return l, badRequest("Invalid 'margin' parameter (must be a non-negative number of mm)")
+		}
+		l.margin = m
+	}
+	if v := r.FormValue("code_width"); v != "" {
+		w, err := strconv.ParseFloat(v, 64)
+		if err != nil || w <= 0 {
+			return l, badRequest("Invalid 'code_width' parameter (must be a positive number of mm)")
+		}
+		l.codeWidth = w
+	}
+	if v := r.FormValue("copies"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPDFCopies {
+			return l, badRequest(fmt.Sprintf("Invalid 'copies' parameter (must be 1 to %d)", maxPDFCopies))
+		}
+		l.copies = n
+	}
+	return l, nil
+}
+
+// renderPDF lays out copies of the PNG in b as l describes, starting new
+// pages as they fill.
+func renderPDF(b []byte, l pdfLayout) ([]byte, error) {
+	pdf := gofpdf.NewCustom(&gofpdf.InitType{
+		UnitStr: "mm",
+		Size:    gofpdf.SizeType{Wd: l.page.width, Ht: l.page.height},
+	})
+	pdf.SetAutoPageBreak(false, 0)
+	opts := gofpdf.ImageOptions{ImageType: "PNG"}
+	info := pdf.RegisterImageOptionsReader("code", opts, bytes.NewReader(b))
+	if err := pdf.Error(); err != nil {
+		return nil, internalError("Failed to embed QR code image", err)
+	}
+
+	// Fit the code to the printable area unless a width is given
+	aspect := info.Height() / info.Width()
+	areaW, areaH := l.page.width-2*l.margin, l.page.height-2*l.margin
+	w := l.codeWidth
+	if w == 0 {
+		w = areaW
+		if w*aspect > areaH {
+			w = areaH / aspect
+		}
+	}
+	h := w * aspect
+	cols := int((areaW + l.margin) / (w + l.margin))
+	rows := int((areaH + l.margin) / (h + l.margin))
+	if w > areaW || h > areaH || cols < 1 || rows < 1 {
+		return nil, badRequest(fmt.Sprintf("A %.1f x %.1f mm code does not fit the page inside its margins", w, h))
+	}
+
+	for i := 0; i < l.copies; i++ {
+		k := i % (cols * rows)
+		if k == 0 {
+			pdf.AddPage()
+		}
+		x := l.margin + float64(k%cols)*(w+l.margin)
+		y := l.margin + float64(k/cols)*(h+l.margin)
+		pdf.ImageOptions("code", x, y, w, h, false, opts, 0, "")
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, internalError("Failed to write PDF", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// servePDF responds with spec's PNG render placed on PDF pages.
+func servePDF(w http.ResponseWriter, r *http.Request, spec renderSpec) {
+	layout, err := pdfLayoutFromRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	tm := requestTimer()
+	id, b, cached, warnings, err := renderStored(spec, tm, interactive)
+	if err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+	done := tm.start("pdf")
+	doc, err := renderPDF(b, layout)
+	done()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeTiming(w, tm)
+	writeWarnings(w, warnings)
+	recordGeneration(r, "pdf", spec, storedBytes(b, cached))
+	w.Header().Set("X-QR-Id", id)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", "inline; filename=SmartQR-"+id+".pdf")
+	w.Write(doc)
+}
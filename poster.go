@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"net/http"
+	"strings"
+)
+
+// POST /qrcode/poster lays several different codes out on one poster, for
+// flyers that point at an app in both stores and a website at once. The
+// body is JSON like a batch: "codes" are rows of /qrcode parameters on top
+// of "defaults", and each code's label is its caption. "title" adds a
+// heading above the codes, "columns" fixes the grid width, "gap" is the
+// space between and around codes in pixels, and "background" and
+// "title_color" colour the poster. format=pdf puts the poster on a page
+// instead of returning the PNG, with page, margin, code_width and copies
+// as for /qrcode.
+
+const (
+	maxPosterCodes   = 12
+	maxPosterColumns = 6
+	maxPosterSide    = 6000
+	defaultPosterGap = 40
+)
+
+type posterRequest struct {
+	Title      string              `json:"title"`
+	Columns    int                 `json:"columns"`
+	Gap        *int                `json:"gap"`
+	Background string              `json:"background"`
+	TitleColor string              `json:"title_color"`
+	Defaults   map[string]string   `json:"defaults"`
+	Codes      []map[string]string `json:"codes"`
+}
+
+// posterCodeError prefixes err's message with the position of the code it
+// is about.
+func posterCodeError(i int, err error) error {
+	he, ok := err.(*httpError)
+	if !ok {
+		return err
+	}
+	c := *he
+	c.msg = fmt.Sprintf("Code %d: %s", i+1, c.msg)
+	return &c
+}
+
+// posterColumns picks a grid as close to rows of four as the codes fill
+// evenly: three codes sit in one row, five in rows of three and two.
+func posterColumns(n int) int {
+	rows := (n + 3) / 4
+	return (n + rows - 1) / rows
+}
+
+// composePoster places the codes in a grid of equal cells, each centred
+// in its cell, under the title strip if there is one.
+func composePoster(codes []image.Image, title *image.RGBA, cols, gap int, bg image.Image) (image.Image, error) {
+	var cellW, cellH int
+	for _, img := range codes {
+		cellW = max(cellW, img.Bounds().Dx())
+		cellH = max(cellH, img.Bounds().Dy())
+	}
+	rows := (len(codes) + cols - 1) / cols
+	width := cols*cellW + (cols+1)*gap
+	top := gap
+	if title != nil {
+		top += title.Bounds().Dy() + gap
+	}
+	height := top + rows*cellH + rows*gap
+	if width > maxPosterSide || height > maxPosterSide {
+		return nil, tooLarge(fmt.Sprintf("Poster would be %dx%d pixels, maximum is %d on each side", width, height, maxPosterSide))
+	}
+
+	poster := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(poster, poster.Bounds(), bg, image.Point{}, draw.Src)
+	if title != nil {
+		tb := title.Bounds()
+		draw.Draw(poster, tb.Add(image.Pt((width-tb.Dx())/2, gap)), title, tb.Min, draw.Over)
+	}
+	for i, img := range codes {
+		b := img.Bounds()
+		x := gap + (i%cols)*(cellW+gap) + (cellW-b.Dx())/2
+		y := top + (i/cols)*(cellH+gap) + (cellH-b.Dy())/2
+		draw.Draw(poster, b.Sub(b.Min).Add(image.Pt(x, y)), img, b.Min, draw.Over)
+	}
+	return poster, nil
+}
+
+// posterTitle typesets the heading in the first code's font at twice its
+// label size, across the width the codes take up.
+func posterTitle(text string, spec renderSpec, width int, bg, fg string) (*image.RGBA, error) {
+	font, err := loadFont(spec.FontFile)
+	if err != nil {
+		return nil, err
+	}
+	spec.Label = text
+	spec.LabelFontSize *= 2
+	spec.LabelHeight *= 2
+	spec.LabelBackground, spec.LabelColor = bg, fg
+	spec.LabelOutline, spec.LabelShadow = "", ""
+	return rasterizeLabel(spec, font, width)
+}
+
+func posterHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "png" && format != "pdf" {
+		http.Error(w, "Invalid 'format' parameter (must be png or pdf)", http.StatusBadRequest)
+		return
+	}
+
+	var req posterRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, serverLimits.MaxBodyBytes)).Decode(&req); err != nil {
+		writeError(w, bodyError(err, "Invalid poster JSON"))
+		return
+	}
+	// The page parameters come from the query; they are read after the body
+	// so FormValue does not take it for a form.
+	var layout pdfLayout
+	if format == "pdf" {
+		var err error
+		if layout, err = pdfLayoutFromRequest(r); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if len(req.Codes) == 0 {
+		writeError(w, classified(badRequest("Missing 'codes'"), classMissingParam))
+		return
+	}
+	if len(req.Codes) > maxPosterCodes {
+		writeError(w, tooLarge(fmt.Sprintf("Poster has %d codes, maximum is %d", len(req.Codes), maxPosterCodes)))
+		return
+	}
+	cols := req.Columns
+	if cols == 0 {
+		cols = posterColumns(len(req.Codes))
+	}
+	if cols < 1 || cols > maxPosterColumns {
+		writeError(w, badRequest(fmt.Sprintf("Invalid 'columns' (must be 1 to %d)", maxPosterColumns)))
+		return
+	}
+	cols = min(cols, len(req.Codes))
+	gap := defaultPosterGap
+	if req.Gap != nil {
+		gap = *req.Gap
+	}
+	if gap < 0 {
+		writeError(w, badRequest("Invalid 'gap' (must be a non-negative number of pixels)"))
+		return
+	}
+	if req.Background == "" {
+		req.Background = "#ffffff"
+	}
+	if req.TitleColor == "" {
+		req.TitleColor = "#000000"
+	}
+	bg, err := parseHexColor(req.Background)
+	if err != nil {
+		writeError(w, badRequest("Invalid 'background' (must be a hex color)"))
+		return
+	}
+	if _, err := parseHexColor(req.TitleColor); err != nil {
+		writeError(w, badRequest("Invalid 'title_color' (must be a hex color)"))
+		return
+	}
+
+	t := tenantFrom(r.Context())
+	base := publicBaseURL(r)
+	specs := make([]renderSpec, len(req.Codes))
+	for i, row := range req.Codes {
+		merged := make(map[string]string, len(req.Defaults)+len(row))
+		for k, v := range req.Defaults {
+			merged[k] = v
+		}
+		for k, v := range row {
+			merged[k] = v
+		}
+		spec, action, err := batchRowSpec(t, base, merged)
+		if err != nil {
+			failGeneration(w, r, posterCodeError(i, err))
+			return
+		}
+		if action != "" {
+			w.Header().Set("X-Quota-Exceeded", action)
+		}
+		specs[i] = spec
+	}
+
+	tm := requestTimer()
+	ids := make([]string, len(specs))
+	codes := make([]image.Image, len(specs))
+	for i, spec := range specs {
+		id, b, cached, warnings, err := renderStored(spec, tm, interactive)
+		if err != nil {
+			failGeneration(w, r, posterCodeError(i, err))
+			return
+		}
+		if codes[i], _, err = image.Decode(bytes.NewReader(b)); err != nil {
+			writeError(w, internalError("Failed to decode QR code image", err))
+			return
+		}
+		writeWarnings(w, warnings)
+		recordGeneration(r, "poster", spec, storedBytes(b, cached))
+		ids[i] = id
+	}
+
+	done := tm.start("poster")
+	var title *image.RGBA
+	if req.Title != "" {
+		var cellW int
+		for _, img := range codes {
+			cellW = max(cellW, img.Bounds().Dx())
+		}
+		title, err = posterTitle(req.Title, specs[0], cols*cellW+(cols-1)*gap, req.Background, req.TitleColor)
+	}
+	var poster image.Image
+	if err == nil {
+		poster, err = composePoster(codes, title, cols, gap, image.NewUniform(bg))
+	}
+	var b []byte
+	if err == nil {
+		if b, err = encodePNG(poster); err != nil {
+			err = internalError("Failed to encode poster", err)
+		}
+	}
+	if err == nil && format == "pdf" {
+		b, err = renderPDF(b, layout)
+	}
+	done()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeTiming(w, tm)
+	w.Header().Set("X-QR-Ids", strings.Join(ids, ","))
+	if format == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", "inline; filename=SmartQR-poster.pdf")
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+	}
+	w.Write(b)
+}
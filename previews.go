@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Preview tokens let a design under review be shared before it is saved.
+// POST /previews takes the /qrcode parameters and returns a token that
+// renders the design at /previews/{token} for QR_PREVIEW_TTL_SECONDS.
+// Neither the spec nor the image is stored: tokens live in memory and
+// every GET renders afresh.
+
+// maxPreviews caps the tokens held at once.
+const maxPreviews = 10000
+
+type preview struct {
+	spec    renderSpec
+	tenant  *tenant
+	expires time.Time
+}
+
+type previewStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	previews map[string]preview
+}
+
+var previews *previewStore
+
+func newPreviewStore(ttl time.Duration) *previewStore {
+	return &previewStore{ttl: ttl, previews: make(map[string]preview)}
+}
+
+func (s *previewStore) create(spec renderSpec, t *tenant) (string, time.Time, error) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(now)
+	if len(s.previews) >= maxPreviews {
+		return "", time.Time{}, &httpError{status: http.StatusServiceUnavailable, class: classLimit, msg: "Too many previews open, try again in a few minutes"}
+	}
+	p := preview{spec: spec, tenant: t, expires: now.Add(s.ttl)}
+	s.previews[token] = p
+	return token, p.expires, nil
+}
+
+func (s *previewStore) get(token string) (preview, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.previews[token]
+	if !ok || time.Now().After(p.expires) {
+		return preview{}, false
+	}
+	return p, true
+}
+
+// prune drops expired previews. The caller holds s.mu.
+func (s *previewStore) prune(now time.Time) {
+	for token, p := range s.previews {
+		if now.After(p.expires) {
+			delete(s.previews, token)
+		}
+	}
+}
+
+type previewResponse struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// createPreview checks a design as /qrcode would and hands out a token for
+// it. Logos must already be uploaded or fetched; a preview does not take
+// one in the request.
+func createPreview(w http.ResponseWriter, r *http.Request) {
+	spec, err := specFromRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkSpec(spec); err != nil {
+		writeError(w, err)
+		return
+	}
+	t := tenantFrom(r.Context())
+	token, expires, err := previews.create(spec, t)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(previewResponse{token, publicBaseURL(r) + "/previews/" + token, expires.UTC()})
+}
+
+// getPreview renders the design of a preview token. Anyone with the token
+// can view it until it expires; renders count towards the usage of the
+// tenant that created it.
+func getPreview(w http.ResponseWriter, r *http.Request) {
+	p, ok := previews.get(mux.Vars(r)["token"])
+	if !ok {
+		http.Error(w, "Preview not found or expired", http.StatusNotFound)
+		return
+	}
+	spec, _, err := quotaSpec(p.tenant, p.spec)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	tm := requestTimer()
+	release := interactive.acquire(tm)
+	img, warnings, err := render(spec, tm)
+	var b []byte
+	if err == nil {
+		if b, err = encodePNG(img); err != nil {
+			err = internalError("Failed to encode QR code image", err)
+		}
+	}
+	release()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	recordUsage(p.tenant, "preview", spec, 0)
+
+	writeTiming(w, tm)
+	writeWarnings(w, warnings)
+	remaining := int(time.Until(p.expires).Seconds())
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(remaining))
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(b)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// The 10:1 rule of thumb: a code can be scanned from about ten times its
+// width away. It holds for codes of about 25 modules, version 2, so denser
+// codes need proportionally larger prints to keep each module as wide.
+const (
+	scanDistanceRatio     = 10.0
+	scanDistanceReference = 25
+)
+
+// printSize is the smallest a code should be printed to be read from
+// ScanDistanceMM away. Sizes are of the code with its quiet zone, not
+// counting the label.
+type printSize struct {
+	ScanDistanceMM float64 `json:"scan_distance_mm"`
+	SymbolModules  int     `json:"symbol_modules"`
+	QuietZone      int     `json:"quiet_zone_modules"`
+	ModuleMM       float64 `json:"min_module_mm"`
+	CodeMM         float64 `json:"min_code_mm"`
+	CodeInches     float64 `json:"min_code_inches"`
+}
+
+var scanDistancePattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)(mm|cm|m|in|ft)$`)
+
+var millimetresPer = map[string]float64{"mm": 1, "cm": 10, "m": 1000, "in": 25.4, "ft": 304.8}
+
+// parseScanDistance reads a distance such as 30cm, 2m or 4ft in
+// millimetres.
+func parseScanDistance(v string) (float64, error) {
+	m := scanDistancePattern.FindStringSubmatch(v)
+	if m == nil {
+		return 0, badRequest("Invalid 'scan_distance' parameter (a positive length in mm, cm, m, in or ft, such as 30cm)")
+	}
+	n, _ := strconv.ParseFloat(m[1], 64)
+	if n <= 0 {
+		return 0, badRequest("Invalid 'scan_distance' parameter (a positive length in mm, cm, m, in or ft, such as 30cm)")
+	}
+	return n * millimetresPer[m[2]], nil
+}
+
+// recommendPrintSize applies the 10:1 rule to spec read from distance
+// millimetres away.
+func recommendPrintSize(spec renderSpec, distance float64) (*printSize, error) {
+	level, ok := recoveryLevels[spec.RecoveryLevel]
+	if !ok {
+		return nil, badRequest("Unknown recovery level " + spec.RecoveryLevel)
+	}
+	qr, err := qrcode.New(spec.Data, level)
+	if err != nil {
+		return nil, classified(badRequest("Data is too long to encode at recovery level "+spec.RecoveryLevel), classCapacity)
+	}
+	symbol := len(qr.Bitmap()) - 2*quietZoneModules
+	module := distance / scanDistanceRatio / scanDistanceReference
+	code := module * float64(symbol+2*spec.quietZone())
+	return &printSize{
+		ScanDistanceMM: distance,
+		SymbolModules:  symbol,
+		QuietZone:      spec.quietZone(),
+		ModuleMM:       roundTo(module, 100),
+		CodeMM:         roundTo(code, 10),
+		CodeInches:     roundTo(code/millimetresPer["in"], 100),
+	}, nil
+}
+
+func roundTo(v, per float64) float64 {
+	return math.Ceil(v*per) / per
+}
+
+// printSizeFrom reads 'scan_distance' and recommends a print size for
+// spec, or returns nil without the parameter.
+func printSizeFrom(r *http.Request, spec renderSpec) (*printSize, error) {
+	v := r.FormValue("scan_distance")
+	if v == "" {
+		return nil, nil
+	}
+	distance, err := parseScanDistance(v)
+	if err != nil {
+		return nil, err
+	}
+	return recommendPrintSize(spec, distance)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// proxyRule routes outbound requests for matching hosts through proxy, or
+// directly when proxy is nil. A host of ".example.com" or "*.example.com"
+// matches example.com and every name under it.
+type proxyRule struct {
+	host  string
+	proxy *url.URL
+}
+
+func (r proxyRule) matches(host string) bool {
+	if suffix, ok := strings.CutPrefix(r.host, "."); ok {
+		return host == suffix || strings.HasSuffix(host, r.host)
+	}
+	return host == r.host
+}
+
+// proxyRules are the per-destination rules from QR_PROXY_RULES. Hosts they
+// do not cover follow HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+var proxyRules []proxyRule
+
+// loadProxyRules parses QR_PROXY_RULES, a comma separated list of
+// host=proxy entries tried in order, where proxy is a proxy URL or
+// "direct".
+func loadProxyRules() ([]proxyRule, error) {
+	var rules []proxyRule
+	for _, s := range envList("QR_PROXY_RULES", nil) {
+		host, target, ok := strings.Cut(s, "=")
+		host = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(host), "*"))
+		if !ok || host == "" || host == "." {
+			return nil, fmt.Errorf("invalid QR_PROXY_RULES entry %q: expected host=proxy", s)
+		}
+		rule := proxyRule{host: host}
+		if target = strings.TrimSpace(target); target != "direct" {
+			u, err := url.Parse(target)
+			if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+				return nil, fmt.Errorf("invalid QR_PROXY_RULES entry %q: proxy must be an http, https or socks5 URL, or direct", s)
+			}
+			rule.proxy = u
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// outboundProxy picks the proxy for an outbound request: the first rule
+// matching its host, else the environment.
+func outboundProxy(req *http.Request) (*url.URL, error) {
+	host := strings.ToLower(req.URL.Hostname())
+	for _, r := range proxyRules {
+		if r.matches(host) {
+			return r.proxy, nil
+		}
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// proxyAddrs returns the host:port of every proxy outbound requests may go
+// through, as the transport dials them.
+func proxyAddrs() map[string]bool {
+	urls := make([]string, 0, len(proxyRules)+4)
+	for _, r := range proxyRules {
+		if r.proxy != nil {
+			urls = append(urls, r.proxy.String())
+		}
+	}
+	for _, key := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+		if v := os.Getenv(key); v != "" {
+			urls = append(urls, v)
+		}
+	}
+
+	addrs := make(map[string]bool)
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			// ProxyFromEnvironment also accepts a bare host[:port]
+			if u, err = url.Parse("http://" + raw); err != nil {
+				continue
+			}
+		}
+		port := u.Port()
+		if port == "" {
+			port = map[string]string{"http": "80", "https": "443", "socks5": "1080"}[u.Scheme]
+		}
+		addrs[net.JoinHostPort(u.Hostname(), port)] = true
+	}
+	return addrs
+}
+
+// outboundTransport is the transport for calls to services we are
+// configured with, such as scanners and alarm hooks, routed by
+// outboundProxy.
+func outboundTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = outboundProxy
+	return t
+}
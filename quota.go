@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// What happens to a tenant's requests once its monthly quota is used up.
+const (
+	quotaReject    = "reject"
+	quotaWatermark = "watermark"
+	quotaDownscale = "downscale"
+)
+
+const (
+	quotaWatermarkText   = "generated with free tier"
+	defaultDownscaleSize = 256
+)
+
+// quota caps a tenant's generations per calendar month (UTC). OnExceed
+// picks between refusing with 429, watermarking the image, or rendering
+// it at DownscaleSize.
+type quota struct {
+	Monthly       int    `json:"monthly"`
+	OnExceed      string `json:"on_exceed"`
+	DownscaleSize int    `json:"downscale_size,omitempty"`
+}
+
+func (q *quota) validate() error {
+	if q.Monthly <= 0 {
+		return fmt.Errorf("quota monthly must be positive")
+	}
+	switch q.OnExceed {
+	case "":
+		q.OnExceed = quotaReject
+	case quotaReject, quotaWatermark:
+	case quotaDownscale:
+		if q.DownscaleSize == 0 {
+			q.DownscaleSize = defaultDownscaleSize
+		}
+		if q.DownscaleSize < minSize {
+			return fmt.Errorf("quota downscale_size must be at least %d", minSize)
+		}
+	default:
+		return fmt.Errorf("unknown quota on_exceed %q", q.OnExceed)
+	}
+	return nil
+}
+
+// applyQuota adjusts spec for a tenant over its quota, or refuses the
+// request when the quota is hard. Softened responses carry an
+// X-Quota-Exceeded header naming what was done.
+func applyQuota(w http.ResponseWriter, r *http.Request, spec renderSpec) (renderSpec, error) {
+	spec, action, err := quotaSpec(tenantFrom(r.Context()), spec)
+	if action != "" {
+		w.Header().Set("X-Quota-Exceeded", action)
+	}
+	return spec, err
+}
+
+// quotaSpec applies t's over-quota behaviour to spec. action is the
+// on_exceed mode applied, or empty while t is within its quota.
+func quotaSpec(t *tenant, spec renderSpec) (renderSpec, string, error) {
+	if t == nil || t.Quota == nil {
+		return spec, "", nil
+	}
+
+	rec, err := usage.Get(t.ID, usageMonth(time.Now()))
+	if err != nil {
+		return spec, "", internalError("Failed to read usage", err)
+	}
+	if rec.Generations < t.Quota.Monthly {
+		return spec, "", nil
+	}
+
+	switch t.Quota.OnExceed {
+	case quotaWatermark:
+		spec.Watermark = quotaWatermarkText
+	case quotaDownscale:
+		if spec.Size > t.Quota.DownscaleSize {
+			spec = spec.scaled(t.Quota.DownscaleSize)
+		}
+	default:
+		return spec, "", &httpError{status: http.StatusTooManyRequests, class: classQuota, msg: fmt.Sprintf("Monthly quota of %d generations exceeded", t.Quota.Monthly)}
+	}
+	return spec, t.Quota.OnExceed, nil
+}
+
+// recordGeneration counts a successful generation against the request's
+// tenant.
+func recordGeneration(r *http.Request, format string, spec renderSpec, stored int) {
+	recordUsage(tenantFrom(r.Context()), format, spec, stored)
+}
+
+// recordUsage counts a successful generation against t, which may be nil.
+// stored is the size of the render if it was newly written to the render
+// store, or 0 for a cache hit.
+func recordUsage(t *tenant, format string, spec renderSpec, stored int) {
+	if t == nil {
+		return
+	}
+	err := usage.Update(t.ID, func(rec *usageRecord) {
+		rec.Generations++
+		if rec.ByFormatSize == nil {
+			rec.ByFormatSize = make(map[string]int)
+		}
+		rec.ByFormatSize[format+"/"+strconv.Itoa(spec.Size)]++
+		rec.StorageBytes += int64(stored)
+	})
+	if err != nil {
+		log.Printf("Failed to record usage for tenant %s: %v", t.ID, err)
+	}
+}
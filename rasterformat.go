@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// Renders are stored as PNG; a code asked for as JPEG or WebP is encoded
+// from the stored render, so each format shares one render and one id.
+
+// defaultJPEGQuality is the JPEG quality used when none is given. WebP is
+// written lossless, so it has no quality.
+const defaultJPEGQuality = 90
+
+// rasterFormat is an image format a rendered code can be served in.
+type rasterFormat struct {
+	name        string
+	contentType string
+	ext         string
+	quality     int
+}
+
+var pngFormat = rasterFormat{name: "png", contentType: "image/png", ext: ".png"}
+
+// rasterFormatFrom reads the 'format' and 'quality' parameters. quality
+// applies to JPEG only, as WebP is lossless. The vector formats, served by
+// their own handlers, give the zero rasterFormat.
+func rasterFormatFrom(r *http.Request) (f rasterFormat, err error) {
+	switch format := r.FormValue("format"); format {
+	case "", "png":
+		return pngFormat, nil
+	case "jpeg", "jpg":
+		f = rasterFormat{name: "jpeg", contentType: "image/jpeg", ext: ".jpg", quality: defaultJPEGQuality}
+	case "webp":
+		f = rasterFormat{name: "webp", contentType: "image/webp", ext: ".webp"}
+	case "svg", "pdf":
+		return rasterFormat{}, nil
+	default:
+		return rasterFormat{}, badRequest("Unsupported 'format' parameter (expected png, jpeg, webp, svg or pdf)")
+	}
+
+	if v := r.FormValue("quality"); v != "" {
+		if f.name == "webp" {
+			return rasterFormat{}, badRequest("Invalid 'quality' parameter (WebP is served lossless and takes no quality)")
+		}
+		q, err := strconv.Atoi(v)
+		if err != nil || q < 1 || q > 100 {
+			return rasterFormat{}, badRequest("Invalid 'quality' parameter (must be 1 to 100)")
+		}
+		f.quality = q
+	}
+	return f, nil
+}
+
+// encode converts a stored PNG render to f.
+func (f rasterFormat) encode(b []byte) ([]byte, error) {
+	if f.name == "png" {
+		return b, nil
+	}
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, internalError("Failed to decode stored render", err)
+	}
+
+	var buf bytes.Buffer
+	switch f.name {
+	case "jpeg":
+		err = jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: f.quality})
+	case "webp":
+		// WebP is written lossless, so the flat colours and sharp module
+		// edges scan exactly as in the PNG.
+		err = nativewebp.Encode(&buf, img, nil)
+	default:
+		err = fmt.Errorf("unknown raster format %q", f.name)
+	}
+	if err != nil {
+		return nil, internalError("Failed to encode "+f.name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// flatten composites img over white, as JPEG has no alpha channel.
+func flatten(img image.Image) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(out, b, img, b.Min, draw.Over)
+	return out
+}
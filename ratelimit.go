@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter gives each client a token bucket: Burst requests at once,
+// refilled at PerMinute a minute. Clients are told apart by their API key,
+// or by address for requests without one.
+type rateLimiter struct {
+	perMinute int
+	burst     int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// rateLimitSweep is how many clients are tracked before the idle ones,
+// whose buckets have refilled, are dropped.
+const rateLimitSweep = 10000
+
+// loadRateLimiter reads QR_RATE_LIMIT_PER_MINUTE, unset for no limit, and
+// QR_RATE_LIMIT_BURST, which defaults to the per minute rate.
+func loadRateLimiter() *rateLimiter {
+	perMinute := envInt("QR_RATE_LIMIT_PER_MINUTE", 0)
+	if perMinute == 0 {
+		return nil
+	}
+	return &rateLimiter{
+		perMinute: perMinute,
+		burst:     envInt("QR_RATE_LIMIT_BURST", perMinute),
+		buckets:   make(map[string]*tokenBucket),
+	}
+}
+
+// take spends a token of client's bucket. When there is none it returns
+// how long until there is.
+func (l *rateLimiter) take(client string, now time.Time) (bool, time.Duration) {
+	rate := float64(l.perMinute) / float64(time.Minute)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[client]
+	if b == nil {
+		if len(l.buckets) >= rateLimitSweep {
+			l.sweep(now, rate)
+		}
+		b = &tokenBucket{tokens: float64(l.burst), at: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(l.burst), b.tokens+float64(now.Sub(b.at))*rate)
+	b.at = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate)
+}
+
+func (l *rateLimiter) sweep(now time.Time, rate float64) {
+	for client, b := range l.buckets {
+		if b.tokens+float64(now.Sub(b.at))*rate >= float64(l.burst) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// rateLimitClient names the bucket a request takes from.
+func rateLimitClient(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return "key:" + key
+	}
+	if addr, ok := clientAddr(r); ok {
+		return "ip:" + addr.String()
+	}
+	return "ip:" + r.RemoteAddr
+}
+
+// rateLimitExempt reports requests the limit does not apply to: short link
+// redirects, which come from whoever scans a printed code, often many
+// people behind one address, and health checks and metrics scrapes.
+func rateLimitExempt(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/healthz", "/readyz", "/metrics":
+		return true
+	}
+	return strings.HasPrefix(r.URL.Path, "/s/")
+}
+
+// middleware refuses requests over the limit with 429 and a Retry-After.
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimitExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := l.take(rateLimitClient(r), time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Rate limit exceeded ("+strconv.Itoa(l.perMinute)+" requests a minute)", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// Remote logos larger than this on either side are scaled down before they
+// are stored. It is well over any logo size we draw.
+const maxRemoteLogoSide = 1024
+
+var remoteLogoTypes = map[string]bool{
+	"image/png":     true,
+	"image/jpeg":    true,
+	"image/gif":     true,
+	"image/webp":    true,
+	"image/svg+xml": true,
+}
+
+// logoURLCache remembers which stored logo a logo_url resolved to, so codes
+// for the same brand only download it again once the entry is older than
+// ttl. Entries are keyed by a hash of the URL; the logos themselves are
+// stored by content and never expire, so stored specs keep rendering.
+type logoURLCache struct {
+	st  storage
+	ttl time.Duration
+}
+
+var logoURLs *logoURLCache
+
+const logoURLPrefix = "logo-urls/"
+
+type logoURLEntry struct {
+	URL       string    `json:"url"`
+	Logo      string    `json:"logo"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+func logoURLKey(rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	return logoURLPrefix + hex.EncodeToString(sum[:16]) + ".json"
+}
+
+// lookup returns the logo rawURL resolved to, unless the entry has expired.
+func (c *logoURLCache) lookup(rawURL string) (string, bool) {
+	b, err := c.st.Get(logoURLKey(rawURL))
+	if err != nil {
+		return "", false
+	}
+	var e logoURLEntry
+	if err := json.Unmarshal(b, &e); err != nil || e.URL != rawURL || time.Since(e.FetchedAt) > c.ttl {
+		return "", false
+	}
+	return e.Logo, true
+}
+
+func (c *logoURLCache) store(rawURL, logo string) {
+	b, err := json.Marshal(logoURLEntry{URL: rawURL, Logo: logo, FetchedAt: time.Now().UTC()})
+	if err == nil {
+		err = c.st.Put(logoURLKey(rawURL), b)
+	}
+	if err != nil {
+		log.Printf("Failed to cache logo for %s: %v", rawURL, err)
+	}
+}
+
+// logoFromURL resolves a 'logo_url' to a stored logo, downloading it
+// through fetchClient unless a fresh cache entry has it. The download is
+// scanned before it is stored, as an uploaded logo is.
+func logoFromURL(ctx context.Context, rawURL string) (string, error) {
+	if logo, ok := logoURLs.lookup(rawURL); ok {
+		return logo, nil
+	}
+
+	resp, err := fetchRemote(ctx, rawURL)
+	if err != nil {
+		return "", logoFetchError(rawURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", logoFetchError(rawURL, fmt.Errorf("server returned %s", resp.Status))
+	}
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !remoteLogoTypes[ct] {
+		return "", badRequest(fmt.Sprintf("Unsupported 'logo_url' content type %q (must be PNG, JPEG, GIF, WebP or SVG)", ct))
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, serverLimits.MaxLogoBytes+1))
+	if err != nil {
+		return "", logoFetchError(rawURL, err)
+	}
+	if int64(len(data)) > serverLimits.MaxLogoBytes {
+		return "", tooLarge(fmt.Sprintf("Logo at 'logo_url' exceeds the maximum of %d bytes", serverLimits.MaxLogoBytes))
+	}
+
+	// A fetched logo is as untrusted as an uploaded one
+	if err := scanUpload(ctx, rawURL, data); err != nil {
+		return "", err
+	}
+	if data, err = shrinkLogo(data); err != nil {
+		return "", err
+	}
+	logo, err := storeLogo(data)
+	if err != nil {
+		return "", err
+	}
+	logoURLs.store(rawURL, logo)
+	return logo, nil
+}
+
+// checkNoLogoURL refuses 'logo_url' in parameters resolved by
+// specFromValues alone, such as batch and poster rows and warmup specs.
+// Only requests for a single code fetch remote logos; elsewhere it would be
+// dropped and the default logo drawn.
+func checkNoLogoURL(params url.Values) error {
+	if params.Get("logo_url") != "" {
+		return badRequest("'logo_url' cannot be used here; remote logos are only fetched for single codes")
+	}
+	return nil
+}
+
+// logoFetchError logs why a logo_url could not be fetched and answers with
+// a fixed message. Dial errors name the address a host resolved to, which
+// for a blocked internal address would tell the client about the network.
+func logoFetchError(rawURL string, err error) error {
+	log.Printf("Failed to fetch logo_url %s: %v", rawURL, err)
+	return badRequest("Could not fetch 'logo_url'")
+}
+
+// shrinkLogo scales raster logos down to maxRemoteLogoSide, so the cache
+// does not keep full size brand artwork. SVGs and small images are kept as
+// they are.
+func shrinkLogo(data []byte) ([]byte, error) {
+	if isSVG(data) {
+		return data, nil
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, badRequest("Unsupported image at 'logo_url'")
+	}
+	if cfg.Width <= maxRemoteLogoSide && cfg.Height <= maxRemoteLogoSide {
+		return data, nil
+	}
+	if limit := 2 * serverLimits.MaxSize; cfg.Width > limit || cfg.Height > limit {
+		return nil, tooLarge(fmt.Sprintf("Logo is %dx%d, maximum is %dx%d", cfg.Width, cfg.Height, limit, limit))
+	}
+	img, err := decodeLogo(data, maxRemoteLogoSide)
+	if err != nil {
+		return nil, badRequest("Unsupported image at 'logo_url': " + err.Error())
+	}
+	b, err := encodePNG(imaging.Fit(img, maxRemoteLogoSide, maxRemoteLogoSide, imaging.Lanczos))
+	if err != nil {
+		return nil, internalError("Failed to encode logo", err)
+	}
+	return b, nil
+}
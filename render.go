@@ -0,0 +1,436 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+	qrcode "github.com/skip2/go-qrcode"
+	"golang.org/x/image/math/fixed"
+)
+
+// render draws the QR code, logo and label described by spec, recording
+// the time spent in each stage in tm, which may be nil. A logo that cannot
+// be decoded is left out with a warning, unless QR_LOGO_DECODE_ERRORS=fail;
+// such an image does not match its spec and must not be stored.
+func render(spec renderSpec, tm *stageTimer) (image.Image, []string, error) {
+	img, warnings, err := renderCode(spec, tm)
+	if err != nil || spec.Canvas == "" {
+		return img, warnings, err
+	}
+	return placeOnCanvas(img, spec, tm)
+}
+
+// renderCode draws the code and its label, without the canvas.
+func renderCode(spec renderSpec, tm *stageTimer) (image.Image, []string, error) {
+	if spec.Renderer < 1 || spec.Renderer > rendererVersion {
+		return nil, nil, internalError("Unsupported renderer", fmt.Errorf("renderer %d", spec.Renderer))
+	}
+	if spec.Size > serverLimits.MaxSize {
+		return nil, nil, tooLarge(fmt.Sprintf("Size %d exceeds the maximum of %d", spec.Size, serverLimits.MaxSize))
+	}
+
+	level, ok := recoveryLevels[spec.RecoveryLevel]
+	if !ok {
+		return nil, nil, badRequest("Unknown recovery level " + spec.RecoveryLevel)
+	}
+
+	// The encoding, logo and font do not depend on each other, so prepare
+	// them concurrently before composing
+	var (
+		wg                      sync.WaitGroup
+		qr                      *qrcode.QRCode
+		logoImg, resizedLogo    image.Image
+		font                    *truetype.Font
+		qrErr, logoErr, fontErr error
+	)
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		defer tm.start("encode")()
+		qr, qrErr = qrcode.New(spec.Data, level)
+		if qrErr != nil {
+			qrErr = classified(badRequest("Data is too long to encode at recovery level "+spec.RecoveryLevel), classCapacity)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer tm.start("logo")()
+		logoImg, resizedLogo, logoErr = loadLogo(spec)
+	}()
+	go func() {
+		defer wg.Done()
+		defer tm.start("font")()
+		font, fontErr = loadFont(spec.FontFile)
+	}()
+	wg.Wait()
+	var warnings []string
+	if errors.Is(logoErr, errLogoDecode) && !failOnLogoDecode {
+		log.Println("Rendering without logo:", logoErr)
+		warnings = append(warnings, "Logo "+spec.LogoFile+" could not be decoded and was left out")
+		logoErr = nil
+	}
+	for _, err := range []error{qrErr, logoErr, fontErr} {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	done := tm.start("compose")
+	fg, bg, err := moduleColors(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if spec.Foreground != "" {
+		qr.ForegroundColor = fg
+	}
+	if spec.Background != "" {
+		qr.BackgroundColor = bg
+	}
+
+	// Resolve the optional confetti palette for the dark modules
+	var palette []color.Color
+	if len(spec.Palette) > 0 {
+		palette, err = parsePalette(strings.Join(spec.Palette, ","))
+		if err != nil {
+			return nil, nil, badRequest("Invalid palette: " + err.Error())
+		}
+	}
+	dark := append([]color.Color{fg}, palette...)
+
+	// Resolve the optional background pattern drawn behind the modules
+	var patternImg image.Image
+	if spec.Pattern != "" {
+		patternColor, err := parseHexColor(spec.PatternColor)
+		if err != nil {
+			return nil, nil, badRequest("Invalid pattern color")
+		}
+
+		patternImg, err = patternTile(spec.Pattern, patternColor, logoImg)
+		if err != nil {
+			return nil, nil, badRequest("Invalid pattern: " + err.Error())
+		}
+
+		for _, c := range dark {
+			if err := checkPatternContrast(patternImg, spec.PatternOpacity, c, bg); err != nil {
+				return nil, nil, classified(badRequest("Pattern rejected: "+err.Error()), classLowContrast)
+			}
+		}
+
+		// Let the pattern show through the light modules
+		qr.BackgroundColor = color.Transparent
+	}
+
+	// Add the logo to the center of the QR code
+	bitmap := moduleBitmap(qr, spec)
+	grid := newModuleGrid(spec, len(bitmap))
+	qrImg := qrImage(qr, bitmap, grid)
+	if palette != nil {
+		qrImg = confettiImage(qr, bitmap, grid, palette, spec.PaletteSeed)
+	}
+	if patternImg != nil {
+		qrImg = applyPattern(qrImg, patternImg, spec.PatternOpacity, bg)
+	}
+
+	if resizedLogo != nil {
+		// Calculate the position to overlay the logo at the center of the QR code
+		logoX := (qrImg.Bounds().Max.X - resizedLogo.Bounds().Max.X) / 2
+		logoY := (qrImg.Bounds().Max.Y - resizedLogo.Bounds().Max.Y) / 2
+		logoPos := image.Point{X: logoX, Y: logoY}
+
+		// Overlay the resized logo on the QR code image
+		qrImg = imaging.Overlay(qrImg, resizedLogo, logoPos, 1.0)
+	}
+
+	// Multicolored modules lower the effective contrast, so make sure the
+	// result still scans before handing it out
+	if palette != nil {
+		if err := verifyDecode(qrImg, spec.Data); err != nil {
+			log.Println("Confetti verification failed:", err)
+			return nil, nil, classified(badRequest("Palette produces an unscannable QR code"), classUnscannable)
+		}
+	}
+
+	if spec.Watermark != "" {
+		qrImg = drawWatermark(qrImg, spec, font, grid.quietZone())
+	}
+	done()
+
+	done = tm.start("label")
+	img, err := drawLabel(qrImg, spec, font)
+	done()
+	return img, warnings, err
+}
+
+// writeWarnings reports render warnings in X-QR-Warning headers.
+func writeWarnings(w http.ResponseWriter, warnings []string) {
+	for _, msg := range warnings {
+		w.Header().Add("X-QR-Warning", msg)
+	}
+}
+
+// checkSpec runs the checks render makes before drawing: limits, capacity,
+// colours, pattern contrast and assets. A spec that passes can still fail
+// the scan check confetti codes get once drawn.
+func checkSpec(spec renderSpec) error {
+	if spec.Renderer < 1 || spec.Renderer > rendererVersion {
+		return internalError("Unsupported renderer", fmt.Errorf("renderer %d", spec.Renderer))
+	}
+	if spec.Size > serverLimits.MaxSize {
+		return tooLarge(fmt.Sprintf("Size %d exceeds the maximum of %d", spec.Size, serverLimits.MaxSize))
+	}
+	level, ok := recoveryLevels[spec.RecoveryLevel]
+	if !ok {
+		return badRequest("Unknown recovery level " + spec.RecoveryLevel)
+	}
+	if _, err := qrcode.New(spec.Data, level); err != nil {
+		return classified(badRequest("Data is too long to encode at recovery level "+spec.RecoveryLevel), classCapacity)
+	}
+	if err := checkLogoArea(spec); err != nil {
+		return err
+	}
+
+	logoImg, _, err := loadLogo(spec)
+	if err != nil && !(errors.Is(err, errLogoDecode) && !failOnLogoDecode) {
+		return err
+	}
+	if _, err := loadFont(spec.FontFile); err != nil {
+		return err
+	}
+	if spec.CanvasImage != "" {
+		if _, err := loadCanvasImage(spec.CanvasImage); err != nil {
+			return err
+		}
+	}
+
+	if err := checkSpecColors(spec); err != nil {
+		return err
+	}
+	fg, bg, err := moduleColors(spec)
+	if err != nil {
+		return err
+	}
+	dark := []color.Color{fg}
+	if len(spec.Palette) > 0 {
+		palette, err := parsePalette(strings.Join(spec.Palette, ","))
+		if err != nil {
+			return badRequest("Invalid palette: " + err.Error())
+		}
+		dark = append(dark, palette...)
+	}
+	if spec.Pattern != "" {
+		patternColor, err := parseHexColor(spec.PatternColor)
+		if err != nil {
+			return badRequest("Invalid pattern color")
+		}
+		patternImg, err := patternTile(spec.Pattern, patternColor, logoImg)
+		if err != nil {
+			return badRequest("Invalid pattern: " + err.Error())
+		}
+		for _, c := range dark {
+			if err := checkPatternContrast(patternImg, spec.PatternOpacity, c, bg); err != nil {
+				return classified(badRequest("Pattern rejected: "+err.Error()), classLowContrast)
+			}
+		}
+	}
+	return nil
+}
+
+// errLogoDecode marks a logo asset that exists but is not a readable image.
+var errLogoDecode = errors.New("logo is not a supported image")
+
+// failOnLogoDecode makes an undecodable logo fail the render, from
+// QR_LOGO_DECODE_ERRORS=fail. By default the code is drawn without it.
+var failOnLogoDecode bool
+
+// loadLogo reads the logo asset and returns it as decoded and as resized
+// for the centre of the code. A spec without a logo returns nil images.
+func loadLogo(spec renderSpec) (logoImg, resized image.Image, err error) {
+	if spec.LogoFile == "" {
+		return nil, nil, nil
+	}
+	logo, err := assets.Get(spec.LogoFile)
+	if err != nil {
+		return nil, nil, internalError("Failed to open logo file", err)
+	}
+
+	// Read and resize the logo image
+	logoImg, err = decodeLogo(logo, spec.LogoSize)
+	if err != nil {
+		return nil, nil, internalError("Failed to decode logo image", fmt.Errorf("%w: %v", errLogoDecode, err))
+	}
+	if spec.RemoveLogoBackground {
+		logoImg = removeLogoBackground(logoImg)
+	}
+
+	// Resize the logo image while maintaining its aspect ratio
+	return logoImg, imaging.Fit(logoImg, spec.LogoSize, spec.LogoSize, imaging.Lanczos), nil
+}
+
+// loadFont parses the named font asset, or returns builtinFont for "".
+func loadFont(name string) (*truetype.Font, error) {
+	if name == "" {
+		return builtinFont, nil
+	}
+	fontBytes, err := assets.Get(name)
+	if err != nil {
+		return nil, internalError("Failed to load font file", err)
+	}
+
+	font, err := truetype.Parse(fontBytes)
+	if err != nil {
+		return nil, internalError("Failed to parse font", err)
+	}
+	return font, nil
+}
+
+// drawLabel appends the label banner below or above qrImg, or rotated
+// along its left or right side. Label strips are cached, so batches repeating a label
+// only rasterise it once.
+func drawLabel(qrImg image.Image, spec renderSpec, font *truetype.Font) (image.Image, error) {
+	labelWidth := qrImg.Bounds().Dx()
+	if spec.sideLabel() {
+		labelWidth = qrImg.Bounds().Dy()
+	}
+
+	key := labelKey{
+		renderer:   spec.Renderer,
+		text:       spec.Label,
+		font:       spec.FontFile,
+		emojiFont:  spec.EmojiFont,
+		fallbacks:  strings.Join(spec.FallbackFonts, ","),
+		spacing:    spec.LetterSpacing,
+		noKerning:  spec.DisableKerning,
+		outline:    spec.LabelOutline,
+		outlineW:   spec.LabelOutlineWidth,
+		shadow:     spec.LabelShadow,
+		shadowOff:  spec.LabelShadowOffset,
+		shadowBlur: spec.LabelShadowBlur,
+		fontSize:   spec.LabelFontSize,
+		width:      labelWidth,
+		height:     spec.LabelHeight,
+		autoHeight: spec.LabelAutoHeight,
+		padding:    spec.LabelPadding,
+		background: spec.LabelBackground,
+		color:      spec.LabelColor,
+	}
+	labelImg, ok := labels.get(key)
+	if !ok {
+		var err error
+		labelImg, err = rasterizeLabel(spec, font, labelWidth)
+		if err != nil {
+			return nil, err
+		}
+		labels.add(key, labelImg)
+	}
+	if spec.sideLabel() {
+		return drawSideLabel(qrImg, labelImg, spec.LabelPosition), nil
+	}
+
+	// Calculate the new height for the qrImg bounds
+	newHeight := qrImg.Bounds().Dy() + labelImg.Bounds().Dy()
+
+	// Create a new rectangle with the updated height
+	newBounds := image.Rect(qrImg.Bounds().Min.X, qrImg.Bounds().Min.Y, qrImg.Bounds().Max.X, newHeight)
+
+	// Create a new image with the updated bounds
+	newQrImg := image.NewRGBA(newBounds)
+
+	// Copy the qrImg to the new image, below the label if it goes on top
+	codeY, labelY := 0, qrImg.Bounds().Dy()
+	if spec.LabelPosition == labelTop {
+		codeY, labelY = labelImg.Bounds().Dy(), 0
+	}
+	draw.Draw(newQrImg, qrImg.Bounds().Add(image.Pt(0, codeY)), qrImg, image.Point{}, draw.Src)
+
+	// Overlay the label below or above the QR code
+	return imaging.Overlay(newQrImg, labelImg, image.Pt(0, labelY), 1.0), nil
+}
+
+// drawSideLabel places the label strip beside qrImg, turned to read
+// bottom to top on the left or top to bottom on the right.
+func drawSideLabel(qrImg image.Image, labelImg *image.RGBA, position string) image.Image {
+	b := qrImg.Bounds()
+	strip, qrX, stripX := imaging.Rotate90(labelImg), labelImg.Bounds().Dy(), 0
+	if position == labelRight {
+		strip, qrX, stripX = imaging.Rotate270(labelImg), 0, b.Dx()
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx()+strip.Bounds().Dx(), b.Dy()))
+	draw.Draw(out, image.Rect(qrX, 0, qrX+b.Dx(), b.Dy()), qrImg, b.Min, draw.Src)
+	draw.Draw(out, strip.Bounds().Add(image.Pt(stripX, 0)), strip, image.Point{}, draw.Src)
+	return out
+}
+
+// labelStrip returns the height of the label strip and the baseline of its
+// text before renderer 3. An auto-height strip fits the font's ascent and
+// descent between the padding; a fixed one keeps the original baseline.
+func labelStrip(spec renderSpec, font *truetype.Font) (height, baseline int) {
+	if !spec.LabelAutoHeight {
+		return spec.LabelHeight, spec.LabelHeight - int(spec.LabelFontSize)
+	}
+	m := truetype.NewFace(font, &truetype.Options{Size: spec.LabelFontSize, DPI: 72}).Metrics()
+	return m.Ascent.Ceil() + m.Descent.Ceil() + 2*spec.LabelPadding, spec.LabelPadding + m.Ascent.Ceil()
+}
+
+// rasterizeLabel draws the label strip for spec, labelWidth pixels wide.
+func rasterizeLabel(spec renderSpec, font *truetype.Font, labelWidth int) (*image.RGBA, error) {
+	style, err := labelStyleFor(spec)
+	if err != nil {
+		return nil, err
+	}
+	layout := layoutLabel(spec, font, style, labelWidth)
+
+	// Define the background color for the label
+	backgroundColor, err := parseHexColor(spec.LabelBackground)
+	if err != nil {
+		return nil, badRequest("Invalid label background color")
+	}
+	textColor, err := parseHexColor(spec.LabelColor)
+	if err != nil {
+		return nil, badRequest("Invalid label color")
+	}
+
+	// Create the label image with a background color
+	labelImg := image.NewRGBA(image.Rect(0, 0, labelWidth, layout.height))
+	draw.Draw(labelImg, labelImg.Bounds(), &image.Uniform{C: backgroundColor}, image.ZP, draw.Src)
+
+	labelContext := freetype.NewContext()
+	labelContext.SetDPI(72)
+	labelContext.SetFont(font)
+	labelContext.SetFontSize(layout.style.size)
+	labelContext.SetClip(labelImg.Bounds())
+	labelContext.SetDst(labelImg)
+	labelContext.SetSrc(image.NewUniform(textColor))
+
+	drawLines := func(dst draw.Image, src image.Image) {
+		for _, line := range layout.lines {
+			pt := fixed.Point26_6{X: line.x, Y: fixed.I(line.baseline)}
+			if err := drawLabelText(labelContext, dst, src, font, line.text, pt, layout.style); err != nil {
+				log.Println("Failed to draw label:", err)
+			}
+		}
+	}
+	if spec.hasLabelEffects() {
+		mask := image.NewAlpha(labelImg.Bounds())
+		labelContext.SetDst(mask)
+		labelContext.SetSrc(image.Opaque)
+		drawLines(mask, image.Opaque)
+		if err := drawLabelEffects(labelImg, mask, spec); err != nil {
+			return nil, err
+		}
+		labelContext.SetDst(labelImg)
+		labelContext.SetSrc(image.NewUniform(textColor))
+	}
+	drawLines(labelImg, image.NewUniform(textColor))
+	return labelImg, nil
+}
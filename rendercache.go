@@ -0,0 +1,103 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// renderCache keeps the most recently served PNGs in memory by spec id,
+// so a code embedded on a busy page is served without going to the render
+// store. It holds up to limit entries and maxBytes of images, and drops
+// entries older than ttl. Cached bytes are shared and must not be
+// modified.
+type renderCache struct {
+	mu       sync.Mutex
+	limit    int
+	maxBytes int
+	ttl      time.Duration
+	bytes    int
+	order    *list.List
+	entries  map[string]*list.Element
+
+	hits, misses, evictions uint64
+}
+
+type renderEntry struct {
+	id    string
+	b     []byte
+	added time.Time
+}
+
+var rendered *renderCache
+
+// loadRenderCache reads QR_RENDER_CACHE_ENTRIES, QR_RENDER_CACHE_BYTES and
+// QR_RENDER_CACHE_TTL_SECONDS.
+func loadRenderCache() *renderCache {
+	return &renderCache{
+		limit:    envInt("QR_RENDER_CACHE_ENTRIES", 1024),
+		maxBytes: envInt("QR_RENDER_CACHE_BYTES", 64<<20),
+		ttl:      time.Duration(envInt("QR_RENDER_CACHE_TTL_SECONDS", 3600)) * time.Second,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *renderCache) get(id string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[id]
+	if ok && time.Since(e.Value.(*renderEntry).added) > c.ttl {
+		c.remove(e)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(e)
+	return e.Value.(*renderEntry).b, true
+}
+
+// add caches b under id. Images larger than the whole cache are not kept.
+func (c *renderCache) add(id string, b []byte) {
+	if len(b) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[id]; ok {
+		c.remove(e)
+	}
+	c.entries[id] = c.order.PushFront(&renderEntry{id: id, b: b, added: time.Now()})
+	c.bytes += len(b)
+	for c.order.Len() > c.limit || c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+}
+
+// remove drops e. The caller holds c.mu.
+func (c *renderCache) remove(e *list.Element) {
+	entry := c.order.Remove(e).(*renderEntry)
+	delete(c.entries, entry.id)
+	c.bytes -= len(entry.b)
+}
+
+func (c *renderCache) writeMetrics(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintln(w, "# HELP qr_render_cache_requests_total Lookups in the in-memory render cache.")
+	fmt.Fprintln(w, "# TYPE qr_render_cache_requests_total counter")
+	fmt.Fprintf(w, "qr_render_cache_requests_total{result=\"hit\"} %d\n", c.hits)
+	fmt.Fprintf(w, "qr_render_cache_requests_total{result=\"miss\"} %d\n", c.misses)
+	fmt.Fprintln(w, "# HELP qr_render_cache_evictions_total Images dropped from the render cache to make room.")
+	fmt.Fprintln(w, "# TYPE qr_render_cache_evictions_total counter")
+	fmt.Fprintf(w, "qr_render_cache_evictions_total %d\n", c.evictions)
+	fmt.Fprintln(w, "# HELP qr_render_cache_bytes Bytes of images held in the render cache.")
+	fmt.Fprintln(w, "# TYPE qr_render_cache_bytes gauge")
+	fmt.Fprintf(w, "qr_render_cache_bytes %d\n", c.bytes)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replication keeps a standby instance in another region up to date with
+// the links and templates of the primary, so printed codes keep
+// redirecting while the primary's region is out. QR_REPLICATION=primary
+// records every change to a link or template in a change log, which a
+// QR_REPLICATION=secondary instance pulls from the primary's admin API and
+// applies to its own stores. Hits are not replicated; each region counts
+// the redirects it serves.
+//
+// Changes carry the whole link or template, so applying one again is
+// harmless. A secondary can be seeded from a backup of the primary and
+// then replay the log from the start.
+
+// Replication roles, from QR_REPLICATION.
+const (
+	replicationPrimary   = "primary"
+	replicationSecondary = "secondary"
+)
+
+// Change kinds and actions.
+const (
+	changeLink     = "link"
+	changeTemplate = "template"
+	changePut      = "put"
+	changeDelete   = "delete"
+)
+
+// changeEvent is one change of a link or template. Put carries the
+// resource as it now is.
+type changeEvent struct {
+	Seq      uint64         `json:"seq"`
+	Time     time.Time      `json:"time"`
+	Kind     string         `json:"kind"`
+	Name     string         `json:"name"`
+	Action   string         `json:"action"`
+	Link     *shortLink     `json:"link,omitempty"`
+	Template *styleTemplate `json:"template,omitempty"`
+}
+
+const (
+	changeLogKey        = "replication/changes.jsonl"
+	replicaPositionKey  = "replication/position"
+	maxChangesPerPull   = 1000
+	defaultChangesLimit = 500
+)
+
+// changeLog is the primary's record of changes, one JSON line each in the
+// data store, numbered from 1.
+type changeLog struct {
+	st storage
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+// changes is the change log of a primary, nil on other instances.
+var changes *changeLog
+
+func openChangeLog(st storage) (*changeLog, error) {
+	events, err := readChanges(st)
+	if err != nil {
+		return nil, err
+	}
+	c := &changeLog{st: st}
+	if len(events) > 0 {
+		c.seq = events[len(events)-1].Seq
+	}
+	return c, nil
+}
+
+// readChanges reads the whole log. A last line without its newline is
+// still being written and is left for the next read.
+func readChanges(st storage) ([]changeEvent, error) {
+	b, err := st.Get(changeLogKey)
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+		b = b[:i+1]
+	} else {
+		b = nil
+	}
+
+	var events []changeEvent
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var ev changeEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			return nil, fmt.Errorf("decode change log: %w", err)
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// emit records a change that has been made. It is safe on a nil log. The
+// change itself has already happened, so a failure to record it is only
+// logged; the secondary misses it until the resource changes again.
+func (c *changeLog) emit(kind, name, action string, l *shortLink, t *styleTemplate) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ev := changeEvent{Seq: c.seq + 1, Time: time.Now().UTC(), Kind: kind, Name: name, Action: action, Link: l, Template: t}
+	b, err := json.Marshal(ev)
+	if err == nil {
+		err = c.st.Append(changeLogKey, append(b, '\n'))
+	}
+	if err != nil {
+		log.Printf("Failed to record %s %s of %s for replication: %v", kind, action, name, err)
+		return
+	}
+	c.seq = ev.Seq
+}
+
+// since returns up to limit changes after seq, and the latest seq.
+func (c *changeLog) since(after uint64, limit int) ([]changeEvent, uint64, error) {
+	c.mu.Lock()
+	latest := c.seq
+	c.mu.Unlock()
+
+	events, err := readChanges(c.st)
+	if err != nil {
+		return nil, 0, err
+	}
+	out := []changeEvent{}
+	for _, ev := range events {
+		if ev.Seq > after && ev.Seq <= latest && len(out) < limit {
+			out = append(out, ev)
+		}
+	}
+	return out, latest, nil
+}
+
+// replicatedLinks records the changes made through a link store.
+type replicatedLinks struct {
+	linkStore
+	changes *changeLog
+}
+
+func (s replicatedLinks) Create(l shortLink) error {
+	if err := s.linkStore.Create(l); err != nil {
+		return err
+	}
+	s.changes.emit(changeLink, l.Slug, changePut, &l, nil)
+	return nil
+}
+
+func (s replicatedLinks) Update(slug string, fn func(*shortLink) error) (shortLink, error) {
+	l, err := s.linkStore.Update(slug, fn)
+	if err != nil {
+		return l, err
+	}
+	s.changes.emit(changeLink, slug, changePut, &l, nil)
+	return l, nil
+}
+
+func (s replicatedLinks) Delete(slug string) error {
+	if err := s.linkStore.Delete(slug); err != nil {
+		return err
+	}
+	s.changes.emit(changeLink, slug, changeDelete, nil, nil)
+	return nil
+}
+
+// replicationChanges serves the change log to secondaries: the changes
+// after 'after', at most 'limit' of them, and the latest seq, which is
+// lower than 'after' if the log was started over.
+func replicationChanges(w http.ResponseWriter, r *http.Request) {
+	if changes == nil {
+		http.Error(w, "This instance is not a replication primary", http.StatusNotFound)
+		return
+	}
+	var after uint64
+	if v := r.FormValue("after"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid 'after' parameter", http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+	limit := defaultChangesLimit
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxChangesPerPull {
+			http.Error(w, fmt.Sprintf("Invalid 'limit' parameter (must be 1 to %d)", maxChangesPerPull), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	events, latest, err := changes.since(after, limit)
+	if err != nil {
+		writeError(w, internalError("Failed to read change log", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Changes []changeEvent `json:"changes"`
+		Latest  uint64        `json:"latest"`
+	}{events, latest})
+}
+
+// replica pulls the primary's changes into this instance's stores.
+type replica struct {
+	from     string
+	token    string
+	interval time.Duration
+	client   *http.Client
+	st       storage
+
+	mu       sync.Mutex
+	position uint64
+	lastPull time.Time
+}
+
+var secondary *replica
+
+// loadReplication sets up the role named by QR_REPLICATION. A secondary
+// pulls from the admin API at QR_REPLICATE_FROM with QR_REPLICATION_TOKEN,
+// one of the primary's admin tokens, every QR_REPLICATION_POLL_SECONDS.
+func loadReplication(st storage) (role string, err error) {
+	switch role = os.Getenv("QR_REPLICATION"); role {
+	case "":
+		return "", nil
+	case replicationPrimary:
+		changes, err = openChangeLog(st)
+		return role, err
+	case replicationSecondary:
+		from := strings.TrimRight(os.Getenv("QR_REPLICATE_FROM"), "/")
+		token := os.Getenv("QR_REPLICATION_TOKEN")
+		if from == "" || token == "" {
+			return "", errors.New("a secondary needs QR_REPLICATE_FROM and QR_REPLICATION_TOKEN")
+		}
+		b, err := st.Get(replicaPositionKey)
+		if err != nil && !errors.Is(err, errNotFound) {
+			return "", err
+		}
+		var pos uint64
+		if len(b) > 0 {
+			if pos, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err != nil {
+				return "", fmt.Errorf("invalid replication position %q", b)
+			}
+		}
+		secondary = &replica{
+			from:     from,
+			token:    token,
+			interval: time.Duration(envInt("QR_REPLICATION_POLL_SECONDS", 5)) * time.Second,
+			client:   &http.Client{Timeout: 30 * time.Second, Transport: outboundTransport()},
+			st:       st,
+			position: pos,
+		}
+		return role, nil
+	default:
+		return "", fmt.Errorf("unknown QR_REPLICATION %q (expected primary or secondary)", role)
+	}
+}
+
+// run pulls until it is caught up, then waits for the next poll.
+func (rp *replica) run() {
+	log.Printf("Replicating from %s, after change %d", rp.from, rp.position)
+	for {
+		n, err := rp.pull()
+		if err != nil {
+			log.Printf("Replication from %s failed: %v", rp.from, err)
+		}
+		if err != nil || n < defaultChangesLimit {
+			time.Sleep(rp.interval)
+		}
+	}
+}
+
+// pull applies one page of changes and returns how many there were.
+func (rp *replica) pull() (int, error) {
+	rp.mu.Lock()
+	pos := rp.position
+	rp.mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/admin/replication/changes?after=%d&limit=%d", rp.from, pos, defaultChangesLimit), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+rp.token)
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var page struct {
+		Changes []changeEvent `json:"changes"`
+		Latest  uint64        `json:"latest"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return 0, fmt.Errorf("decode changes: %w", err)
+	}
+
+	if page.Latest < pos {
+		// The primary's log was started over; replaying it is harmless
+		log.Printf("Replication log of %s is at %d, behind our %d; replaying it", rp.from, page.Latest, pos)
+		return 0, rp.save(0)
+	}
+	for _, ev := range page.Changes {
+		if err := applyChange(ev); err != nil {
+			return 0, fmt.Errorf("change %d (%s %s of %s): %w", ev.Seq, ev.Kind, ev.Action, ev.Name, err)
+		}
+		pos = ev.Seq
+	}
+	if err := rp.save(pos); err != nil {
+		return 0, err
+	}
+	return len(page.Changes), nil
+}
+
+func (rp *replica) save(pos uint64) error {
+	if err := rp.st.Put(replicaPositionKey, []byte(strconv.FormatUint(pos, 10))); err != nil {
+		return err
+	}
+	rp.mu.Lock()
+	rp.position = pos
+	rp.lastPull = time.Now()
+	rp.mu.Unlock()
+	return nil
+}
+
+// applyChange makes a change from the primary to the local stores.
+func applyChange(ev changeEvent) error {
+	switch {
+	case ev.Kind == changeLink && ev.Action == changePut && ev.Link != nil:
+		l := *ev.Link
+		_, err := links.Update(l.Slug, func(cur *shortLink) error {
+			*cur = l
+			return nil
+		})
+		if errors.Is(err, errLinkNotFound) {
+			err = links.Create(l)
+		}
+		return err
+	case ev.Kind == changeLink && ev.Action == changeDelete:
+		if err := links.Delete(ev.Name); err != nil && !errors.Is(err, errLinkNotFound) {
+			return err
+		}
+		return nil
+	case ev.Kind == changeTemplate && ev.Action == changePut && ev.Template != nil:
+		return templates.Save(*ev.Template)
+	case ev.Kind == changeTemplate && ev.Action == changeDelete:
+		if err := templates.Delete(ev.Name); err != nil && !errors.Is(err, errTemplateNotFound) {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown change %s %s", ev.Kind, ev.Action)
+}
+
+func writeReplicationMetrics(w io.Writer) {
+	if changes != nil {
+		changes.mu.Lock()
+		seq := changes.seq
+		changes.mu.Unlock()
+		fmt.Fprintln(w, "# HELP qr_replication_sequence Latest change recorded for secondaries.")
+		fmt.Fprintln(w, "# TYPE qr_replication_sequence gauge")
+		fmt.Fprintf(w, "qr_replication_sequence %d\n", seq)
+	}
+	if secondary != nil {
+		secondary.mu.Lock()
+		pos, last := secondary.position, secondary.lastPull
+		secondary.mu.Unlock()
+		fmt.Fprintln(w, "# HELP qr_replication_position Latest change applied from the primary.")
+		fmt.Fprintln(w, "# TYPE qr_replication_position gauge")
+		fmt.Fprintf(w, "qr_replication_position %d\n", pos)
+		if !last.IsZero() {
+			fmt.Fprintln(w, "# HELP qr_replication_last_pull_timestamp_seconds When changes were last pulled from the primary.")
+			fmt.Fprintln(w, "# TYPE qr_replication_last_pull_timestamp_seconds gauge")
+			fmt.Fprintf(w, "qr_replication_last_pull_timestamp_seconds %d\n", last.Unix())
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// requestLogger writes one JSON line per request to stdout, for auditing
+// and capacity planning. QR_REQUEST_LOG=off turns it off. Query parameters
+// are logged as a hash so payloads and labels stay out of the log while
+// repeated requests can still be matched up; client addresses are not
+// logged.
+var requestLogger *slog.Logger
+
+func loadRequestLogger() *slog.Logger {
+	switch v := os.Getenv("QR_REQUEST_LOG"); v {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	case "off":
+		return nil
+	default:
+		log.Fatalf("Invalid QR_REQUEST_LOG=%q: expected json or off", v)
+		return nil
+	}
+}
+
+// paramsHash is a short digest of the query parameters in canonical order,
+// or "" without any.
+func paramsHash(r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(r.URL.Query().Encode()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// requestClient names who made r: the tenant of its API key, "invalid" for
+// an unknown key, or "anonymous".
+func requestClient(r *http.Request) string {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return "anonymous"
+	}
+	if t := tenants[key]; t != nil {
+		return t.ID
+	}
+	return "invalid"
+}
+
+// logRequests goes first in the middleware chain so requests turned away
+// by the filters are logged too.
+func logRequests(next http.Handler) http.Handler {
+	if requestLogger == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", routeName(r)),
+			slog.Int("status", rec.status),
+			slog.Int("bytes", rec.bytes),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client", requestClient(r)),
+		}
+		if h := paramsHash(r); h != "" {
+			attrs = append(attrs, slog.String("params_hash", h))
+		}
+		if id := rec.Header().Get("X-QR-Id"); id != "" {
+			attrs = append(attrs, slog.String("qr_id", id))
+		}
+		requestLogger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
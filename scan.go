@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// uploadScanner inspects a user-supplied file before it is stored or
+// rendered. Any upload handler must call it and refuse the file on error;
+// scanner outages fail closed.
+type uploadScanner interface {
+	Scan(ctx context.Context, name string, data []byte) error
+}
+
+// infectedError reports that the scanner flagged an upload.
+type infectedError struct {
+	signature string
+}
+
+func (e *infectedError) Error() string {
+	return "upload rejected by content scanner: " + e.signature
+}
+
+var scanner uploadScanner = noopScanner{}
+
+// newUploadScanner picks the scanner from QR_SCAN_MODE: empty for none,
+// "clamd" for a clamd daemon at QR_SCAN_CLAMD_ADDR, or "http" to POST each
+// file to QR_SCAN_HTTP_URL.
+func newUploadScanner() (uploadScanner, error) {
+	timeout := time.Duration(envInt("QR_SCAN_TIMEOUT_SECONDS", 30)) * time.Second
+	switch mode := os.Getenv("QR_SCAN_MODE"); mode {
+	case "":
+		return noopScanner{}, nil
+	case "clamd":
+		addr := os.Getenv("QR_SCAN_CLAMD_ADDR")
+		if addr == "" {
+			return nil, errors.New("QR_SCAN_CLAMD_ADDR is required when QR_SCAN_MODE=clamd")
+		}
+		return &clamdScanner{addr: addr, timeout: timeout}, nil
+	case "http":
+		url := os.Getenv("QR_SCAN_HTTP_URL")
+		if url == "" {
+			return nil, errors.New("QR_SCAN_HTTP_URL is required when QR_SCAN_MODE=http")
+		}
+		return &httpScanner{url: url, client: &http.Client{Timeout: timeout, Transport: outboundTransport()}}, nil
+	default:
+		return nil, fmt.Errorf("unknown QR_SCAN_MODE %q", mode)
+	}
+}
+
+type noopScanner struct{}
+
+func (noopScanner) Scan(context.Context, string, []byte) error { return nil }
+
+// clamdScanner streams files to clamd with the INSTREAM command. addr is
+// host:port, or a filesystem path for a unix socket.
+type clamdScanner struct {
+	addr    string
+	timeout time.Duration
+}
+
+const clamdChunkSize = 64 << 10
+
+func (s *clamdScanner) Scan(ctx context.Context, name string, data []byte) error {
+	network := "tcp"
+	if strings.HasPrefix(s.addr, "/") {
+		network = "unix"
+	}
+
+	d := net.Dialer{Timeout: s.timeout}
+	conn, err := d.DialContext(ctx, network, s.addr)
+	if err != nil {
+		return fmt.Errorf("connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return fmt.Errorf("send to clamd: %w", err)
+	}
+	var size [4]byte
+	for off := 0; off < len(data); off += clamdChunkSize {
+		end := off + clamdChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[off:end]
+		binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+		if _, err := conn.Write(size[:]); err != nil {
+			return fmt.Errorf("send to clamd: %w", err)
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			return fmt.Errorf("send to clamd: %w", err)
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := conn.Write(size[:]); err != nil {
+		return fmt.Errorf("send to clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("read clamd reply: %w", err)
+	}
+	reply = strings.TrimRight(reply, "\x00\n")
+
+	// Replies look like "stream: OK" or "stream: <signature> FOUND"
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return nil
+	case strings.HasSuffix(reply, " FOUND"):
+		sig := strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")
+		log.Printf("clamd flagged upload %q: %s", name, sig)
+		return &infectedError{signature: sig}
+	default:
+		return fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+}
+
+// httpScanner POSTs the raw file to an external scanning service. A 2xx
+// reply means clean; 403, 422 and 451 mean the file was flagged, with the
+// reason in the body. Anything else is treated as a scanner failure.
+type httpScanner struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpScanner) Scan(ctx context.Context, name string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Filename", name)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("call scanner: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusUnprocessableEntity,
+		resp.StatusCode == http.StatusUnavailableForLegalReasons:
+		sig := strings.TrimSpace(string(body))
+		log.Printf("Scanner flagged upload %q: %s", name, sig)
+		return &infectedError{signature: sig}
+	default:
+		return fmt.Errorf("scanner returned %s", resp.Status)
+	}
+}
+
+// scanUpload runs the configured scanner and maps its verdict to a
+// response error.
+func scanUpload(ctx context.Context, name string, data []byte) error {
+	err := scanner.Scan(ctx, name, data)
+	var infected *infectedError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &infected):
+		return &httpError{status: http.StatusUnprocessableEntity, class: classUploadRejected, msg: "Upload rejected by content scanner"}
+	default:
+		return &httpError{status: http.StatusServiceUnavailable, class: classDependency, msg: "Content scanner unavailable", err: err}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"net/http"
+
+	"github.com/disintegration/imaging"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// GET /qrcode/scan-report renders a code from the /qrcode parameters and
+// scans it under worsening camera conditions, one at a time, to find where
+// decoding stops. Blur and downscaling are measured in modules, so the
+// result carries over to any print size: a code whose modules must be at
+// least 1.5 pixels wide on the sensor has to be printed large enough for
+// that at the intended reading distance.
+
+// scanCondition is a way a camera can degrade a code, and the levels it is
+// tried at, mildest first.
+type scanCondition struct {
+	name   string
+	unit   string
+	levels []float64
+	apply  func(img image.Image, level float64, modulePixels int) image.Image
+}
+
+var scanConditions = []scanCondition{
+	{"blur", "modules", []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.8, 1, 1.25, 1.5}, blurCondition},
+	{"downscale", "pixels_per_module", []float64{6, 4, 3, 2.5, 2, 1.75, 1.5, 1.25, 1, 0.8}, downscaleCondition},
+	{"skew", "narrowing", []float64{0.05, 0.1, 0.15, 0.2, 0.3, 0.4, 0.5, 0.6}, skewCondition},
+	{"brightness", "percent", []float64{-10, -20, -30, -40, -50, -60, -70, -80, -90}, brightnessCondition},
+}
+
+// blurCondition is a Gaussian blur of level modules, as from a camera out
+// of focus.
+func blurCondition(img image.Image, level float64, modulePixels int) image.Image {
+	return imaging.Blur(img, level*float64(modulePixels))
+}
+
+// downscaleCondition resamples the image to level pixels per module, as a
+// code seen from further away covers fewer sensor pixels.
+func downscaleCondition(img image.Image, level float64, modulePixels int) image.Image {
+	f := level / float64(modulePixels)
+	b := img.Bounds()
+	return imaging.Resize(img, max(int(float64(b.Dx())*f), 1), max(int(float64(b.Dy())*f), 1), imaging.Box)
+}
+
+// skewCondition narrows the top edge of the image by level of its width,
+// as when the camera looks up at a code from below.
+func skewCondition(img image.Image, level float64, modulePixels int) image.Image {
+	src := imaging.Clone(img)
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := imaging.New(w, h, color.White)
+	cx := float64(w) / 2
+	for y := 0; y < h; y++ {
+		scale := 1 - level*(1-float64(y)/float64(h))
+		for x := 0; x < w; x++ {
+			sx := int(math.Floor(cx + (float64(x)+0.5-cx)/scale))
+			if sx < 0 || sx >= w {
+				continue
+			}
+			i, j := out.PixOffset(x, y), src.PixOffset(sx, y)
+			copy(out.Pix[i:i+4], src.Pix[j:j+4])
+		}
+	}
+	return out
+}
+
+// sensorNoise is the amplitude of the noise brightnessCondition adds, in
+// 8-bit levels.
+const sensorNoise = 12
+
+// brightnessCondition darkens the image by level percent over a fixed
+// noise floor, so as in low light less and less contrast is left above
+// the sensor's noise. The noise is seeded, so reports are repeatable.
+func brightnessCondition(img image.Image, level float64, modulePixels int) image.Image {
+	out := imaging.AdjustBrightness(img, level)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < len(out.Pix); i += 4 {
+		n := rnd.Intn(2*sensorNoise+1) - sensorNoise
+		for c := i; c < i+3; c++ {
+			out.Pix[c] = uint8(min(max(int(out.Pix[c])+n, 0), 255))
+		}
+	}
+	return out
+}
+
+type scanStep struct {
+	Level   float64 `json:"level"`
+	Decoded bool    `json:"decoded"`
+}
+
+type scanConditionResult struct {
+	Condition string `json:"condition"`
+	Unit      string `json:"unit"`
+	// PassedUpTo is the worst level that still decoded, and FailedAt the
+	// first that did not. Either is absent when no level, or every level,
+	// decoded.
+	PassedUpTo *float64   `json:"passed_up_to,omitempty"`
+	FailedAt   *float64   `json:"failed_at,omitempty"`
+	Steps      []scanStep `json:"steps"`
+}
+
+type scanReport struct {
+	Modules      int                   `json:"modules"`
+	ModulePixels int                   `json:"module_pixels"`
+	Conditions   []scanConditionResult `json:"conditions"`
+}
+
+// simulateScans tries each condition over img until a level fails to
+// decode.
+func simulateScans(img image.Image, data string, modules, modulePixels int) scanReport {
+	report := scanReport{Modules: modules, ModulePixels: modulePixels}
+	for _, c := range scanConditions {
+		res := scanConditionResult{Condition: c.name, Unit: c.unit, Steps: []scanStep{}}
+		for _, level := range c.levels {
+			level := level
+			ok := verifyDecode(c.apply(img, level, modulePixels), data) == nil
+			res.Steps = append(res.Steps, scanStep{level, ok})
+			if !ok {
+				res.FailedAt = &level
+				break
+			}
+			res.PassedUpTo = &level
+		}
+		report.Conditions = append(report.Conditions, res)
+	}
+	return report
+}
+
+// scanReportHandler renders the code without storing it and reports how
+// it holds up. The simulation runs in the render slot, as it costs about
+// as much as a few dozen renders.
+func scanReportHandler(w http.ResponseWriter, r *http.Request) {
+	spec, err := specFromRequest(r)
+	if err == nil {
+		spec, err = applyQuota(w, r, spec)
+	}
+	if err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+
+	qr, err := qrcode.New(spec.Data, recoveryLevels[spec.RecoveryLevel])
+	if err != nil {
+		writeError(w, classified(badRequest("Data is too long to encode at recovery level "+spec.RecoveryLevel), classCapacity))
+		return
+	}
+	modules := len(moduleBitmap(qr, spec))
+
+	tm := requestTimer()
+	release := interactive.acquire(tm)
+	img, warnings, err := render(spec, tm)
+	var report scanReport
+	if err == nil {
+		done := tm.start("simulate")
+		report = simulateScans(img, spec.Data, modules, max(newModuleGrid(spec, modules).modulePixels(), 1))
+		done()
+	}
+	release()
+	if err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+	recordGeneration(r, "scan-report", spec, 0)
+
+	writeTiming(w, tm)
+	writeWarnings(w, warnings)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Job priority classes, most urgent first.
+const (
+	priorityHigh = iota
+	priorityNormal
+	priorityLow
+	numPriorities
+)
+
+var priorityNames = []string{"high", "normal", "low"}
+
+// slotPool hands out a fixed number of render slots shared by all jobs. A
+// freed slot goes to the oldest waiter of the most urgent class, so a small
+// urgent job overtakes a large background one between rows.
+type slotPool struct {
+	mu      sync.Mutex
+	free    int
+	waiting [numPriorities][]chan struct{}
+}
+
+// Interactive requests and background jobs render in separate pools, so a
+// batch working through its queue never delays a /qrcode request.
+// renderSlots is sized by QR_RENDER_WORKERS and jobSlots by QR_JOB_WORKERS.
+var (
+	renderSlots *slotPool
+	jobSlots    *slotPool
+)
+
+func newSlotPool(n int) *slotPool {
+	return &slotPool{free: n}
+}
+
+func (p *slotPool) acquire(priority int) {
+	p.mu.Lock()
+	if p.free > 0 {
+		p.free--
+		p.mu.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	p.waiting[priority] = append(p.waiting[priority], ch)
+	p.mu.Unlock()
+	<-ch
+}
+
+func (p *slotPool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for pri := range p.waiting {
+		if q := p.waiting[pri]; len(q) > 0 {
+			p.waiting[pri] = q[1:]
+			close(q[0])
+			return
+		}
+	}
+	p.free++
+}
+
+// renderLane is the pool and priority a render waits in.
+type renderLane struct {
+	pool     *slotPool
+	priority int
+}
+
+// interactive is the lane of requests a client is waiting on.
+var interactive = renderLane{priority: priorityNormal}
+
+// acquire waits for a slot, timing the wait as the "queue" stage of tm,
+// and returns the function releasing it.
+func (l renderLane) acquire(tm *stageTimer) func() {
+	done := tm.start("queue")
+	l.pool.acquire(l.priority)
+	done()
+	return l.pool.release
+}
+
+// jobOptions is how a job asks to be scheduled: how many of its rows may
+// render at once, and its priority class.
+type jobOptions struct {
+	concurrency int
+	priority    int
+}
+
+// jobOptionsFromRequest reads the optional 'concurrency' and 'priority'
+// parameters, defaulting to one row at a time at normal priority.
+func jobOptionsFromRequest(r *http.Request) (jobOptions, error) {
+	opts := jobOptions{concurrency: 1, priority: priorityNormal}
+	q := r.URL.Query()
+	if v := q.Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, badRequest("Invalid 'concurrency' parameter (must be a positive integer)")
+		}
+		if n > serverLimits.MaxJobConcurrency {
+			return opts, tooLarge(fmt.Sprintf("Concurrency %d exceeds the maximum of %d", n, serverLimits.MaxJobConcurrency))
+		}
+		opts.concurrency = n
+	}
+	if v := q.Get("priority"); v != "" {
+		opts.priority = -1
+		for i, name := range priorityNames {
+			if v == name {
+				opts.priority = i
+			}
+		}
+		if opts.priority < 0 {
+			return opts, badRequest("Invalid 'priority' parameter (must be high, normal or low)")
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// selftestCases is a fixed battery covering each rendering feature. Every
+// case must render and decode back to its payload.
+var selftestCases = []struct {
+	name   string
+	params map[string]string
+}{
+	{"plain", map[string]string{"data": "https://smartlink.example/selftest", "label": "Self test"}},
+	{"long-payload", map[string]string{"data": "https://smartlink.example/selftest?campaign=autumn&source=print&medium=poster&content=variant-b", "label": "Long payload"}},
+	{"pattern-dots", map[string]string{"data": "https://smartlink.example/dots", "label": "Dots", "pattern": "dots"}},
+	{"pattern-diagonal", map[string]string{"data": "https://smartlink.example/diagonal", "label": "Diagonal", "pattern": "diagonal"}},
+	{"pattern-brand", map[string]string{"data": "https://smartlink.example/brand", "label": "Brand", "pattern": "brand"}},
+	{"confetti", map[string]string{"data": "https://smartlink.example/confetti", "label": "Confetti", "palette": "c0392b,1a5276,6c3483,117a65"}},
+}
+
+type selftestResult struct {
+	Name     string  `json:"name"`
+	Passed   bool    `json:"passed"`
+	RenderMS float64 `json:"render_ms"`
+	DecodeMS float64 `json:"decode_ms"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type selftestReport struct {
+	Passed  bool             `json:"passed"`
+	TotalMS float64          `json:"total_ms"`
+	Results []selftestResult `json:"results"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// runSelftest renders and decodes every case, bypassing the render store so
+// the drawing code itself is exercised.
+func runSelftest() selftestReport {
+	report := selftestReport{Passed: true}
+	start := time.Now()
+	for _, c := range selftestCases {
+		res := selftestResult{Name: c.name}
+		params := make(map[string][]string, len(c.params))
+		for k, v := range c.params {
+			params[k] = []string{v}
+		}
+
+		spec, err := specFromValues(nil, params)
+		if err == nil {
+			t := time.Now()
+			img, _, rerr := render(spec, nil)
+			res.RenderMS = milliseconds(time.Since(t))
+			err = rerr
+			if err == nil {
+				t = time.Now()
+				err = verifyDecode(img, spec.Data)
+				res.DecodeMS = milliseconds(time.Since(t))
+			}
+		}
+
+		if err != nil {
+			res.Error = err.Error()
+			report.Passed = false
+		} else {
+			res.Passed = true
+		}
+		report.Results = append(report.Results, res)
+	}
+	report.TotalMS = milliseconds(time.Since(start))
+	return report
+}
+
+// selftest serves the report, with 500 when any case fails so canaries can
+// key off the status code alone.
+func selftest(w http.ResponseWriter, r *http.Request) {
+	report := runSelftest()
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Passed {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// selftestCommand runs the battery from the command line and exits non-zero
+// on failure.
+func selftestCommand() {
+	report := runSelftest()
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if !report.Passed {
+		fmt.Fprintln(os.Stderr, "selftest failed")
+		os.Exit(1)
+	}
+}
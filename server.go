@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// serverTimeouts bound how long a client can take over each part of a
+// request, so slow ones cannot hold connections open. Write covers
+// rendering as well as sending the response.
+type serverTimeouts struct {
+	readHeader time.Duration
+	read       time.Duration
+	write      time.Duration
+	idle       time.Duration
+	shutdown   time.Duration
+}
+
+func loadServerTimeouts() serverTimeouts {
+	seconds := func(key string, def int) time.Duration {
+		return time.Duration(envInt(key, def)) * time.Second
+	}
+	return serverTimeouts{
+		readHeader: seconds("QR_READ_HEADER_TIMEOUT_SECONDS", 10),
+		read:       seconds("QR_READ_TIMEOUT_SECONDS", 60),
+		write:      seconds("QR_WRITE_TIMEOUT_SECONDS", 120),
+		idle:       seconds("QR_IDLE_TIMEOUT_SECONDS", 120),
+		shutdown:   seconds("QR_SHUTDOWN_TIMEOUT_SECONDS", 30),
+	}
+}
+
+var (
+	timeouts serverTimeouts
+
+	serversMu sync.Mutex
+	servers   []*http.Server
+)
+
+// listen serves h on addr until shutdown. Every listener goes through
+// here so shutdown can drain them all.
+func listen(addr string, h http.Handler) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: timeouts.readHeader,
+		ReadTimeout:       timeouts.read,
+		WriteTimeout:      timeouts.write,
+		IdleTimeout:       timeouts.idle,
+	}
+	serversMu.Lock()
+	servers = append(servers, srv)
+	serversMu.Unlock()
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// serveUntilSignalled serves the public router until SIGTERM or SIGINT,
+// then stops accepting connections on every listener and waits up to
+// QR_SHUTDOWN_TIMEOUT_SECONDS for requests in flight to finish. Jobs
+// running in the background are not waited for.
+func serveUntilSignalled(addr string, h http.Handler) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go listen(addr, h)
+	<-ctx.Done()
+	stop()
+
+	log.Printf("Shutting down, draining requests for up to %s", timeouts.shutdown)
+	ctx, cancel := context.WithTimeout(context.Background(), timeouts.shutdown)
+	defer cancel()
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Listener %s did not drain: %v", srv.Addr, err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+	log.Println("Shutdown complete")
+}
@@ -0,0 +1,304 @@
+package main
+
+import "unicode"
+
+// Labels are laid out in logical order and set left to right, so from
+// renderer 5 each line is shaped first: Arabic letters take the joined
+// form for their position in the word, and right-to-left runs are put in
+// display order. This covers the labels people put under a code, not full
+// OpenType shaping; marks are drawn where the pen is and scripts that need
+// reordering of their own, like Devanagari, come out in logical order.
+
+// Arabic joining types.
+const (
+	joinNone  = iota
+	joinRight // joins only to the letter before it
+	joinDual  // joins on both sides
+	joinCause // tatweel, joins both ways but has no forms of its own
+)
+
+// arabicForm is a letter's forms in the Presentation Forms-B block: the
+// isolated form, then final, and for dual joining letters initial and
+// medial.
+type arabicForm struct {
+	isolated rune
+	join     int
+}
+
+var arabicForms = map[rune]arabicForm{
+	0x0621: {0xfe80, joinNone},
+	0x0622: {0xfe81, joinRight},
+	0x0623: {0xfe83, joinRight},
+	0x0624: {0xfe85, joinRight},
+	0x0625: {0xfe87, joinRight},
+	0x0626: {0xfe89, joinDual},
+	0x0627: {0xfe8d, joinRight},
+	0x0628: {0xfe8f, joinDual},
+	0x0629: {0xfe93, joinRight},
+	0x062a: {0xfe95, joinDual},
+	0x062b: {0xfe99, joinDual},
+	0x062c: {0xfe9d, joinDual},
+	0x062d: {0xfea1, joinDual},
+	0x062e: {0xfea5, joinDual},
+	0x062f: {0xfea9, joinRight},
+	0x0630: {0xfeab, joinRight},
+	0x0631: {0xfead, joinRight},
+	0x0632: {0xfeaf, joinRight},
+	0x0633: {0xfeb1, joinDual},
+	0x0634: {0xfeb5, joinDual},
+	0x0635: {0xfeb9, joinDual},
+	0x0636: {0xfebd, joinDual},
+	0x0637: {0xfec1, joinDual},
+	0x0638: {0xfec5, joinDual},
+	0x0639: {0xfec9, joinDual},
+	0x063a: {0xfecd, joinDual},
+	0x0640: {0x0640, joinCause},
+	0x0641: {0xfed1, joinDual},
+	0x0642: {0xfed5, joinDual},
+	0x0643: {0xfed9, joinDual},
+	0x0644: {0xfedd, joinDual},
+	0x0645: {0xfee1, joinDual},
+	0x0646: {0xfee5, joinDual},
+	0x0647: {0xfee9, joinDual},
+	0x0648: {0xfeed, joinRight},
+	0x0649: {0xfeef, joinRight},
+	0x064a: {0xfef1, joinDual},
+}
+
+// lamAlef maps an alef after lam to the isolated form of their ligature,
+// which is followed by its final form.
+var lamAlef = map[rune]rune{
+	0x0622: 0xfef5,
+	0x0623: 0xfef7,
+	0x0625: 0xfef9,
+	0x0627: 0xfefb,
+}
+
+const arabicLam = 0x0644
+
+// isArabicMark reports marks that sit on a letter without breaking its
+// joins.
+func isArabicMark(r rune) bool {
+	return unicode.Is(unicode.Mn, r) && unicode.Is(unicode.Arabic, r)
+}
+
+// joinArabic replaces Arabic letters with their joined forms, where has
+// reports the font can draw them.
+func joinArabic(text []rune, has func(rune) bool) []rune {
+	joinOf := func(i int) int {
+		if i < 0 || i >= len(text) {
+			return joinNone
+		}
+		return arabicForms[text[i]].join
+	}
+	// Neighbours skip over marks
+	prev := func(i int) int {
+		for i--; i >= 0 && isArabicMark(text[i]); i-- {
+		}
+		return i
+	}
+	next := func(i int) int {
+		for i++; i < len(text) && isArabicMark(text[i]); i++ {
+		}
+		return i
+	}
+
+	out := make([]rune, 0, len(text))
+	for i := 0; i < len(text); i++ {
+		r := text[i]
+		f, ok := arabicForms[r]
+		if !ok || f.join == joinNone || f.join == joinCause {
+			out = append(out, r)
+			continue
+		}
+		p := joinOf(prev(i))
+		joinsBefore := p == joinDual || p == joinCause
+
+		if r == arabicLam {
+			if j := next(i); j < len(text) && j == i+1 {
+				if lig, ok := lamAlef[text[j]]; ok {
+					if joinsBefore {
+						lig++
+					}
+					if has(lig) {
+						out = append(out, lig)
+						i = j
+						continue
+					}
+				}
+			}
+		}
+
+		joinsAfter := false
+		if f.join == joinDual {
+			n := joinOf(next(i))
+			joinsAfter = n != joinNone
+		}
+		form := f.isolated
+		switch {
+		case joinsBefore && joinsAfter:
+			form += 3
+		case joinsBefore:
+			form++
+		case joinsAfter:
+			form += 2
+		}
+		if has(form) {
+			r = form
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// Bidi classes, reduced to what a single line label needs.
+const (
+	bidiL = iota
+	bidiR
+	bidiNumber
+	bidiNeutral
+)
+
+func bidiClass(r rune) int {
+	switch {
+	case unicode.IsDigit(r):
+		return bidiNumber
+	case unicode.In(r, unicode.Arabic, unicode.Hebrew, unicode.Syriac, unicode.Thaana, unicode.Nko) && !unicode.Is(unicode.Mn, r):
+		return bidiR
+	case unicode.IsLetter(r):
+		return bidiL
+	}
+	return bidiNeutral
+}
+
+// hasRTL reports whether text holds any right-to-left letters.
+func hasRTL(text []rune) bool {
+	for _, r := range text {
+		if bidiClass(r) == bidiR {
+			return true
+		}
+	}
+	return false
+}
+
+var bidiMirror = map[rune]rune{'(': ')', ')': '(', '[': ']', ']': '[', '{': '}', '}': '{', '<': '>', '>': '<', '«': '»', '»': '«'}
+
+// visualOrder reorders a line for display with the implicit levels of the
+// Unicode bidi algorithm. The paragraph takes the direction of its first
+// strong letter; numbers keep their order inside right-to-left runs, and
+// spaces and punctuation go with the run on both sides of them, or the
+// paragraph's direction between runs of different directions.
+func visualOrder(text []rune) []rune {
+	classes := make([]int, len(text))
+	para := bidiL
+	found := false
+	for i, r := range text {
+		classes[i] = bidiClass(r)
+		if !found && (classes[i] == bidiL || classes[i] == bidiR) {
+			para, found = classes[i], true
+		}
+	}
+
+	// Numbers after a left-to-right letter are left-to-right; for neutrals
+	// the rest count as right-to-left
+	strong := para
+	for i, c := range classes {
+		switch c {
+		case bidiL, bidiR:
+			strong = c
+		case bidiNumber:
+			if strong == bidiL {
+				classes[i] = bidiL
+			}
+		}
+	}
+	resolved := func(c int) int {
+		if c == bidiNumber {
+			return bidiR
+		}
+		return c
+	}
+	for i := 0; i < len(classes); {
+		if classes[i] != bidiNeutral {
+			i++
+			continue
+		}
+		j := i
+		for j < len(classes) && classes[j] == bidiNeutral {
+			j++
+		}
+		before, after := para, para
+		if i > 0 {
+			before = resolved(classes[i-1])
+		}
+		if j < len(classes) {
+			after = resolved(classes[j])
+		}
+		dir := para
+		if before == after {
+			dir = before
+		}
+		for k := i; k < j; k++ {
+			classes[k] = dir
+		}
+		i = j
+	}
+
+	base := 0
+	if para == bidiR {
+		base = 1
+	}
+	levels := make([]int, len(text))
+	highest := base
+	for i, c := range classes {
+		switch {
+		case base == 0 && c == bidiR:
+			levels[i] = 1
+		case base == 0 && c == bidiNumber:
+			levels[i] = 2
+		case base == 1 && c != bidiR:
+			levels[i] = 2
+		default:
+			levels[i] = base
+		}
+		if levels[i] > highest {
+			highest = levels[i]
+		}
+	}
+
+	out := append([]rune(nil), text...)
+	for i, r := range out {
+		if levels[i]%2 == 1 {
+			if m, ok := bidiMirror[r]; ok {
+				out[i] = m
+			}
+		}
+	}
+	for level := highest; level >= 1; level-- {
+		for i := 0; i < len(out); {
+			if levels[i] < level {
+				i++
+				continue
+			}
+			j := i
+			for j < len(out) && levels[j] >= level {
+				j++
+			}
+			for a, b := i, j-1; a < b; a, b = a+1, b-1 {
+				out[a], out[b] = out[b], out[a]
+				levels[a], levels[b] = levels[b], levels[a]
+			}
+			i = j
+		}
+	}
+	return out
+}
+
+// shapeLine returns text as it is drawn left to right.
+func shapeLine(text string, has func(rune) bool) string {
+	runes := []rune(text)
+	if !hasRTL(runes) {
+		return text
+	}
+	return string(visualOrder(joinArabic(runes, has)))
+}
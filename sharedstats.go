@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// A link's stats can be shared read-only through a URL carrying a random
+// token, so clients can show scan numbers to their own customers without
+// an API key. Sharing again replaces the token, and unsharing removes it;
+// either way the old URL stops working.
+
+type sharedStatsLink struct {
+	StatsURL string `json:"stats_url"`
+}
+
+func sharedStatsURL(base string, l shortLink) string {
+	return shortURL(base, l.Slug) + "/stats/" + l.StatsToken
+}
+
+// shareStats issues a new stats token for a link and returns the URL of
+// its public stats page.
+func shareStats(w http.ResponseWriter, r *http.Request) {
+	l, ok := ownLink(w, r)
+	if !ok {
+		return
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	l, err := links.Update(l.Slug, func(l *shortLink) error {
+		l.StatsToken = hex.EncodeToString(b)
+		return nil
+	})
+	if err != nil {
+		writeError(w, internalError("Failed to store short link", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sharedStatsLink{sharedStatsURL(publicBaseURL(r), l)})
+}
+
+func unshareStats(w http.ResponseWriter, r *http.Request) {
+	l, ok := ownLink(w, r)
+	if !ok {
+		return
+	}
+	_, err := links.Update(l.Slug, func(l *shortLink) error {
+		l.StatsToken = ""
+		return nil
+	})
+	if err != nil && !errors.Is(err, errLinkNotFound) {
+		writeError(w, internalError("Failed to store short link", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sharedStats is the public stats page of a link: HTML, or with
+// output=json the same document as /links/{slug}/stats. It answers 404
+// for a wrong token as for a link that is not shared.
+func sharedStats(w http.ResponseWriter, r *http.Request) {
+	output := r.FormValue("output")
+	if output != "" && output != "html" && output != "json" {
+		http.Error(w, "Invalid 'output' parameter (must be html or json)", http.StatusBadRequest)
+		return
+	}
+	days, err := statsDays(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	vars := mux.Vars(r)
+	l, err := links.Get(vars["slug"])
+	if err != nil && !errors.Is(err, errLinkNotFound) {
+		writeError(w, internalError("Failed to load short link", err))
+		return
+	}
+	if err != nil || l.StatsToken == "" || subtle.ConstantTimeCompare([]byte(l.StatsToken), []byte(vars["token"])) != 1 {
+		http.Error(w, "Stats not found", http.StatusNotFound)
+		return
+	}
+	stats, err := collectStats(l, days)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Keep the token out of referrers and shared caches
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Cache-Control", "private, max-age=60")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	if output == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statsPage.Execute(w, statsPageData{stats, shortURL(publicBaseURL(r), l.Slug)})
+}
+
+type statsPageData struct {
+	linkStats
+	ShortURL string
+}
+
+type namedCount struct {
+	Name  string
+	Count int
+}
+
+// sortedCounts orders a breakdown for display, largest first.
+func sortedCounts(counts map[string]int) []namedCount {
+	out := make([]namedCount, 0, len(counts))
+	for name, n := range counts {
+		out = append(out, namedCount{name, n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+var statsPage = template.Must(template.New("stats").Funcs(template.FuncMap{"sorted": sortedCounts}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Scans of {{.ShortURL}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; color: #1f2a44; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+td, th { padding: 0.2em 1em 0.2em 0; text-align: left; }
+td.n { text-align: right; }
+</style>
+</head>
+<body>
+<h1>{{.ShortURL}}</h1>
+<p><strong>{{.Hits}}</strong> scans in the last {{.Days}} days, {{.Total}} in all.</p>
+<h2>By day</h2>
+<table>
+{{range .Daily}}<tr><td>{{.Date}}</td><td class="n">{{.Hits}}</td></tr>
+{{end}}</table>
+{{define "breakdown"}}<table>
+{{range sorted .}}<tr><td>{{.Name}}</td><td class="n">{{.Count}}</td></tr>
+{{else}}<tr><td>No scans yet</td></tr>
+{{end}}</table>{{end}}
+<h2>Devices</h2>
+{{template "breakdown" .Devices}}
+<h2>Operating systems</h2>
+{{template "breakdown" .OS}}
+<h2>Countries</h2>
+{{template "breakdown" .Countries}}
+<h2>Referrers</h2>
+{{template "breakdown" .Referrers}}
+</body>
+</html>
+`))
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+)
+
+// Email signature codes are shown 150 pixels wide and rendered at twice
+// that for high density screens, with a caption sized to stay legible
+// rather than scaled down with the code.
+const (
+	signatureWidth      = 150
+	signatureScale      = 2
+	signatureFontSize   = 12.0
+	signaturePadding    = 4
+	maxSignatureCaption = 40
+)
+
+// signatureAsset is both ways of putting a signature code in an email: the
+// image inline as a data URI, which needs no hosting but some clients
+// block, or linked from the API.
+type signatureAsset struct {
+	ID         string `json:"id"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	InlineHTML string `json:"inline_html"`
+	HostedURL  string `json:"hosted_url"`
+	HostedHTML string `json:"hosted_html"`
+}
+
+// signatureSpec turns a /qrcode spec into the small signature layout.
+func signatureSpec(spec renderSpec) renderSpec {
+	spec = spec.scaled(signatureWidth * signatureScale)
+	spec.LabelFontSize = signatureFontSize * signatureScale
+	spec.LabelAutoHeight = true
+	spec.LabelHeight = 0
+	spec.LabelPadding = signaturePadding * signatureScale
+	return spec
+}
+
+// signatureQRCode renders an email signature code from the /qrcode
+// parameters. The label is the caption and must be short.
+func signatureQRCode(w http.ResponseWriter, r *http.Request) {
+	spec, err := specFromRequest(r)
+	if err == nil && utf8.RuneCountInString(spec.Label) > maxSignatureCaption {
+		err = badRequest(fmt.Sprintf("Caption is longer than %d characters", maxSignatureCaption))
+	}
+	if err == nil {
+		spec, err = applyQuota(w, r, signatureSpec(spec))
+	}
+	if err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+
+	tm := requestTimer()
+	id, b, cached, warnings, err := renderStored(spec, tm, interactive)
+	if err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+	width, height, err := displaySize(b, signatureWidth)
+	if err != nil {
+		writeError(w, internalError("Failed to read QR code image", err))
+		return
+	}
+	writeTiming(w, tm)
+	writeWarnings(w, warnings)
+	recordGeneration(r, "png", spec, storedBytes(b, cached))
+
+	hosted := publicBaseURL(r) + "/qrcodes/" + id + ".png"
+	w.Header().Set("X-QR-Id", id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(signatureAsset{
+		ID:         id,
+		Width:      width,
+		Height:     height,
+		InlineHTML: imgTag(pngDataURI(b), spec.Label, width, height),
+		HostedURL:  hosted,
+		HostedHTML: imgTag(hosted, spec.Label, width, height),
+	})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxSLOSamples bounds the memory kept per route; under heavy load the
+// window effectively shrinks to the most recent samples.
+const (
+	maxSLOSamples    = 10000
+	minAlarmSamples  = 100
+	sloAlarmTimeout  = 5 * time.Second
+	defaultSLORoutes = "/qrcode"
+)
+
+var sloQuantiles = []float64{0.5, 0.95, 0.99}
+
+// sloConfig describes the latency objective: within every rolling Window,
+// at least Objective of the requests to Routes must succeed within Target.
+// The rest of the window is the error budget.
+type sloConfig struct {
+	Target    time.Duration
+	Objective float64
+	Window    time.Duration
+	Routes    map[string]bool
+	AlarmURL  string
+}
+
+func loadSLOConfig() sloConfig {
+	cfg := sloConfig{
+		Target:    time.Duration(envInt("QR_SLO_TARGET_MS", 200)) * time.Millisecond,
+		Objective: 0.99,
+		Window:    time.Duration(envInt("QR_SLO_WINDOW_SECONDS", 300)) * time.Second,
+		Routes:    make(map[string]bool),
+		AlarmURL:  os.Getenv("QR_SLO_ALARM_URL"),
+	}
+	if v := os.Getenv("QR_SLO_OBJECTIVE"); v != "" {
+		o, err := strconv.ParseFloat(v, 64)
+		if err != nil || o <= 0 || o >= 1 {
+			log.Fatalf("Invalid QR_SLO_OBJECTIVE=%q: expected a fraction such as 0.99", v)
+		}
+		cfg.Objective = o
+	}
+	for _, route := range envList("QR_SLO_ROUTES", []string{defaultSLORoutes}) {
+		cfg.Routes[route] = true
+	}
+	return cfg
+}
+
+type sloSample struct {
+	at      time.Time
+	latency time.Duration
+	good    bool
+}
+
+// sloTracker keeps the samples of the rolling window per route.
+type sloTracker struct {
+	mu        sync.Mutex
+	cfg       sloConfig
+	samples   map[string][]sloSample
+	lastAlarm map[string]time.Time
+
+	// alarm is called, at most once per window and route, when a route
+	// has spent its error budget.
+	alarm func(sloAlarm)
+}
+
+type sloAlarm struct {
+	Route      string  `json:"route"`
+	Window     string  `json:"window"`
+	Requests   int     `json:"requests"`
+	BadRatio   float64 `json:"bad_ratio"`
+	Budget     float64 `json:"budget"`
+	TargetMs   int64   `json:"target_ms"`
+	LatencyP99 float64 `json:"latency_p99_seconds"`
+}
+
+var slo *sloTracker
+
+func newSLOTracker(cfg sloConfig) *sloTracker {
+	t := &sloTracker{
+		cfg:       cfg,
+		samples:   make(map[string][]sloSample),
+		lastAlarm: make(map[string]time.Time),
+	}
+	t.alarm = logAlarm
+	if cfg.AlarmURL != "" {
+		client := &http.Client{Timeout: sloAlarmTimeout, Transport: outboundTransport()}
+		t.alarm = func(a sloAlarm) {
+			logAlarm(a)
+			b, _ := json.Marshal(a)
+			resp, err := client.Post(cfg.AlarmURL, "application/json", bytes.NewReader(b))
+			if err != nil {
+				log.Printf("Failed to send SLO alarm: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}
+	}
+	return t
+}
+
+func logAlarm(a sloAlarm) {
+	log.Printf("SLO error budget exhausted for %s: %.2f%% of %d requests over %s missed the %dms target (budget %.2f%%)",
+		a.Route, 100*a.BadRatio, a.Requests, a.Window, a.TargetMs, 100*a.Budget)
+}
+
+// observe records one request. Requests are good when they did not fail
+// server side and finished within the target.
+func (t *sloTracker) observe(route string, status int, latency time.Duration) {
+	now := time.Now()
+	s := sloSample{at: now, latency: latency, good: status < 500 && latency <= t.cfg.Target}
+
+	t.mu.Lock()
+	samples := append(t.prune(route, now), s)
+	if len(samples) > maxSLOSamples {
+		samples = samples[len(samples)-maxSLOSamples:]
+	}
+	t.samples[route] = samples
+
+	var fire *sloAlarm
+	if t.cfg.Routes[route] && now.Sub(t.lastAlarm[route]) > t.cfg.Window {
+		if st := t.stats(route, samples); st.Requests >= minAlarmSamples && st.BadRatio > 1-t.cfg.Objective {
+			t.lastAlarm[route] = now
+			fire = &sloAlarm{
+				Route:      route,
+				Window:     t.cfg.Window.String(),
+				Requests:   st.Requests,
+				BadRatio:   st.BadRatio,
+				Budget:     1 - t.cfg.Objective,
+				TargetMs:   t.cfg.Target.Milliseconds(),
+				LatencyP99: st.Quantiles["0.99"],
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	if fire != nil {
+		go t.alarm(*fire)
+	}
+}
+
+// prune drops samples that have left the window. The caller holds t.mu.
+func (t *sloTracker) prune(route string, now time.Time) []sloSample {
+	samples := t.samples[route]
+	cut := sort.Search(len(samples), func(i int) bool {
+		return now.Sub(samples[i].at) <= t.cfg.Window
+	})
+	return samples[cut:]
+}
+
+type sloStats struct {
+	Requests  int                `json:"requests"`
+	Quantiles map[string]float64 `json:"latency_seconds"`
+	SumSecs   float64            `json:"-"`
+
+	// Only set for routes with an objective
+	Target    string   `json:"target,omitempty"`
+	Objective float64  `json:"objective,omitempty"`
+	BadRatio  float64  `json:"bad_ratio"`
+	Remaining *float64 `json:"budget_remaining,omitempty"`
+}
+
+func (t *sloTracker) stats(route string, samples []sloSample) sloStats {
+	st := sloStats{Requests: len(samples), Quantiles: make(map[string]float64)}
+	if len(samples) == 0 {
+		return st
+	}
+
+	latencies := make([]float64, len(samples))
+	bad := 0
+	for i, s := range samples {
+		latencies[i] = s.latency.Seconds()
+		st.SumSecs += latencies[i]
+		if !s.good {
+			bad++
+		}
+	}
+	sort.Float64s(latencies)
+	for _, q := range sloQuantiles {
+		i := int(math.Ceil(q*float64(len(latencies)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		st.Quantiles[strconv.FormatFloat(q, 'g', -1, 64)] = latencies[i]
+	}
+	st.BadRatio = float64(bad) / float64(len(samples))
+
+	if t.cfg.Routes[route] {
+		budget := 1 - t.cfg.Objective
+		remaining := 1 - st.BadRatio/budget
+		st.Target = t.cfg.Target.String()
+		st.Objective = t.cfg.Objective
+		st.Remaining = &remaining
+	}
+	return st
+}
+
+// snapshot returns the current window's stats for every route seen.
+func (t *sloTracker) snapshot() map[string]sloStats {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]sloStats)
+	for route := range t.samples {
+		samples := t.prune(route, now)
+		t.samples[route] = samples
+		out[route] = t.stats(route, samples)
+	}
+	return out
+}
+
+// serveSLO reports rolling latency quantiles and error budget per route.
+func (t *sloTracker) serveSLO(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Window string              `json:"window"`
+		Routes map[string]sloStats `json:"routes"`
+	}{t.cfg.Window.String(), t.snapshot()})
+}
+
+// writePrometheus appends the latency summaries to a /metrics response.
+func (t *sloTracker) writePrometheus(w http.ResponseWriter) {
+	snap := t.snapshot()
+	routes := make([]string, 0, len(snap))
+	for route := range snap {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	fmt.Fprintf(w, "# HELP qr_http_request_latency_seconds Request latency over the last %s.\n", t.cfg.Window)
+	fmt.Fprintln(w, "# TYPE qr_http_request_latency_seconds summary")
+	for _, route := range routes {
+		st := snap[route]
+		for _, q := range sloQuantiles {
+			qs := strconv.FormatFloat(q, 'g', -1, 64)
+			fmt.Fprintf(w, "qr_http_request_latency_seconds{route=%q,quantile=%q} %g\n", route, qs, st.Quantiles[qs])
+		}
+		fmt.Fprintf(w, "qr_http_request_latency_seconds_sum{route=%q} %g\n", route, st.SumSecs)
+		fmt.Fprintf(w, "qr_http_request_latency_seconds_count{route=%q} %d\n", route, st.Requests)
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// rendererVersion identifies the drawing code a spec was rendered with.
+// Bump it whenever a change would alter the pixels produced for an existing
+// spec, and keep the old path reachable for specs that carry the old value.
+//
+//  1. go-qrcode's nearest-module scaling; module widths vary by a pixel.
+//  2. Integer pixels per module, the remainder added to the quiet zone.
+//  3. Labels measured with the font and centred, shrunk or wrapped to two
+//     lines when they do not fit.
+//  4. Newlines in a label start a new line, and the strip grows to fit.
+//  5. Right-to-left runs put in display order and Arabic letters joined.
+const rendererVersion = 5
+
+// renderSpec is the fully resolved description of a QR code image. Every
+// server default is written out explicitly, so a stored spec keeps
+// producing the same image after those defaults change.
+type renderSpec struct {
+	Renderer int    `json:"renderer"`
+	Template string `json:"template,omitempty"`
+
+	Data          string `json:"data"`
+	RecoveryLevel string `json:"recovery_level"`
+	Size          int    `json:"size"`
+	QuietZone     *int   `json:"quiet_zone,omitempty"`
+
+	Foreground string `json:"foreground,omitempty"`
+	Background string `json:"background,omitempty"`
+
+	LogoFile             string `json:"logo_file"`
+	LogoSize             int    `json:"logo_size"`
+	RemoveLogoBackground bool   `json:"remove_logo_background,omitempty"`
+
+	Label           string   `json:"label"`
+	FontFile        string   `json:"font_file"`
+	EmojiFont       string   `json:"emoji_font,omitempty"`
+	FallbackFonts   []string `json:"fallback_fonts,omitempty"`
+	LabelFontSize   float64  `json:"label_font_size"`
+	LabelHeight     int      `json:"label_height"`
+	LabelAutoHeight bool     `json:"label_auto_height,omitempty"`
+	LabelPadding    int      `json:"label_padding,omitempty"`
+	LabelPosition   string   `json:"label_position,omitempty"`
+	LabelBackground string   `json:"label_background"`
+	LabelColor      string   `json:"label_color"`
+	LetterSpacing   float64  `json:"letter_spacing,omitempty"`
+	DisableKerning  bool     `json:"disable_kerning,omitempty"`
+
+	LabelOutline      string  `json:"label_outline,omitempty"`
+	LabelOutlineWidth int     `json:"label_outline_width,omitempty"`
+	LabelShadow       string  `json:"label_shadow,omitempty"`
+	LabelShadowOffset int     `json:"label_shadow_offset,omitempty"`
+	LabelShadowBlur   float64 `json:"label_shadow_blur,omitempty"`
+
+	Pattern        string  `json:"pattern,omitempty"`
+	PatternColor   string  `json:"pattern_color,omitempty"`
+	PatternOpacity float64 `json:"pattern_opacity,omitempty"`
+
+	Palette     []string `json:"palette,omitempty"`
+	PaletteSeed int64    `json:"palette_seed,omitempty"`
+
+	Watermark string `json:"watermark,omitempty"`
+
+	Canvas           string `json:"canvas,omitempty"`
+	CanvasBackground string `json:"canvas_background,omitempty"`
+	CanvasImage      string `json:"canvas_image,omitempty"`
+
+	// snappedFrom is the size asked for before snap=true changed it. It
+	// is only reported, not part of the spec.
+	snappedFrom int
+	// params and tenant are the request the spec was resolved from. They
+	// are stored beside it, not hashed into its id, so it can be resolved
+	// again when its template changes (see styleTemplate.restyle).
+	params url.Values
+	tenant string
+}
+
+var recoveryLevels = map[string]qrcode.RecoveryLevel{
+	"low":      qrcode.Low,
+	"medium":   qrcode.Medium,
+	"quartile": qrcode.High,
+	"high":     qrcode.Highest,
+}
+
+// defaultSpec returns a spec with every server default filled in.
+func defaultSpec() renderSpec {
+	return renderSpec{
+		Renderer:        rendererVersion,
+		RecoveryLevel:   "medium",
+		Size:            serverConfig.Size,
+		LogoFile:        serverLogo,
+		LogoSize:        serverConfig.LogoSize,
+		FontFile:        serverFont,
+		LabelFontSize:   serverConfig.LabelFontSize,
+		LabelHeight:     serverConfig.LabelHeight,
+		LabelPosition:   serverConfig.LabelPosition,
+		LabelBackground: serverConfig.LabelBackground,
+		LabelColor:      serverConfig.LabelColor,
+	}
+}
+
+// specFromRequest resolves the request parameters against the server
+// defaults. Only syntax is checked here; render rejects specs that would
+// produce an unusable image.
+func specFromRequest(r *http.Request) (renderSpec, error) {
+	t := tenantFrom(r.Context())
+	if err := r.ParseForm(); err != nil {
+		return t.defaultSpec(), bodyError(err, "Invalid form data")
+	}
+	if err := resolveLink(t, r.Form, publicBaseURL(r)); err != nil {
+		return t.defaultSpec(), err
+	}
+	spec, err := specFromValues(t, r.Form)
+	if err != nil {
+		return spec, err
+	}
+	if v := r.Form.Get("logo_url"); v != "" {
+		if r.MultipartForm != nil && len(r.MultipartForm.File["logo"]) > 0 {
+			return spec, badRequest("Use either a 'logo' file or 'logo_url', not both")
+		}
+		if spec.LogoFile, err = logoFromURL(r.Context(), v); err != nil {
+			return spec, err
+		}
+		if err := checkLogoArea(spec); err != nil {
+			return spec, err
+		}
+	}
+	return spec, checkFeatures(t, spec)
+}
+
+// specFromValues resolves request-style parameters against the defaults
+// of tenant t, or the server defaults when t is nil. Templates still
+// override the tenant's assets.
+func specFromValues(t *tenant, params url.Values) (renderSpec, error) {
+	spec := t.defaultSpec()
+	spec.params = params
+	if t != nil {
+		spec.tenant = t.ID
+	}
+
+	spec.Data = params.Get("data")
+	if spec.Data == "" {
+		return spec, classified(badRequest("Missing 'data' parameter"), classMissingParam)
+	}
+
+	spec.Label = params.Get("label")
+	if spec.Label == "" {
+		return spec, classified(badRequest("Missing 'label' parameter"), classMissingParam)
+	}
+	if v := params.Get("label2"); v != "" {
+		spec.Label += "\n" + v
+	}
+	spec.Label = strings.ReplaceAll(spec.Label, "\r\n", "\n")
+	if n := strings.Count(spec.Label, "\n") + 1; n > maxLabelLines {
+		return spec, badRequest(fmt.Sprintf("Label has %d lines (at most %d)", n, maxLabelLines))
+	}
+
+	// Scale the defaults to the size first. Parameters given in pixels
+	// below are taken as they are, so they keep to their limits
+	scale := 1.0
+	if v := params.Get("size"); v != "" {
+		size, err := parseSize(v)
+		if err != nil {
+			return spec, err
+		}
+		scale = float64(size) / float64(spec.Size)
+		spec = spec.scaled(size)
+	}
+
+	if name := params.Get("template"); name != "" {
+		if !templateNamePattern.MatchString(name) {
+			return spec, badRequest("Invalid 'template' parameter")
+		}
+		t, err := templates.Load(name)
+		if errors.Is(err, errTemplateNotFound) {
+			return spec, badRequest("Unknown template " + name)
+		}
+		if err != nil {
+			return spec, internalError("Failed to load template", err)
+		}
+		spec = t.apply(spec)
+	}
+
+	if name := params.Get("theme"); name != "" {
+		th, ok := t.theme(name)
+		if !ok {
+			return spec, badRequest("Unknown theme " + name)
+		}
+		spec = th.apply(spec)
+	}
+
+	if v := params.Get("ec"); v != "" {
+		if _, ok := recoveryLevels[v]; !ok {
+			return spec, badRequest("Invalid 'ec' parameter (must be low, medium, quartile or high)")
+		}
+		spec.RecoveryLevel = v
+	}
+
+	// Black and white are left unset, so their ids are unchanged
+	for _, p := range []struct {
+		name  string
+		field *string
+		def   color.Color
+	}{{"fg", &spec.Foreground, color.Black}, {"bg", &spec.Background, color.White}} {
+		if v := params.Get(p.name); v != "" {
+			c, err := parseHexColor(v)
+			if err != nil {
+				return spec, badRequest(fmt.Sprintf("Invalid '%s' parameter (must be a hex color)", p.name))
+			}
+			*p.field = hexColor(c)
+			if *p.field == hexColor(p.def) {
+				*p.field = ""
+			}
+		}
+	}
+
+	if v := params.Get("remove_logo_background"); v != "" {
+		if v != "true" && v != "false" {
+			return spec, badRequest("Invalid 'remove_logo_background' parameter (must be true or false)")
+		}
+		spec.RemoveLogoBackground = v == "true"
+	}
+
+	switch v := params.Get("label_position"); v {
+	case "":
+	case labelBottom:
+		spec.LabelPosition = ""
+	case labelTop, labelLeft, labelRight:
+		spec.LabelPosition = v
+	default:
+		return spec, badRequest("Invalid 'label_position' parameter (must be bottom, top, left or right)")
+	}
+
+	for _, p := range []struct {
+		name  string
+		field *string
+	}{{"label_background", &spec.LabelBackground}, {"label_color", &spec.LabelColor}} {
+		if v := params.Get(p.name); v != "" {
+			c, err := parseHexColor(v)
+			if err != nil {
+				return spec, badRequest(fmt.Sprintf("Invalid '%s' parameter (must be a hex color)", p.name))
+			}
+			*p.field = hexColor(c)
+		}
+	}
+
+	if err := labelHeightFromValues(&spec, params, scale); err != nil {
+		return spec, err
+	}
+
+	if v := params.Get("label_font_size"); v != "" {
+		size, err := strconv.ParseFloat(v, 64)
+		if err != nil || size < minLabelFontSize || size > maxLabelFontSize {
+			return spec, badRequest(fmt.Sprintf("Invalid 'label_font_size' parameter (must be %d to %d pixels)", minLabelFontSize, maxLabelFontSize))
+		}
+		if !spec.LabelAutoHeight && size > float64(spec.LabelHeight) {
+			return spec, badRequest(fmt.Sprintf("Label font size %g does not fit a %d pixel label (use label_height=auto)", size, spec.LabelHeight))
+		}
+		spec.LabelFontSize = size
+	}
+
+	if v := params.Get("letter_spacing"); v != "" {
+		spacing, err := strconv.ParseFloat(v, 64)
+		if err != nil || spacing < minLetterSpacing || spacing > maxLetterSpacing {
+			return spec, badRequest(fmt.Sprintf("Invalid 'letter_spacing' parameter (must be in [%g, %g] ems)", minLetterSpacing, maxLetterSpacing))
+		}
+		spec.LetterSpacing = spacing
+	}
+
+	if v := params.Get("kerning"); v != "" {
+		if v != "true" && v != "false" {
+			return spec, badRequest("Invalid 'kerning' parameter (must be true or false)")
+		}
+		spec.DisableKerning = v == "false"
+	}
+
+	if v := params.Get("label_outline"); v != "" {
+		c, err := parseHexColor(v)
+		if err != nil {
+			return spec, badRequest("Invalid 'label_outline' parameter")
+		}
+		spec.LabelOutline = hexColor(c)
+		spec.LabelOutlineWidth = max(1, int(math.Round(defaultOutlineWidth*scale)))
+		if v := params.Get("label_outline_width"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxOutlineWidth {
+				return spec, badRequest(fmt.Sprintf("Invalid 'label_outline_width' parameter (must be 1 to %d pixels)", maxOutlineWidth))
+			}
+			spec.LabelOutlineWidth = n
+		}
+	}
+
+	if v := params.Get("label_shadow"); v != "" {
+		c, err := parseHexColor(v)
+		if err != nil {
+			return spec, badRequest("Invalid 'label_shadow' parameter")
+		}
+		spec.LabelShadow = hexColor(c)
+		spec.LabelShadowOffset = int(math.Round(defaultShadowOffset * scale))
+		if v := params.Get("label_shadow_offset"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > maxShadowOffset {
+				return spec, badRequest(fmt.Sprintf("Invalid 'label_shadow_offset' parameter (must be 0 to %d pixels)", maxShadowOffset))
+			}
+			spec.LabelShadowOffset = n
+		}
+		if v := params.Get("label_shadow_blur"); v != "" {
+			sigma, err := strconv.ParseFloat(v, 64)
+			if err != nil || sigma < 0 || sigma > maxShadowBlur {
+				return spec, badRequest(fmt.Sprintf("Invalid 'label_shadow_blur' parameter (must be in [0, %d] pixels)", maxShadowBlur))
+			}
+			spec.LabelShadowBlur = sigma
+		}
+	}
+
+	if v := params.Get("canvas"); v != "" {
+		name, ok := canvasPresetName(v)
+		if !ok {
+			return spec, badRequest("Invalid 'canvas' parameter (must be square, story or banner)")
+		}
+		spec.Canvas = name
+		spec.CanvasBackground = "#ffffff"
+		if v := params.Get("canvas_background"); v != "" {
+			c, err := parseHexColor(v)
+			if err != nil {
+				return spec, badRequest("Invalid 'canvas_background' parameter")
+			}
+			spec.CanvasBackground = hexColor(c)
+		}
+		if v := params.Get("canvas_image"); v != "" {
+			if err := checkKey(v); err != nil {
+				return spec, badRequest("Invalid 'canvas_image' parameter")
+			}
+			spec.CanvasImage = v
+		}
+	}
+
+	if v := params.Get("palette"); v != "" {
+		palette, err := parsePalette(v)
+		if err != nil {
+			return spec, badRequest(fmt.Sprintf("Invalid 'palette' parameter: %v", err))
+		}
+		for _, c := range palette {
+			spec.Palette = append(spec.Palette, hexColor(c))
+		}
+		spec.PaletteSeed = paletteSeed(spec.Data)
+	}
+
+	if v := params.Get("pattern"); v != "" {
+		if !isPattern(v) {
+			return spec, badRequest("Invalid 'pattern' parameter")
+		}
+		spec.Pattern = v
+		spec.PatternColor = hexColor(defaultPatternColor)
+		spec.PatternOpacity = defaultPatternOpacity
+
+		if v := params.Get("pattern_color"); v != "" {
+			c, err := parseHexColor(v)
+			if err != nil {
+				return spec, badRequest("Invalid 'pattern_color' parameter")
+			}
+			spec.PatternColor = hexColor(c)
+		}
+
+		if v := params.Get("pattern_opacity"); v != "" {
+			opacity, err := strconv.ParseFloat(v, 64)
+			if err != nil || opacity <= 0 || opacity > maxPatternOpacity {
+				return spec, badRequest(fmt.Sprintf("Invalid 'pattern_opacity' parameter (must be in (0, %g])", maxPatternOpacity))
+			}
+			spec.PatternOpacity = opacity
+		}
+	}
+
+	if v := params.Get("logo_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minLogoUpload || n > spec.Size/2 {
+			return spec, badRequest(fmt.Sprintf("Invalid 'logo_size' parameter (must be %d to %d pixels)", minLogoUpload, spec.Size/2))
+		}
+		spec.LogoSize = n
+	}
+
+	// The default width is left unset, so its ids are unchanged
+	if v := params.Get("border"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxQuietZone {
+			return spec, badRequest(fmt.Sprintf("Invalid 'border' parameter (must be 0 to %d modules)", maxQuietZone))
+		}
+		spec.QuietZone = nil
+		if n != quietZoneModules {
+			spec.QuietZone = &n
+		}
+	}
+
+	if err := snapFromValues(&spec, params); err != nil {
+		return spec, err
+	}
+
+	if err := checkLogoArea(spec); err != nil {
+		return spec, err
+	}
+	if spec.Foreground != "" || spec.Background != "" {
+		if err := checkSpecColors(spec); err != nil {
+			return spec, err
+		}
+	}
+
+	// Only labels with emoji carry the emoji font, so the ids of all other
+	// specs are unchanged
+	if serverEmojiFont != "" && hasEmoji(spec.Label) {
+		spec.EmojiFont = serverEmojiFont
+	}
+	// Likewise only labels with characters the label font lacks carry
+	// fallback fonts
+	fallbacks, err := labelFallbacks(spec)
+	if err != nil {
+		return spec, err
+	}
+	spec.FallbackFonts = fallbacks
+
+	return spec, nil
+}
+
+// labelHeightFromValues reads 'label_height', a height in pixels or
+// "auto", and 'label_padding', the space above and below the text of an
+// auto-height strip. Padding alone implies an auto height. The default
+// padding is scaled by scale, the factor the spec was resized by.
+func labelHeightFromValues(spec *renderSpec, params url.Values, scale float64) error {
+	height, padding := params.Get("label_height"), params.Get("label_padding")
+	if height != "" && height != "auto" {
+		n, err := strconv.Atoi(height)
+		if err != nil || n < minLabelHeight || n > maxLabelHeight {
+			return badRequest(fmt.Sprintf("Invalid 'label_height' parameter (must be auto or %d to %d pixels)", minLabelHeight, maxLabelHeight))
+		}
+		if padding != "" {
+			return badRequest("Invalid 'label_padding' parameter (only applies with label_height=auto)")
+		}
+		spec.LabelHeight = n
+		return nil
+	}
+	if height == "" && padding == "" {
+		return nil
+	}
+
+	spec.LabelAutoHeight = true
+	spec.LabelHeight = 0
+	spec.LabelPadding = int(math.Round(defaultLabelPadding * scale))
+	if padding != "" {
+		n, err := strconv.Atoi(padding)
+		if err != nil || n < 0 || n > maxLabelPadding {
+			return badRequest(fmt.Sprintf("Invalid 'label_padding' parameter (must be 0 to %d pixels)", maxLabelPadding))
+		}
+		spec.LabelPadding = n
+	}
+	return nil
+}
+
+// parseSize reads a requested image width in pixels.
+func parseSize(v string) (int, error) {
+	size, err := strconv.Atoi(v)
+	if err != nil || size < minSize {
+		return 0, badRequest(fmt.Sprintf("Invalid 'size' parameter (must be at least %d)", minSize))
+	}
+	if size > serverLimits.MaxSize {
+		return 0, tooLarge(fmt.Sprintf("Requested size %d exceeds the maximum of %d", size, serverLimits.MaxSize))
+	}
+	return size, nil
+}
+
+// quietZone is the width of the light border around the symbol, in
+// modules. A watermarked code keeps at least the standard zone, since the
+// watermark is drawn there and a narrower border would shrink it until it
+// could not be read.
+func (s renderSpec) quietZone() int {
+	if s.QuietZone != nil && (s.Watermark == "" || *s.QuietZone >= quietZoneModules) {
+		return *s.QuietZone
+	}
+	return quietZoneModules
+}
+
+// scaled returns a copy of the spec drawn at size pixels wide, with the logo
+// and label scaled by the same factor so the layout stays proportional.
+func (s renderSpec) scaled(size int) renderSpec {
+	factor := float64(size) / float64(s.Size)
+	s.Size = size
+	s.LogoSize = int(math.Round(float64(s.LogoSize) * factor))
+	s.LabelHeight = int(math.Round(float64(s.LabelHeight) * factor))
+	s.LabelPadding = int(math.Round(float64(s.LabelPadding) * factor))
+	s.LabelFontSize = s.LabelFontSize * factor
+	if s.LabelOutlineWidth > 0 {
+		s.LabelOutlineWidth = int(math.Max(1, math.Round(float64(s.LabelOutlineWidth)*factor)))
+	}
+	s.LabelShadowOffset = int(math.Round(float64(s.LabelShadowOffset) * factor))
+	s.LabelShadowBlur = s.LabelShadowBlur * factor
+	return s
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// spillDir holds spilled job artifacts, the temp_dir of the config. Empty
+// means the system temporary directory.
+var spillDir string
+
+// spillBuffer collects a job artifact in memory until it would exceed
+// limit bytes, then moves it to a temporary file in dir and keeps writing
+// there, so big batch ZIPs do not have to fit in memory.
+type spillBuffer struct {
+	limit int64
+	dir   string
+	mem   bytes.Buffer
+	file  *os.File
+	size  int64
+}
+
+func newSpillBuffer(limit int64, dir string) *spillBuffer {
+	return &spillBuffer{limit: limit, dir: dir}
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && int64(b.mem.Len()+len(p)) > b.limit {
+		f, err := os.CreateTemp(b.dir, "qr-job-*.zip")
+		if err != nil {
+			return 0, err
+		}
+		if _, err := f.Write(b.mem.Bytes()); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+		b.file = f
+		b.mem = bytes.Buffer{}
+	}
+
+	var n int
+	var err error
+	if b.file != nil {
+		n, err = b.file.Write(p)
+	} else {
+		n, err = b.mem.Write(p)
+	}
+	b.size += int64(n)
+	return n, err
+}
+
+// finish closes the buffer and returns its contents as an artifact.
+func (b *spillBuffer) finish() (*jobArtifact, error) {
+	if b.file == nil {
+		return &jobArtifact{data: b.mem.Bytes(), size: b.size}, nil
+	}
+	if err := b.file.Close(); err != nil {
+		os.Remove(b.file.Name())
+		return nil, err
+	}
+	return &jobArtifact{path: b.file.Name(), size: b.size}, nil
+}
+
+// discard drops whatever was written, removing any spill file.
+func (b *spillBuffer) discard() {
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+	}
+}
+
+// jobArtifact is a finished job's output, held in memory or, when it was
+// spilled, in a temporary file.
+type jobArtifact struct {
+	data []byte
+	path string
+	size int64
+}
+
+type artifactReader interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+}
+
+func (a *jobArtifact) open() (artifactReader, error) {
+	if a.path != "" {
+		return os.Open(a.path)
+	}
+	return nopCloser{bytes.NewReader(a.data)}, nil
+}
+
+// remove deletes a spilled artifact's file.
+func (a *jobArtifact) remove() {
+	if a.path != "" {
+		os.Remove(a.path)
+	}
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
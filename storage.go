@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// storage is a blob store addressed by slash separated keys. Every key is
+// checked segment by segment before it gets anywhere near a filesystem
+// path, so ids and names taken from requests cannot escape the store.
+type storage interface {
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte) error
+	// Append adds data to the end of key, creating it if needed.
+	Append(key string, data []byte) error
+	// List returns the keys directly under prefix, which must end in "/".
+	List(prefix string) ([]string, error)
+	// Delete removes key, returning errNotFound if it does not exist.
+	Delete(key string) error
+}
+
+var errNotFound = errors.New("not found")
+
+// A key segment starts with a letter or digit, which rules out "", "." and
+// ".." as well as hidden files.
+var keySegmentPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// checkKey reports whether key is safe to use as a storage key.
+func checkKey(key string) error {
+	if key == "" {
+		return errors.New("empty storage key")
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if !keySegmentPattern.MatchString(seg) {
+			return fmt.Errorf("invalid storage key %q", key)
+		}
+	}
+	return nil
+}
+
+// diskStorage stores each key as a file below root.
+type diskStorage struct {
+	root string
+}
+
+func newDiskStorage(root string) (*diskStorage, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &diskStorage{root: abs}, nil
+}
+
+// path maps a checked key to its file, refusing anything that would resolve
+// outside root.
+func (d *diskStorage) path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	p := filepath.Join(d.root, filepath.FromSlash(key))
+	rel, err := filepath.Rel(d.root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("storage key %q escapes the store", key)
+	}
+	return p, nil
+}
+
+func (d *diskStorage) Get(key string) ([]byte, error) {
+	p, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errNotFound
+	}
+	return b, err
+}
+
+// Put writes through a temporary file so readers never see a partial blob.
+func (d *diskStorage) Put(key string, data []byte) error {
+	p, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// Append relies on O_APPEND, so concurrent appends of a single write each
+// land whole.
+func (d *diskStorage) Append(key string, data []byte) error {
+	p, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (d *diskStorage) List(prefix string) ([]string, error) {
+	dir := strings.TrimSuffix(prefix, "/")
+	p, err := d.path(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, e := range entries {
+		if !e.IsDir() && keySegmentPattern.MatchString(e.Name()) {
+			keys = append(keys, prefix+e.Name())
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Walk calls fn with every key in the store, in lexical order. Files that
+// could not have been stored under a key, such as temporary files, are
+// skipped.
+func (d *diskStorage) Walk(fn func(key string) error) error {
+	return filepath.WalkDir(d.root, func(p string, e fs.DirEntry, err error) error {
+		if err != nil || p == d.root {
+			return err
+		}
+		if !keySegmentPattern.MatchString(e.Name()) {
+			if e.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if e.IsDir() || !e.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel))
+	})
+}
+
+func (d *diskStorage) Delete(key string) error {
+	p, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return errNotFound
+	}
+	return err
+}
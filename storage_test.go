@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var traversalKeys = []string{
+	"",
+	"..",
+	"../x",
+	"a/../../x",
+	"a/./x",
+	"./x",
+	"/etc/passwd",
+	"/x",
+	"a//x",
+	"a/",
+	`..\x`,
+	`a\..\..\x`,
+	`C:\x`,
+	"%2e%2e/x",
+	"a/%2e%2e/%2e%2e/x",
+	"%2E%2E%2Fx",
+	".hidden",
+	"a/.x",
+	"a\x00b",
+}
+
+func TestCheckKeyRejectsTraversal(t *testing.T) {
+	for _, key := range traversalKeys {
+		if err := checkKey(key); err == nil {
+			t.Errorf("checkKey(%q) = nil, want an error", key)
+		}
+	}
+}
+
+func TestCheckKeyAcceptsStoreKeys(t *testing.T) {
+	for _, key := range []string{
+		"health/probe",
+		"specs/0123456789abcdef0123.json",
+		"renders/0123456789abcdef0123.png",
+		"logos/ab/cd.v2_x-y.png",
+		"a..b",
+	} {
+		if err := checkKey(key); err != nil {
+			t.Errorf("checkKey(%q) = %v, want nil", key, err)
+		}
+	}
+}
+
+func TestDiskStorageRejectsTraversal(t *testing.T) {
+	parent := t.TempDir()
+	d, err := newDiskStorage(filepath.Join(parent, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range traversalKeys {
+		if err := d.Put(key, []byte("x")); err == nil {
+			t.Errorf("Put(%q) = nil, want an error", key)
+		}
+		if err := d.Append(key, []byte("x")); err == nil {
+			t.Errorf("Append(%q) = nil, want an error", key)
+		}
+		if _, err := d.Get(key); err == nil || errors.Is(err, errNotFound) {
+			t.Errorf("Get(%q) = %v, want a key error", key, err)
+		}
+		if err := d.Delete(key); err == nil || errors.Is(err, errNotFound) {
+			t.Errorf("Delete(%q) = %v, want a key error", key, err)
+		}
+		if _, err := d.List(key + "/"); err == nil {
+			t.Errorf("List(%q) = nil, want an error", key+"/")
+		}
+	}
+
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "store" {
+			t.Errorf("%s was written outside the store", e.Name())
+		}
+	}
+}
+
+func TestDiskStorageRoundTrip(t *testing.T) {
+	d, err := newDiskStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("specs/a.json", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Append("specs/a.json", []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := d.Get("specs/a.json")
+	if err != nil || string(b) != "onetwo" {
+		t.Fatalf("Get = %q, %v, want \"onetwo\"", b, err)
+	}
+	keys, err := d.List("specs/")
+	if err != nil || len(keys) != 1 || keys[0] != "specs/a.json" {
+		t.Fatalf("List = %q, %v", keys, err)
+	}
+	if err := d.Delete("specs/a.json"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("specs/a.json"); !errors.Is(err, errNotFound) {
+		t.Fatalf("Get after Delete = %v, want errNotFound", err)
+	}
+}
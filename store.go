@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// specStore keeps resolved render specs so a code can be regenerated
+// exactly, long after the request that created it.
+type specStore struct {
+	st storage
+}
+
+const specPrefix = "specs/"
+
+var specIDPattern = regexp.MustCompile(`^[0-9a-f]{20}$`)
+
+// specID derives the id of a spec from its contents, so identical specs
+// share one record.
+func specID(spec renderSpec) (string, error) {
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:10]), nil
+}
+
+// storedSpec is a spec as it is kept: the resolved fields its id is
+// derived from, and the request they were resolved from.
+type storedSpec struct {
+	renderSpec
+	Params url.Values `json:"request_params,omitempty"`
+	Tenant string     `json:"request_tenant,omitempty"`
+}
+
+// Put stores spec under id, replacing what was there.
+func (s *specStore) Put(id string, spec renderSpec) error {
+	if !specIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid spec id %q", id)
+	}
+	b, err := json.MarshalIndent(storedSpec{spec, spec.params, spec.tenant}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.st.Put(specPrefix+id+".json", b)
+}
+
+// List returns the ids of all stored specs.
+func (s *specStore) List() ([]string, error) {
+	keys, err := s.st.List(specPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, k := range keys {
+		id := strings.TrimSuffix(strings.TrimPrefix(k, specPrefix), ".json")
+		if specIDPattern.MatchString(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+var errSpecNotFound = errors.New("spec not found")
+
+// Load returns the spec stored under id.
+func (s *specStore) Load(id string) (renderSpec, error) {
+	var spec renderSpec
+	if !specIDPattern.MatchString(id) {
+		return spec, errSpecNotFound
+	}
+
+	b, err := s.st.Get(specPrefix + id + ".json")
+	if errors.Is(err, errNotFound) {
+		return spec, errSpecNotFound
+	}
+	if err != nil {
+		return spec, err
+	}
+
+	var stored storedSpec
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return spec, fmt.Errorf("decode spec %s: %w", id, err)
+	}
+	spec = stored.renderSpec
+	spec.params, spec.tenant = stored.Params, stored.Tenant
+	return spec, nil
+}
+
+// renderStore keeps encoded PNGs next to their specs, so a spec that has
+// been rendered once (or warmed up ahead of a deploy) is served without
+// drawing it again.
+type renderStore struct {
+	st storage
+}
+
+const renderPrefix = "renders/"
+
+func (s *renderStore) Get(id string) ([]byte, error) {
+	if !specIDPattern.MatchString(id) {
+		return nil, errNotFound
+	}
+	return s.st.Get(renderPrefix + id + ".png")
+}
+
+func (s *renderStore) Put(id string, b []byte) error {
+	if !specIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid spec id %q", id)
+	}
+	return s.st.Put(renderPrefix+id+".png", b)
+}
+
+// unsavedWarning goes with a code served while storage is unavailable.
+const unsavedWarning = "Storage is unavailable, so the code was not saved and its id cannot be used to fetch it again"
+
+// renderStored returns the PNG for spec and its id, rendering and storing
+// both on first use. cached reports whether the image came from the render
+// cache or the store.
+// Stage timings, including the store lookup, go to tm, which may be nil.
+// Only a render that misses the store waits for a slot in lane. A render
+// with warnings is returned but not stored, so it is redone once the
+// problem is fixed.
+func renderStored(spec renderSpec, tm *stageTimer, lane renderLane) (id string, b []byte, cached bool, warnings []string, err error) {
+	id, err = specID(spec)
+	if err != nil {
+		return "", nil, false, nil, internalError("Failed to hash QR code spec", err)
+	}
+
+	if b, ok := rendered.get(id); ok {
+		return id, b, true, nil, nil
+	}
+	done := tm.start("store")
+	b, err = renders.Get(id)
+	done()
+	if err == nil {
+		rendered.add(id, b)
+		return id, b, true, nil, nil
+	}
+	if !errors.Is(err, errNotFound) && !errors.Is(err, errBreakerOpen) {
+		log.Println("Failed to read stored render:", err)
+	}
+
+	release := lane.acquire(tm)
+	img, warnings, err := render(spec, tm)
+	if err == nil {
+		done = tm.start("png")
+		b, err = encodePNG(img)
+		done()
+		if err != nil {
+			err = internalError("Failed to encode QR code image", err)
+		}
+	}
+	release()
+	if err != nil {
+		return "", nil, false, nil, err
+	}
+
+	// Keep the resolved spec so the code can be reprinted identically later.
+	// With storage down the image is still served, it just cannot be
+	// fetched again by id.
+	if err := specs.Put(id, spec); errors.Is(err, errBreakerOpen) {
+		return id, b, false, append(warnings, unsavedWarning), nil
+	} else if err != nil {
+		return "", nil, false, nil, internalError("Failed to store QR code spec", err)
+	}
+	if len(warnings) == 0 {
+		rendered.add(id, b)
+		if err := renders.Put(id, b); err != nil {
+			log.Println("Failed to store render:", err)
+		}
+	}
+	return id, b, false, warnings, nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"image/color"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/freetype/truetype"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// renderSVG draws spec as an SVG document for print: the modules as
+// paths, the logo embedded as an image and the label as live text in the
+// label font's family. Patterns, watermarks and canvases exist only in
+// raster output.
+func renderSVG(spec renderSpec, opts svgOptions) ([]byte, []string, error) {
+	switch {
+	case spec.Pattern != "":
+		return nil, nil, badRequest("Patterns are not available in SVG output")
+	case spec.Watermark != "":
+		return nil, nil, badRequest("Watermarks are not available in SVG output")
+	case spec.Canvas != "":
+		return nil, nil, badRequest("Canvases are not available in SVG output")
+	}
+	if spec.Size > serverLimits.MaxSize {
+		return nil, nil, tooLarge(fmt.Sprintf("Size %d exceeds the maximum of %d", spec.Size, serverLimits.MaxSize))
+	}
+	level, ok := recoveryLevels[spec.RecoveryLevel]
+	if !ok {
+		return nil, nil, badRequest("Unknown recovery level " + spec.RecoveryLevel)
+	}
+	qr, err := qrcode.New(spec.Data, level)
+	if err != nil {
+		return nil, nil, classified(badRequest("Data is too long to encode at recovery level "+spec.RecoveryLevel), classCapacity)
+	}
+	fg, bg, err := moduleColors(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	qr.ForegroundColor, qr.BackgroundColor = fg, bg
+	font, err := loadFont(spec.FontFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	logo, err := svgLogo(spec)
+	var warnings []string
+	if errors.Is(err, errLogoDecode) && !failOnLogoDecode {
+		log.Println("Rendering without logo:", err)
+		warnings = append(warnings, "Logo "+spec.LogoFile+" could not be decoded and was left out")
+		logo, err = "", nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	size := spec.Size
+	style, err := labelStyleFor(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	layout := layoutLabel(spec, font, style, size)
+	stripHeight := layout.height
+	width, height, codeX, codeY := size, size+stripHeight, 0, 0
+	if spec.sideLabel() {
+		width, height = size+stripHeight, size
+		if spec.LabelPosition == labelLeft {
+			codeX = stripHeight
+		}
+	} else if spec.LabelPosition == labelTop {
+		codeY = stripHeight
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" %s>`+"\n", opts.rootAttrs(width, height))
+	fmt.Fprintf(&buf, `<g transform="translate(%d %d)">`+"\n", codeX, codeY)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" %s/>`+"\n", size, size, opts.paint.attrs(svgFill("background", hexColor(qr.BackgroundColor))))
+	if err := writeSVGModules(&buf, qr, spec, opts.paint); err != nil {
+		return nil, nil, err
+	}
+	buf.WriteString(logo)
+	buf.WriteString("</g>\n")
+	if err := writeSVGLabel(&buf, spec, font, size, layout, opts.paint); err != nil {
+		return nil, nil, err
+	}
+	buf.WriteString("</svg>\n")
+	return buf.Bytes(), warnings, nil
+}
+
+// writeSVGModules writes the dark modules as one path per color, each row
+// merged into runs, scaled so the symbol and quiet zone fill the code.
+func writeSVGModules(buf *bytes.Buffer, qr *qrcode.QRCode, spec renderSpec, paint svgPaint) error {
+	bitmap := moduleBitmap(qr, spec)
+	var colors [][]color.Color
+	var names map[string]string
+	if len(spec.Palette) > 0 {
+		palette, err := parsePalette(strings.Join(spec.Palette, ","))
+		if err != nil {
+			return badRequest("Invalid palette: " + err.Error())
+		}
+		colors = confettiColors(qr, bitmap, palette, spec.PaletteSeed)
+		names = make(map[string]string, len(palette))
+		for i := len(palette) - 1; i >= 0; i-- {
+			names[hexColor(palette[i])] = "palette-" + strconv.Itoa(i+1)
+		}
+	}
+	colorAt := func(x, y int) string {
+		if colors != nil {
+			return hexColor(colors[y][x])
+		}
+		return hexColor(qr.ForegroundColor)
+	}
+
+	paths := make(map[string]*strings.Builder)
+	for y, row := range bitmap {
+		for x := 0; x < len(row); {
+			if !row[x] {
+				x++
+				continue
+			}
+			c := colorAt(x, y)
+			run := 1
+			for x+run < len(row) && row[x+run] && colorAt(x+run, y) == c {
+				run++
+			}
+			if paths[c] == nil {
+				paths[c] = &strings.Builder{}
+			}
+			fmt.Fprintf(paths[c], "M%d %dh%dv1h-%dz", x, y, run, run)
+			x += run
+		}
+	}
+
+	keys := make([]string, 0, len(paths))
+	for c := range paths {
+		keys = append(keys, c)
+	}
+	sort.Strings(keys)
+	scale := strconv.FormatFloat(float64(spec.Size)/float64(len(bitmap)), 'g', 8, 64)
+	fmt.Fprintf(buf, `<g transform="scale(%s %s)" shape-rendering="crispEdges">`+"\n", scale, scale)
+	for _, c := range keys {
+		// Modules confetti leaves alone keep the foreground
+		name, ok := names[c]
+		if !ok {
+			name = "foreground"
+		}
+		fmt.Fprintf(buf, `<path %s d="%s"/>`+"\n", paint.attrs(svgFill(name, c)), paths[c].String())
+	}
+	buf.WriteString("</g>\n")
+	return nil
+}
+
+// svgLogo returns the image element centring the logo in the code. An SVG
+// logo is embedded as it is, so it stays vector; other logos are embedded
+// as PNG at their full resolution after orientation and background
+// removal.
+func svgLogo(spec renderSpec) (string, error) {
+	if spec.LogoFile == "" {
+		return "", nil
+	}
+	data, err := assets.Get(spec.LogoFile)
+	if err != nil {
+		return "", internalError("Failed to open logo file", err)
+	}
+	img, err := decodeLogo(data, spec.LogoSize)
+	if err != nil {
+		return "", internalError("Failed to decode logo image", fmt.Errorf("%w: %v", errLogoDecode, err))
+	}
+
+	href := "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString(data)
+	if !isSVG(data) {
+		if spec.RemoveLogoBackground {
+			img = removeLogoBackground(img)
+		}
+		b, err := encodePNG(img)
+		if err != nil {
+			return "", internalError("Failed to encode logo image", err)
+		}
+		href = "data:image/png;base64," + base64.StdEncoding.EncodeToString(b)
+	}
+
+	// Fit the logo in its box, keeping the aspect ratio
+	b := img.Bounds()
+	scale := math.Min(float64(spec.LogoSize)/float64(b.Dx()), float64(spec.LogoSize)/float64(b.Dy()))
+	w, h := float64(b.Dx())*scale, float64(b.Dy())*scale
+	x, y := (float64(spec.Size)-w)/2, (float64(spec.Size)-h)/2
+	return fmt.Sprintf(`<image x="%s" y="%s" width="%s" height="%s" href="%s"/>`+"\n", svgNumber(x), svgNumber(y), svgNumber(w), svgNumber(h), href), nil
+}
+
+// writeSVGLabel writes the label strip, laid out along the code's width
+// and turned like the raster label when it runs along a side. Each line is
+// centred; its outline is a stroke painted under the fill and its shadow a
+// copy drawn first.
+func writeSVGLabel(buf *bytes.Buffer, spec renderSpec, font *truetype.Font, length int, layout labelLayout, paint svgPaint) error {
+	bg, err := parseHexColor(spec.LabelBackground)
+	if err != nil {
+		return badRequest("Invalid label background color")
+	}
+	fg, err := parseHexColor(spec.LabelColor)
+	if err != nil {
+		return badRequest("Invalid label color")
+	}
+
+	switch spec.LabelPosition {
+	case labelLeft:
+		fmt.Fprintf(buf, `<g transform="translate(0 %d) rotate(-90)">`+"\n", length)
+	case labelRight:
+		fmt.Fprintf(buf, `<g transform="translate(%d 0) rotate(90)">`+"\n", length+layout.height)
+	case labelTop:
+		buf.WriteString("<g>\n")
+	default:
+		fmt.Fprintf(buf, `<g transform="translate(0 %d)">`+"\n", length)
+	}
+	fmt.Fprintf(buf, `<rect width="%d" height="%d" %s/>`+"\n", length, layout.height, paint.attrs(svgFill("label-background", hexColor(bg))))
+	for i, line := range layout.lines {
+		writeSVGLabelLine(buf, spec, font, length, line, layout.style.size, fg, i == 0, paint)
+	}
+	buf.WriteString("</g>\n")
+	return nil
+}
+
+// writeSVGLabelLine writes one line of the label, defining the shadow
+// filter when first is set.
+func writeSVGLabelLine(buf *bytes.Buffer, spec renderSpec, font *truetype.Font, length int, line labelLine, size float64, fg color.Color, first bool, paint svgPaint) {
+	family := font.Name(truetype.NameIDFontFamily)
+	attrs := fmt.Sprintf(`x="%s" y="%d" font-family="%s" font-size="%s" text-anchor="middle"`,
+		svgNumber(float64(length)/2), line.baseline, html.EscapeString(svgFontFamily(family, fallbackFamilies(spec.FallbackFonts)...)), svgNumber(size))
+	if spec.LetterSpacing != 0 {
+		attrs += fmt.Sprintf(` letter-spacing="%sem"`, svgNumber(spec.LetterSpacing))
+	}
+	if spec.DisableKerning {
+		attrs += ` font-kerning="none"`
+	}
+	outline := ""
+	if spec.LabelOutline != "" {
+		outline = fmt.Sprintf(` stroke-width="%d" stroke-linejoin="round" paint-order="stroke"`, 2*spec.LabelOutlineWidth)
+	}
+	text := html.EscapeString(line.text)
+
+	if spec.LabelShadow != "" {
+		filter := ""
+		if spec.LabelShadowBlur > 0 {
+			if first {
+				fmt.Fprintf(buf, `<filter id="label-shadow"><feGaussianBlur stdDeviation="%s"/></filter>`+"\n", svgNumber(spec.LabelShadowBlur))
+			}
+			filter = ` filter="url(#label-shadow)"`
+		}
+		props := []svgProp{svgFill("label-shadow", spec.LabelShadow)}
+		if outline != "" {
+			props = append(props, svgStroke("label-shadow", spec.LabelShadow))
+		}
+		fmt.Fprintf(buf, `<text %s %s%s transform="translate(%d %d)"%s>%s</text>`+"\n",
+			attrs, paint.attrs(props...), outline, spec.LabelShadowOffset, spec.LabelShadowOffset, filter, text)
+	}
+	props := []svgProp{svgFill("label-color", hexColor(fg))}
+	if outline != "" {
+		props = append(props, svgStroke("label-outline", spec.LabelOutline))
+	}
+	fmt.Fprintf(buf, `<text %s %s%s>%s</text>`+"\n", attrs, paint.attrs(props...), outline, text)
+}
+
+// svgPaint says how colours are written. With vars set each one is a CSS
+// custom property, --qr-foreground, --qr-background, --qr-palette-1 and
+// so on, falling back to the rendered colour, so a page that inlines the
+// SVG can re-theme the code from its own stylesheet. SVGs loaded through
+// an img element or the logo's own colours are not reached.
+type svgPaint struct {
+	vars bool
+}
+
+// svgProp is a colour an element is painted with and the custom property
+// that can replace it.
+type svgProp struct {
+	property, name, color string
+}
+
+func svgFill(name, color string) svgProp   { return svgProp{"fill", name, color} }
+func svgStroke(name, color string) svgProp { return svgProp{"stroke", name, color} }
+
+// attrs writes props as presentation attributes, or as a style attribute
+// using the custom properties.
+func (p svgPaint) attrs(props ...svgProp) string {
+	parts := make([]string, len(props))
+	for i, pr := range props {
+		if p.vars {
+			parts[i] = fmt.Sprintf("%s: var(--qr-%s, %s)", pr.property, pr.name, pr.color)
+		} else {
+			parts[i] = fmt.Sprintf(`%s="%s"`, pr.property, pr.color)
+		}
+	}
+	if p.vars {
+		return `style="` + strings.Join(parts, "; ") + `"`
+	}
+	return strings.Join(parts, " ")
+}
+
+// svgFontFamily quotes family and the fallback families for the
+// font-family attribute, ending with any sans-serif face where none of them
+// is installed.
+func svgFontFamily(family string, fallbacks ...string) string {
+	var list []string
+	for _, f := range append([]string{family}, fallbacks...) {
+		if f != "" {
+			list = append(list, "'"+strings.ReplaceAll(f, "'", "")+"'")
+		}
+	}
+	return strings.Join(append(list, "sans-serif"), ", ")
+}
+
+// svgNumber formats v compactly, to a hundredth of a pixel.
+func svgNumber(v float64) string {
+	return strings.TrimSuffix(strings.TrimRight(fmt.Sprintf("%.2f", v), "0"), ".")
+}
+
+// serveSVG responds with spec as SVG. The spec is stored like a PNG's so
+// its X-QR-Id works for reprints, but the document is cheap to redraw and
+// is not kept. css_vars=true writes the colours as custom properties, and
+// svgOptions covers the sizing attributes; they only change the markup, so
+// the id is the same either way.
+func serveSVG(w http.ResponseWriter, r *http.Request, spec renderSpec) {
+	id, err := specID(spec)
+	if err != nil {
+		writeError(w, internalError("Failed to hash QR code spec", err))
+		return
+	}
+	opts, err := svgOptionsFrom(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, warnings, err := renderSVG(spec, opts)
+	if err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+	if err := specs.Put(id, spec); errors.Is(err, errBreakerOpen) {
+		warnings = append(warnings, unsavedWarning)
+	} else if err != nil {
+		writeError(w, internalError("Failed to store QR code spec", err))
+		return
+	}
+
+	writeWarnings(w, warnings)
+	recordGeneration(r, "svg", spec, 0)
+	w.Header().Set("X-QR-Id", id)
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Write(b)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// svgOptions shape the SVG document without changing the code, so they
+// are read from the request and left out of the spec and its id.
+//
+// By default the document is as many pixels wide and high as the raster
+// image, with a viewBox so it can be scaled. For responsive layouts
+// svg_width and svg_height take any CSS length, such as 100% or 20em, or
+// auto to leave the attribute out and let the page size it;
+// svg_aspect sets preserveAspectRatio; svg_viewbox=none leaves the viewBox
+// out for consumers that want fixed pixels.
+type svgOptions struct {
+	paint       svgPaint
+	width       string
+	height      string
+	aspectRatio string
+	noViewBox   bool
+}
+
+var (
+	svgLengthPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(px|%|em|rem|vw|vh|vmin|vmax|cm|mm|in|pt|pc)?$`)
+	svgAlignPattern  = regexp.MustCompile(`^x(Min|Mid|Max)Y(Min|Mid|Max)$`)
+)
+
+func svgOptionsFrom(r *http.Request) (svgOptions, error) {
+	var opts svgOptions
+	switch v := r.FormValue("css_vars"); v {
+	case "", "false":
+	case "true":
+		opts.paint.vars = true
+	default:
+		return opts, badRequest("Invalid 'css_vars' parameter (must be true or false)")
+	}
+
+	for _, p := range []struct {
+		name  string
+		field *string
+	}{{"svg_width", &opts.width}, {"svg_height", &opts.height}} {
+		v := r.FormValue(p.name)
+		if v != "" && v != "auto" && !svgLengthPattern.MatchString(v) {
+			return opts, badRequest(fmt.Sprintf("Invalid '%s' parameter (must be auto or a CSS length such as 512, 100%% or 20em)", p.name))
+		}
+		*p.field = v
+	}
+
+	if v := r.FormValue("svg_aspect"); v != "" {
+		align, mode, _ := strings.Cut(v, " ")
+		if (align != "none" && !svgAlignPattern.MatchString(align)) || (mode != "" && mode != "meet" && mode != "slice") {
+			return opts, badRequest("Invalid 'svg_aspect' parameter (must be none or xMinYMin to xMaxYMax, optionally followed by meet or slice)")
+		}
+		opts.aspectRatio = v
+	}
+
+	switch v := r.FormValue("svg_viewbox"); v {
+	case "", "full":
+	case "none":
+		opts.noViewBox = true
+	default:
+		return opts, badRequest("Invalid 'svg_viewbox' parameter (must be full or none)")
+	}
+	return opts, nil
+}
+
+// rootAttrs returns the sizing attributes of the svg element for a
+// document of width by height pixels.
+func (o svgOptions) rootAttrs(width, height int) string {
+	var attrs []string
+	for _, a := range []struct {
+		name, value string
+		def         int
+	}{{"width", o.width, width}, {"height", o.height, height}} {
+		switch a.value {
+		case "":
+			attrs = append(attrs, fmt.Sprintf(`%s="%d"`, a.name, a.def))
+		case "auto":
+		default:
+			attrs = append(attrs, fmt.Sprintf(`%s="%s"`, a.name, a.value))
+		}
+	}
+	if !o.noViewBox {
+		attrs = append(attrs, fmt.Sprintf(`viewBox="0 0 %d %d"`, width, height))
+	}
+	if o.aspectRatio != "" {
+		attrs = append(attrs, fmt.Sprintf(`preserveAspectRatio="%s"`, o.aspectRatio))
+	}
+	return strings.Join(attrs, " ")
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// syncDocument is the desired state of a tenant's links and of the style
+// templates. A section that is left out is not managed: its links or
+// templates are neither changed nor deleted. A section that is present is
+// the complete list, and anything missing from it is deleted.
+type syncDocument struct {
+	Tenant    string           `json:"tenant"`
+	Links     *[]syncLink      `json:"links"`
+	Templates *[]styleTemplate `json:"templates"`
+}
+
+type syncLink struct {
+	Slug string `json:"slug"`
+	URL  string `json:"url"`
+}
+
+// Sync actions.
+const (
+	syncCreate = "create"
+	syncUpdate = "update"
+	syncDelete = "delete"
+)
+
+// syncChange is one step of a sync plan. Before is the resource as it is,
+// absent for a create, and After as it will be, absent for a delete.
+type syncChange struct {
+	Kind   string      `json:"kind"`
+	Name   string      `json:"name"`
+	Action string      `json:"action"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+
+	apply func() error
+}
+
+type syncPlan struct {
+	Applied bool         `json:"applied"`
+	Changes []syncChange `json:"changes"`
+}
+
+// decodeSyncDocument reads a JSON body, or YAML with a YAML content type.
+// YAML goes through JSON so both share the field names.
+func decodeSyncDocument(r *http.Request) (syncDocument, error) {
+	var doc syncDocument
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return doc, bodyError(err, "Invalid sync document")
+	}
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/yaml" || ct == "application/x-yaml" || ct == "text/yaml" {
+		var v interface{}
+		if err := yaml.Unmarshal(body, &v); err != nil {
+			return doc, badRequest("Invalid sync YAML: " + err.Error())
+		}
+		if body, err = json.Marshal(v); err != nil {
+			return doc, badRequest("Invalid sync YAML: " + err.Error())
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		return doc, badRequest("Invalid sync document: " + err.Error())
+	}
+	return doc, nil
+}
+
+// validate checks the whole document before anything is planned, so a
+// document with a mistake in it changes nothing.
+func (doc syncDocument) validate() error {
+	if doc.Tenant != "" {
+		known := false
+		for _, id := range tenantIDs() {
+			known = known || id == doc.Tenant
+		}
+		if !known {
+			return badRequest("Unknown tenant " + doc.Tenant)
+		}
+	}
+	if doc.Links != nil {
+		seen := make(map[string]bool)
+		for _, l := range *doc.Links {
+			if !slugPattern.MatchString(l.Slug) || l.Slug == expiringLinksSlug {
+				return badRequest(fmt.Sprintf("Invalid link slug %q", l.Slug))
+			}
+			if seen[l.Slug] {
+				return badRequest("Link " + l.Slug + " is listed twice")
+			}
+			seen[l.Slug] = true
+			if err := checkDestination(l.URL); err != nil {
+				return badRequest("Link " + l.Slug + ": " + publicMessage(err))
+			}
+		}
+	}
+	if doc.Templates != nil {
+		seen := make(map[string]bool)
+		for _, t := range *doc.Templates {
+			if !templateNamePattern.MatchString(t.Name) {
+				return badRequest(fmt.Sprintf("Invalid template name %q", t.Name))
+			}
+			if seen[t.Name] {
+				return badRequest("Template " + t.Name + " is listed twice")
+			}
+			seen[t.Name] = true
+			if err := t.validate(); err != nil {
+				return badRequest("Template " + t.Name + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// plan diffs the document against the stored links and templates.
+func (doc syncDocument) plan() ([]syncChange, error) {
+	changes := []syncChange{}
+	if doc.Links != nil {
+		c, err := doc.planLinks()
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c...)
+	}
+	if doc.Templates != nil {
+		c, err := doc.planTemplates()
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c...)
+	}
+	return changes, nil
+}
+
+func (doc syncDocument) planLinks() ([]syncChange, error) {
+	current, err := links.List(doc.Tenant)
+	if err != nil {
+		return nil, internalError("Failed to list short links", err)
+	}
+	existing := make(map[string]shortLink, len(current))
+	for _, l := range current {
+		existing[l.Slug] = l
+	}
+
+	var changes []syncChange
+	for _, want := range *doc.Links {
+		want := want
+		have, ok := existing[want.Slug]
+		delete(existing, want.Slug)
+		switch {
+		case !ok:
+			if _, err := links.Get(want.Slug); err == nil {
+				return nil, &httpError{status: http.StatusConflict, class: classInvalidRequest, msg: "Short link " + want.Slug + " belongs to another tenant"}
+			} else if !errors.Is(err, errLinkNotFound) {
+				return nil, internalError("Failed to load short link", err)
+			}
+			changes = append(changes, syncChange{Kind: "link", Name: want.Slug, Action: syncCreate, After: want, apply: func() error {
+				now := time.Now().UTC()
+				return links.Create(shortLink{Slug: want.Slug, URL: want.URL, Tenant: doc.Tenant, CreatedAt: now, UpdatedAt: now})
+			}})
+		case have.URL != want.URL:
+			changes = append(changes, syncChange{Kind: "link", Name: want.Slug, Action: syncUpdate, Before: syncLink{have.Slug, have.URL}, After: want, apply: func() error {
+				_, err := links.Update(want.Slug, func(l *shortLink) error {
+					l.URL = want.URL
+					l.UpdatedAt = time.Now().UTC()
+					return nil
+				})
+				return err
+			}})
+		}
+	}
+
+	// What is left over is no longer wanted
+	for _, l := range current {
+		if _, ok := existing[l.Slug]; !ok {
+			continue
+		}
+		slug := l.Slug
+		changes = append(changes, syncChange{Kind: "link", Name: slug, Action: syncDelete, Before: syncLink{l.Slug, l.URL}, apply: func() error {
+			return links.Delete(slug)
+		}})
+	}
+	return changes, nil
+}
+
+func (doc syncDocument) planTemplates() ([]syncChange, error) {
+	names, err := templates.List()
+	if err != nil {
+		return nil, internalError("Failed to list templates", err)
+	}
+	unwanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		unwanted[name] = true
+	}
+
+	var changes []syncChange
+	for _, want := range *doc.Templates {
+		want := want
+		delete(unwanted, want.Name)
+		have, err := templates.Load(want.Name)
+		save := func() error { return templates.Save(want) }
+		switch {
+		case errors.Is(err, errTemplateNotFound):
+			changes = append(changes, syncChange{Kind: "template", Name: want.Name, Action: syncCreate, After: want, apply: save})
+		case err != nil:
+			return nil, internalError("Failed to load template", err)
+		case !sameJSON(have, want):
+			changes = append(changes, syncChange{Kind: "template", Name: want.Name, Action: syncUpdate, Before: have, After: want, apply: save})
+		}
+	}
+
+	var gone []string
+	for name := range unwanted {
+		gone = append(gone, name)
+	}
+	sort.Strings(gone)
+	for _, name := range gone {
+		name := name
+		have, err := templates.Load(name)
+		if err != nil {
+			return nil, internalError("Failed to load template", err)
+		}
+		changes = append(changes, syncChange{Kind: "template", Name: name, Action: syncDelete, Before: have, apply: func() error {
+			return templates.Delete(name)
+		}})
+	}
+	return changes, nil
+}
+
+// sameJSON compares values as they would be stored.
+func sameJSON(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+// syncState brings links and templates in line with a declarative
+// document, JSON or YAML, and returns the plan of changes it made. With
+// dry_run=true the plan is only returned. Changes apply in plan order; if
+// one fails the sync stops there, and running it again picks up the rest.
+func syncState(w http.ResponseWriter, r *http.Request) {
+	doc, err := decodeSyncDocument(r)
+	if err == nil {
+		err = doc.validate()
+	}
+	var changes []syncChange
+	if err == nil {
+		changes, err = doc.plan()
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	plan := syncPlan{Changes: changes}
+	if r.URL.Query().Get("dry_run") != "true" {
+		for _, c := range changes {
+			if err := c.apply(); err != nil {
+				writeError(w, internalError(fmt.Sprintf("Failed to %s %s %s", c.Action, c.Kind, c.Name), err))
+				return
+			}
+		}
+		plan.Applied = true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
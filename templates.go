@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// styleTemplate is a named set of styling applied on top of the server
+// defaults when a request passes template=<name>. Empty fields leave the
+// default alone.
+type styleTemplate struct {
+	Name                 string   `json:"name"`
+	RecoveryLevel        string   `json:"recovery_level,omitempty"`
+	Foreground           string   `json:"foreground,omitempty"`
+	Background           string   `json:"background,omitempty"`
+	LogoFile             string   `json:"logo_file,omitempty"`
+	RemoveLogoBackground bool     `json:"remove_logo_background,omitempty"`
+	FontFile             string   `json:"font_file,omitempty"`
+	LabelColor           string   `json:"label_color,omitempty"`
+	LabelBackground      string   `json:"label_background,omitempty"`
+	LabelPosition        string   `json:"label_position,omitempty"`
+	LetterSpacing        float64  `json:"letter_spacing,omitempty"`
+	DisableKerning       bool     `json:"disable_kerning,omitempty"`
+	Pattern              string   `json:"pattern,omitempty"`
+	PatternColor         string   `json:"pattern_color,omitempty"`
+	PatternOpacity       float64  `json:"pattern_opacity,omitempty"`
+	Palette              []string `json:"palette,omitempty"`
+}
+
+// validate checks the template fields that can be checked without
+// rendering.
+func (t styleTemplate) validate() error {
+	if t.RecoveryLevel != "" {
+		if _, ok := recoveryLevels[t.RecoveryLevel]; !ok {
+			return fmt.Errorf("unknown recovery level %q", t.RecoveryLevel)
+		}
+	}
+	for _, f := range []string{t.LogoFile, t.FontFile} {
+		if f != "" {
+			if err := checkKey(f); err != nil {
+				return fmt.Errorf("invalid asset name %q", f)
+			}
+		}
+	}
+	if t.Foreground != "" || t.Background != "" {
+		fg, bg, err := moduleColors(renderSpec{Foreground: t.Foreground, Background: t.Background})
+		if err != nil {
+			return errors.New(publicMessage(err))
+		}
+		if err := checkModuleContrast(fg, bg); err != nil {
+			return err
+		}
+	}
+	for _, c := range []string{t.LabelColor, t.LabelBackground, t.PatternColor} {
+		if c != "" {
+			if _, err := parseHexColor(c); err != nil {
+				return err
+			}
+		}
+	}
+	switch t.LabelPosition {
+	case "", labelBottom, labelTop, labelLeft, labelRight:
+	default:
+		return fmt.Errorf("unknown label position %q", t.LabelPosition)
+	}
+	if t.LetterSpacing < minLetterSpacing || t.LetterSpacing > maxLetterSpacing {
+		return fmt.Errorf("letter spacing must be in [%g, %g] ems", minLetterSpacing, maxLetterSpacing)
+	}
+	if t.Pattern != "" && !isPattern(t.Pattern) {
+		return fmt.Errorf("unknown pattern %q", t.Pattern)
+	}
+	if t.PatternOpacity < 0 || t.PatternOpacity > maxPatternOpacity {
+		return fmt.Errorf("pattern opacity must be in (0, %g]", maxPatternOpacity)
+	}
+	if len(t.Palette) > 0 {
+		if _, err := parsePalette(strings.Join(t.Palette, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply writes the template's fields over spec and records the template
+// name, so the code can be found again when the template changes.
+func (t styleTemplate) apply(spec renderSpec) renderSpec {
+	spec.Template = t.Name
+	if t.RecoveryLevel != "" {
+		spec.RecoveryLevel = t.RecoveryLevel
+	}
+	if t.Foreground != "" {
+		spec.Foreground = t.Foreground
+	}
+	if t.Background != "" {
+		spec.Background = t.Background
+	}
+	if t.LogoFile != "" {
+		spec.LogoFile = t.LogoFile
+	}
+	if t.RemoveLogoBackground {
+		spec.RemoveLogoBackground = true
+	}
+	if t.FontFile != "" {
+		spec.FontFile = t.FontFile
+	}
+	if t.LabelColor != "" {
+		spec.LabelColor = t.LabelColor
+	}
+	if t.LabelBackground != "" {
+		spec.LabelBackground = t.LabelBackground
+	}
+	if t.LabelPosition == labelBottom {
+		spec.LabelPosition = ""
+	} else if t.LabelPosition != "" {
+		spec.LabelPosition = t.LabelPosition
+	}
+	if t.LetterSpacing != 0 {
+		spec.LetterSpacing = t.LetterSpacing
+	}
+	if t.DisableKerning {
+		spec.DisableKerning = true
+	}
+	if t.Pattern != "" {
+		spec.Pattern = t.Pattern
+		spec.PatternColor = hexColor(defaultPatternColor)
+		spec.PatternOpacity = defaultPatternOpacity
+		if t.PatternColor != "" {
+			spec.PatternColor = t.PatternColor
+		}
+		if t.PatternOpacity != 0 {
+			spec.PatternOpacity = t.PatternOpacity
+		}
+	}
+	if len(t.Palette) > 0 {
+		spec.Palette = t.Palette
+		spec.PaletteSeed = paletteSeed(spec.Data)
+	}
+	return spec
+}
+
+// restyle resolves spec again under the template as it is now. The
+// request that produced spec is replayed and the fields a template can set
+// are taken from the result, so the request's own overrides still beat the
+// template and fields the template no longer sets fall back to the
+// defaults. Everything decided after resolving, such as quota watermarks,
+// signature sizing and snapping, is kept as stored. A logo uploaded or
+// fetched with the request beat the template, and still does. Specs stored
+// without their request only get t applied over them.
+func (t styleTemplate) restyle(spec renderSpec) (renderSpec, error) {
+	if spec.params == nil {
+		return t.apply(spec), nil
+	}
+	var owner *tenant
+	if spec.tenant != "" {
+		if owner = tenantByID(spec.tenant); owner == nil {
+			return spec, badRequest("Tenant " + spec.tenant + " no longer exists")
+		}
+	}
+	re, err := specFromValues(owner, spec.params)
+	if err != nil {
+		return spec, err
+	}
+
+	spec.Template = re.Template
+	spec.RecoveryLevel = re.RecoveryLevel
+	spec.Foreground, spec.Background = re.Foreground, re.Background
+	if !strings.HasPrefix(spec.LogoFile, logoUploadPrefix) {
+		spec.LogoFile = re.LogoFile
+	}
+	spec.RemoveLogoBackground = re.RemoveLogoBackground
+	spec.FontFile, spec.FallbackFonts = re.FontFile, re.FallbackFonts
+	spec.LabelColor, spec.LabelBackground = re.LabelColor, re.LabelBackground
+	spec.LabelPosition = re.LabelPosition
+	spec.LetterSpacing, spec.DisableKerning = re.LetterSpacing, re.DisableKerning
+	spec.Pattern, spec.PatternColor, spec.PatternOpacity = re.Pattern, re.PatternColor, re.PatternOpacity
+	spec.Palette, spec.PaletteSeed = re.Palette, re.PaletteSeed
+	return spec, nil
+}
+
+// templateStore keeps templates as JSON blobs, one per name. Changes are
+// recorded in changes for replication when it is set.
+type templateStore struct {
+	st      storage
+	changes *changeLog
+}
+
+const templatePrefix = "templates/"
+
+var errTemplateNotFound = errors.New("template not found")
+
+func (s *templateStore) Save(t styleTemplate) error {
+	if !templateNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("invalid template name %q", t.Name)
+	}
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := s.st.Put(templatePrefix+t.Name+".json", b); err != nil {
+		return err
+	}
+	s.changes.emit(changeTemplate, t.Name, changePut, nil, &t)
+	return nil
+}
+
+func (s *templateStore) Load(name string) (styleTemplate, error) {
+	var t styleTemplate
+	if !templateNamePattern.MatchString(name) {
+		return t, errTemplateNotFound
+	}
+
+	b, err := s.st.Get(templatePrefix + name + ".json")
+	if errors.Is(err, errNotFound) {
+		return t, errTemplateNotFound
+	}
+	if err != nil {
+		return t, err
+	}
+
+	if err := json.Unmarshal(b, &t); err != nil {
+		return t, fmt.Errorf("decode template %s: %w", name, err)
+	}
+	return t, nil
+}
+
+// List returns the names of all templates.
+func (s *templateStore) List() ([]string, error) {
+	keys, err := s.st.List(templatePrefix)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, k := range keys {
+		name := strings.TrimSuffix(strings.TrimPrefix(k, templatePrefix), ".json")
+		if templateNamePattern.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Delete removes a template. Codes already rendered from it keep their
+// styling, but requests naming it fail.
+func (s *templateStore) Delete(name string) error {
+	if !templateNamePattern.MatchString(name) {
+		return errTemplateNotFound
+	}
+	err := s.st.Delete(templatePrefix + name + ".json")
+	if errors.Is(err, errNotFound) {
+		return errTemplateNotFound
+	}
+	if err != nil {
+		return err
+	}
+	s.changes.emit(changeTemplate, name, changeDelete, nil, nil)
+	return nil
+}
+
+var templateNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+// putTemplate creates or replaces a template from the JSON body. Existing
+// codes keep their old styling until the template is re-rendered.
+func putTemplate(w http.ResponseWriter, r *http.Request) {
+	var t styleTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		writeError(w, bodyError(err, "Invalid template JSON"))
+		return
+	}
+	t.Name = mux.Vars(r)["name"]
+
+	if err := t.validate(); err != nil {
+		http.Error(w, "Invalid template: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := templates.Save(t); err != nil {
+		writeError(w, internalError("Failed to store template", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+func getTemplate(w http.ResponseWriter, r *http.Request) {
+	t, err := templates.Load(mux.Vars(r)["name"])
+	if errors.Is(err, errTemplateNotFound) {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, internalError("Failed to load template", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// rerenderTemplate starts a background job re-rendering every stored code
+// that references the template, so a restyle reaches the whole catalog.
+func rerenderTemplate(w http.ResponseWriter, r *http.Request) {
+	t, err := templates.Load(mux.Vars(r)["name"])
+	if errors.Is(err, errTemplateNotFound) {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, internalError("Failed to load template", err))
+		return
+	}
+
+	j := jobs.create("template-rerender")
+	j.schedule(jobOptions{concurrency: 1, priority: priorityLow})
+	go rerenderTemplateJob(j, t)
+
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	writeJob(w, http.StatusAccepted, j)
+}
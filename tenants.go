@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// tenant is a customer integration, identified by any of its API keys in
+// the X-API-Key header. Requests without a key are served as before with
+// no tenant. LogoFile and FontFile name assets that replace the global
+// defaults for the tenant's codes.
+type tenant struct {
+	ID       string          `json:"id"`
+	APIKeys  []string        `json:"api_keys"`
+	Features map[string]bool `json:"features,omitempty"`
+	LogoFile string          `json:"logo_file,omitempty"`
+	FontFile string          `json:"font_file,omitempty"`
+	Quota    *quota          `json:"quota,omitempty"`
+	// Themes adds to the built-in colour themes, or replaces them by name.
+	Themes map[string]colorTheme `json:"themes,omitempty"`
+}
+
+// tenants maps API keys to their tenant. It is loaded once at startup.
+var tenants map[string]*tenant
+
+// loadTenants reads the JSON array of tenants in the file named by
+// QR_TENANTS_FILE. With the variable unset there are no tenants and any
+// X-API-Key is rejected. Default assets must already exist in the asset
+// store, so a typo cannot silently fall back to the smartlink logo.
+func loadTenants() (map[string]*tenant, error) {
+	byKey := make(map[string]*tenant)
+	path := os.Getenv("QR_TENANTS_FILE")
+	if path == "" {
+		return byKey, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []*tenant
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	ids := make(map[string]bool)
+	for _, t := range list {
+		if !keySegmentPattern.MatchString(t.ID) {
+			return nil, fmt.Errorf("invalid tenant id %q", t.ID)
+		}
+		if ids[t.ID] {
+			return nil, fmt.Errorf("duplicate tenant id %q", t.ID)
+		}
+		ids[t.ID] = true
+		for name := range t.Features {
+			if !isFeature(name) {
+				return nil, fmt.Errorf("tenant %s: unknown feature %q", t.ID, name)
+			}
+		}
+		if t.Quota != nil {
+			if err := t.Quota.validate(); err != nil {
+				return nil, fmt.Errorf("tenant %s: %w", t.ID, err)
+			}
+		}
+		if err := checkThemes(t.Themes); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", t.ID, err)
+		}
+		for _, f := range []string{t.LogoFile, t.FontFile} {
+			if f == "" {
+				continue
+			}
+			if err := checkKey(f); err != nil {
+				return nil, fmt.Errorf("tenant %s: %w", t.ID, err)
+			}
+			if _, err := assets.Get(f); err != nil {
+				return nil, fmt.Errorf("tenant %s: asset %s: %w", t.ID, f, err)
+			}
+		}
+		for _, k := range t.APIKeys {
+			if k == "" {
+				return nil, fmt.Errorf("tenant %s: empty API key", t.ID)
+			}
+			if byKey[k] != nil {
+				return nil, fmt.Errorf("tenant %s: API key already used by %s", t.ID, byKey[k].ID)
+			}
+			byKey[k] = t
+		}
+	}
+	return byKey, nil
+}
+
+// defaultSpec returns the server defaults with the tenant's own assets
+// substituted. t may be nil.
+func (t *tenant) defaultSpec() renderSpec {
+	spec := defaultSpec()
+	if t == nil {
+		return spec
+	}
+	if t.LogoFile != "" {
+		spec.LogoFile = t.LogoFile
+	}
+	if t.FontFile != "" {
+		spec.FontFile = t.FontFile
+	}
+	return spec
+}
+
+// tenantIDs returns the configured tenant ids, sorted.
+func tenantIDs() []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, t := range tenants {
+		if !seen[t.ID] {
+			seen[t.ID] = true
+			ids = append(ids, t.ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// tenantByID returns the configured tenant with the given id, or nil.
+func tenantByID(id string) *tenant {
+	for _, t := range tenants {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+type tenantKey struct{}
+
+// tenantFrom returns the tenant a request was authenticated as, or nil.
+func tenantFrom(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantKey{}).(*tenant)
+	return t
+}
+
+// identifyTenant attaches the tenant named by X-API-Key to the request
+// context. An unknown key is refused rather than served anonymously.
+func identifyTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t := tenants[key]
+		if t == nil {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, t)))
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"net/http"
+	"sort"
+)
+
+// colorTheme is a named set of colours chosen to go together, selected
+// with theme=<name>. A theme sets the modules and the label at once;
+// fg, bg, label_background and label_color given alongside it still win.
+type colorTheme struct {
+	Foreground      string `json:"foreground"`
+	Background      string `json:"background"`
+	LabelBackground string `json:"label_background"`
+	LabelColor      string `json:"label_color"`
+}
+
+// builtinThemes are offered to everyone. Tenants can add their own, or
+// replace one of these, in the tenants file.
+var builtinThemes = map[string]colorTheme{
+	"mono":     {"#000000", "#ffffff", "#000000", "#ffffff"},
+	"midnight": {"#0b1a33", "#e8eef8", "#0b1a33", "#e8eef8"},
+	"sunrise":  {"#7a2e0e", "#fff4e6", "#f26b1d", "#ffffff"},
+	"forest":   {"#1b4332", "#f1f8f4", "#2d6a4f", "#ffffff"},
+	"ocean":    {"#023e8a", "#f0f7ff", "#0077b6", "#ffffff"},
+}
+
+// validate checks that every colour is set and the modules can be scanned.
+func (th colorTheme) validate() error {
+	for _, c := range []string{th.Foreground, th.Background, th.LabelBackground, th.LabelColor} {
+		if _, err := parseHexColor(c); err != nil {
+			return err
+		}
+	}
+	fg, _ := parseHexColor(th.Foreground)
+	bg, _ := parseHexColor(th.Background)
+	return checkModuleContrast(fg, bg)
+}
+
+// apply writes the theme's colours over spec. Black and white modules are
+// left unset, as fg and bg leave them.
+func (th colorTheme) apply(spec renderSpec) renderSpec {
+	for _, p := range []struct {
+		value string
+		field *string
+		def   color.Color
+	}{
+		{th.Foreground, &spec.Foreground, color.Black},
+		{th.Background, &spec.Background, color.White},
+		{th.LabelBackground, &spec.LabelBackground, nil},
+		{th.LabelColor, &spec.LabelColor, nil},
+	} {
+		c, _ := parseHexColor(p.value)
+		*p.field = hexColor(c)
+		if p.def != nil && *p.field == hexColor(p.def) {
+			*p.field = ""
+		}
+	}
+	return spec
+}
+
+// theme looks up a theme by name, the tenant's own first. t may be nil.
+func (t *tenant) theme(name string) (colorTheme, bool) {
+	if t != nil {
+		if th, ok := t.Themes[name]; ok {
+			return th, true
+		}
+	}
+	th, ok := builtinThemes[name]
+	return th, ok
+}
+
+// themes returns every theme the tenant can use. t may be nil.
+func (t *tenant) themes() map[string]colorTheme {
+	all := make(map[string]colorTheme, len(builtinThemes))
+	for name, th := range builtinThemes {
+		all[name] = th
+	}
+	if t != nil {
+		for name, th := range t.Themes {
+			all[name] = th
+		}
+	}
+	return all
+}
+
+// listThemes serves GET /themes: the themes open to the caller, by name.
+func listThemes(w http.ResponseWriter, r *http.Request) {
+	all := tenantFrom(r.Context()).themes()
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type namedTheme struct {
+		Name string `json:"name"`
+		colorTheme
+	}
+	list := make([]namedTheme, 0, len(names))
+	for _, name := range names {
+		list = append(list, namedTheme{name, all[name]})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// checkThemes validates the themes a tenant defines.
+func checkThemes(themes map[string]colorTheme) error {
+	for name, th := range themes {
+		if !templateNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid theme name %q", name)
+		}
+		if err := th.validate(); err != nil {
+			return fmt.Errorf("theme %s: %w", name, err)
+		}
+	}
+	return nil
+}
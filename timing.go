@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverTiming enables Server-Timing response headers, from
+// QR_SERVER_TIMING=on.
+var serverTiming bool
+
+// stageTimer accumulates how long each render stage took. A nil
+// *stageTimer records nothing, so callers that do not report timings pass
+// nil.
+type stageTimer struct {
+	mu     sync.Mutex
+	order  []string
+	stages map[string]time.Duration
+}
+
+func newStageTimer() *stageTimer {
+	return &stageTimer{stages: make(map[string]time.Duration)}
+}
+
+// start begins timing stage name; call the returned func when it ends.
+func (t *stageTimer) start(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+	began := time.Now()
+	return func() {
+		d := time.Since(began)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, ok := t.stages[name]; !ok {
+			t.order = append(t.order, name)
+		}
+		t.stages[name] += d
+	}
+}
+
+// header formats the stages as a Server-Timing value, in milliseconds.
+func (t *stageTimer) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parts := make([]string, len(t.order))
+	for i, name := range t.order {
+		parts[i] = fmt.Sprintf("%s;dur=%.3f", name, float64(t.stages[name])/float64(time.Millisecond))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// requestTimer returns a timer for the request when Server-Timing is
+// enabled, or nil.
+func requestTimer() *stageTimer {
+	if !serverTiming {
+		return nil
+	}
+	return newStageTimer()
+}
+
+// writeTiming sets the Server-Timing header from t, if any.
+func writeTiming(w http.ResponseWriter, t *stageTimer) {
+	if t == nil {
+		return
+	}
+	if h := t.header(); h != "" {
+		w.Header().Set("Server-Timing", h)
+	}
+}
+
+func loadServerTiming() bool {
+	switch v := os.Getenv("QR_SERVER_TIMING"); v {
+	case "", "off":
+		return false
+	case "on":
+		return true
+	default:
+		log.Fatalf("Invalid QR_SERVER_TIMING=%q: expected on or off", v)
+		return false
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/disintegration/imaging"
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomedium"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// Letter spacing is in ems, like CSS letter-spacing, so it scales with the
+// label font size.
+const (
+	minLetterSpacing = -0.5
+	maxLetterSpacing = 1.0
+)
+
+// labelStyle is how drawLabelText sets a label beyond the freetype context:
+// the font size in pixels, the emoji font if any, fonts for characters the
+// label font lacks, extra space after each character, the font whose
+// kerning pairs apply, and whether lines are shaped first.
+type labelStyle struct {
+	size      float64
+	emoji     *colorFont
+	fallbacks []*sfnt.Font
+	spacing   fixed.Int26_6
+	tracked   bool
+	kern      *sfnt.Font
+	shape     bool
+}
+
+// labelStyleFor loads what spec's label needs beyond the label font.
+func labelStyleFor(spec renderSpec) (labelStyle, error) {
+	st := labelStyle{
+		size:    spec.LabelFontSize,
+		spacing: fixed.Int26_6(spec.LetterSpacing * spec.LabelFontSize * 64),
+		tracked: spec.LetterSpacing != 0 || spec.DisableKerning,
+		shape:   spec.Renderer >= 5,
+	}
+	for _, name := range spec.FallbackFonts {
+		f, err := loadFallbackFont(name)
+		if err != nil {
+			return st, err
+		}
+		st.fallbacks = append(st.fallbacks, f)
+	}
+	if spec.EmojiFont != "" {
+		emoji, err := loadColorFont(spec.EmojiFont)
+		if err != nil {
+			return st, err
+		}
+		st.emoji = emoji
+	}
+	if st.tracked && !spec.DisableKerning {
+		kern, err := loadKernFont(spec.FontFile)
+		if err != nil {
+			return st, err
+		}
+		st.kern = kern
+	}
+	return st, nil
+}
+
+// at returns the style for the label set at size instead, with the letter
+// spacing scaled along.
+func (st labelStyle) at(size float64) labelStyle {
+	if size != st.size {
+		st.spacing = fixed.Int26_6(float64(st.spacing) * size / st.size)
+		st.size = size
+	}
+	return st
+}
+
+// loadKernFont parses the named font asset for its kerning, which sfnt
+// reads from GPOS pair adjustments as well as the legacy kern table that
+// freetype is limited to.
+func loadKernFont(name string) (*sfnt.Font, error) {
+	b := gomedium.TTF
+	if name != "" {
+		var err error
+		if b, err = assets.Get(name); err != nil {
+			return nil, internalError("Failed to load font file", err)
+		}
+	}
+	f, err := sfnt.Parse(b)
+	if err != nil {
+		return nil, internalError("Failed to parse font", err)
+	}
+	return f, nil
+}
+
+// drawLabelText draws text in f from pt, in the colour src. A plain label
+// is a single DrawString, so labels drawn before letter spacing and emoji
+// existed stay identical. A tracked label is set one character at a time,
+// kerning each pair and adding the letter spacing after every character.
+// Characters f has no glyph for are drawn from the first fallback that has.
+func drawLabelText(ctx *freetype.Context, dst draw.Image, src image.Image, f *truetype.Font, text string, pt fixed.Point26_6, st labelStyle) error {
+	lf := newLabelFonts(f, st)
+	if st.shape {
+		text = shapeLine(text, lf.has)
+	}
+	if !st.tracked && st.emoji == nil && st.fallbacks == nil {
+		_, err := ctx.DrawString(text, pt)
+		return err
+	}
+
+	var run []rune
+	flush := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+		next, err := ctx.DrawString(string(run), pt)
+		pt, run = next, run[:0]
+		return err
+	}
+
+	var buf sfnt.Buffer
+	var prev sfnt.GlyphIndex
+	ppem := fixed.Int26_6(st.size * 64)
+	for _, r := range text {
+		if st.emoji != nil {
+			if r == variationSelector16 || r == zeroWidthJoiner {
+				continue
+			}
+			if g, ok := st.emoji.glyph(r); ok && isEmoji(r) {
+				if err := flush(); err != nil {
+					return err
+				}
+				pt.X += st.emoji.drawGlyph(dst, g, pt, st.size) + st.spacing
+				prev = 0
+				continue
+			}
+		}
+		if face := lf.fallbackFor(r); face != nil {
+			if err := flush(); err != nil {
+				return err
+			}
+			d := font.Drawer{Dst: dst, Src: src, Face: face, Dot: pt}
+			d.DrawString(string(r))
+			pt = d.Dot
+			pt.X += st.spacing
+			prev = 0
+			continue
+		}
+		if !st.tracked {
+			run = append(run, r)
+			continue
+		}
+
+		if st.kern != nil {
+			x, _ := st.kern.GlyphIndex(&buf, r)
+			if prev != 0 && x != 0 {
+				if k, err := st.kern.Kern(&buf, prev, x, ppem, font.HintingNone); err == nil {
+					pt.X += k
+				}
+			}
+			prev = x
+		}
+		next, err := ctx.DrawString(string(r), pt)
+		if err != nil {
+			return err
+		}
+		pt = next
+		pt.X += st.spacing
+	}
+	return flush()
+}
+
+// measureLabelText returns how far drawLabelText advances the pen over
+// text in f, following the same steps without drawing.
+func measureLabelText(f *truetype.Font, text string, st labelStyle) fixed.Int26_6 {
+	lf := newLabelFonts(f, st)
+	if st.shape {
+		text = shapeLine(text, lf.has)
+	}
+	face := truetype.NewFace(f, &truetype.Options{Size: st.size, DPI: 72})
+	if !st.tracked && st.emoji == nil && st.fallbacks == nil {
+		return font.MeasureString(face, text)
+	}
+
+	var width fixed.Int26_6
+	var run []rune
+	flush := func() {
+		width += font.MeasureString(face, string(run))
+		run = run[:0]
+	}
+
+	var buf sfnt.Buffer
+	var prev sfnt.GlyphIndex
+	ppem := fixed.Int26_6(st.size * 64)
+	for _, r := range text {
+		if st.emoji != nil {
+			if r == variationSelector16 || r == zeroWidthJoiner {
+				continue
+			}
+			if g, ok := st.emoji.glyph(r); ok && isEmoji(r) {
+				flush()
+				width += st.emoji.advance(g, st.size) + st.spacing
+				prev = 0
+				continue
+			}
+		}
+		if fb := lf.fallbackFor(r); fb != nil {
+			flush()
+			width += font.MeasureString(fb, string(r)) + st.spacing
+			prev = 0
+			continue
+		}
+		if !st.tracked {
+			run = append(run, r)
+			continue
+		}
+
+		if st.kern != nil {
+			x, _ := st.kern.GlyphIndex(&buf, r)
+			if prev != 0 && x != 0 {
+				if k, err := st.kern.Kern(&buf, prev, x, ppem, font.HintingNone); err == nil {
+					width += k
+				}
+			}
+			prev = x
+		}
+		width += font.MeasureString(face, string(r)) + st.spacing
+	}
+	flush()
+	return width
+}
+
+// Label positions. Bottom is the default and is left out of specs.
+const (
+	labelBottom = "bottom"
+	labelTop    = "top"
+	labelLeft   = "left"
+	labelRight  = "right"
+)
+
+func (s renderSpec) sideLabel() bool {
+	return s.LabelPosition == labelLeft || s.LabelPosition == labelRight
+}
+
+// Bounds of the label strip, outline and shadow, in pixels at the spec's
+// size.
+const (
+	minLabelFontSize    = 8
+	maxLabelFontSize    = 200
+	minLabelHeight      = 16
+	maxLabelHeight      = 400
+	defaultLabelPadding = 12
+	maxLabelPadding     = 100
+
+	defaultOutlineWidth = 2
+	maxOutlineWidth     = 8
+	defaultShadowOffset = 2
+	maxShadowOffset     = 16
+	maxShadowBlur       = 8
+)
+
+func (s renderSpec) hasLabelEffects() bool {
+	return s.LabelOutline != "" || s.LabelShadow != ""
+}
+
+// drawLabelEffects paints the shadow and outline of the text whose coverage
+// is mask, for the text itself to be drawn over. The shadow is cast by the
+// outlined shape, so the two read as one.
+func drawLabelEffects(dst *image.RGBA, mask *image.Alpha, spec renderSpec) error {
+	shape := image.Image(mask)
+	var outline *image.Alpha
+	if spec.LabelOutline != "" {
+		outline = dilate(mask, spec.LabelOutlineWidth)
+		shape = outline
+	}
+
+	if spec.LabelShadow != "" {
+		c, err := parseHexColor(spec.LabelShadow)
+		if err != nil {
+			return badRequest("Invalid label shadow color")
+		}
+		if spec.LabelShadowBlur > 0 {
+			shape = imaging.Blur(shape, spec.LabelShadowBlur)
+		}
+		off := image.Pt(spec.LabelShadowOffset, spec.LabelShadowOffset)
+		draw.DrawMask(dst, dst.Bounds(), image.NewUniform(c), image.Point{}, shape, dst.Bounds().Min.Sub(off), draw.Over)
+	}
+	if outline != nil {
+		c, err := parseHexColor(spec.LabelOutline)
+		if err != nil {
+			return badRequest("Invalid label outline color")
+		}
+		draw.DrawMask(dst, dst.Bounds(), image.NewUniform(c), image.Point{}, outline, dst.Bounds().Min, draw.Over)
+	}
+	return nil
+}
+
+// dilate grows the coverage of m by radius pixels in every direction.
+func dilate(m *image.Alpha, radius int) *image.Alpha {
+	var offsets []image.Point
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			if dx*dx+dy*dy <= radius*radius {
+				offsets = append(offsets, image.Pt(dx, dy))
+			}
+		}
+	}
+
+	b := m.Bounds()
+	out := image.NewAlpha(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			a := m.AlphaAt(x, y).A
+			if a == 0 {
+				continue
+			}
+			for _, o := range offsets {
+				p := image.Pt(x+o.X, y+o.Y)
+				if p.In(b) && out.AlphaAt(p.X, p.Y).A < a {
+					out.SetAlpha(p.X, p.Y, color.Alpha{A: a})
+				}
+			}
+		}
+	}
+	return out
+}
+
+// Renderer 3 fits the label to its strip: a label too wide for one line is
+// shrunk down to minLabelShrink of its size, and past that wrapped to two
+// lines, which are shrunk as far as they need.
+const minLabelShrink = 0.75
+
+// maxLabelLines caps the lines a label can be written on.
+const maxLabelLines = 4
+
+// labelLine is one line of a laid out label, with the pen position it
+// starts from.
+type labelLine struct {
+	text     string
+	x        fixed.Int26_6
+	baseline int
+}
+
+// labelLayout is where a label's lines go in a strip of the given height,
+// and the style, possibly shrunk, they are set in.
+type labelLayout struct {
+	height int
+	style  labelStyle
+	lines  []labelLine
+}
+
+// layoutLabel sets spec's label in a strip width pixels wide. From
+// renderer 4 a label may hold several lines, separated by newlines. Specs
+// from before renderer 3 keep the original estimate of the text width, so
+// they draw as they always have.
+func layoutLabel(spec renderSpec, f *truetype.Font, st labelStyle, width int) labelLayout {
+	if spec.Renderer < 3 {
+		height, baseline := labelStrip(spec, f)
+		n := len(spec.Label)
+		condition := n * 2
+		x := ((width / 2) - (n * 7)) + (n-condition)*3
+		return labelLayout{height: height, style: st, lines: []labelLine{{spec.Label, fixed.I(x), baseline}}}
+	}
+
+	// Keep half an em clear at either end
+	avail := fixed.I(width - 2*int(math.Ceil(spec.LabelFontSize/2)))
+	lines := []string{spec.Label}
+	explicit := spec.Renderer >= 4 && strings.Contains(spec.Label, "\n")
+	if explicit {
+		lines = strings.Split(spec.Label, "\n")
+	}
+	var longest fixed.Int26_6
+	for _, text := range lines {
+		if w := measureLabelText(f, text, st); w > longest {
+			longest = w
+		}
+	}
+	if !explicit && longest > avail && float64(avail) < minLabelShrink*float64(longest) {
+		if split, w := splitLabel(f, spec.Label, st); split != nil {
+			lines, longest = split, w
+		}
+	}
+	if longest > avail && longest > 0 {
+		st = st.at(st.size * float64(avail) / float64(longest))
+	}
+
+	m := truetype.NewFace(f, &truetype.Options{Size: st.size, DPI: 72}).Metrics()
+	ascent, descent, lineHeight := m.Ascent.Ceil(), m.Descent.Ceil(), m.Height.Ceil()
+	block := ascent + descent + (len(lines)-1)*lineHeight
+	height, top := block+2*spec.LabelPadding, spec.LabelPadding
+	if !spec.LabelAutoHeight {
+		height = spec.LabelHeight
+		if explicit {
+			// Each line past the first grows the strip by its line height
+			height += (len(lines) - 1) * lineHeight
+		} else if block > height && len(lines) > 1 {
+			st = st.at(st.size * float64(height) / float64(block))
+			m = truetype.NewFace(f, &truetype.Options{Size: st.size, DPI: 72}).Metrics()
+			ascent, descent, lineHeight = m.Ascent.Ceil(), m.Descent.Ceil(), m.Height.Ceil()
+			block = ascent + descent + (len(lines)-1)*lineHeight
+		}
+		top = (height - block) / 2
+	}
+
+	layout := labelLayout{height: height, style: st}
+	for i, text := range lines {
+		w := measureLabelText(f, text, st)
+		layout.lines = append(layout.lines, labelLine{text, (fixed.I(width) - w) / 2, top + ascent + i*lineHeight})
+	}
+	return layout
+}
+
+// splitLabel breaks text into two lines as evenly as it can, at a space,
+// or between any two characters of a label in a script written without
+// spaces. It returns nil when there is nowhere to break, and otherwise
+// the width of the longer line.
+func splitLabel(f *truetype.Font, text string, st labelStyle) ([]string, fixed.Int26_6) {
+	var breaks []int
+	spaced := strings.ContainsRune(strings.TrimSpace(text), ' ')
+	for i, r := range text {
+		if i == 0 {
+			continue
+		}
+		if (spaced && r == ' ') || (!spaced && unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul, unicode.Thai)) {
+			breaks = append(breaks, i)
+		}
+	}
+
+	var best []string
+	var bestWidth fixed.Int26_6
+	for _, i := range breaks {
+		first, second := strings.TrimSpace(text[:i]), strings.TrimSpace(text[i:])
+		if first == "" || second == "" {
+			continue
+		}
+		w := measureLabelText(f, first, st)
+		if w2 := measureLabelText(f, second, st); w2 > w {
+			w = w2
+		}
+		if best == nil || w < bestWidth {
+			best, bestWidth = []string{first, second}, w
+		}
+	}
+	return best, bestWidth
+}
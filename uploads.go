@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads follow the core of the tus protocol: POST /uploads
+// announces the Upload-Length, each PATCH appends a chunk at the
+// Upload-Offset the server reports, and HEAD tells a client that lost its
+// connection where to resume.
+const (
+	uploadOffsetHeader = "Upload-Offset"
+	uploadLengthHeader = "Upload-Length"
+	uploadChunkType    = "application/offset+octet-stream"
+)
+
+// upload is a file being received in chunks. Its bytes go to a temporary
+// file in spillDir.
+type upload struct {
+	mu      sync.Mutex
+	id      string
+	tenant  *tenant
+	path    string
+	length  int64
+	offset  int64
+	updated time.Time
+}
+
+func (u *upload) complete() bool {
+	return u.offset == u.length
+}
+
+// uploadStore holds uploads in memory; like jobs they do not survive a
+// restart. Uploads untouched for ttl are removed.
+type uploadStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	uploads map[string]*upload
+}
+
+var uploads *uploadStore
+
+func newUploadStore(ttl time.Duration) *uploadStore {
+	return &uploadStore{ttl: ttl, uploads: make(map[string]*upload)}
+}
+
+func (s *uploadStore) create(t *tenant, length int64) (*upload, error) {
+	f, err := os.CreateTemp(spillDir, "qr-upload-*.csv")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	u := &upload{id: hex.EncodeToString(b), tenant: t, path: f.Name(), length: length, updated: time.Now()}
+
+	s.mu.Lock()
+	s.prune(time.Now())
+	s.uploads[u.id] = u
+	s.mu.Unlock()
+	return u, nil
+}
+
+// get returns the upload with id if it belongs to tenant t.
+func (s *uploadStore) get(id string, t *tenant) (*upload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	u, ok := s.uploads[id]
+	if !ok || u.tenant != t {
+		return nil, false
+	}
+	return u, true
+}
+
+func (s *uploadStore) remove(u *upload) {
+	s.mu.Lock()
+	delete(s.uploads, u.id)
+	s.mu.Unlock()
+	os.Remove(u.path)
+}
+
+// prune drops expired uploads. The caller holds s.mu. Handlers lock an
+// upload before the store to remove it, so a locked upload is in use and
+// skipped rather than waited for.
+func (s *uploadStore) prune(now time.Time) {
+	for id, u := range s.uploads {
+		if !u.mu.TryLock() {
+			continue
+		}
+		expired := now.Sub(u.updated) > s.ttl
+		u.mu.Unlock()
+		if expired {
+			delete(s.uploads, id)
+			os.Remove(u.path)
+		}
+	}
+}
+
+func writeUploadHeaders(w http.ResponseWriter, u *upload) {
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(u.offset, 10))
+	w.Header().Set(uploadLengthHeader, strconv.FormatInt(u.length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// createUpload starts a resumable upload of Upload-Length bytes.
+func createUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get(uploadLengthHeader), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "Invalid 'Upload-Length' header", http.StatusBadRequest)
+		return
+	}
+	if length > serverLimits.MaxUploadBytes {
+		writeError(w, tooLarge(fmt.Sprintf("Upload is %d bytes, maximum is %d", length, serverLimits.MaxUploadBytes)))
+		return
+	}
+
+	u, err := uploads.create(tenantFrom(r.Context()), length)
+	if err != nil {
+		writeError(w, internalError("Failed to create upload", err))
+		return
+	}
+	writeUploadHeaders(w, u)
+	w.Header().Set("Location", "/uploads/"+u.id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// headUpload reports how many bytes of an upload have been received.
+func headUpload(w http.ResponseWriter, r *http.Request) {
+	u, ok := uploads.get(mux.Vars(r)["id"], tenantFrom(r.Context()))
+	if !ok {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	u.mu.Lock()
+	writeUploadHeaders(w, u)
+	u.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// patchUpload appends a chunk, which must start at the current offset.
+// Whatever arrives before a connection drops is kept, so the client
+// resumes from the offset HEAD reports. The finished file is scanned like
+// any other upload.
+func patchUpload(w http.ResponseWriter, r *http.Request) {
+	u, ok := uploads.get(mux.Vars(r)["id"], tenantFrom(r.Context()))
+	if !ok {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("Content-Type") != uploadChunkType {
+		http.Error(w, "Chunks must be sent as "+uploadChunkType, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid 'Upload-Offset' header", http.StatusBadRequest)
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if offset != u.offset {
+		writeUploadHeaders(w, u)
+		http.Error(w, "Upload-Offset does not match the bytes received", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(u.path, os.O_WRONLY, 0)
+	if err != nil {
+		writeError(w, internalError("Failed to open upload", err))
+		return
+	}
+	if _, err = f.Seek(u.offset, io.SeekStart); err == nil {
+		var n int64
+		n, err = io.Copy(f, io.LimitReader(r.Body, u.length-u.offset))
+		u.offset += n
+		u.updated = time.Now()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		writeUploadHeaders(w, u)
+		writeError(w, bodyError(err, "Failed to read upload chunk"))
+		return
+	}
+	if u.complete() {
+		if n, _ := r.Body.Read(make([]byte, 1)); n > 0 {
+			writeUploadHeaders(w, u)
+			http.Error(w, "Chunk runs past Upload-Length", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := scanUploadFile(r, u); err != nil {
+			uploads.remove(u)
+			writeError(w, err)
+			return
+		}
+	}
+
+	writeUploadHeaders(w, u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func scanUploadFile(r *http.Request, u *upload) error {
+	data, err := os.ReadFile(u.path)
+	if err != nil {
+		return internalError("Failed to read upload", err)
+	}
+	return scanUpload(r.Context(), "upload-"+u.id+".csv", data)
+}
+
+// deleteUpload abandons an upload.
+func deleteUpload(w http.ResponseWriter, r *http.Request) {
+	u, ok := uploads.get(mux.Vars(r)["id"], tenantFrom(r.Context()))
+	if !ok {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	uploads.remove(u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readUploadedBatch parses the batch rows of a finished upload and removes
+// the upload.
+func readUploadedBatch(r *http.Request, id string) ([]map[string]string, error) {
+	u, ok := uploads.get(id, tenantFrom(r.Context()))
+	if !ok {
+		return nil, &httpError{status: http.StatusNotFound, class: classInvalidRequest, msg: "Upload not found"}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.complete() {
+		return nil, &httpError{status: http.StatusConflict, class: classInvalidRequest, msg: fmt.Sprintf("Upload is incomplete (%d of %d bytes)", u.offset, u.length)}
+	}
+
+	f, err := os.Open(u.path)
+	if err != nil {
+		return nil, internalError("Failed to open upload", err)
+	}
+	rows, err := readBatchCSV(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	uploads.remove(u)
+	return rows, nil
+}
+
+// readBatchCSV parses batch rows from CSV whose header row names the
+// /qrcode parameters. Empty cells are left out of their row.
+func readBatchCSV(rd io.Reader) ([]map[string]string, error) {
+	cr := csv.NewReader(rd)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, badRequest("Invalid batch CSV: missing header row")
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+
+	var rows []map[string]string
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, bodyError(err, fmt.Sprintf("Invalid batch CSV: %v", err))
+		}
+		if len(rows) == serverLimits.MaxBatchRows {
+			return nil, tooLarge(fmt.Sprintf("Batch has more than %d rows", serverLimits.MaxBatchRows))
+		}
+		row := make(map[string]string, len(header))
+		for i, v := range rec {
+			if v != "" {
+				row[strings.TrimSpace(header[i])] = v
+			}
+		}
+		rows = append(rows, row)
+	}
+}
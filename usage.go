@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usageRecord is one tenant's usage for one calendar month (UTC).
+// Generations are also broken down by "<format>/<size>". StorageBytes
+// counts newly stored renders only, not cache hits. Redirects counts
+// short link redirects.
+type usageRecord struct {
+	Generations  int            `json:"generations"`
+	ByFormatSize map[string]int `json:"by_format_size,omitempty"`
+	Redirects    int            `json:"redirects"`
+	StorageBytes int64          `json:"storage_bytes"`
+}
+
+// usageStore keeps monthly usage per tenant under "usage/<tenant>/<month>.json".
+// Updates are serialised in-process; a single server owns the data dir.
+type usageStore struct {
+	mu sync.Mutex
+	st storage
+}
+
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+func usageKey(tenantID, month string) string {
+	return "usage/" + tenantID + "/" + month + ".json"
+}
+
+func (s *usageStore) load(tenantID, month string) (usageRecord, error) {
+	var rec usageRecord
+	b, err := s.st.Get(usageKey(tenantID, month))
+	if errors.Is(err, errNotFound) {
+		return rec, nil
+	}
+	if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal(b, &rec)
+	return rec, err
+}
+
+// Get returns the tenant's usage for month, formatted as "2006-01".
+func (s *usageStore) Get(tenantID, month string) (usageRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(tenantID, month)
+}
+
+// Update applies fn to the tenant's record for the current month.
+func (s *usageStore) Update(tenantID string, fn func(*usageRecord)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	month := usageMonth(time.Now())
+	rec, err := s.load(tenantID, month)
+	if err != nil {
+		return err
+	}
+	fn(&rec)
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.st.Put(usageKey(tenantID, month), b)
+}
+
+// storedBytes is the storage a render added: nothing when it was cached.
+func storedBytes(b []byte, cached bool) int {
+	if cached {
+		return 0
+	}
+	return len(b)
+}
+
+type formatSizeCount struct {
+	Format      string `json:"format"`
+	Size        int    `json:"size"`
+	Generations int    `json:"generations"`
+}
+
+type tenantUsage struct {
+	Tenant       string            `json:"tenant"`
+	Month        string            `json:"month"`
+	Generations  int               `json:"generations"`
+	ByFormatSize []formatSizeCount `json:"by_format_size"`
+	Redirects    int               `json:"redirects"`
+	StorageBytes int64             `json:"storage_bytes"`
+}
+
+func (rec usageRecord) export(tenantID, month string) tenantUsage {
+	u := tenantUsage{
+		Tenant:       tenantID,
+		Month:        month,
+		Generations:  rec.Generations,
+		ByFormatSize: []formatSizeCount{},
+		Redirects:    rec.Redirects,
+		StorageBytes: rec.StorageBytes,
+	}
+	for k, n := range rec.ByFormatSize {
+		format, size, _ := strings.Cut(k, "/")
+		px, _ := strconv.Atoi(size)
+		u.ByFormatSize = append(u.ByFormatSize, formatSizeCount{Format: format, Size: px, Generations: n})
+	}
+	sort.Slice(u.ByFormatSize, func(i, j int) bool {
+		a, b := u.ByFormatSize[i], u.ByFormatSize[j]
+		if a.Format != b.Format {
+			return a.Format < b.Format
+		}
+		return a.Size < b.Size
+	})
+	return u
+}
+
+// usageExport reports every tenant's usage for 'month' ("2006-01",
+// default the current month) for the billing system. output=csv returns
+// one row per metric: generations per format and size, then redirects and
+// storage_bytes.
+func usageExport(w http.ResponseWriter, r *http.Request) {
+	month := usageMonth(time.Now())
+	if v := r.FormValue("month"); v != "" {
+		if _, err := time.Parse("2006-01", v); err != nil {
+			http.Error(w, "Invalid 'month' parameter (expected YYYY-MM)", http.StatusBadRequest)
+			return
+		}
+		month = v
+	}
+
+	var rows []tenantUsage
+	for _, id := range tenantIDs() {
+		rec, err := usage.Get(id, month)
+		if err != nil {
+			writeError(w, internalError("Failed to read usage", err))
+			return
+		}
+		rows = append(rows, rec.export(id, month))
+	}
+
+	switch r.FormValue("output") {
+	case "", "json":
+		if rows == nil {
+			rows = []tenantUsage{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rows)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=usage-"+month+".csv")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"tenant", "month", "metric", "format", "size", "value"})
+		for _, u := range rows {
+			for _, c := range u.ByFormatSize {
+				cw.Write([]string{u.Tenant, month, "generations", c.Format, strconv.Itoa(c.Size), strconv.Itoa(c.Generations)})
+			}
+			cw.Write([]string{u.Tenant, month, "redirects", "", "", strconv.Itoa(u.Redirects)})
+			cw.Write([]string{u.Tenant, month, "storage_bytes", "", "", strconv.FormatInt(u.StorageBytes, 10)})
+		}
+		cw.Flush()
+	default:
+		http.Error(w, "Unsupported 'output' parameter (expected json or csv)", http.StatusBadRequest)
+	}
+}
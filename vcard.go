@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// GET /qrcode/vcard builds a contact card from separate fields and
+// renders it as /qrcode would render it as data. Clients writing vCards
+// by hand tend to get the escaping, line endings or required properties
+// wrong, which phones then refuse to import.
+//
+// The fields are name (or first_name and last_name), org, title, phone,
+// email, url, address, city, region, postal_code, country and note; phone,
+// email and url can be repeated. version selects vCard 3.0, the default
+// and what most scanner apps read, or 4.0. The label defaults to the name.
+
+var (
+	vcardPhonePattern = regexp.MustCompile(`^\+?[0-9 ()./-]*[0-9][0-9 ()./-]*$`)
+	vcardEmailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+)
+
+// vcardLineLimit is the length in bytes lines are folded at, per RFC 6350
+// and RFC 2426.
+const vcardLineLimit = 75
+
+// vcardText escapes a text value: backslash, comma and semicolon are
+// quoted, and line breaks become \n.
+func vcardText(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\n", `\n`, "\r", `\n`).Replace(s)
+}
+
+// vcardFold splits a content line into lines of at most vcardLineLimit
+// bytes, each continuation starting with a space, without cutting a UTF-8
+// sequence in two.
+func vcardFold(line string) string {
+	var b strings.Builder
+	limit := vcardLineLimit
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = vcardLineLimit - 1
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// buildVCard assembles a vCard from the request's fields and returns it
+// with the formatted name.
+func buildVCard(params url.Values) (string, string, error) {
+	version := params.Get("version")
+	switch version {
+	case "":
+		version = "3.0"
+	case "3.0", "4.0":
+	default:
+		return "", "", badRequest("Invalid 'version' parameter (must be 3.0 or 4.0)")
+	}
+
+	first := strings.TrimSpace(params.Get("first_name"))
+	last := strings.TrimSpace(params.Get("last_name"))
+	name := strings.TrimSpace(params.Get("name"))
+	if name == "" {
+		name = strings.TrimSpace(first + " " + last)
+	}
+	if name == "" {
+		return "", "", classified(badRequest("Missing 'name' parameter"), classMissingParam)
+	}
+	if first == "" && last == "" {
+		// Without separate fields the family name is taken to be the
+		// last word, which is right for most names and harmless for the
+		// rest: phones show FN.
+		if i := strings.LastIndex(name, " "); i >= 0 {
+			first, last = strings.TrimSpace(name[:i]), name[i+1:]
+		} else {
+			last = name
+		}
+	}
+
+	var lines []string
+	add := func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	add("BEGIN:VCARD")
+	add("VERSION:%s", version)
+	add("N:%s;%s;;;", vcardText(last), vcardText(first))
+	add("FN:%s", vcardText(name))
+	if v := params.Get("org"); v != "" {
+		add("ORG:%s", vcardText(v))
+	}
+	if v := params.Get("title"); v != "" {
+		add("TITLE:%s", vcardText(v))
+	}
+	for _, v := range params["phone"] {
+		if !vcardPhonePattern.MatchString(v) {
+			return "", "", badRequest(fmt.Sprintf("Invalid 'phone' parameter %q (digits, spaces and + ( ) . / - only)", v))
+		}
+		if version == "4.0" {
+			add("TEL;VALUE=uri:tel:%s", strings.NewReplacer(" ", "-", "(", "", ")", "", "/", "-").Replace(v))
+		} else {
+			add("TEL:%s", v)
+		}
+	}
+	for _, v := range params["email"] {
+		if !vcardEmailPattern.MatchString(v) {
+			return "", "", badRequest(fmt.Sprintf("Invalid 'email' parameter %q", v))
+		}
+		add("EMAIL:%s", vcardText(v))
+	}
+	for _, v := range params["url"] {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", "", badRequest(fmt.Sprintf("Invalid 'url' parameter %q (must be an http or https URL)", v))
+		}
+		add("URL:%s", v)
+	}
+	adr := make([]string, 5)
+	for i, p := range []string{"address", "city", "region", "postal_code", "country"} {
+		adr[i] = vcardText(params.Get(p))
+	}
+	if strings.Join(adr, "") != "" {
+		// The post office box and extended address components stay empty.
+		add("ADR:;;%s", strings.Join(adr, ";"))
+	}
+	if v := params.Get("note"); v != "" {
+		add("NOTE:%s", vcardText(v))
+	}
+	add("END:VCARD")
+
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(vcardFold(l))
+	}
+	return b.String(), name, nil
+}
+
+// renderPayload serves a code whose data the endpoint builds from other
+// parameters. build returns the payload and the label to use when none is
+// given.
+func renderPayload(w http.ResponseWriter, r *http.Request, build func(url.Values) (string, string, error)) {
+	err := r.ParseForm()
+	if err != nil {
+		err = bodyError(err, "Invalid form data")
+	} else if r.Form.Get("data") != "" || r.Form.Get("link") != "" {
+		err = badRequest("'data' and 'link' cannot be used here; the payload is built from the other parameters")
+	}
+	var data, label string
+	if err == nil {
+		data, label, err = build(r.Form)
+	}
+	if err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+	r.Form.Set("data", data)
+	if r.Form.Get("label") == "" {
+		r.Form.Set("label", label)
+	}
+	generateQRCode(w, r)
+}
+
+func vcardQRCode(w http.ResponseWriter, r *http.Request) {
+	renderPayload(w, r, buildVCard)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"go.mozilla.org/pkcs7"
+)
+
+// applePassSigner signs Apple Wallet passes with a Pass Type ID
+// certificate, chained to Apple's WWDR intermediate.
+type applePassSigner struct {
+	passTypeID string
+	teamID     string
+	cert       *x509.Certificate
+	key        crypto.PrivateKey
+	wwdr       *x509.Certificate
+}
+
+// googleWalletIssuer signs Google Wallet save links as a service account
+// of the issuer, for objects of one generic class.
+type googleWalletIssuer struct {
+	issuerID string
+	classID  string
+	email    string
+	key      *rsa.PrivateKey
+}
+
+var (
+	applePasses        *applePassSigner
+	googleWallet       *googleWalletIssuer
+	walletOrganization = embedProvider
+)
+
+const googleWalletSaveURL = "https://pay.google.com/gp/v/save/"
+
+// loadWallets reads the wallet signing credentials. Apple passes need
+// QR_APPLE_PASS_TYPE_ID, QR_APPLE_TEAM_ID, QR_APPLE_PASS_CERT (a PEM file
+// with the pass certificate and its key) and QR_APPLE_WWDR_CERT; Google
+// Wallet links need QR_GOOGLE_WALLET_ISSUER_ID and QR_GOOGLE_WALLET_KEY (a
+// service account JSON key), with QR_GOOGLE_WALLET_CLASS naming the class.
+// Either wallet is off when its settings are unset.
+func loadWallets() error {
+	if v := os.Getenv("QR_WALLET_ORGANIZATION"); v != "" {
+		walletOrganization = v
+	}
+
+	if passType := os.Getenv("QR_APPLE_PASS_TYPE_ID"); passType != "" {
+		s := &applePassSigner{passTypeID: passType, teamID: os.Getenv("QR_APPLE_TEAM_ID")}
+		if s.teamID == "" {
+			return errors.New("QR_APPLE_TEAM_ID is required when QR_APPLE_PASS_TYPE_ID is set")
+		}
+		var err error
+		s.cert, s.key, err = loadCertAndKey(os.Getenv("QR_APPLE_PASS_CERT"))
+		if err != nil {
+			return fmt.Errorf("QR_APPLE_PASS_CERT: %w", err)
+		}
+		if s.key == nil {
+			return errors.New("QR_APPLE_PASS_CERT: no private key found")
+		}
+		s.wwdr, _, err = loadCertAndKey(os.Getenv("QR_APPLE_WWDR_CERT"))
+		if err != nil {
+			return fmt.Errorf("QR_APPLE_WWDR_CERT: %w", err)
+		}
+		applePasses = s
+	}
+
+	if issuer := os.Getenv("QR_GOOGLE_WALLET_ISSUER_ID"); issuer != "" {
+		g := &googleWalletIssuer{issuerID: issuer, classID: issuer + ".smartqr"}
+		if class := os.Getenv("QR_GOOGLE_WALLET_CLASS"); class != "" {
+			g.classID = issuer + "." + class
+		}
+		var err error
+		g.email, g.key, err = loadServiceAccount(os.Getenv("QR_GOOGLE_WALLET_KEY"))
+		if err != nil {
+			return fmt.Errorf("QR_GOOGLE_WALLET_KEY: %w", err)
+		}
+		googleWallet = g
+	}
+	return nil
+}
+
+// loadCertAndKey reads the first certificate in a PEM file and its private
+// key, which may be absent.
+func loadCertAndKey(path string) (*x509.Certificate, crypto.PrivateKey, error) {
+	if path == "" {
+		return nil, nil, errors.New("not set")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cert *x509.Certificate
+	var key crypto.PrivateKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			if cert == nil {
+				cert, err = x509.ParseCertificate(block.Bytes)
+			}
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if cert == nil {
+		return nil, nil, errors.New("no certificate found")
+	}
+	return cert, key, nil
+}
+
+// loadServiceAccount reads the client email and RSA key from a Google
+// service account key file.
+func loadServiceAccount(path string) (string, *rsa.PrivateKey, error) {
+	if path == "" {
+		return "", nil, errors.New("not set")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	var account struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	if err := json.Unmarshal(data, &account); err != nil {
+		return "", nil, err
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if account.ClientEmail == "" || block == nil {
+		return "", nil, errors.New("missing client_email or private_key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return "", nil, errors.New("private_key is not an RSA key")
+	}
+	return account.ClientEmail, rsaKey, nil
+}
+
+// walletQRCode wraps the /qrcode payload in a wallet pass: with
+// wallet=apple a signed .pkpass, with wallet=google a JSON document holding
+// the save link. The wallet app draws the barcode itself from the data; the
+// label is the pass's main field and 'title' its heading.
+func walletQRCode(w http.ResponseWriter, r *http.Request) {
+	wallet := r.FormValue("wallet")
+	switch {
+	case wallet != "apple" && wallet != "google":
+		http.Error(w, "Invalid 'wallet' parameter (must be apple or google)", http.StatusBadRequest)
+		return
+	case wallet == "apple" && applePasses == nil:
+		http.Error(w, "Apple Wallet passes are not configured", http.StatusNotImplemented)
+		return
+	case wallet == "google" && googleWallet == nil:
+		http.Error(w, "Google Wallet passes are not configured", http.StatusNotImplemented)
+		return
+	}
+
+	spec, err := specFromRequest(r)
+	if err == nil {
+		spec, err = applyQuota(w, r, spec)
+	}
+	if err != nil {
+		failGeneration(w, r, err)
+		return
+	}
+	id, err := specID(spec)
+	if err != nil {
+		writeError(w, internalError("Failed to hash QR code spec", err))
+		return
+	}
+	if err := specs.Put(id, spec); err != nil {
+		writeError(w, internalError("Failed to store QR code spec", err))
+		return
+	}
+	title := r.FormValue("title")
+	if title == "" {
+		title = walletOrganization
+	}
+
+	w.Header().Set("X-QR-Id", id)
+	if wallet == "apple" {
+		pass, err := applePasses.pass(id, title, spec)
+		if err != nil {
+			failGeneration(w, r, err)
+			return
+		}
+		recordGeneration(r, "pkpass", spec, 0)
+		w.Header().Set("Content-Type", "application/vnd.apple.pkpass")
+		w.Header().Set("Content-Disposition", "attachment; filename=SmartQR-"+id+".pkpass")
+		w.Write(pass)
+		return
+	}
+
+	jwt, err := googleWallet.saveJWT(id, title, spec)
+	if err != nil {
+		writeError(w, internalError("Failed to sign Google Wallet link", err))
+		return
+	}
+	recordGeneration(r, "gwallet", spec, 0)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID      string `json:"id"`
+		SaveURL string `json:"save_url"`
+	}{id, googleWalletSaveURL + jwt})
+}
+
+// pass builds the .pkpass archive for spec: pass.json, the icons, and the
+// manifest of their SHA-1 hashes with its detached PKCS #7 signature.
+func (s *applePassSigner) pass(serial, title string, spec renderSpec) ([]byte, error) {
+	bg, err := parseHexColor(spec.LabelBackground)
+	if err != nil {
+		return nil, badRequest("Invalid label background color")
+	}
+	fg, err := parseHexColor(spec.LabelColor)
+	if err != nil {
+		return nil, badRequest("Invalid label color")
+	}
+
+	barcode := map[string]string{
+		"format":          "PKBarcodeFormatQR",
+		"message":         spec.Data,
+		"messageEncoding": passEncoding(spec.Data),
+		"altText":         spec.Label,
+	}
+	passJSON, err := json.Marshal(map[string]interface{}{
+		"formatVersion":      1,
+		"passTypeIdentifier": s.passTypeID,
+		"teamIdentifier":     s.teamID,
+		"serialNumber":       serial,
+		"organizationName":   walletOrganization,
+		"description":        title,
+		"backgroundColor":    passColor(bg),
+		"foregroundColor":    passColor(fg),
+		"labelColor":         passColor(fg),
+		"barcodes":           []map[string]string{barcode},
+		"barcode":            barcode,
+		"generic": map[string]interface{}{
+			"primaryFields": []map[string]string{{"key": "label", "label": title, "value": spec.Label}},
+		},
+	})
+	if err != nil {
+		return nil, internalError("Failed to encode pass", err)
+	}
+
+	files := map[string][]byte{"pass.json": passJSON}
+	icon, err := passIcon(spec, bg)
+	if err != nil {
+		return nil, err
+	}
+	for name, side := range map[string]int{"icon.png": 29, "icon@2x.png": 58, "icon@3x.png": 87} {
+		if files[name], err = encodePNG(imaging.Resize(icon, side, side, imaging.Lanczos)); err != nil {
+			return nil, internalError("Failed to encode pass icon", err)
+		}
+	}
+
+	manifest := make(map[string]string, len(files))
+	for name, b := range files {
+		sum := sha1.Sum(b)
+		manifest[name] = hex.EncodeToString(sum[:])
+	}
+	files["manifest.json"], err = json.Marshal(manifest)
+	if err != nil {
+		return nil, internalError("Failed to encode pass manifest", err)
+	}
+	files["signature"], err = s.sign(files["manifest.json"])
+	if err != nil {
+		return nil, internalError("Failed to sign pass", err)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"pass.json", "icon.png", "icon@2x.png", "icon@3x.png", "manifest.json", "signature"} {
+		f, err := zw.Create(name)
+		if err == nil {
+			_, err = f.Write(files[name])
+		}
+		if err != nil {
+			return nil, internalError("Failed to write pass", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, internalError("Failed to write pass", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *applePassSigner) sign(manifest []byte) ([]byte, error) {
+	sd, err := pkcs7.NewSignedData(manifest)
+	if err != nil {
+		return nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.AddSignerChain(s.cert, s.key, []*x509.Certificate{s.wwdr}, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, err
+	}
+	sd.Detach()
+	return sd.Finish()
+}
+
+// passIcon is the square icon Wallet shows in notifications: the code's
+// logo on the label background, or the plain background without a logo.
+func passIcon(spec renderSpec, bg color.Color) (image.Image, error) {
+	const side = 87
+	icon := imaging.New(side, side, bg)
+	if spec.LogoFile == "" {
+		return icon, nil
+	}
+	data, err := assets.Get(spec.LogoFile)
+	if err != nil {
+		return nil, internalError("Failed to open logo file", err)
+	}
+	logo, err := decodeLogo(data, side)
+	if err != nil {
+		return nil, internalError("Failed to decode logo image", fmt.Errorf("%w: %v", errLogoDecode, err))
+	}
+	return imaging.OverlayCenter(icon, imaging.Fit(logo, side, side, imaging.Lanczos), 1.0), nil
+}
+
+// passEncoding is the encoding Wallet should turn the data into bytes
+// with: Latin-1, which scanners read most reliably, unless the data needs
+// more.
+func passEncoding(data string) string {
+	for _, r := range data {
+		if r > 0xff {
+			return "utf-8"
+		}
+	}
+	return "iso-8859-1"
+}
+
+func passColor(c color.RGBA) string {
+	return fmt.Sprintf("rgb(%d, %d, %d)", c.R, c.G, c.B)
+}
+
+// saveJWT signs the Add to Google Wallet token for spec, carrying a
+// generic pass object whose id is derived from the spec's.
+func (g *googleWalletIssuer) saveJWT(id, title string, spec renderSpec) (string, error) {
+	localized := func(s string) map[string]interface{} {
+		return map[string]interface{}{"defaultValue": map[string]string{"language": "en", "value": s}}
+	}
+	object := map[string]interface{}{
+		"id":                 g.issuerID + "." + id,
+		"classId":            g.classID,
+		"state":              "ACTIVE",
+		"cardTitle":          localized(walletOrganization),
+		"header":             localized(spec.Label),
+		"subheader":          localized(title),
+		"hexBackgroundColor": spec.LabelBackground,
+		"barcode": map[string]string{
+			"type":          "QR_CODE",
+			"value":         spec.Data,
+			"alternateText": spec.Label,
+		},
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":     g.email,
+		"aud":     "google",
+		"typ":     "savetowallet",
+		"iat":     time.Now().Unix(),
+		"origins": []string{},
+		"payload": map[string]interface{}{"genericObjects": []interface{}{object}},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, g.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
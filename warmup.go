@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+type warmupResult struct {
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// warmupFailure reports a spec that could not be warmed. The client gets
+// the public message; the full error, which may name internal paths, goes
+// to the log.
+func warmupFailure(i int, err error) warmupResult {
+	log.Println("Warmup spec", i+1, "failed:", err)
+	return warmupResult{Status: "error", Error: publicMessage(err)}
+}
+
+// warmup pre-renders a list of request parameter sets into the render
+// store, so the first requests after a deploy are served from storage. The
+// body is a JSON array of objects using the same keys as /qrcode, e.g.
+// [{"data": "https://example.com", "label": "Scan me"}].
+func warmup(w http.ResponseWriter, r *http.Request) {
+	var items []map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		writeError(w, bodyError(err, "Invalid warmup JSON"))
+		return
+	}
+	if len(items) > serverLimits.MaxBatchRows {
+		writeError(w, tooLarge(fmt.Sprintf("Warmup has %d specs, maximum is %d", len(items), serverLimits.MaxBatchRows)))
+		return
+	}
+
+	results := make([]warmupResult, len(items))
+	for i, item := range items {
+		params := url.Values{}
+		for k, v := range item {
+			params.Set(k, v)
+		}
+
+		err := checkNoLogoURL(params)
+		var spec renderSpec
+		if err == nil {
+			spec, err = specFromValues(nil, params)
+		}
+		if err != nil {
+			results[i] = warmupFailure(i, err)
+			continue
+		}
+
+		id, _, cached, _, err := renderStored(spec, nil, renderLane{pool: jobSlots, priority: priorityLow})
+		switch {
+		case err != nil:
+			results[i] = warmupFailure(i, err)
+		case cached:
+			results[i] = warmupResult{ID: id, Status: "cached"}
+		default:
+			results[i] = warmupResult{ID: id, Status: "rendered"}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+var watermarkColor = color.RGBA{R: 128, G: 128, B: 128, A: 255}
+
+// drawWatermark writes spec.Watermark centred in the top quiet zone of
+// qrImg, which is zone pixels tall, so the modules stay untouched.
+func drawWatermark(qrImg image.Image, spec renderSpec, f *truetype.Font, zone int) image.Image {
+	size := float64(zone) * 0.5
+	if limit := float64(spec.Size) / 40; size > limit {
+		size = limit
+	}
+	face := truetype.NewFace(f, &truetype.Options{Size: size, DPI: 72})
+	defer face.Close()
+
+	dst := image.NewRGBA(qrImg.Bounds())
+	draw.Draw(dst, dst.Bounds(), qrImg, qrImg.Bounds().Min, draw.Src)
+
+	d := font.Drawer{Dst: dst, Src: image.NewUniform(watermarkColor), Face: face}
+	width := d.MeasureString(spec.Watermark)
+	metrics := face.Metrics()
+	baseline := (fixed.I(zone) + metrics.Ascent - metrics.Descent) / 2
+	d.Dot = fixed.Point26_6{X: (fixed.I(dst.Bounds().Dx()) - width) / 2, Y: baseline}
+	d.DrawString(spec.Watermark)
+	return dst
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// GET /qrcode/wifi renders a code that joins a Wi-Fi network when scanned,
+// in the WIFI: format Android and iOS cameras read. ssid names the
+// network, password is its key, security is WPA (which covers WPA2 and
+// WPA3), WEP or nopass, and hidden=true marks a network that does not
+// broadcast its name. security defaults to WPA with a password and nopass
+// without one. The label defaults to the network name.
+
+var wepHexKeyPattern = regexp.MustCompile(`^(?:[0-9A-Fa-f]{10}|[0-9A-Fa-f]{26})$`)
+
+// wifiEscape quotes the characters the WIFI: format uses as delimiters.
+func wifiEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, ":", `\:`, `"`, `\"`).Replace(s)
+}
+
+// checkWiFiKey checks that a password could be a key for the security
+// type, so a typo is caught before the code is printed rather than by
+// guests who cannot connect.
+func checkWiFiKey(security, password string) error {
+	switch security {
+	case "WPA":
+		if n := len(password); n < 8 || n > 63 {
+			return badRequest("Invalid 'password' parameter (a WPA passphrase is 8 to 63 characters)")
+		}
+	case "WEP":
+		if n := len(password); n != 5 && n != 13 && !wepHexKeyPattern.MatchString(password) {
+			return badRequest("Invalid 'password' parameter (a WEP key is 5 or 13 characters, or 10 or 26 hex digits)")
+		}
+	case "nopass":
+		if password != "" {
+			return badRequest("A 'password' cannot be used with security nopass")
+		}
+	}
+	return nil
+}
+
+// buildWiFi assembles the WIFI: payload and returns it with the network
+// name.
+func buildWiFi(params url.Values) (string, string, error) {
+	ssid := params.Get("ssid")
+	if ssid == "" {
+		return "", "", classified(badRequest("Missing 'ssid' parameter"), classMissingParam)
+	}
+	if len(ssid) > 32 {
+		return "", "", badRequest("Invalid 'ssid' parameter (at most 32 bytes)")
+	}
+	password := params.Get("password")
+
+	security := params.Get("security")
+	switch strings.ToLower(security) {
+	case "":
+		security = "nopass"
+		if password != "" {
+			security = "WPA"
+		}
+	case "wpa", "wpa2", "wpa3":
+		security = "WPA"
+	case "wep":
+		security = "WEP"
+	case "nopass", "none":
+		security = "nopass"
+	default:
+		return "", "", badRequest("Invalid 'security' parameter (must be WPA, WEP or nopass)")
+	}
+	if security != "nopass" && password == "" {
+		return "", "", classified(badRequest(fmt.Sprintf("Missing 'password' parameter (required for %s)", security)), classMissingParam)
+	}
+	if err := checkWiFiKey(security, password); err != nil {
+		return "", "", err
+	}
+
+	hidden := false
+	if v := params.Get("hidden"); v != "" {
+		if v != "true" && v != "false" {
+			return "", "", badRequest("Invalid 'hidden' parameter (must be true or false)")
+		}
+		hidden = v == "true"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "WIFI:T:%s;S:%s;", security, wifiEscape(ssid))
+	if password != "" {
+		fmt.Fprintf(&b, "P:%s;", wifiEscape(password))
+	}
+	if hidden {
+		b.WriteString("H:true;")
+	}
+	b.WriteString(";")
+	return b.String(), ssid, nil
+}
+
+func wifiQRCode(w http.ResponseWriter, r *http.Request) {
+	renderPayload(w, r, buildWiFi)
+}